@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"mss/internal/sitecfg"
+	"mss/internal/store"
+)
+
+const applyUsage = `usage:
+  mss-server apply [-dry-run] -f FILE|DIR [-f FILE|DIR ...]
+
+Reconciles sites and their schemas with the config and prints the plan.
+Sites applied here become managed: API edits to them are rejected
+(MSS_MANAGED_SITES=reject) or reported as drift (flag). Sites an earlier
+apply from the same files created and that are no longer listed go to trash.
+The database is MSS_DB_PATH (default ./data/mss.db).`
+
+type pathList []string
+
+func (p *pathList) String() string     { return strings.Join(*p, ",") }
+func (p *pathList) Set(v string) error { *p = append(*p, v); return nil }
+
+// runApply implements the "apply" subcommand against the SQLite database.
+func runApply(args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(os.Stderr, applyUsage) }
+	var files pathList
+	fs.Var(&files, "f", "config file or directory (repeatable)")
+	dryRun := fs.Bool("dry-run", false, "print the plan without writing")
+	_ = fs.Parse(args)
+	if len(files) == 0 || fs.NArg() != 0 { fs.Usage(); os.Exit(2) }
+
+	// The source names the config that owns the sites, so the same files
+	// must be passed on every apply.
+	for i, f := range files {
+		if abs, err := filepath.Abs(f); err == nil { files[i] = abs }
+	}
+	cfg, err := sitecfg.Load(files...)
+	if err != nil { log.Fatalf("apply: %v", err) }
+
+	secrets := revisionSecrets()
+	db := openSQLite(getenv("MSS_DB_PATH", "./data/mss.db"), false)
+	defer func() { _ = db.Close() }()
+	plan, err := sitecfg.Apply(context.Background(), store.NewSQLite(db, secrets), cfg, files.String(), *dryRun)
+	if err != nil { log.Fatalf("apply: %v", err) }
+
+	for _, key := range plan.Adopted { fmt.Printf("adopt site %s\n", key) }
+	for _, c := range plan.Changes { fmt.Println(c) }
+	for _, im := range plan.Impact {
+		for _, v := range im.Violations { fmt.Printf("warning: site %s: %s\n", im.SiteKey, v) }
+	}
+	switch {
+	case len(plan.Changes) == 0:
+		fmt.Println("No changes.")
+	case *dryRun:
+		fmt.Printf("Dry run: %d changes not applied.\n", len(plan.Changes))
+	default:
+		fmt.Printf("Applied %d changes.\n", len(plan.Changes))
+	}
+}
+
+// startConfigWatch applies MSS_CONFIG_DIR once and then re-applies it
+// whenever its files change, calling onApply after each successful apply.
+func startConfigWatch(ctx context.Context, repos store.Repos, dir string, onApply func()) {
+	poll, err := time.ParseDuration(getenv("MSS_CONFIG_POLL", "30s"))
+	if err != nil || poll <= 0 { log.Fatalf("MSS_CONFIG_POLL: invalid duration %q", os.Getenv("MSS_CONFIG_POLL")) }
+	w := sitecfg.NewWatcher(repos, dir, onApply)
+	plan, err := w.Sync(ctx)
+	if err != nil { log.Fatalf("MSS_CONFIG_DIR: %v", err) }
+	sitecfg.LogPlan(plan)
+	go w.Run(ctx, poll)
+}
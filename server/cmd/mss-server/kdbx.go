@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"mss/internal/kdbx"
+	"mss/internal/store"
+)
+
+const kdbxUsage = `usage:
+  mss-server kdbx export [-cipher chacha20|aes] [-password-file F] -o FILE
+  mss-server kdbx import [-dry-run] [-password-file F] FILE
+
+The master password is read from MSS_KDBX_PASSWORD or -password-file.
+The database is MSS_DB_PATH (default ./data/mss.db).`
+
+// runKDBX implements the "kdbx" subcommand against the SQLite database.
+func runKDBX(args []string) {
+	if len(args) == 0 { fmt.Fprintln(os.Stderr, kdbxUsage); os.Exit(2) }
+	fs := flag.NewFlagSet("kdbx "+args[0], flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(os.Stderr, kdbxUsage) }
+	passFile := fs.String("password-file", "", "read the master password from this file")
+	out := fs.String("o", "", "output file (export)")
+	cipherName := fs.String("cipher", "chacha20", "payload cipher: chacha20 or aes (export)")
+	dryRun := fs.Bool("dry-run", false, "report what would change without writing (import)")
+	_ = fs.Parse(args[1:])
+
+	pass := os.Getenv("MSS_KDBX_PASSWORD")
+	if *passFile != "" {
+		b, err := os.ReadFile(*passFile)
+		if err != nil { log.Fatalf("kdbx: %v", err) }
+		pass = strings.TrimRight(string(b), "\r\n")
+	}
+	if pass == "" { log.Fatalf("kdbx: no master password; set MSS_KDBX_PASSWORD or -password-file") }
+
+	secrets := revisionSecrets()
+	db := openSQLite(getenv("MSS_DB_PATH", "./data/mss.db"), false)
+	defer func() { _ = db.Close() }()
+	repos := store.NewSQLite(db, secrets)
+	ctx := context.Background()
+
+	switch args[0] {
+	case "export":
+		if *out == "" { fs.Usage(); os.Exit(2) }
+		cipher, err := kdbx.ParseCipher(*cipherName)
+		if err != nil { log.Fatalf("kdbx: %v", err) }
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil { log.Fatalf("kdbx: %v", err) }
+		if err := kdbx.Export(ctx, repos, f, pass, cipher); err != nil { _ = f.Close(); log.Fatalf("kdbx export: %v", err) }
+		if err := f.Close(); err != nil { log.Fatalf("kdbx export: %v", err) }
+		log.Printf("kdbx: wrote %s", *out)
+	case "import":
+		if fs.NArg() != 1 { fs.Usage(); os.Exit(2) }
+		data, err := os.ReadFile(fs.Arg(0))
+		if err != nil { log.Fatalf("kdbx: %v", err) }
+		kdb, err := kdbx.Open(data, pass)
+		if err != nil { log.Fatalf("kdbx import: %v", err) }
+		rep, err := kdbx.Import(ctx, repos, kdb, *dryRun)
+		if err != nil { log.Fatalf("kdbx import: %v", err) }
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(rep)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -12,11 +14,15 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/jmoiron/sqlx"
 
 	"mss/internal/api"
+	"mss/internal/backup"
 	"mss/internal/migrate"
+	"mss/internal/secret"
 	"mss/internal/ui"
 	"mss/internal/store"
+	"mss/internal/validation"
 )
 
 func getenv(key, def string) string {
@@ -25,11 +31,29 @@ func getenv(key, def string) string {
 	return v
 }
 
-func main() {
-	addr := getenv("MSS_LISTEN_ADDR", ":8080")
-	dbPath := getenv("MSS_DB_PATH", "./data/mss.db")
-	autoMigrate := getenv("MSS_AUTO_MIGRATE", "0") == "1"
+// runTrashPurge permanently removes trashed rows older than retention, once at
+// startup and then hourly.
+func runTrashPurge(ctx context.Context, trash store.TrashRepo, retention time.Duration) {
+	tick := time.NewTicker(time.Hour)
+	defer tick.Stop()
+	for {
+		res, err := trash.PurgeBefore(ctx, time.Now().Add(-retention).Unix())
+		if err != nil {
+			log.Printf("trash: purge failed: %v", err)
+		} else if res.Sites+res.Accounts+res.Schemas > 0 {
+			log.Printf("trash: purged %d sites, %d accounts, %d schema fields older than %s", res.Sites, res.Accounts, res.Schemas, retention)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
 
+// openSQLite opens the database file, initializing or migrating its schema
+// according to MSS_AUTO_MIGRATE.
+func openSQLite(dbPath string, autoMigrate bool) *sqlx.DB {
 	// Check DB file existence BEFORE opening sqlite (which would create the file).
 	needInit := false
 	if _, err := os.Stat(dbPath); err != nil {
@@ -46,24 +70,39 @@ func main() {
 
 	db, err := store.Open(dbPath)
 	if err != nil { log.Fatalf("open db: %v", err) }
-	defer func() { _ = db.Close() }()
+	// replicas sharing the volume wait this long for whoever is migrating
+	wait, err := time.ParseDuration(getenv("MSS_MIGRATE_WAIT", "2m"))
+	if err != nil { log.Fatalf("MSS_MIGRATE_WAIT: %v", err) }
 
 	if needInit {
 		log.Printf("database not found at %s; initializing schema (auto-migrate forced)", dbPath)
-		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second+wait)
 		defer cancel()
-		if err := migrate.Apply(ctx, db); err != nil { log.Fatalf("migrate: %v", err) }
+		if _, err := migrate.Apply(ctx, db, migrate.Options{Progress: logProgress, Wait: wait}); err != nil { log.Fatalf("migrate: %v", err) }
 	} else if autoMigrate {
 		log.Printf("existing database found; MSS_AUTO_MIGRATE=1 -> applying migrations")
-		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second+wait)
 		defer cancel()
-		if err := migrate.Apply(ctx, db); err != nil { log.Fatalf("migrate: %v", err) }
+		force := getenv("MSS_MIGRATE_FORCE", "0") == "1"
+		ran, err := migrate.Apply(ctx, db, migrate.Options{Force: force, Progress: logProgress, Snapshots: atoiEnv("MSS_MIGRATE_SNAPSHOTS", 3), Logf: log.Printf, Wait: wait})
+		if err != nil {
+			var drift *migrate.DriftError
+			if errors.As(err, &drift) && drift.Forceable() && !force { log.Fatalf("migrate: %v (fix the scripts, or set MSS_MIGRATE_FORCE=1 to accept them)", err) }
+			log.Fatalf("migrate: %v", err)
+		}
+		if len(ran) > 0 { log.Printf("migrate: applied %s", strings.Join(ran, ",")) }
 	} else {
 		log.Printf("existing database found; skipping migrations (MSS_AUTO_MIGRATE=0). If schema changes are required, enable MSS_AUTO_MIGRATE=1 and restart.")
 		// Log pending migrations for manual operation visibility
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		if pend, err := migrate.Pending(ctx, db); err != nil {
+		pend, err := migrate.Pending(ctx, db)
+		var drift *migrate.DriftError
+		if errors.As(err, &drift) {
+			for _, is := range drift.Issues { log.Printf("migrate: WARNING %s", is) }
+			err = nil
+		}
+		if err != nil {
 			log.Printf("migrate: pending check failed: %v", err)
 		} else if len(pend) > 0 {
 			log.Printf("migrate: pending versions: %s", strings.Join(pend, ","))
@@ -71,6 +110,76 @@ func main() {
 			log.Printf("migrate: no pending migrations")
 		}
 	}
+	return db
+}
+
+// revisionSecrets reads MSS_SECRET_KEY and MSS_REVISION_SECRETS.
+func revisionSecrets() store.RevisionSecrets {
+	secretBox, err := secret.ParseKey(os.Getenv("MSS_SECRET_KEY"))
+	if err != nil { log.Fatalf("MSS_SECRET_KEY: %v", err) }
+	secrets := store.RevisionSecrets{Mode: getenv("MSS_REVISION_SECRETS", store.SecretsRedacted), Box: secretBox}
+	if err := secrets.Check(); err != nil { log.Fatalf("MSS_REVISION_SECRETS: %v", err) }
+	return secrets
+}
+
+const usage = `usage: mss-server [command] [flags]
+
+commands:
+  serve     run the HTTP server (the default)
+  migrate   show, plan, apply, baseline or roll back schema migrations
+  apply     reconcile sites and schemas with config files
+  restore   replace the database with a backup
+  kdbx      import or export a KeePass database
+
+Run "mss-server <command> -h" for a command's flags.`
+
+func main() {
+	cmd, args := "serve", []string{}
+	if len(os.Args) > 1 { cmd, args = os.Args[1], os.Args[2:] }
+	switch cmd {
+	case "serve":
+		runServe(args)
+	case "migrate":
+		runMigrate(args)
+	case "apply":
+		runApply(args)
+	case "restore":
+		runRestore(args)
+	case "kdbx":
+		runKDBX(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Println(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s\n", cmd, usage)
+		os.Exit(2)
+	}
+}
+
+// runServe runs the HTTP server; its settings come from the environment.
+func runServe(args []string) {
+	if len(args) > 0 { fmt.Fprintln(os.Stderr, "usage: mss-server serve (configured through MSS_* environment variables)"); os.Exit(2) }
+	addr := getenv("MSS_LISTEN_ADDR", ":8080")
+	dbPath := getenv("MSS_DB_PATH", "./data/mss.db")
+	autoMigrate := getenv("MSS_AUTO_MIGRATE", "0") == "1"
+	adminToken := os.Getenv("MSS_ADMIN_TOKEN")
+	trashRetention, err := time.ParseDuration(getenv("MSS_TRASH_RETENTION", "720h"))
+	if err != nil { log.Fatalf("MSS_TRASH_RETENTION: %v", err) }
+	secrets := revisionSecrets()
+
+	var repos store.Repos
+	var backups *backup.Manager
+	switch backend := getenv("MSS_STORE", "sqlite"); backend {
+	case "sqlite":
+		db := openSQLite(dbPath, autoMigrate)
+		defer func() { _ = db.Close() }()
+		repos = store.NewSQLite(db, secrets)
+		backups = newBackupManager(db, dbPath)
+	case "memory":
+		log.Printf("store: using in-memory backend (MSS_STORE=memory); data is lost on exit")
+		repos = store.NewMemory(secrets)
+	default:
+		log.Fatalf("MSS_STORE: unknown backend %q (want sqlite|memory)", backend)
+	}
 
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
@@ -90,11 +199,40 @@ func main() {
 		w.WriteHeader(http.StatusNoContent)
 	})
 
-	apiRouter := api.NewRouter(db)
+	if trashRetention > 0 {
+		go runTrashPurge(context.Background(), repos.Trash, trashRetention)
+	} else {
+		log.Printf("trash: automatic purge disabled (MSS_TRASH_RETENTION=0)")
+	}
+
+	if backups != nil {
+		interval, err := time.ParseDuration(getenv("MSS_BACKUP_INTERVAL", "0"))
+		if err != nil { log.Fatalf("MSS_BACKUP_INTERVAL: %v", err) }
+		if interval > 0 {
+			go backups.Run(context.Background(), interval)
+		} else {
+			log.Printf("backup: scheduled backups disabled (MSS_BACKUP_INTERVAL=0)")
+		}
+	}
+
+	schemaCacheTTL, err := time.ParseDuration(getenv("MSS_SCHEMA_CACHE_TTL", "30s"))
+	if err != nil { log.Fatalf("MSS_SCHEMA_CACHE_TTL: %v", err) }
+	validators := validation.NewCache(schemaCacheTTL)
+	if dir := os.Getenv("MSS_CONFIG_DIR"); dir != "" { startConfigWatch(context.Background(), repos, dir, validators.Reset) }
+	managedSites := getenv("MSS_MANAGED_SITES", "reject")
+	if managedSites != "reject" && managedSites != "flag" { log.Fatalf("MSS_MANAGED_SITES: unknown mode %q (want reject|flag)", managedSites) }
+
+	apiRouter := api.NewRouter(repos, api.Options{
+		AdminToken:     adminToken,
+		RequireIfMatch: getenv("MSS_REQUIRE_IF_MATCH", "0") == "1",
+		ManagedSites:   managedSites,
+		Backups:        backups,
+		Validators:     validators,
+	})
 	r.Mount("/api", apiRouter)
 
 	// minimal server-side rendered UI
-	r.Mount("/ui", ui.NewRouter(db))
+	r.Mount("/ui", ui.NewRouter(repos))
 
 	srv := &http.Server{ Addr: addr, Handler: r }
 	log.Printf("mss-server listening on %s", addr)
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"mss/internal/migrate"
+	"mss/internal/store"
+)
+
+const migrateUsage = `usage:
+  mss-server migrate status
+  mss-server migrate plan [-to VERSION]
+  mss-server migrate up [-to VERSION] [-force] [-wait DURATION]
+  mss-server migrate baseline VERSION
+  mss-server migrate down [-to VERSION]
+
+status   lists every version with when it was applied, and ledger drift
+plan     prints the SQL that up would run
+up       applies pending migrations (through VERSION) in one transaction,
+         after snapshotting the database (MSS_MIGRATE_SNAPSHOTS, default 3
+         kept) and verifying the result; -force accepts modified or missing
+         scripts and skips the schema fingerprint check
+baseline records versions through VERSION as applied without running them,
+         for a database whose schema already matches
+down     rolls back the latest migration, or every migration newer than
+         VERSION (0 rolls back all), using the NNNN_name.down.sql scripts;
+         it drops the affected data, so take a backup first
+
+Processes sharing the database take turns through a lease in schema_lock;
+up waits -wait for it and the others fail at once if it is taken. A lease
+left by a crashed process expires after 30s.
+
+The database is MSS_DB_PATH (default ./data/mss.db). Stop the server
+before changing the schema.`
+
+// runMigrate implements the "migrate" subcommand.
+func runMigrate(args []string) {
+	if len(args) == 0 { fmt.Fprintln(os.Stderr, migrateUsage); os.Exit(2) }
+	fs := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(os.Stderr, migrateUsage) }
+	to := fs.String("to", "", "target version (plan, up, down)")
+	force := fs.Bool("force", false, "apply despite modified or missing scripts (up)")
+	wait := fs.Duration("wait", 0, "wait this long for another process's migration lease (up)")
+	_ = fs.Parse(args[1:])
+	wantArgs := 0
+	if args[0] == "baseline" { wantArgs = 1 }
+	if fs.NArg() != wantArgs { fs.Usage(); os.Exit(2) }
+
+	dbPath := getenv("MSS_DB_PATH", "./data/mss.db")
+	var db *sqlx.DB
+	if args[0] == "up" {
+		if err := os.MkdirAll(filepath.Dir(dbPath), 0o755); err != nil { log.Fatalf("mkdir data: %v", err) }
+		var err error
+		if db, err = store.Open(dbPath); err != nil { log.Fatalf("open db: %v", err) }
+	} else {
+		db = openExisting(dbPath)
+	}
+	defer func() { _ = db.Close() }()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "status":
+		st, err := migrate.Inspect(ctx, db)
+		if err != nil { log.Fatalf("migrate status: %v", err) }
+		pending := 0
+		for _, v := range st.Versions {
+			state := "pending"
+			if v.AppliedAt > 0 { state = "applied " + time.Unix(v.AppliedAt, 0).UTC().Format(time.RFC3339) } else { pending++ }
+			name := v.Name
+			if name == "" { name = "(no script)" }
+			down := ""
+			if v.HasDown { down = "  [down]" }
+			fmt.Printf("%s  %-32s %s%s\n", v.Version, name, state, down)
+		}
+		for _, is := range st.Issues { fmt.Printf("WARNING %s\n", is) }
+		if l := st.Lease; l != nil { fmt.Printf("Migration running: %s since %s.\n", l.Holder, time.Unix(l.AcquiredAt, 0).UTC().Format(time.RFC3339)) }
+		fmt.Printf("%d pending.\n", pending)
+	case "plan":
+		steps, err := migrate.Plan(ctx, db, *to)
+		if err != nil { log.Fatalf("migrate plan: %v", err) }
+		if len(steps) == 0 { fmt.Println("-- nothing to apply"); return }
+		for _, s := range steps {
+			if s.Go { fmt.Printf("-- %s (%s): Go data migration, no SQL\n", s.Version, s.Name); continue }
+			fmt.Printf("-- %s (%s)\n%s\n", s.Version, s.Name, strings.TrimRight(s.SQL, "\n"))
+		}
+	case "up":
+		ran, err := migrate.Apply(ctx, db, migrate.Options{Force: *force, To: *to, Progress: logProgress, Snapshots: atoiEnv("MSS_MIGRATE_SNAPSHOTS", 3), Logf: log.Printf, Wait: *wait})
+		var drift *migrate.DriftError
+		if errors.As(err, &drift) && drift.Forceable() && !*force { log.Fatalf("migrate up: %v (fix the scripts, or use -force to accept them)", err) }
+		if err != nil { log.Fatalf("migrate up: %v", err) }
+		if len(ran) == 0 { fmt.Println("Nothing to apply."); return }
+		fmt.Printf("Applied %s.\n", strings.Join(ran, ", "))
+	case "baseline":
+		marked, err := migrate.Baseline(ctx, db, fs.Arg(0))
+		if err != nil { log.Fatalf("migrate baseline: %v", err) }
+		if len(marked) == 0 { fmt.Println("Nothing to mark."); return }
+		fmt.Printf("Marked %s as applied.\n", strings.Join(marked, ", "))
+	case "down":
+		done, err := migrate.Down(ctx, db, *to)
+		if err != nil { log.Fatalf("migrate down: %v", err) }
+		if len(done) == 0 { fmt.Println("Nothing to roll back."); return }
+		fmt.Printf("Rolled back %s.\n", strings.Join(done, ", "))
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// logProgress logs how far a Go data migration got.
+func logProgress(version string, done, total int) {
+	if total > 0 { log.Printf("migrate: %s: %d/%d", version, done, total); return }
+	log.Printf("migrate: %s: %d done", version, done)
+}
+
+// openExisting opens the database without creating or migrating it.
+func openExisting(dbPath string) *sqlx.DB {
+	if _, err := os.Stat(dbPath); err != nil { log.Fatalf("open db: %v", err) }
+	db, err := store.Open(dbPath)
+	if err != nil { log.Fatalf("open db: %v", err) }
+	return db
+}
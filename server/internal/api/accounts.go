@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -25,6 +26,7 @@ type accountResp struct {
 	Props     map[string]interface{} `json:"props,omitempty"`
 	CreatedAt int64                  `json:"createdAt"`
 	UpdatedAt int64                  `json:"updatedAt"`
+	Version   int64                  `json:"version"`
 }
 
 func toAccountResp(a store.Account) accountResp {
@@ -34,46 +36,103 @@ func toAccountResp(a store.Account) accountResp {
 	}
 	return accountResp{
 		ID: a.ID, SiteKey: a.SiteKey, Username: a.Username, Password: a.Password,
-		Props: props, CreatedAt: a.Created, UpdatedAt: a.Updated,
+		Props: props, CreatedAt: a.Created, UpdatedAt: a.Updated, Version: a.Version,
 	}
 }
 
+// maskedAccountResp converts an account for output with secret props masked.
+func (a *API) maskedAccountResp(r *http.Request, acc store.Account) accountResp {
+	resp := toAccountResp(acc)
+	if resp.Props != nil {
+		if v, err := a.validator(r, acc.SiteKey); err == nil { resp.Props = v.Mask(resp.Props) }
+	}
+	return resp
+}
+
+// accountMismatch answers a failed account precondition with the current account.
+func (a *API) accountMismatch(w http.ResponseWriter, r *http.Request, key, id string) {
+	cur, err := a.repos.Accounts.Get(r.Context(), key, id)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	if cur == nil { fail(w, http.StatusNotFound, store.ErrNotFound); return }
+	preconditionFailed(w, cur.Version, a.maskedAccountResp(r, *cur))
+}
+
+func (a *API) getAccount(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	id := chi.URLParam(r, "id")
+	acc, err := a.repos.Accounts.Get(r.Context(), key, id)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	if acc == nil { fail(w, http.StatusNotFound, store.ErrNotFound); return }
+	setETag(w, acc.Version)
+	ok(w, a.maskedAccountResp(r, *acc))
+}
+
 func (a *API) listAccounts(w http.ResponseWriter, r *http.Request) {
 	key := chi.URLParam(r, "key")
-	accs, err := store.ListAccounts(r.Context(), a.db, key)
+	accs, err := a.repos.Accounts.List(r.Context(), key)
 	if err != nil { fail(w, http.StatusInternalServerError, err); return }
-	activeId, err := store.GetActiveAccountID(r.Context(), a.db, key)
+	active, err := a.repos.Active.Get(r.Context(), key)
 	if err != nil { fail(w, http.StatusInternalServerError, err); return }
 	res := make([]accountResp, 0, len(accs))
 	for _, it := range accs {
-		ar := toAccountResp(it)
-		if ar.Props != nil {
-			if masked, err := validation.MaskSecretProps(r.Context(), a.db, key, ar.Props); err == nil { ar.Props = masked }
+		res = append(res, a.maskedAccountResp(r, it))
+	}
+	ok(w, map[string]interface{}{"accounts": res, "activeId": active.AccountID})
+}
+
+type undeclaredResp struct {
+	ID       string   `json:"id"`
+	Username string   `json:"username"`
+	Props    []string `json:"props"` // names the schema does not declare
+}
+
+// listUndeclaredProps lists the site's accounts carrying props outside its
+// schema, e.g. before switching the site to additionalProps=reject.
+func (a *API) listUndeclaredProps(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	site, err := a.repos.Sites.Get(r.Context(), key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	if site == nil { fail(w, http.StatusNotFound, store.ErrNotFound); return }
+	v, err := a.validator(r, key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	accs, err := a.repos.Accounts.List(r.Context(), key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	out := []undeclaredResp{}
+	for _, acc := range accs {
+		if extra := validation.UndeclaredProps(v.Schemas, toAccountResp(acc).Props); len(extra) > 0 {
+			out = append(out, undeclaredResp{ID: acc.ID, Username: acc.Username, Props: extra})
 		}
-		res = append(res, ar)
 	}
-	ok(w, map[string]interface{}{"accounts": res, "activeId": activeId})
+	ok(w, map[string]interface{}{"additionalProps": site.AdditionalProps, "accounts": out})
 }
 
 func (a *API) createAccount(w http.ResponseWriter, r *http.Request) {
 	key := chi.URLParam(r, "key")
 	var body accountReq
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil { fail(w, http.StatusBadRequest, err); return }
-	if body.Props != nil {
-		if err := validation.ValidateProps(r.Context(), a.db, key, body.Props); err != nil { fail(w, http.StatusBadRequest, err); return }
-	}
+	v, err := a.validator(r, key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	props := v.Normalize(body.Props)
 	acc := store.Account{ ID: body.ID, SiteKey: key, Username: body.Username, Password: body.Password }
-	if acc.ID == "" { acc.ID = store.GenerateID("acc") }
-	if body.Props != nil {
-		b, _ := json.Marshal(body.Props)
+	checked := props
+	if body.Props == nil { checked = nil }
+	if props != nil {
+		b, _ := json.Marshal(props)
 		acc.Extra = string(b)
 	}
-	if err := store.CreateAccount(r.Context(), a.db, &acc); err != nil { fail(w, http.StatusInternalServerError, err); return }
-	resp := toAccountResp(acc)
-	if resp.Props != nil {
-		if masked, err := validation.MaskSecretProps(r.Context(), a.db, key, resp.Props); err == nil { resp.Props = masked }
-	}
-	ok(w, resp)
+	// validate and write in one tx so a concurrent write cannot slip a
+	// duplicate unique value in between
+	var warnings []string
+	err = a.repos.Tx.InTx(r.Context(), func(tx store.Repos) error {
+		var err error
+		if warnings, err = v.ValidateAccount(r.Context(), tx, acc, checked); err != nil { return err }
+		if acc.ID == "" { acc.ID = store.GenerateID("acc") }
+		return tx.Accounts.Create(r.Context(), &acc)
+	})
+	if err != nil { failInvalid(w, err); return }
+	if created, err := a.repos.Accounts.Get(r.Context(), key, acc.ID); err == nil && created != nil { acc = *created }
+	setETag(w, acc.Version)
+	okWarn(w, a.maskedAccountResp(r, acc), warnings)
 }
 
 func (a *API) updateAccount(w http.ResponseWriter, r *http.Request) {
@@ -81,25 +140,53 @@ func (a *API) updateAccount(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	var body accountReq
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil { fail(w, http.StatusBadRequest, err); return }
-	if body.Props != nil {
-		if err := validation.ValidateProps(r.Context(), a.db, key, body.Props); err != nil { fail(w, http.StatusBadRequest, err); return }
-	}
+	v, err := a.validator(r, key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	props := v.Normalize(body.Props)
 	acc := store.Account{ ID: id, SiteKey: key, Username: body.Username, Password: body.Password }
-	if body.Props != nil {
-		b, _ := json.Marshal(body.Props)
+	checked := props
+	if body.Props == nil { checked = nil }
+	ver, good := a.ifMatch(w, r)
+	if !good { return }
+	if props != nil {
+		b, _ := json.Marshal(props)
 		acc.Extra = string(b)
 	}
-	if err := store.UpdateAccount(r.Context(), a.db, &acc); err != nil { fail(w, http.StatusInternalServerError, err); return }
-	resp := toAccountResp(acc)
-	if resp.Props != nil {
-		if masked, err := validation.MaskSecretProps(r.Context(), a.db, key, resp.Props); err == nil { resp.Props = masked }
+	var warnings []string
+	err = a.repos.Tx.InTx(r.Context(), func(tx store.Repos) error {
+		var err error
+		if warnings, err = v.ValidateAccount(r.Context(), tx, acc, checked); err != nil { return err }
+		return tx.Accounts.Update(r.Context(), &acc, ver)
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrVersionMismatch) { a.accountMismatch(w, r, key, id); return }
+		failInvalid(w, err); return
 	}
-	ok(w, resp)
+	setETag(w, acc.Version)
+	okWarn(w, a.maskedAccountResp(r, acc), warnings)
 }
 
 func (a *API) deleteAccount(w http.ResponseWriter, r *http.Request) {
 	key := chi.URLParam(r, "key")
 	id := chi.URLParam(r, "id")
-	if err := store.DeleteAccount(r.Context(), a.db, key, id); err != nil { fail(w, http.StatusInternalServerError, err); return }
+	if wantsHardDelete(r) {
+		if !a.isAdmin(r) { fail(w, http.StatusForbidden, errAdminOnly); return }
+		if err := a.repos.Accounts.Purge(r.Context(), key, id); err != nil { failStore(w, err); return }
+		ok(w, map[string]string{"status":"purged"})
+		return
+	}
+	ver, good := a.ifMatch(w, r)
+	if !good { return }
+	if err := a.repos.Accounts.Delete(r.Context(), key, id, ver); err != nil {
+		if errors.Is(err, store.ErrVersionMismatch) { a.accountMismatch(w, r, key, id); return }
+		failStore(w, err); return
+	}
 	ok(w, map[string]string{"status":"deleted"})
 }
+
+func (a *API) restoreAccount(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	id := chi.URLParam(r, "id")
+	if err := a.repos.Accounts.Restore(r.Context(), key, id); err != nil { failStore(w, err); return }
+	ok(w, map[string]string{"status":"restored"})
+}
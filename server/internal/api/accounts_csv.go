@@ -0,0 +1,354 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"mss/internal/store"
+	"mss/internal/validation"
+)
+
+// maxCSVBytes bounds the size of an uploaded CSV file.
+const maxCSVBytes = 16 << 20
+
+// csvColumn is where one CSV column lands on an account.
+type csvColumn struct {
+	index  int
+	header string
+	target string // "username", "password" or a prop name
+	typ    string // schema type for props; "string" when the prop has no schema
+}
+
+type csvRowResult struct {
+	Row      int    `json:"row"`
+	Username string `json:"username,omitempty"`
+	Action   string                 `json:"action,omitempty"` // create or update
+	ID       string                 `json:"id,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	Warnings []string               `json:"warnings,omitempty"`
+	Details  []validation.Violation `json:"details,omitempty"`
+}
+
+// csvPlan is one validated row ready to be written.
+type csvPlan struct {
+	acc    store.Account
+	update bool
+}
+
+// csvRecord is one row as read, or the parse error in its place.
+type csvRecord struct {
+	line   int
+	fields []string
+	err    string
+}
+
+// errCSVInvalid rolls back an import in which some row failed validation.
+var errCSVInvalid = errors.New("csv validation failed")
+
+// importAccountsCSV upserts accounts by username from a CSV body.
+//
+// Columns are mapped with repeated ?map=<header>:<target>, where target is
+// username, password, a schema field, or props.<name> for props outside the
+// schema; "-" drops the column. Without ?map headers are matched by name.
+// Cells are coerced to the schema type before the props are validated; a
+// username repeated in the file updates the account its earlier row wrote,
+// and unique props must not repeat between rows. ?dryRun=1 only reports;
+// otherwise the file is planned and applied in one transaction, and any row
+// error rejects the whole file.
+func (a *API) importAccountsCSV(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	ctx := r.Context()
+	dry := r.URL.Query().Get("dryRun")
+	dryRun := dry == "1" || dry == "true"
+
+	site, err := a.repos.Sites.Get(ctx, key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	if site == nil { fail(w, http.StatusNotFound, store.ErrNotFound); return }
+	schema, err := a.validator(r, key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+
+	cr := csv.NewReader(http.MaxBytesReader(w, r.Body, maxCSVBytes))
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil { fail(w, http.StatusBadRequest, fmt.Errorf("reading csv header: %w", err)); return }
+	if len(header) > 0 { header[0] = strings.TrimPrefix(header[0], "\ufeff") }
+	cols, ignored, err := mapCSVColumns(header, r.URL.Query()["map"], schema.Schemas)
+	if err != nil { fail(w, http.StatusBadRequest, err); return }
+
+	var records []csvRecord
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF { break }
+		if err != nil {
+			var pe *csv.ParseError
+			if !errors.As(err, &pe) { fail(w, http.StatusBadRequest, err); return }
+			records = append(records, csvRecord{line: pe.StartLine, err: pe.Err.Error()})
+			continue
+		}
+		line, _ := cr.FieldPos(0)
+		records = append(records, csvRecord{line: line, fields: rec})
+	}
+
+	var (
+		results []csvRowResult
+		plans   []csvPlan
+		errs    map[string]string
+	)
+	summary := func(created, updated int) map[string]interface{} {
+		return map[string]interface{}{
+			"dryRun": dryRun, "created": created, "updated": updated, "failed": len(errs),
+			"ignoredColumns": ignored, "rows": results, "errors": errs,
+		}
+	}
+	counts := func() (created, updated int) {
+		for _, p := range plans {
+			if p.update { updated++ } else { created++ }
+		}
+		return
+	}
+	if dryRun {
+		if results, plans, errs, err = a.planCSV(r, a.repos, schema, records, cols); err != nil { fail(w, http.StatusInternalServerError, err); return }
+		ok(w, summary(counts()))
+		return
+	}
+	// plan inside the transaction so the file is checked against the
+	// accounts it is written over
+	err = a.repos.Tx.InTx(ctx, func(tx store.Repos) error {
+		var err error
+		if results, plans, errs, err = a.planCSV(r, tx, schema, records, cols); err != nil { return err }
+		if len(errs) > 0 { return errCSVInvalid }
+		for i := range plans {
+			p := &plans[i]
+			if p.update {
+				if err := tx.Accounts.Update(ctx, &p.acc, 0); err != nil { return fmt.Errorf("%s: %w", p.acc.Username, err) }
+				continue
+			}
+			if err := tx.Accounts.Create(ctx, &p.acc); err != nil { return fmt.Errorf("%s: %w", p.acc.Username, err) }
+		}
+		return nil
+	})
+	if errors.Is(err, errCSVInvalid) {
+		writeJSON(w, http.StatusBadRequest, Response{Ok: false, Data: summary(0, 0), Error: errCSVInvalid.Error()})
+		return
+	}
+	if err != nil { failStore(w, err); return }
+	ok(w, summary(counts()))
+}
+
+// planCSV plans every record against the accounts in repos, returning a
+// result per row, the plans of the rows that passed and the row errors by
+// line number.
+func (a *API) planCSV(r *http.Request, repos store.Repos, schema *validation.Validator, records []csvRecord, cols []csvColumn) ([]csvRowResult, []csvPlan, map[string]string, error) {
+	existing, err := repos.Accounts.List(r.Context(), schema.SiteKey)
+	if err != nil { return nil, nil, nil, err }
+	byUsername := make(map[string][]store.Account, len(existing))
+	for _, acc := range existing { byUsername[acc.Username] = append(byUsername[acc.Username], acc) }
+
+	var results []csvRowResult
+	var plans []csvPlan
+	errs := map[string]string{}
+	batch := schema.Batch()
+	for _, rec := range records {
+		if rec.err != "" {
+			results = append(results, csvRowResult{Row: rec.line, Error: rec.err})
+			errs[strconv.Itoa(rec.line)] = rec.err
+			continue
+		}
+		res, plan, err := planCSVRow(r, repos, batch, schema, rec.line, rec.fields, cols, byUsername)
+		if err != nil { return nil, nil, nil, err }
+		results = append(results, res)
+		if res.Error != "" { errs[strconv.Itoa(res.Row)] = res.Error; continue }
+		plans = append(plans, plan)
+		// later rows for this username update what this row writes
+		batch.Claim(plan.acc)
+		byUsername[plan.acc.Username] = []store.Account{plan.acc}
+	}
+	return results, plans, errs, nil
+}
+
+// planCSVRow turns one record into a create or update, or an error result.
+// The error is for failures to read repos.
+func planCSVRow(r *http.Request, repos store.Repos, batch *validation.Batch, schema *validation.Validator, line int, rec []string, cols []csvColumn, byUsername map[string][]store.Account) (csvRowResult, csvPlan, error) {
+	res := csvRowResult{Row: line}
+	cell := func(c csvColumn) string {
+		if c.index < len(rec) { return rec[c.index] }
+		return ""
+	}
+	var password *string
+	var coerceErr error
+	values := map[string]interface{}{}
+	for _, c := range cols {
+		switch c.target {
+		case "username":
+			res.Username = strings.TrimSpace(cell(c))
+		case "password":
+			if v := cell(c); v != "" { password = &v }
+		default:
+			v, err := validation.CoerceString(cell(c), c.typ)
+			if err != nil {
+				if coerceErr == nil { coerceErr = fmt.Errorf("column %q: %v", c.header, err) }
+				continue
+			}
+			if v != nil { values[c.target] = v }
+		}
+	}
+	if res.Username == "" { res.Error = "username required"; return res, csvPlan{}, nil }
+	if coerceErr != nil { res.Error = coerceErr.Error(); return res, csvPlan{}, nil }
+
+	plan := csvPlan{acc: store.Account{SiteKey: schema.SiteKey, Username: res.Username}}
+	props := map[string]interface{}{}
+	switch matches := byUsername[res.Username]; len(matches) {
+	case 0:
+		plan.acc.ID = store.GenerateID("acc")
+		res.Action = "create"
+	case 1:
+		cur := matches[0]
+		plan.acc.ID, plan.acc.Password, plan.update = cur.ID, cur.Password, true
+		if cur.Extra != "" { _ = json.Unmarshal([]byte(cur.Extra), &props) }
+		res.Action = "update"
+	default:
+		res.Error = fmt.Sprintf("username matches %d existing accounts", len(matches))
+		return res, csvPlan{}, nil
+	}
+	res.ID = plan.acc.ID
+	if password != nil { plan.acc.Password = *password }
+	// mapped cells overwrite, unmapped props of an existing account are kept
+	for k, v := range values { props[k] = v }
+	props = schema.Normalize(props)
+	warnings, err := batch.ValidateAccount(r.Context(), repos, plan.acc, props)
+	if details := detailsOf(err); details != nil {
+		res.Error, res.Details = err.Error(), details
+		return res, csvPlan{}, nil
+	}
+	if err != nil { return res, csvPlan{}, err }
+	res.Warnings = warnings
+	if len(props) > 0 {
+		b, _ := json.Marshal(props)
+		plan.acc.Extra = string(b)
+	}
+	return res, plan, nil
+}
+
+// mapCSVColumns resolves explicit "<header>:<target>" mappings, or matches
+// headers by name when none are given. It returns the headers left unmapped.
+func mapCSVColumns(header []string, mappings []string, schemas []store.SiteFieldSchema) ([]csvColumn, []string, error) {
+	types := make(map[string]string, len(schemas))
+	for _, s := range schemas { types[s.Field] = s.Type }
+	resolve := func(target string) (string, string, bool) {
+		switch {
+		case strings.EqualFold(target, "username"):
+			return "username", "", true
+		case strings.EqualFold(target, "password"):
+			return "password", "", true
+		case strings.HasPrefix(target, "props.") && len(target) > len("props."):
+			name := strings.TrimPrefix(target, "props.")
+			if t, ok := types[name]; ok { return name, t, true }
+			return name, "string", true
+		}
+		if t, ok := types[target]; ok { return target, t, true }
+		return "", "", false
+	}
+
+	index := make(map[string]int, len(header))
+	for i, h := range header { index[strings.TrimSpace(h)] = i }
+	var cols []csvColumn
+	used := map[int]bool{}
+	targets := map[string]string{}
+	add := func(i int, target, typ string) error {
+		if prev, dup := targets[target]; dup { return fmt.Errorf("columns %q and %q both map to %s", prev, header[i], target) }
+		targets[target] = header[i]
+		used[i] = true
+		cols = append(cols, csvColumn{index: i, header: header[i], target: target, typ: typ})
+		return nil
+	}
+	if len(mappings) > 0 {
+		for _, m := range mappings {
+			sep := strings.LastIndex(m, ":")
+			if sep <= 0 { return nil, nil, fmt.Errorf("invalid map %q, want <header>:<target>", m) }
+			h, target := strings.TrimSpace(m[:sep]), strings.TrimSpace(m[sep+1:])
+			i, ok := index[h]
+			if !ok { return nil, nil, fmt.Errorf("map %q: no column %q in header", m, h) }
+			if target == "-" { used[i] = true; continue }
+			name, typ, ok := resolve(target)
+			if !ok { return nil, nil, fmt.Errorf("map %q: %q is not username, password, a schema field or props.<name>", m, target) }
+			if err := add(i, name, typ); err != nil { return nil, nil, err }
+		}
+	} else {
+		for i, h := range header {
+			name, typ, ok := resolve(strings.TrimSpace(h))
+			if !ok { continue }
+			if err := add(i, name, typ); err != nil { return nil, nil, err }
+		}
+	}
+	if _, ok := targets["username"]; !ok { return nil, nil, errors.New("no column mapped to username") }
+	ignored := []string{}
+	for i, h := range header {
+		if !used[i] { ignored = append(ignored, h) }
+	}
+	return cols, ignored, nil
+}
+
+// exportAccountsCSV writes the site's accounts in the shape importAccountsCSV
+// reads back: username, password, schema fields, then props.<name> for props
+// outside the schema. Passwords and secret fields are left out unless an
+// admin asks for ?secrets=1.
+func (a *API) exportAccountsCSV(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	ctx := r.Context()
+	withSecrets := r.URL.Query().Get("secrets") == "1" || r.URL.Query().Get("secrets") == "true"
+	if withSecrets && !a.isAdmin(r) { fail(w, http.StatusForbidden, errAdminOnly); return }
+
+	site, err := a.repos.Sites.Get(ctx, key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	if site == nil { fail(w, http.StatusNotFound, store.ErrNotFound); return }
+	schemas, err := a.repos.Schemas.List(ctx, key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	accs, err := a.repos.Accounts.List(ctx, key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+
+	header := []string{"username"}
+	if withSecrets { header = append(header, "password") }
+	var fields []string
+	inSchema := map[string]bool{}
+	for _, s := range schemas {
+		inSchema[s.Field] = true
+		if s.Secret != 0 && !withSecrets { continue }
+		fields = append(fields, s.Field)
+	}
+	props := make([]map[string]interface{}, len(accs))
+	extraSet := map[string]bool{}
+	for i, acc := range accs {
+		if acc.Extra != "" { _ = json.Unmarshal([]byte(acc.Extra), &props[i]) }
+		for k := range props[i] {
+			if !inSchema[k] { extraSet[k] = true }
+		}
+	}
+	extras := make([]string, 0, len(extraSet))
+	for k := range extraSet { extras = append(extras, k) }
+	sort.Strings(extras)
+	header = append(header, fields...)
+	for _, k := range extras { header = append(header, "props."+k) }
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", key+"-accounts.csv"))
+	w.Header().Set("Cache-Control", "no-store")
+	cw := csv.NewWriter(w)
+	_ = cw.Write(header)
+	for i, acc := range accs {
+		row := []string{acc.Username}
+		if withSecrets { row = append(row, acc.Password) }
+		for _, f := range fields { row = append(row, validation.FormatValue(props[i][f])) }
+		for _, k := range extras { row = append(row, validation.FormatValue(props[i][k])) }
+		_ = cw.Write(row)
+	}
+	cw.Flush()
+}
@@ -0,0 +1,60 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"mss/internal/api"
+)
+
+type csvReply struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Failed  int `json:"failed"`
+	Rows    []struct {
+		Row    int    `json:"row"`
+		Action string `json:"action"`
+		Error  string `json:"error"`
+	} `json:"rows"`
+}
+
+func TestAccountsCSV(t *testing.T) {
+	ctx := context.Background()
+	c := newClient(t, api.Options{})
+	c.site("gh", map[string]interface{}{"field": "age", "type": "integer"}, map[string]interface{}{"field": "token", "type": "string", "secret": true})
+	c.account("gh", map[string]interface{}{"username": "alice", "password": "keep", "props": map[string]interface{}{"team": "a"}})
+
+	file := "\ufeffusername,password,age,token,props.team\nalice,,31,t1,\nbob,pw,40,t2,b\nbob,pw2,41,t2,b\n"
+	var rep csvReply
+	c.must(http.StatusOK, "POST", "/sites/gh/accounts:import?dryRun=1", file).into(t, &rep)
+	if rep.Created != 1 || rep.Updated != 2 || rep.Failed != 0 { t.Fatalf("dry run: %+v", rep) }
+	if accs, _ := c.repos.Accounts.List(ctx, "gh"); len(accs) != 1 { t.Fatal("dry run wrote accounts") }
+
+	c.must(http.StatusOK, "POST", "/sites/gh/accounts:import", file).into(t, &rep)
+	accs, err := c.repos.Accounts.List(ctx, "gh")
+	if err != nil { t.Fatal(err) }
+	byName := map[string]map[string]interface{}{}
+	for _, a := range accs {
+		var props map[string]interface{}
+		_ = json.Unmarshal([]byte(a.Extra), &props)
+		byName[a.Username] = props
+		// an empty password cell keeps the stored password
+		if a.Username == "alice" && a.Password != "keep" { t.Errorf("alice password: %q", a.Password) }
+		if a.Username == "bob" && a.Password != "pw2" { t.Errorf("bob password: %q", a.Password) }
+	}
+	if len(accs) != 2 || byName["alice"]["age"] != 31.0 || byName["alice"]["team"] != "a" || byName["bob"]["age"] != 41.0 { t.Fatalf("accounts: %v", byName) }
+
+	// one bad row rejects the whole file
+	c.must(http.StatusBadRequest, "POST", "/sites/gh/accounts:import", "username,age\ncarol,1\ndave,old\n").into(t, &rep)
+	if rep.Failed != 1 || rep.Rows[1].Error == "" { t.Fatalf("bad row: %+v", rep) }
+	if accs, _ := c.repos.Accounts.List(ctx, "gh"); len(accs) != 2 { t.Fatal("a rejected file wrote accounts") }
+	c.must(http.StatusBadRequest, "POST", "/sites/gh/accounts:import?map=nope:username", "username\nx\n")
+
+	// secrets and passwords are only exported on request, by an admin
+	out := string(c.must(http.StatusOK, "GET", "/sites/gh/accounts:export", nil).Body)
+	if want := "username,age,props.team\nalice,31,a\nbob,41,b\n"; out != want { t.Fatalf("export:\n%s\nwant\n%s", out, want) }
+	out = string(c.must(http.StatusOK, "GET", "/sites/gh/accounts:export?secrets=1", nil).Body)
+	if want := "username,password,age,token,props.team\nalice,keep,31,t1,a\nbob,pw2,41,t2,b\n"; out != want { t.Fatalf("export with secrets:\n%s", out) }
+}
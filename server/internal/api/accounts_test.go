@@ -0,0 +1,76 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"mss/internal/api"
+	"mss/internal/store"
+)
+
+func TestAccountFieldTypes(t *testing.T) {
+	c := newClient(t, api.Options{})
+	c.site("gh",
+		map[string]interface{}{"field": "age", "type": "integer", "min": 18},
+		map[string]interface{}{"field": "plan", "type": "enum", "choices": []string{"free", "pro"}},
+		map[string]interface{}{"field": "tags", "type": "array", "items": map[string]interface{}{"type": "string", "minLength": 2}},
+		map[string]interface{}{"field": "addr", "type": "object", "fields": []map[string]interface{}{{"field": "city", "type": "string", "required": true}}},
+		map[string]interface{}{"field": "email", "type": "email", "unique": true},
+	)
+	good := map[string]interface{}{"age": 30, "plan": "pro", "tags": []string{"ab"}, "addr": map[string]interface{}{"city": "Oslo"}, "email": "a@x.io"}
+	acc := c.account("gh", map[string]interface{}{"username": "alice", "props": good})
+	if acc["props"].(map[string]interface{})["age"] != 30.0 { t.Fatalf("account: %v", acc) }
+
+	for name, props := range map[string]map[string]interface{}{
+		"below min":     {"age": 17},
+		"not a choice":  {"plan": "gold"},
+		"short item":    {"tags": []string{"a"}},
+		"nested field":  {"addr": map[string]interface{}{}},
+		"not an email":  {"email": "nope"},
+		"unique":        {"email": "a@x.io"},
+		"wrong type":    {"age": "old"},
+	} {
+		r := c.must(http.StatusBadRequest, "POST", "/sites/gh/accounts", map[string]interface{}{"username": "bob", "props": props})
+		if len(r.Details) != 1 { t.Errorf("%s: %v", name, r.Details) }
+	}
+	id := acc["id"].(string)
+	c.account("gh", map[string]interface{}{"username": "bob", "props": map[string]interface{}{"email": "b@x.io"}})
+	// an account keeps its own unique value but cannot take another's
+	c.must(http.StatusOK, "PUT", "/sites/gh/accounts/"+id, map[string]interface{}{"username": "alice", "props": good})
+	good["email"] = "b@x.io"
+	c.must(http.StatusBadRequest, "PUT", "/sites/gh/accounts/"+id, map[string]interface{}{"username": "alice", "props": good})
+}
+
+// brokenList fails to list accounts, as a store read error would.
+type brokenList struct{ store.AccountRepo }
+
+func (brokenList) List(context.Context, string) ([]store.Account, error) { return nil, errors.New("disk on fire") }
+
+// brokenTx hands out brokenList once broken is set.
+type brokenTx struct {
+	store.Transactor
+	broken *bool
+}
+
+func (b brokenTx) InTx(ctx context.Context, fn func(tx store.Repos) error) error {
+	return b.Transactor.InTx(ctx, func(tx store.Repos) error {
+		if *b.broken { tx.Accounts = brokenList{tx.Accounts} }
+		return fn(tx)
+	})
+}
+
+func TestAccountStoreErrors(t *testing.T) {
+	repos := store.NewMemory(store.RevisionSecrets{})
+	broken := false
+	repos.Tx = brokenTx{repos.Tx, &broken}
+	c := newClientOn(t, repos, api.Options{})
+	c.site("gh", map[string]interface{}{"field": "email", "type": "email", "unique": true})
+	broken = true
+	// the unique check cannot read the accounts: that is not the client's fault
+	body := map[string]interface{}{"username": "alice", "props": map[string]interface{}{"email": "a@x.io"}}
+	if r := c.must(http.StatusInternalServerError, "POST", "/sites/gh/accounts", body); len(r.Details) != 0 { t.Fatalf("details: %v", r.Details) }
+	body["props"] = map[string]interface{}{"email": "nope"}
+	c.must(http.StatusBadRequest, "POST", "/sites/gh/accounts", body)
+}
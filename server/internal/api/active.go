@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -11,15 +12,24 @@ import (
 
 func (a *API) getActiveAccount(w http.ResponseWriter, r *http.Request) {
 	key := chi.URLParam(r, "key")
-	id, err := store.GetActiveAccountID(r.Context(), a.db, key)
+	m, err := a.repos.Active.Get(r.Context(), key)
 	if err != nil { fail(w, http.StatusInternalServerError, err); return }
-	ok(w, map[string]interface{}{"accountId": id})
+	setETag(w, m.Version)
+	ok(w, map[string]interface{}{"accountId": m.AccountID, "version": m.Version})
 }
 
 func (a *API) setActiveAccount(w http.ResponseWriter, r *http.Request) {
 	key := chi.URLParam(r, "key")
 	var body struct{ AccountID *string `json:"accountId"` }
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil { fail(w, http.StatusBadRequest, err); return }
-	if err := store.SetActiveAccountID(r.Context(), a.db, key, body.AccountID); err != nil { fail(w, http.StatusInternalServerError, err); return }
-	ok(w, map[string]interface{}{"accountId": body.AccountID})
+	ver, good := a.ifMatch(w, r)
+	if !good { return }
+	setErr := a.repos.Active.Set(r.Context(), key, body.AccountID, ver)
+	if setErr != nil && !errors.Is(setErr, store.ErrVersionMismatch) { fail(w, http.StatusInternalServerError, setErr); return }
+	m, err := a.repos.Active.Get(r.Context(), key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	cur := map[string]interface{}{"accountId": m.AccountID, "version": m.Version}
+	if setErr != nil { preconditionFailed(w, m.Version, cur); return }
+	setETag(w, m.Version)
+	ok(w, cur)
 }
@@ -0,0 +1,144 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mss/internal/api"
+	"mss/internal/store"
+	"mss/internal/validation"
+)
+
+const adminToken = "adm"
+
+// reply is a decoded response envelope; Body is the raw response, for
+// downloads.
+type reply struct {
+	Code     int                    `json:"-"`
+	Header   http.Header            `json:"-"`
+	Body     []byte                 `json:"-"`
+	Ok       bool                   `json:"ok"`
+	Data     json.RawMessage        `json:"data"`
+	Error    string                 `json:"error"`
+	Warnings []string               `json:"warnings"`
+	Details  []validation.Violation `json:"details"`
+}
+
+// into decodes Data into v.
+func (r reply) into(t *testing.T, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(r.Data, v); err != nil { t.Fatalf("data %s: %v", r.Data, err) }
+}
+
+type client struct {
+	t     *testing.T
+	h     http.Handler
+	repos store.Repos
+}
+
+func newClient(t *testing.T, opts api.Options) *client {
+	return newClientOn(t, store.NewMemory(store.RevisionSecrets{}), opts)
+}
+
+func newClientOn(t *testing.T, repos store.Repos, opts api.Options) *client {
+	if opts.AdminToken == "" { opts.AdminToken = adminToken }
+	return &client{t: t, h: api.NewRouter(repos, opts), repos: repos}
+}
+
+// do sends body (a string or []byte as is, anything else as JSON) with header pairs
+// and decodes the envelope. Requests carry the admin token.
+func (c *client) do(method, path string, body interface{}, header ...string) reply {
+	c.t.Helper()
+	var rd io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		rd = bytes.NewBufferString(b)
+	case []byte:
+		rd = bytes.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil { c.t.Fatal(err) }
+		rd = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, rd)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	for i := 0; i+1 < len(header); i += 2 { req.Header.Set(header[i], header[i+1]) }
+	rec := httptest.NewRecorder()
+	c.h.ServeHTTP(rec, req)
+	out := reply{Code: rec.Code, Header: rec.Header(), Body: rec.Body.Bytes()}
+	if strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(out.Body, &out); err != nil { c.t.Fatalf("%s %s: %v\n%s", method, path, err, out.Body) }
+	}
+	return out
+}
+
+// must is do that fails the test unless the answer has status code.
+func (c *client) must(code int, method, path string, body interface{}, header ...string) reply {
+	c.t.Helper()
+	r := c.do(method, path, body, header...)
+	if r.Code != code { c.t.Fatalf("%s %s: %d %s %v, want %d", method, path, r.Code, r.Error, r.Details, code) }
+	return r
+}
+
+// site creates a site with the given schema fields.
+func (c *client) site(key string, fields ...map[string]interface{}) {
+	c.t.Helper()
+	c.must(http.StatusOK, "POST", "/sites", map[string]string{"key": key, "name": key})
+	if len(fields) > 0 { c.must(http.StatusOK, "POST", "/sites/"+key+"/schema", map[string]interface{}{"fields": fields}) }
+}
+
+// account creates an account and returns it.
+func (c *client) account(key string, body map[string]interface{}) map[string]interface{} {
+	c.t.Helper()
+	var acc map[string]interface{}
+	c.must(http.StatusOK, "POST", "/sites/"+key+"/accounts", body).into(c.t, &acc)
+	return acc
+}
+
+// ids lists the IDs of the site's live accounts.
+func (c *client) ids(key string) []string {
+	c.t.Helper()
+	var list struct{ Accounts []struct{ ID string `json:"id"` } `json:"accounts"` }
+	c.must(http.StatusOK, "GET", "/sites/"+key+"/accounts", nil).into(c.t, &list)
+	out := []string{}
+	for _, a := range list.Accounts { out = append(out, a.ID) }
+	return out
+}
+
+func TestTrash(t *testing.T) {
+	c := newClient(t, api.Options{})
+	c.site("gh")
+	id := c.account("gh", map[string]interface{}{"username": "alice", "password": "pw"})["id"].(string)
+
+	c.must(http.StatusOK, "DELETE", "/sites/gh/accounts/"+id, nil)
+	if ids := c.ids("gh"); len(ids) != 0 { t.Fatalf("trashed account still listed: %q", ids) }
+	var trash store.Trash
+	c.must(http.StatusOK, "GET", "/trash", nil).into(t, &trash)
+	if len(trash.Accounts) != 1 || trash.Accounts[0].ID != id || trash.Accounts[0].Password != "" { t.Fatalf("trash: %+v", trash) }
+	c.must(http.StatusOK, "POST", "/sites/gh/accounts/"+id+"/restore", nil)
+	if ids := c.ids("gh"); len(ids) != 1 { t.Fatalf("restored account not listed: %q", ids) }
+
+	// trashing a site takes its accounts along and restoring brings them back
+	c.must(http.StatusOK, "DELETE", "/sites/gh", nil)
+	c.must(http.StatusNotFound, "GET", "/sites/gh", nil)
+	// the key stays taken while the site is in trash
+	if r := c.must(http.StatusConflict, "POST", "/sites", map[string]string{"key": "gh", "name": "gh"}); !strings.Contains(r.Error, "trash") { t.Fatalf("conflict: %q", r.Error) }
+	c.must(http.StatusOK, "POST", "/sites/gh/restore", nil)
+	if ids := c.ids("gh"); len(ids) != 1 { t.Fatalf("site restore lost the account: %q", ids) }
+
+	c.must(http.StatusOK, "DELETE", "/sites/gh/accounts/"+id, nil)
+	req := httptest.NewRequest("POST", "/trash/purge", nil)
+	rec := httptest.NewRecorder()
+	c.h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden { t.Fatalf("purge without the admin token: %d", rec.Code) }
+	var purged store.PurgeResult
+	c.must(http.StatusOK, "POST", "/trash/purge", nil).into(t, &purged)
+	if purged.Accounts != 1 { t.Fatalf("purge: %+v", purged) }
+	c.must(http.StatusNotFound, "POST", "/sites/gh/accounts/"+id+"/restore", nil)
+}
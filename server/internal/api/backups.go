@@ -0,0 +1,26 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+)
+
+var errNoBackups = errors.New("backups require the sqlite store")
+
+// listBackups returns the snapshots in MSS_BACKUP_DIR, newest first.
+func (a *API) listBackups(w http.ResponseWriter, r *http.Request) {
+	if !a.isAdmin(r) { fail(w, http.StatusForbidden, errAdminOnly); return }
+	if a.opts.Backups == nil { fail(w, http.StatusNotImplemented, errNoBackups); return }
+	list, err := a.opts.Backups.List()
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	ok(w, list)
+}
+
+// createBackup takes an online snapshot now.
+func (a *API) createBackup(w http.ResponseWriter, r *http.Request) {
+	if !a.isAdmin(r) { fail(w, http.StatusForbidden, errAdminOnly); return }
+	if a.opts.Backups == nil { fail(w, http.StatusNotImplemented, errNoBackups); return }
+	b, err := a.opts.Backups.Create(r.Context())
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	ok(w, b)
+}
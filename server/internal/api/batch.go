@@ -0,0 +1,256 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"mss/internal/store"
+	"mss/internal/validation"
+)
+
+const (
+	batchAtomic     = "atomic"
+	batchBestEffort = "bestEffort"
+	maxBatchOps     = 1000
+)
+
+var (
+	// errBatchAborted marks items never committed because an atomic batch rolled back.
+	errBatchAborted = errors.New("not applied: batch rolled back")
+	// errBatchInvalid rolls back an atomic batch in which some item failed validation.
+	errBatchInvalid = errors.New("batch validation failed")
+)
+
+type batchOp struct {
+	Op       string                 `json:"op"`
+	ID       string                 `json:"id,omitempty"`
+	Username string                 `json:"username,omitempty"`
+	Password string                 `json:"password,omitempty"`
+	Props    map[string]interface{} `json:"props,omitempty"`
+	Version  int64                  `json:"version,omitempty"`
+	sent     bool                   // Props was in the request, before defaults
+}
+
+type batchReq struct {
+	Mode       string    `json:"mode,omitempty"`
+	Operations []batchOp `json:"operations"`
+}
+
+type batchResult struct {
+	Index   int          `json:"index"`
+	Op      string       `json:"op"`
+	Ok      bool         `json:"ok"`
+	ID      string       `json:"id,omitempty"`
+	Version int64        `json:"version,omitempty"`
+	Account  *accountResp           `json:"account,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	Warnings []string               `json:"warnings,omitempty"`
+	Details  []validation.Violation `json:"details,omitempty"`
+}
+
+// batchAccounts applies create/update/delete operations for one site in a
+// single transaction. In atomic mode any failure rolls back every item; in
+// bestEffort mode each item runs in its own savepoint and failures are skipped.
+func (a *API) batchAccounts(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	var body batchReq
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil { fail(w, http.StatusBadRequest, err); return }
+	if body.Mode == "" { body.Mode = batchAtomic }
+	if body.Mode != batchAtomic && body.Mode != batchBestEffort {
+		fail(w, http.StatusBadRequest, fmt.Errorf("mode must be %q or %q", batchAtomic, batchBestEffort)); return
+	}
+	if len(body.Operations) == 0 { fail(w, http.StatusBadRequest, errors.New("operations required")); return }
+	if len(body.Operations) > maxBatchOps {
+		fail(w, http.StatusBadRequest, fmt.Errorf("too many operations: %d > %d", len(body.Operations), maxBatchOps)); return
+	}
+	site, err := a.repos.Sites.Get(r.Context(), key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	if site == nil { fail(w, http.StatusNotFound, store.ErrNotFound); return }
+	v, err := a.validator(r, key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+
+	results := make([]batchResult, len(body.Operations))
+	errs := map[string]string{}
+	setErr := func(i int, err error) {
+		results[i].Ok = false
+		results[i].Error = err.Error()
+		results[i].Details = detailsOf(err)
+		errs[strconv.Itoa(i)] = err.Error()
+	}
+
+	// malformed items fail an atomic batch before the transaction starts
+	for i := range body.Operations {
+		op := &body.Operations[i]
+		err := a.checkBatchOp(op, v)
+		results[i] = batchResult{Index: i, Op: op.Op, ID: op.ID}
+		if err != nil { setErr(i, err) }
+	}
+	if body.Mode == batchAtomic && len(errs) > 0 {
+		for i := range results {
+			if results[i].Error == "" { results[i].Error = errBatchAborted.Error() }
+		}
+		writeJSON(w, http.StatusBadRequest, Response{Ok: false, Data: batchSummary(body.Mode, results, errs, 0), Error: errBatchInvalid.Error()})
+		return
+	}
+
+	// props are validated inside the transaction, against the accounts as
+	// the batch leaves them, so unique values cannot repeat between items
+	applied := 0
+	txErr := a.repos.Tx.InTx(r.Context(), func(tx store.Repos) error {
+		batch := v.Batch()
+		invalid := false
+		for i, op := range body.Operations {
+			if results[i].Error != "" { continue }
+			if op.Op != "delete" {
+				var props map[string]interface{}
+				if op.sent { props = op.Props }
+				warnings, err := batch.ValidateAccount(r.Context(), tx, op.account(key), props)
+				if err != nil { setErr(i, err); invalid = true; continue }
+				results[i].Warnings = warnings
+			}
+			// an atomic batch is going to roll back: keep validating, stop writing
+			if body.Mode == batchAtomic && invalid {
+				if op.Op != "delete" { batch.Claim(op.account(key)) }
+				continue
+			}
+			var acc *store.Account
+			var err error
+			if body.Mode == batchAtomic {
+				acc, err = applyBatchOp(r, tx, key, op)
+			} else {
+				err = tx.Tx.InTx(r.Context(), func(sp store.Repos) error {
+					var e error
+					acc, e = applyBatchOp(r, sp, key, op)
+					return e
+				})
+			}
+			if err != nil {
+				setErr(i, err)
+				if body.Mode == batchAtomic { return err }
+				continue
+			}
+			results[i].Ok = true
+			if acc != nil {
+				results[i].ID = acc.ID
+				results[i].Version = acc.Version
+				batch.Claim(*acc)
+			}
+			applied++
+		}
+		if invalid && body.Mode == batchAtomic { return errBatchInvalid }
+		return nil
+	})
+	if errors.Is(txErr, errBatchInvalid) {
+		for i := range results {
+			if results[i].Error == "" {
+				results[i].Ok = false
+				results[i].Version = 0
+				results[i].Error = errBatchAborted.Error()
+			}
+		}
+		writeJSON(w, http.StatusBadRequest, Response{Ok: false, Data: batchSummary(body.Mode, results, errs, 0), Error: errBatchInvalid.Error()})
+		return
+	}
+	if txErr != nil {
+		if body.Mode == batchAtomic {
+			for i := range results {
+				if results[i].Error == "" {
+					results[i].Ok = false
+					results[i].Version = 0
+					results[i].Error = errBatchAborted.Error()
+				}
+			}
+		}
+		// an item that failed to apply is the client's problem; a failed commit is not
+		status := http.StatusInternalServerError
+		if len(errs) > 0 { status = http.StatusConflict }
+		switch {
+		case errors.Is(txErr, store.ErrNotFound):
+			status = http.StatusNotFound
+		case errors.Is(txErr, store.ErrConflict):
+			status = http.StatusConflict
+		case errors.Is(txErr, store.ErrVersionMismatch):
+			status = http.StatusPreconditionFailed
+		}
+		writeJSON(w, status, Response{Ok: false, Data: batchSummary(body.Mode, results, errs, 0), Error: txErr.Error()})
+		return
+	}
+
+	// attach masked representations once the transaction has committed
+	for i := range results {
+		if !results[i].Ok || body.Operations[i].Op == "delete" { continue }
+		if acc, err := a.repos.Accounts.Get(r.Context(), key, results[i].ID); err == nil && acc != nil {
+			resp := a.maskedAccountResp(r, *acc)
+			results[i].Account = &resp
+		}
+	}
+	ok(w, batchSummary(body.Mode, results, errs, applied))
+}
+
+func batchSummary(mode string, results []batchResult, errs map[string]string, applied int) map[string]interface{} {
+	return map[string]interface{}{
+		"mode":    mode,
+		"applied": applied,
+		"failed":  len(errs),
+		"results": results,
+		"errors":  errs,
+	}
+}
+
+// checkBatchOp checks the shape of an operation before the transaction
+// starts. Props of creates and updates are normalized in place and creates
+// get their ID, so that later items can refer to them in unique checks.
+func (a *API) checkBatchOp(op *batchOp, v *validation.Validator) error {
+	switch op.Op {
+	case "create":
+		if op.Username == "" { return errors.New("username required") }
+		if op.ID == "" { op.ID = store.GenerateID("acc") }
+	case "update":
+		if op.ID == "" { return errors.New("id required") }
+		if op.Username == "" { return errors.New("username required") }
+		if a.opts.RequireIfMatch && op.Version == 0 { return errPreconditionRequired }
+	case "delete":
+		if op.ID == "" { return errors.New("id required") }
+		if a.opts.RequireIfMatch && op.Version == 0 { return errPreconditionRequired }
+		return nil
+	default:
+		return fmt.Errorf("unknown op %q", op.Op)
+	}
+	op.sent = op.Props != nil
+	op.Props = v.Normalize(op.Props)
+	return nil
+}
+
+// account is the row a create or update writes.
+func (op batchOp) account(key string) store.Account {
+	acc := store.Account{ID: op.ID, SiteKey: key, Username: op.Username, Password: op.Password}
+	if op.Props != nil {
+		b, _ := json.Marshal(op.Props)
+		acc.Extra = string(b)
+	}
+	return acc
+}
+
+// applyBatchOp writes a single operation through repos and returns the
+// resulting account for create and update.
+func applyBatchOp(r *http.Request, repos store.Repos, key string, op batchOp) (*store.Account, error) {
+	ctx := r.Context()
+	switch op.Op {
+	case "create":
+		acc := op.account(key)
+		if err := repos.Accounts.Create(ctx, &acc); err != nil { return nil, err }
+		return repos.Accounts.Get(ctx, key, acc.ID)
+	case "update":
+		acc := op.account(key)
+		if err := repos.Accounts.Update(ctx, &acc, op.Version); err != nil { return nil, err }
+		return &acc, nil
+	case "delete":
+		return nil, repos.Accounts.Delete(ctx, key, op.ID, op.Version)
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
@@ -0,0 +1,47 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"mss/internal/api"
+)
+
+type batchReply struct {
+	Applied int `json:"applied"`
+	Failed  int `json:"failed"`
+	Results []struct {
+		Ok    bool   `json:"ok"`
+		ID    string `json:"id"`
+		Error string `json:"error"`
+	} `json:"results"`
+}
+
+func TestBatch(t *testing.T) {
+	c := newClient(t, api.Options{})
+	c.site("gh", map[string]interface{}{"field": "email", "type": "email", "unique": true})
+	id := c.account("gh", map[string]interface{}{"username": "alice", "props": map[string]interface{}{"email": "a@x.io"}})["id"].(string)
+	ops := []map[string]interface{}{
+		{"op": "create", "username": "bob", "props": map[string]interface{}{"email": "b@x.io"}},
+		{"op": "update", "id": id, "username": "alice", "props": map[string]interface{}{"email": "c@x.io"}},
+		// unique against the batch itself: bob already claimed b@x.io
+		{"op": "create", "username": "carol", "props": map[string]interface{}{"email": "b@x.io"}},
+	}
+
+	// atomic: one bad item rolls back the rest
+	var rep batchReply
+	c.must(http.StatusBadRequest, "POST", "/sites/gh/accounts:batch", map[string]interface{}{"operations": ops}).into(t, &rep)
+	if rep.Applied != 0 || rep.Failed != 1 || rep.Results[2].Ok { t.Fatalf("atomic: %+v", rep) }
+	accs, _ := c.repos.Accounts.List(context.Background(), "gh")
+	if len(accs) != 1 { t.Fatalf("atomic batch wrote %d accounts", len(accs)) }
+
+	c.must(http.StatusOK, "POST", "/sites/gh/accounts:batch", map[string]interface{}{"mode": "bestEffort", "operations": ops}).into(t, &rep)
+	if rep.Applied != 2 || rep.Failed != 1 || !rep.Results[0].Ok || !rep.Results[1].Ok || rep.Results[2].Ok { t.Fatalf("bestEffort: %+v", rep) }
+	accs, _ = c.repos.Accounts.List(context.Background(), "gh")
+	if len(accs) != 2 { t.Fatalf("bestEffort wrote %d accounts", len(accs)) }
+
+	c.must(http.StatusBadRequest, "POST", "/sites/gh/accounts:batch", map[string]interface{}{"operations": []map[string]interface{}{{"op": "rename"}}})
+	c.must(http.StatusBadRequest, "POST", "/sites/gh/accounts:batch", map[string]interface{}{"operations": []interface{}{}})
+	c.must(http.StatusNotFound, "POST", "/sites/nope/accounts:batch", map[string]interface{}{"operations": ops})
+}
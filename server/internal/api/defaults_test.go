@@ -0,0 +1,31 @@
+package api_test
+
+import (
+	"net/http"
+	"testing"
+
+	"mss/internal/api"
+)
+
+func TestSchemaDefaults(t *testing.T) {
+	c := newClient(t, api.Options{})
+	c.site("gh", map[string]interface{}{"field": "plan", "type": "string", "default": "free"})
+	acc := c.account("gh", map[string]interface{}{"username": "alice"})
+	if acc["props"].(map[string]interface{})["plan"] != "free" { t.Fatalf("create: %v", acc) }
+	// a prop given explicitly wins over the default
+	acc = c.account("gh", map[string]interface{}{"username": "bob", "props": map[string]interface{}{"plan": "pro"}})
+	if acc["props"].(map[string]interface{})["plan"] != "pro" { t.Fatalf("explicit: %v", acc) }
+
+	c.must(http.StatusOK, "POST", "/sites/gh/schema", map[string]interface{}{"fields": []map[string]interface{}{{"field": "seats", "type": "integer", "default": 1}}})
+	var res struct {
+		DryRun      bool `json:"dryRun"`
+		Updated     int  `json:"updated"`
+		WouldUpdate int  `json:"wouldUpdate"`
+	}
+	c.must(http.StatusOK, "POST", "/sites/gh/schema/apply-defaults?dryRun=1", nil).into(t, &res)
+	if !res.DryRun || res.Updated != 0 || res.WouldUpdate != 2 { t.Fatalf("dry run: %+v", res) }
+	c.must(http.StatusOK, "POST", "/sites/gh/schema/apply-defaults", nil).into(t, &res)
+	if res.DryRun || res.Updated != 2 { t.Fatalf("apply: %+v", res) }
+	c.must(http.StatusOK, "POST", "/sites/gh/schema/apply-defaults", nil).into(t, &res)
+	if res.Updated != 0 { t.Fatalf("second apply: %+v", res) }
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"mss/internal/store"
+)
+
+var errPreconditionRequired = errors.New("If-Match header required")
+
+func setETag(w http.ResponseWriter, version int64) {
+	w.Header().Set("ETag", fmt.Sprintf("%q", strconv.FormatInt(version, 10)))
+}
+
+// ifMatch reads the If-Match precondition of a write. It returns 0 (write
+// unconditionally) when the header is absent or "*", and store.VersionAbsent
+// for "0", the ETag of a mapping that does not exist yet. When preconditions
+// are required a missing header is answered with 428 and the bool is false.
+func (a *API) ifMatch(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	h := strings.TrimSpace(r.Header.Get("If-Match"))
+	if h == "" {
+		if a.opts.RequireIfMatch { fail(w, http.StatusPreconditionRequired, errPreconditionRequired); return 0, false }
+		return 0, true
+	}
+	if h == "*" { return 0, true }
+	tag := strings.Trim(strings.TrimPrefix(h, "W/"), `"`)
+	v, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil || v < 0 { fail(w, http.StatusBadRequest, fmt.Errorf("invalid If-Match %q", h)); return 0, false }
+	if v == 0 { return store.VersionAbsent, true }
+	return v, true
+}
+
+// preconditionFailed answers 412 with the current representation so the
+// client can merge and retry with the returned ETag.
+func preconditionFailed(w http.ResponseWriter, version int64, current interface{}) {
+	setETag(w, version)
+	writeJSON(w, http.StatusPreconditionFailed, Response{Ok: false, Error: store.ErrVersionMismatch.Error(), Data: current})
+}
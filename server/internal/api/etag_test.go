@@ -0,0 +1,33 @@
+package api_test
+
+import (
+	"net/http"
+	"testing"
+
+	"mss/internal/api"
+)
+
+func TestETags(t *testing.T) {
+	c := newClient(t, api.Options{RequireIfMatch: true})
+	c.site("gh")
+	id := c.account("gh", map[string]interface{}{"username": "alice"})["id"].(string)
+	path := "/sites/gh/accounts/" + id
+	tag := c.must(http.StatusOK, "GET", path, nil).Header.Get("ETag")
+	if tag != `"1"` { t.Fatalf("etag: %q", tag) }
+
+	c.must(http.StatusPreconditionRequired, "PUT", path, map[string]interface{}{"username": "bob"})
+	c.must(http.StatusBadRequest, "PUT", path, map[string]interface{}{"username": "bob"}, "If-Match", `"x"`)
+	r := c.must(http.StatusOK, "PUT", path, map[string]interface{}{"username": "bob"}, "If-Match", tag)
+	if r.Header.Get("ETag") != `"2"` { t.Fatalf("etag after update: %q", r.Header.Get("ETag")) }
+	// a stale tag gets the current account back to merge with
+	r = c.must(http.StatusPreconditionFailed, "PUT", path, map[string]interface{}{"username": "carol"}, "If-Match", tag)
+	var cur map[string]interface{}
+	r.into(t, &cur)
+	if cur["username"] != "bob" || r.Header.Get("ETag") != `"2"` { t.Fatalf("412 body: %v %q", cur, r.Header.Get("ETag")) }
+	c.must(http.StatusPreconditionFailed, "DELETE", path, nil, "If-Match", tag)
+	c.must(http.StatusOK, "DELETE", path, nil, "If-Match", "*")
+
+	// "0" is the tag of an active account mapping that was never set
+	c.must(http.StatusOK, "PUT", "/sites/gh/active-account", map[string]interface{}{"accountId": nil}, "If-Match", `"0"`)
+	c.must(http.StatusPreconditionFailed, "PUT", "/sites/gh/active-account", map[string]interface{}{"accountId": nil}, "If-Match", `"0"`)
+}
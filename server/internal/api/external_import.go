@@ -0,0 +1,149 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"mss/internal/importer"
+	"mss/internal/store"
+)
+
+const (
+	// pendingTTL is how long an uploaded export waits for confirmation.
+	pendingTTL = 15 * time.Minute
+	// maxPending caps uploads held in memory at once.
+	maxPending = 32
+)
+
+var errPendingNotFound = errors.New("import preview not found or expired")
+
+// pendingImport is an uploaded export awaiting confirmation. Entries hold
+// passwords, so they are only kept in memory and dropped on confirm or expiry.
+type pendingImport struct {
+	format  importer.Format
+	entries []importer.Entry
+	expires time.Time
+}
+
+type pendingImports struct {
+	mu    sync.Mutex
+	items map[string]*pendingImport
+}
+
+func (p *pendingImports) put(it *pendingImport) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep()
+	if len(p.items) >= maxPending { return "", errors.New("too many pending imports; confirm or discard one first") }
+	id := store.GenerateID("imp")
+	p.items[id] = it
+	return id, nil
+}
+
+func (p *pendingImports) get(id string) *pendingImport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep()
+	return p.items[id]
+}
+
+// take removes and returns an upload so concurrent confirms cannot both apply it.
+func (p *pendingImports) take(id string) *pendingImport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep()
+	it := p.items[id]
+	delete(p.items, id)
+	return it
+}
+
+// putBack returns a taken upload after a failed confirm so it can be retried.
+func (p *pendingImports) putBack(id string, it *pendingImport) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.items[id] = it
+}
+
+func (p *pendingImports) drop(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.items[id]
+	delete(p.items, id)
+	return ok
+}
+
+func (p *pendingImports) sweep() {
+	now := time.Now()
+	for id, it := range p.items {
+		if now.After(it.expires) { delete(p.items, id) }
+	}
+}
+
+type externalPreview struct {
+	ID        string          `json:"id"`
+	Format    importer.Format `json:"format"`
+	ExpiresAt int64           `json:"expiresAt"`
+	*importer.Preview
+}
+
+// previewExternalImport parses a browser or password-manager export
+// (?format=chrome|edge|firefox|bitwarden) and returns how its logins would
+// map onto sites, without writing anything. Confirm with the returned id.
+func (a *API) previewExternalImport(w http.ResponseWriter, r *http.Request) {
+	format, err := importer.ParseFormat(r.URL.Query().Get("format"))
+	if err != nil { fail(w, http.StatusBadRequest, err); return }
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil { fail(w, http.StatusBadRequest, err); return }
+	entries, err := importer.Parse(format, data)
+	if err != nil { fail(w, http.StatusBadRequest, err); return }
+	p, err := importer.Plan(r.Context(), a.repos, entries, nil)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	it := &pendingImport{format: format, entries: entries, expires: time.Now().Add(pendingTTL)}
+	id, err := a.pending.put(it)
+	if err != nil { fail(w, http.StatusTooManyRequests, err); return }
+	ok(w, externalPreview{ID: id, Format: format, ExpiresAt: it.expires.Unix(), Preview: p})
+}
+
+type externalConfirmReq struct {
+	Groups []importer.Override `json:"groups,omitempty"`
+	// DryRun re-plans with the overrides without writing or consuming the upload.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// confirmExternalImport applies a previewed upload, optionally adjusting
+// individual host groups (skip, or target another site key/name).
+func (a *API) confirmExternalImport(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var body externalConfirmReq
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF { fail(w, http.StatusBadRequest, err); return }
+	if body.DryRun {
+		it := a.pending.get(id)
+		if it == nil { fail(w, http.StatusNotFound, errPendingNotFound); return }
+		p, err := importer.Plan(r.Context(), a.repos, it.entries, body.Groups)
+		if err != nil { failImport(w, err); return }
+		ok(w, externalPreview{ID: id, Format: it.format, ExpiresAt: it.expires.Unix(), Preview: p})
+		return
+	}
+	it := a.pending.take(id)
+	if it == nil { fail(w, http.StatusNotFound, errPendingNotFound); return }
+	p, err := importer.Apply(r.Context(), a.repos, it.entries, body.Groups)
+	if err != nil { a.pending.putBack(id, it); failImport(w, err); return }
+	ok(w, p)
+}
+
+// discardExternalImport forgets an uploaded export.
+func (a *API) discardExternalImport(w http.ResponseWriter, r *http.Request) {
+	if !a.pending.drop(chi.URLParam(r, "id")) { fail(w, http.StatusNotFound, errPendingNotFound); return }
+	ok(w, map[string]string{"status": "discarded"})
+}
+
+func failImport(w http.ResponseWriter, err error) {
+	if errors.Is(err, importer.ErrBadOverride) { fail(w, http.StatusBadRequest, err); return }
+	failStore(w, err)
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"mss/internal/kdbx"
+)
+
+var errKDBXPassword = errors.New("missing " + passphraseHeader + " header (KeePass master password)")
+
+// exportKDBX writes every live site to a KeePass KDBX 4 database protected
+// by the X-MSS-Passphrase password. ?cipher=chacha20|aes picks the payload cipher.
+func (a *API) exportKDBX(w http.ResponseWriter, r *http.Request) {
+	if !a.isAdmin(r) { fail(w, http.StatusForbidden, errAdminOnly); return }
+	pass := r.Header.Get(passphraseHeader)
+	if pass == "" { fail(w, http.StatusBadRequest, errKDBXPassword); return }
+	cipher, err := kdbx.ParseCipher(r.URL.Query().Get("cipher"))
+	if err != nil { fail(w, http.StatusBadRequest, err); return }
+	name := "mss-export-" + time.Now().UTC().Format("20060102-150405") + ".kdbx"
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("Cache-Control", "no-store")
+	if err := kdbx.Export(r.Context(), a.repos, w, pass, cipher); err != nil { fail(w, http.StatusInternalServerError, err); return }
+}
+
+// importKDBX merges an uploaded KDBX 4 database; ?dryRun=1 only reports.
+func (a *API) importKDBX(w http.ResponseWriter, r *http.Request) {
+	if !a.isAdmin(r) { fail(w, http.StatusForbidden, errAdminOnly); return }
+	pass := r.Header.Get(passphraseHeader)
+	if pass == "" { fail(w, http.StatusUnauthorized, errKDBXPassword); return }
+	dry := r.URL.Query().Get("dryRun")
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil { fail(w, http.StatusBadRequest, err); return }
+	db, err := kdbx.Open(data, pass)
+	if err != nil {
+		if errors.Is(err, kdbx.ErrBadPassword) { fail(w, http.StatusUnauthorized, err); return }
+		fail(w, http.StatusBadRequest, err); return
+	}
+	rep, err := kdbx.Import(r.Context(), a.repos, db, dry == "1" || dry == "true")
+	a.validators.Reset()
+	if err != nil { failStore(w, err); return }
+	ok(w, rep)
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"mss/internal/sitecfg"
+)
+
+// guardManaged enforces config ownership before a site or schema write.
+// With ManagedSites "reject" it answers 409 and returns false; with "flag"
+// the write goes through with a Warning header and shows up as drift.
+func (a *API) guardManaged(w http.ResponseWriter, r *http.Request, key string) bool {
+	m, err := a.repos.Managed.Get(r.Context(), key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return false }
+	if m == nil { return true }
+	if a.opts.ManagedSites == "flag" {
+		w.Header().Add("Warning", fmt.Sprintf(`299 mss "site %s is managed by %s; this change is drift until the config is updated"`, key, m.Source))
+		return true
+	}
+	fail(w, http.StatusConflict, fmt.Errorf("site %s is managed by %s; change the config and re-apply it", key, m.Source))
+	return false
+}
+
+// configDrift lists managed sites and how each differs from its config.
+func (a *API) configDrift(w http.ResponseWriter, r *http.Request) {
+	managed, err := a.repos.Managed.List(r.Context())
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	drift, err := sitecfg.Detect(r.Context(), a.repos)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	ok(w, map[string]interface{}{"managed": managed, "drift": drift})
+}
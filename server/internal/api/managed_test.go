@@ -0,0 +1,26 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"mss/internal/api"
+	"mss/internal/store"
+)
+
+func TestManagedSites(t *testing.T) {
+	for _, mode := range []string{"reject", "flag"} {
+		c := newClient(t, api.Options{ManagedSites: mode})
+		c.site("gh")
+		if err := c.repos.Managed.Put(context.Background(), &store.ManagedSite{SiteKey: "gh", Source: "sites.yaml"}); err != nil { t.Fatal(err) }
+		code := http.StatusConflict
+		if mode == "flag" { code = http.StatusOK }
+		r := c.must(code, "PUT", "/sites/gh", map[string]string{"name": "Changed"})
+		if mode == "flag" && !strings.Contains(r.Header.Get("Warning"), "sites.yaml") { t.Fatalf("flag: Warning %q", r.Header.Get("Warning")) }
+		c.must(code, "PUT", "/sites/gh/schema/team", map[string]string{"type": "string"})
+		// accounts of a managed site are not part of its config
+		c.account("gh", map[string]interface{}{"username": "alice"})
+	}
+}
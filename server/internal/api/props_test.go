@@ -0,0 +1,35 @@
+package api_test
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"mss/internal/api"
+)
+
+func TestAdditionalProps(t *testing.T) {
+	c := newClient(t, api.Options{})
+	c.site("gh", map[string]interface{}{"field": "email", "type": "email"})
+	c.must(http.StatusBadRequest, "PUT", "/sites/gh", map[string]string{"name": "gh", "additionalProps": "maybe"})
+	c.account("gh", map[string]interface{}{"username": "alice", "props": map[string]interface{}{"email": "a@x.io", "nick": "al"}})
+
+	var und struct {
+		AdditionalProps string `json:"additionalProps"`
+		Accounts        []struct {
+			Username string   `json:"username"`
+			Props    []string `json:"props"`
+		} `json:"accounts"`
+	}
+	c.must(http.StatusOK, "GET", "/sites/gh/accounts:undeclared", nil).into(t, &und)
+	if len(und.Accounts) != 1 || und.Accounts[0].Username != "alice" || !reflect.DeepEqual(und.Accounts[0].Props, []string{"nick"}) { t.Fatalf("undeclared: %+v", und) }
+
+	c.must(http.StatusOK, "PUT", "/sites/gh", map[string]string{"name": "gh", "additionalProps": "warn"})
+	r := c.must(http.StatusOK, "POST", "/sites/gh/accounts", map[string]interface{}{"username": "bob", "props": map[string]interface{}{"team": "x"}})
+	if len(r.Warnings) != 1 { t.Fatalf("warn: %q", r.Warnings) }
+
+	c.must(http.StatusOK, "PUT", "/sites/gh", map[string]string{"name": "gh", "additionalProps": "reject"})
+	r = c.must(http.StatusBadRequest, "POST", "/sites/gh/accounts", map[string]interface{}{"username": "carol", "props": map[string]interface{}{"team": "x"}})
+	if len(r.Details) != 1 || r.Details[0].Field != "props.team" { t.Fatalf("reject: %+v", r.Details) }
+	c.account("gh", map[string]interface{}{"username": "carol", "props": map[string]interface{}{"email": "c@x.io"}})
+}
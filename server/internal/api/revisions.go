@@ -0,0 +1,196 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"mss/internal/store"
+)
+
+type revisionResp struct {
+	Rev         int64                  `json:"rev"`
+	Username    string                 `json:"username"`
+	HasPassword bool                   `json:"hasPassword"`
+	Props       map[string]interface{} `json:"props,omitempty"`
+	Secrets     string                 `json:"secrets"`
+	UpdatedAt   int64                  `json:"updatedAt"`
+	RecordedAt  int64                  `json:"recordedAt"`
+}
+
+// revisionChange is one field-level difference between two account states.
+// Fields are "username", "password" or "props.<name>"; values of the password
+// and of secret props are never echoed.
+type revisionChange struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"` // added|removed|changed
+	From  interface{} `json:"from,omitempty"`
+	To    interface{} `json:"to,omitempty"`
+}
+
+func parseProps(extra string) map[string]interface{} {
+	var props map[string]interface{}
+	if extra != "" { _ = json.Unmarshal([]byte(extra), &props) }
+	return props
+}
+
+func (a *API) secretFieldSet(r *http.Request, key string) (map[string]bool, error) {
+	v, err := a.validator(r, key)
+	if err != nil { return nil, err }
+	set := make(map[string]bool)
+	for _, s := range v.Schemas {
+		if s.Secret != 0 { set[s.Field] = true }
+	}
+	return set, nil
+}
+
+func (a *API) listRevisions(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	id := chi.URLParam(r, "id")
+	revs, err := a.repos.Accounts.Revisions(r.Context(), key, id)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	v, err := a.validator(r, key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	out := make([]revisionResp, 0, len(revs))
+	for _, rv := range revs {
+		props := parseProps(rv.Extra)
+		if props != nil { props = v.Mask(props) }
+		out = append(out, revisionResp{
+			Rev: rv.Rev, Username: rv.Username, HasPassword: rv.Password != "", Props: props,
+			Secrets: rv.Secrets, UpdatedAt: rv.Updated, RecordedAt: rv.Recorded,
+		})
+	}
+	ok(w, out)
+}
+
+// loadRevisionState resolves a revision reference: a revision number or
+// "current" for the live account.
+func (a *API) loadRevisionState(r *http.Request, key, id, ref string) (*store.AccountRevision, error) {
+	if ref == "" || ref == "current" {
+		acc, err := a.repos.Accounts.Get(r.Context(), key, id)
+		if err != nil { return nil, err }
+		if acc == nil { return nil, store.ErrNotFound }
+		return &store.AccountRevision{AccountID: acc.ID, SiteKey: acc.SiteKey, Username: acc.Username, Password: acc.Password, Extra: acc.Extra, Secrets: store.SecretsPlain}, nil
+	}
+	rev, err := strconv.ParseInt(ref, 10, 64)
+	if err != nil { return nil, errBadRevision }
+	return a.repos.Accounts.Revision(r.Context(), key, id, rev)
+}
+
+var errBadRevision = errors.New("revision must be a number or \"current\"")
+
+// diffRevisions compares two revisions: ?from=<rev>&to=<rev|current>
+// (to defaults to the live account).
+func (a *API) diffRevisions(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	id := chi.URLParam(r, "id")
+	q := r.URL.Query()
+	if q.Get("from") == "" { fail(w, http.StatusBadRequest, errors.New("from is required")); return }
+	from, err := a.loadRevisionState(r, key, id, q.Get("from"))
+	if errors.Is(err, errBadRevision) { fail(w, http.StatusBadRequest, err); return }
+	if err != nil { failStore(w, err); return }
+	to, err := a.loadRevisionState(r, key, id, q.Get("to"))
+	if errors.Is(err, errBadRevision) { fail(w, http.StatusBadRequest, err); return }
+	if err != nil { failStore(w, err); return }
+	secrets, err := a.secretFieldSet(r, key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+
+	changes := []revisionChange{}
+	if from.Username != to.Username {
+		changes = append(changes, revisionChange{Field: "username", Op: "changed", From: from.Username, To: to.Username})
+	}
+	// redacted revisions carry no password, so there is nothing to compare
+	if from.Secrets != store.SecretsRedacted && to.Secrets != store.SecretsRedacted && from.Password != to.Password {
+		changes = append(changes, revisionChange{Field: "password", Op: changeOp(from.Password != "", to.Password != "")})
+	}
+	fp, tp := parseProps(from.Extra), parseProps(to.Extra)
+	names := make([]string, 0, len(fp)+len(tp))
+	for k := range fp { names = append(names, k) }
+	for k := range tp {
+		if _, seen := fp[k]; !seen { names = append(names, k) }
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fv, inFrom := fp[k]
+		tv, inTo := tp[k]
+		if inFrom && inTo && jsonEqual(fv, tv) { continue }
+		c := revisionChange{Field: "props." + k, Op: changeOp(inFrom, inTo)}
+		if secrets[k] {
+			if fv == store.RedactedValue || tv == store.RedactedValue { continue }
+		} else {
+			c.From, c.To = fv, tv
+		}
+		changes = append(changes, c)
+	}
+	ok(w, map[string]interface{}{"from": q.Get("from"), "to": firstNonEmpty(q.Get("to"), "current"), "changes": changes})
+}
+
+func changeOp(inFrom, inTo bool) string {
+	switch {
+	case !inFrom && inTo:
+		return "added"
+	case inFrom && !inTo:
+		return "removed"
+	default:
+		return "changed"
+	}
+}
+
+func jsonEqual(a, b interface{}) bool {
+	ab, _ := json.Marshal(a)
+	bb, _ := json.Marshal(b)
+	return string(ab) == string(bb)
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" { return v }
+	}
+	return ""
+}
+
+// restoreRevision rolls an account back to a revision. The current state is
+// itself recorded as a new revision, so a restore can be undone. In a
+// redacted revision the password and the site's secret fields keep their
+// current values.
+func (a *API) restoreRevision(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	id := chi.URLParam(r, "id")
+	ver, good := a.ifMatch(w, r)
+	if !good { return }
+	rv, err := a.loadRevisionState(r, key, id, chi.URLParam(r, "rev"))
+	if errors.Is(err, errBadRevision) { fail(w, http.StatusBadRequest, err); return }
+	if err != nil { failStore(w, err); return }
+	cur, err := a.repos.Accounts.Get(r.Context(), key, id)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	if cur == nil { fail(w, http.StatusNotFound, store.ErrNotFound); return }
+
+	acc := store.Account{ID: id, SiteKey: key, Username: rv.Username, Password: rv.Password, Extra: rv.Extra}
+	secretsRestored := rv.Secrets != store.SecretsRedacted
+	if !secretsRestored {
+		secrets, err := a.secretFieldSet(r, key)
+		if err != nil { fail(w, http.StatusInternalServerError, err); return }
+		acc.Password = cur.Password
+		props := parseProps(rv.Extra)
+		curProps := parseProps(cur.Extra)
+		// secret fields were redacted; a plain prop holding "***" is data
+		for k := range secrets {
+			if _, ok := props[k]; !ok { continue }
+			if cv, ok := curProps[k]; ok { props[k] = cv } else { delete(props, k) }
+		}
+		if props != nil {
+			b, _ := json.Marshal(props)
+			acc.Extra = string(b)
+		}
+	}
+	if err := a.repos.Accounts.Update(r.Context(), &acc, ver); err != nil {
+		if errors.Is(err, store.ErrVersionMismatch) { a.accountMismatch(w, r, key, id); return }
+		failStore(w, err); return
+	}
+	setETag(w, acc.Version)
+	ok(w, map[string]interface{}{"account": a.maskedAccountResp(r, acc), "secretsRestored": secretsRestored})
+}
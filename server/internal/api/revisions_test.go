@@ -0,0 +1,85 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"mss/internal/api"
+	"mss/internal/migrate"
+	"mss/internal/secret"
+	"mss/internal/store"
+)
+
+func TestRevisions(t *testing.T) {
+	c := newClient(t, api.Options{})
+	c.site("gh", map[string]interface{}{"field": "token", "type": "string", "secret": true})
+	id := c.account("gh", map[string]interface{}{"username": "alice", "password": "pw1", "props": map[string]interface{}{"team": "a", "token": "t1"}})["id"].(string)
+	base := "/sites/gh/accounts/" + id
+	c.must(http.StatusOK, "PUT", base, map[string]interface{}{"username": "alice2", "password": "pw2", "props": map[string]interface{}{"team": "b", "token": "t2"}})
+
+	var revs []struct {
+		Rev         int64                  `json:"rev"`
+		Username    string                 `json:"username"`
+		HasPassword bool                   `json:"hasPassword"`
+		Props       map[string]interface{} `json:"props"`
+		Secrets     string                 `json:"secrets"`
+	}
+	c.must(http.StatusOK, "GET", base+"/revisions", nil).into(t, &revs)
+	if len(revs) != 1 || revs[0].Username != "alice" || revs[0].Props["team"] != "a" || revs[0].Secrets != "redacted" || revs[0].HasPassword {
+		t.Fatalf("revisions: %+v", revs)
+	}
+
+	var diff struct {
+		Changes []struct {
+			Field string      `json:"field"`
+			Op    string      `json:"op"`
+			From  interface{} `json:"from"`
+			To    interface{} `json:"to"`
+		} `json:"changes"`
+	}
+	c.must(http.StatusOK, "GET", base+"/revisions/diff?from=1", nil).into(t, &diff)
+	if len(diff.Changes) != 2 || diff.Changes[0].Field != "username" || diff.Changes[1].Field != "props.team" || diff.Changes[1].To != "b" {
+		t.Fatalf("diff: %+v", diff)
+	}
+	c.must(http.StatusBadRequest, "GET", base+"/revisions/diff", nil)
+
+	// a redacted revision restores everything but the password and secrets
+	var restored struct {
+		Account         map[string]interface{} `json:"account"`
+		SecretsRestored bool                   `json:"secretsRestored"`
+	}
+	c.must(http.StatusOK, "POST", base+"/revisions/1/restore", nil).into(t, &restored)
+	if restored.SecretsRestored || restored.Account["username"] != "alice" { t.Fatalf("restore: %+v", restored) }
+	acc, err := c.repos.Accounts.Get(context.Background(), "gh", id)
+	if err != nil { t.Fatal(err) }
+	if acc.Password != "pw2" || acc.Extra != `{"team":"a","token":"t2"}` { t.Fatalf("restored account: %+v", acc) }
+	c.must(http.StatusOK, "GET", base+"/revisions", nil).into(t, &revs)
+	if len(revs) != 2 { t.Fatalf("the restore was not recorded: %+v", revs) }
+	c.must(http.StatusNotFound, "POST", base+"/revisions/9/restore", nil)
+}
+
+func TestEncryptedRevisions(t *testing.T) {
+	box, err := secret.NewBox(bytes.Repeat([]byte{7}, 32))
+	if err != nil { t.Fatal(err) }
+	db, err := store.Open(filepath.Join(t.TempDir(), "mss.db"))
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(func() { db.Close() })
+	if _, err := migrate.Apply(context.Background(), db, migrate.Options{}); err != nil { t.Fatal(err) }
+	c := newClientOn(t, store.NewSQLite(db, store.RevisionSecrets{Mode: store.SecretsEncrypted, Box: box}), api.Options{})
+	c.site("gh")
+	id := c.account("gh", map[string]interface{}{"username": "alice", "password": "pw1"})["id"].(string)
+	base := "/sites/gh/accounts/" + id
+	c.must(http.StatusOK, "PUT", base, map[string]interface{}{"username": "alice", "password": "pw2"})
+	var stored string
+	if err := db.Get(&stored, `SELECT password FROM account_revisions WHERE account_id = ?`, id); err != nil { t.Fatal(err) }
+	if stored == "" || stored == "pw1" { t.Fatalf("stored revision password %q", stored) }
+
+	var restored struct{ SecretsRestored bool `json:"secretsRestored"` }
+	c.must(http.StatusOK, "POST", base+"/revisions/1/restore", nil).into(t, &restored)
+	acc, err := c.repos.Accounts.Get(context.Background(), "gh", id)
+	if err != nil { t.Fatal(err) }
+	if !restored.SecretsRestored || acc.Password != "pw1" { t.Fatalf("restore: %+v %+v", restored, acc) }
+}
@@ -1,17 +1,30 @@
 package api
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/jmoiron/sqlx"
+
+	"mss/internal/backup"
+	"mss/internal/store"
+	"mss/internal/validation"
 )
 
 type Response struct {
 	Ok    bool        `json:"ok"`
 	Data  interface{} `json:"data,omitempty"`
 	Error string      `json:"error,omitempty"`
+	// Warnings are problems that did not stop the request, such as props
+	// a site in "warn" mode does not declare.
+	Warnings []string `json:"warnings,omitempty"`
+	// Details lists every validation violation behind Error, one per
+	// offending field.
+	Details []validation.Violation `json:"details,omitempty"`
 }
 
 func writeJSON(w http.ResponseWriter, status int, v interface{}) {
@@ -24,18 +37,89 @@ func ok(w http.ResponseWriter, data interface{}) {
 	writeJSON(w, http.StatusOK, Response{Ok: true, Data: data})
 }
 
+func okWarn(w http.ResponseWriter, data interface{}, warnings []string) {
+	writeJSON(w, http.StatusOK, Response{Ok: true, Data: data, Warnings: warnings})
+}
+
 func fail(w http.ResponseWriter, status int, err error) {
 	msg := ""
 	if err != nil { msg = err.Error() }
-	writeJSON(w, status, Response{Ok: false, Error: msg})
+	writeJSON(w, status, Response{Ok: false, Error: msg, Details: detailsOf(err)})
+}
+
+// detailsOf returns the validation violations carried by err, if any.
+func detailsOf(err error) []validation.Violation {
+	var verrs validation.Errors
+	if errors.As(err, &verrs) { return verrs }
+	return nil
+}
+
+// failStore maps store sentinel errors to HTTP statuses.
+func failStore(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		fail(w, http.StatusNotFound, err)
+	case errors.Is(err, store.ErrConflict):
+		fail(w, http.StatusConflict, err)
+	default:
+		fail(w, http.StatusInternalServerError, err)
+	}
+}
+
+// failInvalid answers 400 for validation errors and maps anything else like
+// failStore.
+func failInvalid(w http.ResponseWriter, err error) {
+	if detailsOf(err) != nil { fail(w, http.StatusBadRequest, err); return }
+	failStore(w, err)
+}
+
+// Options configures the API router.
+type Options struct {
+	// AdminToken enables admin-only operations (hard delete, trash purge) for
+	// requests carrying "Authorization: Bearer <token>". Empty disables them.
+	AdminToken string
+	// RequireIfMatch makes PUT/DELETE on versioned resources fail with 428
+	// unless they carry an If-Match header.
+	RequireIfMatch bool
+	// ManagedSites is what site/schema writes to config-managed sites do:
+	// "reject" (409, the default) or "flag" (allowed, reported as drift).
+	ManagedSites string
+	// Backups serves /admin/backups; nil (memory store) answers 501.
+	Backups *backup.Manager
+	// SchemaCacheTTL bounds how long a site's compiled validator is reused
+	// before its schema is read again; schema writes through the API drop it
+	// at once. Zero disables the cache.
+	SchemaCacheTTL time.Duration
+	// Validators is the validator cache to use; nil builds one from
+	// SchemaCacheTTL. Share it with other writers of site definitions (the
+	// config watcher) so they can reset it.
+	Validators *validation.Cache
 }
 
 type API struct {
-	db *sqlx.DB
+	repos      store.Repos
+	opts       Options
+	pending    *pendingImports
+	validators *validation.Cache
+}
+
+// isAdmin reports whether the request carries the configured admin token.
+func (a *API) isAdmin(r *http.Request) bool {
+	if a.opts.AdminToken == "" { return false }
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(tok), []byte(a.opts.AdminToken)) == 1
+}
+
+// wantsHardDelete reports whether a DELETE asks to bypass trash (?hard=1).
+func wantsHardDelete(r *http.Request) bool {
+	v := r.URL.Query().Get("hard")
+	return v == "1" || v == "true"
 }
 
-func NewRouter(db *sqlx.DB) http.Handler {
-	a := &API{db: db}
+func NewRouter(repos store.Repos, opts Options) http.Handler {
+	a := &API{repos: repos, opts: opts, pending: &pendingImports{items: map[string]*pendingImport{}},
+		validators: opts.Validators}
+	if a.validators == nil { a.validators = validation.NewCache(opts.SchemaCacheTTL) }
 	r := chi.NewRouter()
 
 	r.Get("/sites", a.listSites)
@@ -43,22 +127,61 @@ func NewRouter(db *sqlx.DB) http.Handler {
 	r.Post("/sites", a.createSite)
 	r.Put("/sites/{key}", a.updateSite)
 	r.Delete("/sites/{key}", a.deleteSite)
+	r.Post("/sites/{key}/restore", a.restoreSite)
 
 	// site field schemas
 	r.Get("/sites/{key}/schema", a.getSchema)
 	r.Post("/sites/{key}/schema", a.postSchema)
+	r.Get("/sites/{key}/schema.json", a.getSchemaJSON)
+	r.Post("/sites/{key}/schema/apply-defaults", a.applySchemaDefaults)
+	r.Get("/sites/{key}/schema/{field}", a.getSchemaField)
 	r.Put("/sites/{key}/schema/{field}", a.putSchema)
 	r.Delete("/sites/{key}/schema/{field}", a.deleteSchema)
+	r.Post("/sites/{key}/schema/{field}/restore", a.restoreSchema)
 
 	r.Get("/sites/{key}/accounts", a.listAccounts)
 	r.Post("/sites/{key}/accounts", a.createAccount)
+	r.Post("/sites/{key}/accounts:batch", a.batchAccounts)
+	r.Post("/sites/{key}/accounts:import", a.importAccountsCSV)
+	r.Get("/sites/{key}/accounts:export", a.exportAccountsCSV)
+	r.Get("/sites/{key}/accounts:undeclared", a.listUndeclaredProps)
+	r.Get("/sites/{key}/accounts/{id}", a.getAccount)
 	r.Put("/sites/{key}/accounts/{id}", a.updateAccount)
 	r.Delete("/sites/{key}/accounts/{id}", a.deleteAccount)
+	r.Post("/sites/{key}/accounts/{id}/restore", a.restoreAccount)
+	r.Get("/sites/{key}/accounts/{id}/revisions", a.listRevisions)
+	r.Get("/sites/{key}/accounts/{id}/revisions/diff", a.diffRevisions)
+	r.Post("/sites/{key}/accounts/{id}/revisions/{rev}/restore", a.restoreRevision)
 
 	r.Get("/sites/{key}/active-account", a.getActiveAccount)
 	r.Put("/sites/{key}/active-account", a.setActiveAccount)
 
 	r.Post("/sites/{key}/switch", a.switchAccount)
 
+	// trash
+	r.Get("/trash", a.listTrash)
+	r.Post("/trash/purge", a.purgeTrash)
+
+	// export / import
+	r.Get("/export", a.exportVault)
+	r.Post("/import", a.importVault)
+	r.Post("/import/external", a.previewExternalImport)
+	r.Post("/import/external/{id}/confirm", a.confirmExternalImport)
+	r.Delete("/import/external/{id}", a.discardExternalImport)
+	r.Get("/kdbx/export", a.exportKDBX)
+	r.Post("/kdbx/import", a.importKDBX)
+
+	// site packs
+	r.Get("/site-packs", a.listSitePacks)
+	r.Post("/site-packs", a.installSitePack)
+	r.Get("/sites/{key}/pack", a.exportSitePack)
+
+	// declarative config
+	r.Get("/config/drift", a.configDrift)
+
+	// backups
+	r.Get("/admin/backups", a.listBackups)
+	r.Post("/admin/backups", a.createBackup)
+
 	return r
 }
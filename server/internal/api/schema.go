@@ -2,35 +2,58 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"reflect"
+	"sort"
 
 	"github.com/go-chi/chi/v5"
 
+	"mss/internal/jsonschema"
 	"mss/internal/store"
+	"mss/internal/validation"
 )
 
 type schemaFieldReq struct {
-	Field    string      `json:"field"`
-	Type     string      `json:"type"`
-	Required bool        `json:"required"`
-	Default  interface{} `json:"default"`
-	Regex    string      `json:"regex"`
-	Choices  interface{} `json:"choices"`
-	Secret   bool        `json:"secret"`
-	Order    int         `json:"order"`
-	UIHint   string      `json:"uiHint"`
+	Field     string            `json:"field"`
+	Type      string            `json:"type"`
+	Required  bool              `json:"required"`
+	Default   interface{}       `json:"default"`
+	Regex     string            `json:"regex"`
+	Choices   interface{}       `json:"choices"`
+	Secret    bool              `json:"secret"`
+	Order     int               `json:"order"`
+	UIHint    string            `json:"uiHint"`
+	Min       *float64          `json:"min"`
+	Max       *float64          `json:"max"`
+	MinLength *int              `json:"minLength"`
+	MaxLength *int              `json:"maxLength"`
+	Unique    bool              `json:"unique"`
+	Items     *validation.Rule  `json:"items"`
+	Fields    []validation.Rule `json:"fields"`
+	// Migrate tunes ?mode=migrate on PUT; ignored otherwise.
+	Migrate   *schemaMigration  `json:"migrate"`
 }
 
 type schemaFieldResp struct {
-	Field    string      `json:"field"`
-	Type     string      `json:"type"`
-	Required bool        `json:"required"`
-	Default  interface{} `json:"default"`
-	Regex    string      `json:"regex"`
-	Choices  interface{} `json:"choices"`
-	Secret   bool        `json:"secret"`
-	Order    int         `json:"order"`
-	UIHint   string      `json:"uiHint"`
+	Field     string            `json:"field"`
+	Type      string            `json:"type"`
+	Required  bool              `json:"required"`
+	Default   interface{}       `json:"default"`
+	Regex     string            `json:"regex"`
+	Choices   interface{}       `json:"choices"`
+	Secret    bool              `json:"secret"`
+	Order     int               `json:"order"`
+	UIHint    string            `json:"uiHint"`
+	Min       *float64          `json:"min,omitempty"`
+	Max       *float64          `json:"max,omitempty"`
+	MinLength *int              `json:"minLength,omitempty"`
+	MaxLength *int              `json:"maxLength,omitempty"`
+	Unique    bool              `json:"unique,omitempty"`
+	Items     *validation.Rule  `json:"items,omitempty"`
+	Fields    []validation.Rule `json:"fields,omitempty"`
+	Version   int64             `json:"version"`
 }
 
 func toStoreSchema(siteKey string, f schemaFieldReq) store.SiteFieldSchema {
@@ -46,6 +69,15 @@ func toStoreSchema(siteKey string, f schemaFieldReq) store.SiteFieldSchema {
 	if f.Required { req = 1 }
 	sec := 0
 	if f.Secret { sec = 1 }
+	uniq := 0
+	if f.Unique { uniq = 1 }
+	var items, fields string
+	if f.Items != nil {
+		if b, err := json.Marshal(f.Items); err == nil { items = string(b) }
+	}
+	if len(f.Fields) > 0 {
+		if b, err := json.Marshal(f.Fields); err == nil { fields = string(b) }
+	}
 	return store.SiteFieldSchema{
 		SiteKey:      siteKey,
 		Field:        f.Field,
@@ -57,6 +89,13 @@ func toStoreSchema(siteKey string, f schemaFieldReq) store.SiteFieldSchema {
 		Secret:       sec,
 		Order:        f.Order,
 		UIHint:       f.UIHint,
+		Min:          f.Min,
+		Max:          f.Max,
+		MinLength:    f.MinLength,
+		MaxLength:    f.MaxLength,
+		Unique:       uniq,
+		Items:        items,
+		Fields:       fields,
 	}
 }
 
@@ -65,6 +104,7 @@ func toRespSchema(s store.SiteFieldSchema) schemaFieldResp {
 	if s.DefaultValue != "" { _ = json.Unmarshal([]byte(s.DefaultValue), &def) }
 	var ch interface{}
 	if s.Choices != "" { _ = json.Unmarshal([]byte(s.Choices), &ch) }
+	rule, _ := validation.RuleFromSchema(s)
 	return schemaFieldResp{
 		Field: s.Field,
 		Type: s.Type,
@@ -75,34 +115,149 @@ func toRespSchema(s store.SiteFieldSchema) schemaFieldResp {
 		Secret: s.Secret != 0,
 		Order: s.Order,
 		UIHint: s.UIHint,
+		Min: s.Min,
+		Max: s.Max,
+		MinLength: s.MinLength,
+		MaxLength: s.MaxLength,
+		Unique: s.Unique != 0,
+		Items: rule.Items,
+		Fields: rule.Fields,
+		Version: s.Version,
 	}
 }
 
+// schemaMismatch answers a failed field precondition with the current field.
+func (a *API) schemaMismatch(w http.ResponseWriter, r *http.Request, key, field string) {
+	cur, err := a.repos.Schemas.Get(r.Context(), key, field)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	if cur == nil { fail(w, http.StatusNotFound, store.ErrNotFound); return }
+	preconditionFailed(w, cur.Version, toRespSchema(*cur))
+}
+
+func (a *API) getSchemaField(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	field := chi.URLParam(r, "field")
+	s, err := a.repos.Schemas.Get(r.Context(), key, field)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	if s == nil { fail(w, http.StatusNotFound, store.ErrNotFound); return }
+	setETag(w, s.Version)
+	ok(w, toRespSchema(*s))
+}
+
+// validator returns the site's compiled schema from the shared cache.
+// Handlers that write schemas must Invalidate it once committed.
+func (a *API) validator(r *http.Request, key string) (*validation.Validator, error) {
+	return a.validators.Get(r.Context(), a.repos, key)
+}
+
 func (a *API) getSchema(w http.ResponseWriter, r *http.Request) {
 	key := chi.URLParam(r, "key")
-	items, err := store.GetSiteFieldSchemas(r.Context(), a.db, key)
+	items, err := a.repos.Schemas.List(r.Context(), key)
 	if err != nil { fail(w, http.StatusInternalServerError, err); return }
 	out := make([]schemaFieldResp, 0, len(items))
 	for _, it := range items { out = append(out, toRespSchema(it)) }
 	ok(w, out)
 }
 
+// getSchemaJSON renders the site's fields as a JSON Schema document; see
+// package jsonschema.
+func (a *API) getSchemaJSON(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	site, err := a.repos.Sites.Get(r.Context(), key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	if site == nil { fail(w, http.StatusNotFound, store.ErrNotFound); return }
+	items, err := a.repos.Schemas.List(r.Context(), key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	w.Header().Set("Content-Type", "application/schema+json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(jsonschema.Render(*site, items))
+}
+
+// postSchema upserts the posted fields, given either as {"fields": [...]}
+// or as a JSON Schema document whose properties are the fields. Like
+// putSchema it checks what the change does to existing accounts and honours
+// ?mode=.
 func (a *API) postSchema(w http.ResponseWriter, r *http.Request) {
 	key := chi.URLParam(r, "key")
-	var body struct{ Fields []schemaFieldReq `json:"fields"` }
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil { fail(w, http.StatusBadRequest, err); return }
-	for _, f := range body.Fields {
-		if f.Field == "" || f.Type == "" { fail(w, http.StatusBadRequest, nil); return }
-		m := toStoreSchema(key, f)
-		if err := store.UpsertSiteFieldSchema(r.Context(), a.db, &m); err != nil { fail(w, http.StatusInternalServerError, err); return }
+	raw, err := io.ReadAll(r.Body)
+	if err != nil { fail(w, http.StatusBadRequest, err); return }
+	var rows []store.SiteFieldSchema
+	var migs []*schemaMigration
+	propsMode := ""
+	if jsonschema.IsDocument(raw) {
+		doc, err := jsonschema.Parse(key, raw)
+		if err != nil { fail(w, http.StatusBadRequest, err); return }
+		rows, propsMode = doc.Fields, doc.AdditionalProps
+		migs = make([]*schemaMigration, len(rows))
+	} else {
+		var body struct{ Fields []schemaFieldReq `json:"fields"` }
+		if err := json.Unmarshal(raw, &body); err != nil { fail(w, http.StatusBadRequest, err); return }
+		for _, f := range body.Fields {
+			if f.Field == "" || f.Type == "" { fail(w, http.StatusBadRequest, nil); return }
+			m := toStoreSchema(key, f)
+			if err := validation.CheckField(m); err != nil { fail(w, http.StatusBadRequest, err); return }
+			rows, migs = append(rows, m), append(migs, f.Migrate)
+		}
 	}
-	items, err := store.GetSiteFieldSchemas(r.Context(), a.db, key)
-	if err != nil { fail(w, http.StatusInternalServerError, err); return }
-	out := make([]schemaFieldResp, 0, len(items))
-	for _, it := range items { out = append(out, toRespSchema(it)) }
-	ok(w, out)
+	if len(rows) == 0 { fail(w, http.StatusBadRequest, errNoFields); return }
+	mode, good := schemaModeOf(w, r)
+	if !good { return }
+	if !a.guardManaged(w, r, key) { return }
+	dry := r.URL.Query().Get("dryRun")
+	dryRun := mode == schemaDryRun || dry == "1" || dry == "true"
+
+	impact := schemaImpact{Mode: mode}
+	for _, m := range rows { impact.Fields = append(impact.Fields, m.Field) }
+	var fields []schemaFieldResp
+	err = a.repos.Tx.InTx(r.Context(), func(tx store.Repos) error {
+		_, before, err := validation.CheckAccounts(r.Context(), tx, key)
+		if err != nil { return err }
+		impact.Preexisting = len(before)
+		for i := range rows {
+			if err := tx.Schemas.Upsert(r.Context(), &rows[i], 0); err != nil { return err }
+		}
+		if propsMode != "" {
+			site, err := tx.Sites.Get(r.Context(), key)
+			if err != nil { return err }
+			if site == nil { return store.ErrNotFound }
+			if site.AdditionalProps != propsMode {
+				site.AdditionalProps = propsMode
+				if err := tx.Sites.Update(r.Context(), site, 0); err != nil { return err }
+			}
+		}
+		if mode == schemaMigrate {
+			migrated := map[string]bool{}
+			for i, m := range rows {
+				mig := schemaMigration{Cast: true, ApplyDefault: true}
+				if migs[i] != nil { mig = *migs[i] }
+				ids, conflicts, err := migrateProps(r.Context(), tx, m, mig)
+				if err != nil { return err }
+				for _, id := range ids { migrated[id] = true }
+				impact.Conflicts = append(impact.Conflicts, conflicts...)
+			}
+			impact.Migrated = len(migrated)
+		}
+		var after []validation.AccountViolation
+		if impact.Checked, after, err = validation.CheckAccounts(r.Context(), tx, key); err != nil { return err }
+		impact.Violations = validation.Introduced(before, after)
+		items, err := tx.Schemas.List(r.Context(), key)
+		if err != nil { return err }
+		fields = make([]schemaFieldResp, 0, len(items))
+		for _, it := range items { fields = append(fields, toRespSchema(it)) }
+		if dryRun { return errSchemaDryRun }
+		if mode != "" && len(impact.Violations) > 0 { return errSchemaImpact }
+		return nil
+	})
+	a.validators.Invalidate(key)
+	if errors.Is(err, errSchemaImpact) { failSchemaImpact(w, err, fields, impact); return }
+	if err != nil && !errors.Is(err, errSchemaDryRun) { failStore(w, err); return }
+	impact.Applied = !dryRun
+	okSchemaImpact(w, fields, impact)
 }
 
+// putSchema replaces one field definition after checking what it does to
+// existing accounts; see schemaImpact and the schema* modes.
 func (a *API) putSchema(w http.ResponseWriter, r *http.Request) {
 	key := chi.URLParam(r, "key")
 	field := chi.URLParam(r, "field")
@@ -112,18 +267,138 @@ func (a *API) putSchema(w http.ResponseWriter, r *http.Request) {
 	if f.Field != field { fail(w, http.StatusBadRequest, nil); return }
 	if f.Field == "" || f.Type == "" { fail(w, http.StatusBadRequest, nil); return }
 	m := toStoreSchema(key, f)
-	if err := store.UpsertSiteFieldSchema(r.Context(), a.db, &m); err != nil { fail(w, http.StatusInternalServerError, err); return }
-	items, err := store.GetSiteFieldSchemas(r.Context(), a.db, key)
-	if err != nil { fail(w, http.StatusInternalServerError, err); return }
-	out := make([]schemaFieldResp, 0, len(items))
-	for _, it := range items { out = append(out, toRespSchema(it)) }
-	ok(w, out)
+	if err := validation.CheckField(m); err != nil { fail(w, http.StatusBadRequest, err); return }
+	mode, good := schemaModeOf(w, r)
+	if !good { return }
+	if !a.guardManaged(w, r, key) { return }
+	ver, good := a.ifMatch(w, r)
+	if !good { return }
+	dry := r.URL.Query().Get("dryRun")
+	dryRun := mode == schemaDryRun || dry == "1" || dry == "true"
+	mig := schemaMigration{Cast: true, ApplyDefault: true}
+	if f.Migrate != nil { mig = *f.Migrate }
+
+	impact := schemaImpact{Mode: mode, Field: field}
+	var fields []schemaFieldResp
+	err := a.repos.Tx.InTx(r.Context(), func(tx store.Repos) error {
+		_, before, err := validation.CheckAccounts(r.Context(), tx, key)
+		if err != nil { return err }
+		impact.Preexisting = len(before)
+		if err := tx.Schemas.Upsert(r.Context(), &m, ver); err != nil { return err }
+		if mode == schemaMigrate {
+			ids, conflicts, err := migrateProps(r.Context(), tx, m, mig)
+			if err != nil { return err }
+			impact.Migrated, impact.Conflicts = len(ids), conflicts
+		}
+		var after []validation.AccountViolation
+		if impact.Checked, after, err = validation.CheckAccounts(r.Context(), tx, key); err != nil { return err }
+		impact.Violations = validation.Introduced(before, after)
+		items, err := tx.Schemas.List(r.Context(), key)
+		if err != nil { return err }
+		fields = make([]schemaFieldResp, 0, len(items))
+		for _, it := range items { fields = append(fields, toRespSchema(it)) }
+		if dryRun { return errSchemaDryRun }
+		if mode != "" && len(impact.Violations) > 0 { return errSchemaImpact }
+		return nil
+	})
+	a.validators.Invalidate(key)
+	switch {
+	case errors.Is(err, store.ErrVersionMismatch):
+		a.schemaMismatch(w, r, key, field); return
+	case errors.Is(err, errSchemaImpact):
+		failSchemaImpact(w, err, fields, impact); return
+	case err != nil && !errors.Is(err, errSchemaDryRun):
+		failStore(w, err); return
+	}
+	impact.Applied = !dryRun
+	if !dryRun {
+		if cur, err := a.repos.Schemas.Get(r.Context(), key, field); err == nil && cur != nil { setETag(w, cur.Version) }
+	}
+	okSchemaImpact(w, fields, impact)
 }
 
 func (a *API) deleteSchema(w http.ResponseWriter, r *http.Request) {
 	key := chi.URLParam(r, "key")
 	field := chi.URLParam(r, "field")
 	if field == "" { fail(w, http.StatusBadRequest, nil); return }
-	if err := store.DeleteSiteFieldSchema(r.Context(), a.db, key, field); err != nil { fail(w, http.StatusInternalServerError, err); return }
+	if !a.guardManaged(w, r, key) { return }
+	if wantsHardDelete(r) {
+		if !a.isAdmin(r) { fail(w, http.StatusForbidden, errAdminOnly); return }
+		err := a.repos.Schemas.Purge(r.Context(), key, field)
+		a.validators.Invalidate(key)
+		if err != nil { failStore(w, err); return }
+		ok(w, map[string]string{"status":"purged"})
+		return
+	}
+	ver, good := a.ifMatch(w, r)
+	if !good { return }
+	err := a.repos.Schemas.Delete(r.Context(), key, field, ver)
+	a.validators.Invalidate(key)
+	if err != nil {
+		if errors.Is(err, store.ErrVersionMismatch) { a.schemaMismatch(w, r, key, field); return }
+		failStore(w, err); return
+	}
 	ok(w, map[string]string{"status":"deleted"})
 }
+
+func (a *API) restoreSchema(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	field := chi.URLParam(r, "field")
+	err := a.repos.Schemas.Restore(r.Context(), key, field)
+	a.validators.Invalidate(key)
+	if err != nil { failStore(w, err); return }
+	ok(w, map[string]string{"status":"restored"})
+}
+
+type backfillResp struct {
+	ID       string   `json:"id"`
+	Username string   `json:"username"`
+	Changed  []string `json:"changed"` // props filled from defaults or normalized
+}
+
+// applySchemaDefaults rewrites existing accounts through validation.Normalize
+// so they pick up defaults and canonical values added to the schema since
+// they were written. ?dryRun=1 only reports; otherwise every changed account
+// is updated, with a revision, in one transaction.
+func (a *API) applySchemaDefaults(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	dry := r.URL.Query().Get("dryRun")
+	dryRun := dry == "1" || dry == "true"
+	site, err := a.repos.Sites.Get(r.Context(), key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	if site == nil { fail(w, http.StatusNotFound, store.ErrNotFound); return }
+	out := []backfillResp{}
+	err = a.repos.Tx.InTx(r.Context(), func(tx store.Repos) error {
+		schemas, err := tx.Schemas.List(r.Context(), key)
+		if err != nil { return err }
+		v := validation.Compile(key, schemas)
+		accs, err := tx.Accounts.List(r.Context(), key)
+		if err != nil { return err }
+		for _, acc := range accs {
+			var props map[string]interface{}
+			if acc.Extra != "" { _ = json.Unmarshal([]byte(acc.Extra), &props) }
+			norm := v.Normalize(props)
+			changed := changedProps(props, norm)
+			if len(changed) == 0 { continue }
+			out = append(out, backfillResp{ID: acc.ID, Username: acc.Username, Changed: changed})
+			if dryRun { continue }
+			b, _ := json.Marshal(norm)
+			acc.Extra = string(b)
+			if err := tx.Accounts.Update(r.Context(), &acc, acc.Version); err != nil { return err }
+		}
+		return nil
+	})
+	if err != nil { failStore(w, err); return }
+	if dryRun { ok(w, map[string]interface{}{"dryRun": true, "updated": 0, "wouldUpdate": len(out), "accounts": out}); return }
+	ok(w, map[string]interface{}{"dryRun": false, "updated": len(out), "accounts": out})
+}
+
+// changedProps lists, sorted, the keys whose values differ between a and b.
+func changedProps(a, b map[string]interface{}) []string {
+	var out []string
+	for k, v := range b {
+		if old, found := a[k]; !found || !reflect.DeepEqual(old, v) { out = append(out, k) }
+	}
+	sort.Strings(out)
+	return out
+}
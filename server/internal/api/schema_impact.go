@@ -0,0 +1,143 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"mss/internal/store"
+	"mss/internal/validation"
+)
+
+// Schema write modes (?mode=) for putSchema. Without a mode the change is
+// applied and accounts it invalidates are reported as warnings.
+const (
+	schemaDryRun  = "dryRun"
+	schemaReject  = "reject"
+	schemaMigrate = "migrate"
+)
+
+var (
+	errSchemaMode   = fmt.Errorf("mode must be %q, %q or %q", schemaDryRun, schemaReject, schemaMigrate)
+	errSchemaDryRun = errors.New("dry run")
+	errSchemaImpact = errors.New("schema change would invalidate existing accounts")
+	errNoFields     = errors.New("no fields given")
+)
+
+// schemaMigration says how mode=migrate rewrites accounts.extra. Without it
+// values are cast and the default applied.
+type schemaMigration struct {
+	// RenameFrom moves each account's prop of that name into the field and
+	// trashes the old field definition.
+	RenameFrom string `json:"renameFrom,omitempty"`
+	// Cast converts existing values to the field's type where possible.
+	Cast bool `json:"cast,omitempty"`
+	// ApplyDefault fills missing or empty values from the field's default.
+	ApplyDefault bool `json:"applyDefault,omitempty"`
+}
+
+// schemaConflict is an account whose prop could not be renamed because the
+// target prop already holds a value; both are kept.
+type schemaConflict struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+// schemaImpact is what a schema change does to the site's accounts.
+type schemaImpact struct {
+	Mode       string            `json:"mode"`
+	Field      string            `json:"field,omitempty"`
+	Fields     []string          `json:"fields,omitempty"` // the posted fields, for a multi-field write
+	Applied    bool              `json:"applied"`
+	Checked    int               `json:"checked"`
+	Migrated   int               `json:"migrated"`
+	// Violations are only those the change introduces; Preexisting counts
+	// accounts that were already invalid before it.
+	Violations  []validation.AccountViolation `json:"violations"`
+	Preexisting int                           `json:"preexisting"`
+	Conflicts   []schemaConflict              `json:"conflicts,omitempty"`
+}
+
+// migrateProps rewrites every account of the site for the new definition of
+// field s and returns the IDs of the accounts it changed and the renames it
+// skipped.
+func migrateProps(ctx context.Context, tx store.Repos, s store.SiteFieldSchema, mig schemaMigration) ([]string, []schemaConflict, error) {
+	if mig.RenameFrom == s.Field { mig.RenameFrom = "" }
+	if mig.RenameFrom != "" {
+		old, err := tx.Schemas.Get(ctx, s.SiteKey, mig.RenameFrom)
+		if err != nil { return nil, nil, err }
+		if old != nil {
+			if err := tx.Schemas.Delete(ctx, s.SiteKey, mig.RenameFrom, 0); err != nil { return nil, nil, err }
+		}
+	}
+	var def interface{}
+	if s.DefaultValue != "" { _ = json.Unmarshal([]byte(s.DefaultValue), &def) }
+	accs, err := tx.Accounts.List(ctx, s.SiteKey)
+	if err != nil { return nil, nil, err }
+	var ids []string
+	var conflicts []schemaConflict
+	for _, acc := range accs {
+		props := map[string]interface{}{}
+		if acc.Extra != "" {
+			if err := json.Unmarshal([]byte(acc.Extra), &props); err != nil { continue }
+		}
+		changed := false
+		if v, found := props[mig.RenameFrom]; mig.RenameFrom != "" && found {
+			if _, taken := props[s.Field]; taken {
+				conflicts = append(conflicts, schemaConflict{ID: acc.ID, Username: acc.Username, From: mig.RenameFrom, To: s.Field})
+			} else {
+				props[s.Field] = v
+				delete(props, mig.RenameFrom)
+				changed = true
+			}
+		}
+		if v, found := props[s.Field]; mig.Cast && found {
+			if c, good := validation.Cast(v, s.Type); good && !sameValue(c, v) { props[s.Field], changed = c, true }
+		}
+		if v, found := props[s.Field]; mig.ApplyDefault && def != nil && (!found || v == nil || v == "") {
+			props[s.Field], changed = def, true
+		}
+		if !changed { continue }
+		b, _ := json.Marshal(props)
+		acc.Extra = string(b)
+		if err := tx.Accounts.Update(ctx, &acc, acc.Version); err != nil { return nil, nil, err }
+		ids = append(ids, acc.ID)
+	}
+	return ids, conflicts, nil
+}
+
+func sameValue(a, b interface{}) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
+
+// okSchemaImpact answers a schema write: with a mode, data is {fields,
+// impact}; without one, data is the field list and violations are warnings.
+func okSchemaImpact(w http.ResponseWriter, fields []schemaFieldResp, impact schemaImpact) {
+	if impact.Mode != "" { ok(w, map[string]interface{}{"fields": fields, "impact": impact}); return }
+	var warnings []string
+	for _, v := range impact.Violations { warnings = append(warnings, v.String()) }
+	okWarn(w, fields, warnings)
+}
+
+// failSchemaImpact answers 409 for a write rolled back by errSchemaImpact.
+func failSchemaImpact(w http.ResponseWriter, err error, fields []schemaFieldResp, impact schemaImpact) {
+	writeJSON(w, http.StatusConflict, Response{Ok: false, Data: map[string]interface{}{"fields": fields, "impact": impact},
+		Error: fmt.Sprintf("%v: %d of %d fail validation", err, len(impact.Violations), impact.Checked)})
+}
+
+// schemaModeOf reads ?mode=, answering 400 for unknown values.
+func schemaModeOf(w http.ResponseWriter, r *http.Request) (string, bool) {
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "", schemaDryRun, schemaReject, schemaMigrate:
+		return mode, true
+	}
+	fail(w, http.StatusBadRequest, errSchemaMode)
+	return "", false
+}
@@ -0,0 +1,114 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"mss/internal/api"
+)
+
+type impactResp struct {
+	Fields []struct {
+		Field string `json:"field"`
+		Type  string `json:"type"`
+	} `json:"fields"`
+	Impact struct {
+		Applied    bool `json:"applied"`
+		Checked    int  `json:"checked"`
+		Migrated   int  `json:"migrated"`
+		Violations []struct {
+			ID string `json:"id"`
+		} `json:"violations"`
+		Preexisting int `json:"preexisting"`
+		Conflicts   []struct {
+			ID string `json:"id"`
+		} `json:"conflicts"`
+	} `json:"impact"`
+}
+
+func TestSchemaImpact(t *testing.T) {
+	c := newClient(t, api.Options{})
+	c.site("gh", map[string]interface{}{"field": "seats", "type": "string"})
+	alice := c.account("gh", map[string]interface{}{"username": "alice", "props": map[string]interface{}{"seats": "3"}})["id"].(string)
+	bob := c.account("gh", map[string]interface{}{"username": "bob", "props": map[string]interface{}{"seats": "many"}})["id"].(string)
+	seats := map[string]interface{}{"type": "integer"}
+
+	c.must(http.StatusBadRequest, "PUT", "/sites/gh/schema/seats?mode=later", seats)
+	var res impactResp
+	c.must(http.StatusOK, "PUT", "/sites/gh/schema/seats?mode=dryRun", seats).into(t, &res)
+	if res.Impact.Applied || res.Impact.Checked != 2 || len(res.Impact.Violations) != 2 { t.Fatalf("dry run: %+v", res.Impact) }
+	r := c.must(http.StatusConflict, "PUT", "/sites/gh/schema/seats?mode=reject", seats)
+	r.into(t, &res)
+	if len(res.Impact.Violations) != 2 { t.Fatalf("reject: %+v", res.Impact) }
+	var field struct{ Type string `json:"type"` }
+	c.must(http.StatusOK, "GET", "/sites/gh/schema/seats", nil).into(t, &field)
+	if field.Type != "string" { t.Fatalf("a rejected change was written: %+v", field) }
+
+	// migrate refuses to leave accounts it cannot cast invalid
+	c.must(http.StatusConflict, "PUT", "/sites/gh/schema/seats?mode=migrate", seats)
+	c.must(http.StatusOK, "PUT", "/sites/gh/accounts/"+bob, map[string]interface{}{"username": "bob", "props": map[string]interface{}{"seats": "4"}})
+	c.must(http.StatusOK, "PUT", "/sites/gh/schema/seats?mode=migrate", seats).into(t, &res)
+	if !res.Impact.Applied || res.Impact.Migrated != 2 || len(res.Impact.Violations) != 0 { t.Fatalf("migrate: %+v", res.Impact) }
+	var acc map[string]interface{}
+	c.must(http.StatusOK, "GET", "/sites/gh/accounts/"+alice, nil).into(t, &acc)
+	if acc["props"].(map[string]interface{})["seats"] != 3.0 { t.Fatalf("alice: %v", acc) }
+
+	// without a mode the change applies and invalid accounts come back as
+	// warnings; accounts that were invalid before are not reported again
+	r = c.must(http.StatusOK, "PUT", "/sites/gh/schema/seats", map[string]interface{}{"type": "integer", "max": 3})
+	if len(r.Warnings) != 1 || !strings.Contains(r.Warnings[0], "bob") { t.Fatalf("warnings: %q", r.Warnings) }
+	r = c.must(http.StatusOK, "PUT", "/sites/gh/schema/seats", map[string]interface{}{"type": "integer", "max": 2})
+	if len(r.Warnings) != 1 || !strings.Contains(r.Warnings[0], "alice") { t.Fatalf("warnings: %q", r.Warnings) }
+
+	// a rename moves the prop and keeps values it would overwrite
+	c.account("gh", map[string]interface{}{"username": "carol", "props": map[string]interface{}{"team": "b"}})
+	c.must(http.StatusOK, "POST", "/sites/gh/schema", map[string]interface{}{"fields": []map[string]interface{}{{"field": "team", "type": "string"}, {"field": "squad", "type": "string"}}})
+	c.account("gh", map[string]interface{}{"username": "dave", "props": map[string]interface{}{"team": "a", "squad": "z"}})
+	c.must(http.StatusOK, "PUT", "/sites/gh/schema/squad?mode=migrate", map[string]interface{}{"type": "string", "migrate": map[string]string{"renameFrom": "team"}}).into(t, &res)
+	if res.Impact.Migrated != 1 || len(res.Impact.Conflicts) != 1 { t.Fatalf("rename: %+v", res.Impact) }
+	c.must(http.StatusNotFound, "GET", "/sites/gh/schema/team", nil)
+}
+
+func TestSchemaDocument(t *testing.T) {
+	c := newClient(t, api.Options{})
+	c.site("gh")
+	doc := `{"$schema":"https://json-schema.org/draft/2020-12/schema","type":"object","additionalProperties":false,
+		"properties":{"email":{"type":"string","format":"email","x-mss-unique":true},"age":{"type":"integer","minimum":18,"default":18}},
+		"required":["email"]}`
+	c.must(http.StatusOK, "POST", "/sites/gh/schema", doc)
+	r := c.must(http.StatusOK, "GET", "/sites/gh/schema.json", nil)
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/schema+json") { t.Fatalf("content type %q", ct) }
+	var got map[string]interface{}
+	if err := json.Unmarshal(r.Body, &got); err != nil { t.Fatal(err) }
+	if got["additionalProperties"] != false || len(got["properties"].(map[string]interface{})) != 2 { t.Fatalf("document: %s", r.Body) }
+	// the rendered document posts back unchanged
+	c.must(http.StatusOK, "POST", "/sites/gh/schema", r.Body)
+	r2 := c.must(http.StatusOK, "GET", "/sites/gh/schema.json", nil)
+	if string(r2.Body) != string(r.Body) { t.Fatalf("round trip:\n%s\n%s", r.Body, r2.Body) }
+
+	acc := c.account("gh", map[string]interface{}{"username": "alice", "props": map[string]interface{}{"email": "a@x.io"}})
+	if acc["props"].(map[string]interface{})["age"] != 18.0 { t.Fatalf("default: %v", acc) }
+	c.must(http.StatusBadRequest, "POST", "/sites/gh/accounts", map[string]interface{}{"username": "bob", "props": map[string]interface{}{"email": "b@x.io", "nick": "b"}})
+	for _, bad := range []string{
+		`{"$schema":"https://json-schema.org/draft/2020-12/schema","properties":{"":{"type":"string"}}}`,
+		`{"$schema":"https://json-schema.org/draft/2020-12/schema","properties":{"x":{"type":"string","oneOf":[]}}}`,
+		`{"$schema":"https://json-schema.org/draft/07/schema","properties":{}}`,
+	} {
+		c.must(http.StatusBadRequest, "POST", "/sites/gh/schema", bad)
+	}
+}
+
+func TestValidatorCache(t *testing.T) {
+	c := newClient(t, api.Options{SchemaCacheTTL: 1 << 40})
+	c.site("gh", map[string]interface{}{"field": "seats", "type": "integer", "max": 5})
+	c.account("gh", map[string]interface{}{"username": "alice", "props": map[string]interface{}{"seats": 5}})
+	// a schema write through the API is seen by the next request at once
+	c.must(http.StatusOK, "PUT", "/sites/gh/schema/seats", map[string]interface{}{"type": "integer", "max": 2})
+	c.must(http.StatusBadRequest, "POST", "/sites/gh/accounts", map[string]interface{}{"username": "bob", "props": map[string]interface{}{"seats": 5}})
+	c.must(http.StatusOK, "DELETE", "/sites/gh/schema/seats", nil)
+	c.account("gh", map[string]interface{}{"username": "bob", "props": map[string]interface{}{"seats": 5}})
+	c.must(http.StatusOK, "POST", "/sites/gh/schema/seats/restore", nil)
+	c.must(http.StatusBadRequest, "POST", "/sites/gh/accounts", map[string]interface{}{"username": "carol", "props": map[string]interface{}{"seats": 5}})
+}
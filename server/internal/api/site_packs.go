@@ -0,0 +1,84 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"mss/internal/sitepack"
+	"mss/internal/store"
+)
+
+// maxPackBytes bounds an uploaded site pack.
+const maxPackBytes = 1 << 20
+
+type builtinPack struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+	SiteKey     string `json:"siteKey"`
+}
+
+// listSitePacks returns the built-in packs and the packs installed on sites.
+func (a *API) listSitePacks(w http.ResponseWriter, r *http.Request) {
+	all, err := sitepack.Builtins()
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	builtin := make([]builtinPack, 0, len(all))
+	for _, p := range all { builtin = append(builtin, builtinPack{Name: p.Name, Version: p.Version, Description: p.Description, SiteKey: p.Site.Key}) }
+	installed, err := a.repos.Packs.List(r.Context())
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	ok(w, map[string]interface{}{"builtin": builtin, "installed": installed})
+}
+
+// installSitePack installs or upgrades a pack sent as JSON or YAML, or a
+// built-in one named by ?builtin=. ?force=1 adopts existing sites and
+// allows downgrades; ?dryRun=1 only reports.
+func (a *API) installSitePack(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var p *sitepack.Pack
+	if name := q.Get("builtin"); name != "" {
+		var err error
+		p, err = sitepack.Builtin(name)
+		if err != nil { fail(w, http.StatusInternalServerError, err); return }
+		if p == nil { fail(w, http.StatusNotFound, fmt.Errorf("no built-in site pack %q", name)); return }
+	} else {
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPackBytes))
+		if err != nil { fail(w, http.StatusBadRequest, err); return }
+		p, err = sitepack.Parse(data)
+		if err != nil { fail(w, http.StatusBadRequest, err); return }
+	}
+	if !a.guardManaged(w, r, p.Site.Key) { return }
+	force, dry := q.Get("force"), q.Get("dryRun")
+	res, err := sitepack.Install(r.Context(), a.repos, p, sitepack.Options{Force: force == "1" || force == "true", DryRun: dry == "1" || dry == "true"})
+	a.validators.Invalidate(p.Site.Key)
+	if err != nil {
+		if errors.Is(err, sitepack.ErrInvalid) { fail(w, http.StatusBadRequest, err); return }
+		failStore(w, err); return
+	}
+	ok(w, res)
+}
+
+// exportSitePack returns a site's definition as a pack document that can be
+// posted back to /site-packs. ?format=yaml returns YAML instead of JSON.
+func (a *API) exportSitePack(w http.ResponseWriter, r *http.Request) {
+	p, err := sitepack.Export(r.Context(), a.repos, chi.URLParam(r, "key"))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) { fail(w, http.StatusNotFound, err); return }
+		fail(w, http.StatusInternalServerError, err); return
+	}
+	if r.URL.Query().Get("format") == "yaml" {
+		data, err := p.YAML()
+		if err != nil { fail(w, http.StatusInternalServerError, err); return }
+		w.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+		_, _ = w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(p)
+}
@@ -0,0 +1,37 @@
+package api_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"mss/internal/api"
+	"mss/internal/sitepack"
+)
+
+func TestSitePacks(t *testing.T) {
+	c := newClient(t, api.Options{})
+	c.must(http.StatusNotFound, "POST", "/site-packs?builtin=nope", nil)
+	c.must(http.StatusBadRequest, "POST", "/site-packs", "name: Bad\n")
+	var res sitepack.Result
+	c.must(http.StatusOK, "POST", "/site-packs?builtin=github&dryRun=1", nil).into(t, &res)
+	if !res.DryRun || res.Site != "created" { t.Fatalf("dry run: %+v", res) }
+	c.must(http.StatusNotFound, "GET", "/sites/github", nil)
+	c.must(http.StatusOK, "POST", "/site-packs?builtin=github", nil).into(t, &res)
+	if res.Action != "install" { t.Fatalf("install: %+v", res) }
+	// the installed schema validates accounts at once
+	c.must(http.StatusBadRequest, "POST", "/sites/github/accounts", map[string]interface{}{"username": "a", "props": map[string]interface{}{"email": "nope"}})
+
+	r := c.must(http.StatusOK, "GET", "/sites/github/pack?format=yaml", nil)
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/yaml") { t.Fatalf("content type %q", r.Header.Get("Content-Type")) }
+	p, err := sitepack.Parse(r.Body)
+	if err != nil { t.Fatal(err) }
+	if p.Name != "github" || p.Login == nil { t.Fatalf("export: %+v", p) }
+	c.must(http.StatusOK, "POST", "/site-packs", r.Body).into(t, &res)
+	if res.Action != "reinstall" || len(res.Fields.Unchanged) != len(p.Fields) { t.Fatalf("reinstall: %+v", res) }
+
+	c.site("gitlab")
+	c.must(http.StatusConflict, "POST", "/site-packs?builtin=gitlab", nil)
+	c.must(http.StatusOK, "POST", "/site-packs?builtin=gitlab&force=1", nil)
+	c.must(http.StatusNotFound, "GET", "/sites/nope/pack", nil)
+}
@@ -1,44 +1,96 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/go-chi/chi/v5"
 
 	"mss/internal/store"
+	"mss/internal/validation"
 )
 
+// siteResp is a site with its account rules decoded.
+type siteResp struct {
+	store.Site
+	AccountRules *validation.AccountRules `json:"accountRules,omitempty"`
+}
+
+func toSiteResp(s store.Site) siteResp {
+	resp := siteResp{Site: s}
+	if ar, err := validation.ParseAccountRules(s.AccountRules); err == nil && !ar.Empty() { resp.AccountRules = ar }
+	return resp
+}
+
 func (a *API) listSites(w http.ResponseWriter, r *http.Request) {
-	sites, err := store.ListSites(r.Context(), a.db)
+	sites, err := a.repos.Sites.List(r.Context())
 	if err != nil { fail(w, http.StatusInternalServerError, err); return }
-	ok(w, sites)
+	out := make([]siteResp, 0, len(sites))
+	for _, s := range sites { out = append(out, toSiteResp(s)) }
+	ok(w, out)
 }
 
 func (a *API) getSite(w http.ResponseWriter, r *http.Request) {
 	key := chi.URLParam(r, "key")
-	s, err := store.GetSite(r.Context(), a.db, key)
+	s, err := a.repos.Sites.Get(r.Context(), key)
 	if err != nil { fail(w, http.StatusInternalServerError, err); return }
 	if s == nil { fail(w, http.StatusNotFound, nil); return }
-	ok(w, s)
+	setETag(w, s.Version)
+	ok(w, toSiteResp(*s))
 }
 
 type siteReq struct {
 	Key      string `json:"key"`
 	Name     string `json:"name"`
 	LoginURL string `json:"loginUrl"`
+	// AdditionalProps is allow, warn or reject; empty keeps the current
+	// mode (allow for new sites).
+	AdditionalProps string `json:"additionalProps"`
+	// AccountRules are the username and password rules; omitted keeps the
+	// current rules, {} clears them.
+	AccountRules *validation.AccountRules `json:"accountRules"`
 }
 
+var errPropsMode = errors.New("additionalProps must be allow, warn or reject")
+
 func (a *API) createSite(w http.ResponseWriter, r *http.Request) {
 	var body siteReq
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil { fail(w, http.StatusBadRequest, err); return }
 	body.Key = strings.TrimSpace(body.Key)
 	body.Name = strings.TrimSpace(body.Name)
 	if body.Key == "" || body.Name == "" { fail(w, http.StatusBadRequest, nil); return }
-	s := &store.Site{ Key: body.Key, Name: body.Name, LoginURL: body.LoginURL }
-	if err := store.CreateSite(r.Context(), a.db, s); err != nil { fail(w, http.StatusInternalServerError, err); return }
-	ok(w, s)
+	if body.AdditionalProps != "" && !validation.ValidPropsMode(body.AdditionalProps) { fail(w, http.StatusBadRequest, errPropsMode); return }
+	s := &store.Site{ Key: body.Key, Name: body.Name, LoginURL: body.LoginURL, AdditionalProps: body.AdditionalProps }
+	if body.AccountRules != nil {
+		if err := body.AccountRules.Check(); err != nil { fail(w, http.StatusBadRequest, err); return }
+		if !body.AccountRules.Empty() { s.AccountRules = body.AccountRules.Encode() }
+	}
+	err := a.repos.Sites.Create(r.Context(), s)
+	a.validators.Invalidate(s.Key)
+	if err != nil { failStore(w, trashedSiteErr(r.Context(), a.repos, s.Key, err)); return }
+	if created, err := a.repos.Sites.Get(r.Context(), s.Key); err == nil && created != nil { s = created }
+	setETag(w, s.Version)
+	ok(w, toSiteResp(*s))
+}
+
+// trashedSiteErr explains a create conflict caused by a trashed site
+// holding key; other errors are returned as they are.
+func trashedSiteErr(ctx context.Context, repos store.Repos, key string, err error) error {
+	if !errors.Is(err, store.ErrConflict) { return err }
+	if cur, gerr := repos.Sites.Get(ctx, key); gerr != nil || cur != nil { return err }
+	return fmt.Errorf("site %q is in trash; restore or purge it first: %w", key, err)
+}
+
+// siteMismatch answers a failed site precondition with the current site.
+func (a *API) siteMismatch(w http.ResponseWriter, r *http.Request, key string) {
+	cur, err := a.repos.Sites.Get(r.Context(), key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	if cur == nil { fail(w, http.StatusNotFound, store.ErrNotFound); return }
+	preconditionFailed(w, cur.Version, toSiteResp(*cur))
 }
 
 func (a *API) updateSite(w http.ResponseWriter, r *http.Request) {
@@ -47,14 +99,56 @@ func (a *API) updateSite(w http.ResponseWriter, r *http.Request) {
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil { fail(w, http.StatusBadRequest, err); return }
 	body.Name = strings.TrimSpace(body.Name)
 	if body.Name == "" { fail(w, http.StatusBadRequest, nil); return }
-	s := &store.Site{ Key: key, Name: body.Name, LoginURL: body.LoginURL }
-	if err := store.UpdateSite(r.Context(), a.db, s); err != nil { fail(w, http.StatusInternalServerError, err); return }
-	ok(w, s)
+	if body.AdditionalProps != "" && !validation.ValidPropsMode(body.AdditionalProps) { fail(w, http.StatusBadRequest, errPropsMode); return }
+	if body.AccountRules != nil {
+		if err := body.AccountRules.Check(); err != nil { fail(w, http.StatusBadRequest, err); return }
+	}
+	if !a.guardManaged(w, r, key) { return }
+	ver, good := a.ifMatch(w, r)
+	if !good { return }
+	s := &store.Site{ Key: key, Name: body.Name, LoginURL: body.LoginURL, AdditionalProps: body.AdditionalProps }
+	if body.AccountRules != nil { s.AccountRules = body.AccountRules.Encode() }
+	err := a.repos.Sites.Update(r.Context(), s, ver)
+	a.validators.Invalidate(key)
+	if err != nil {
+		if errors.Is(err, store.ErrVersionMismatch) { a.siteMismatch(w, r, key); return }
+		failStore(w, err); return
+	}
+	setETag(w, s.Version)
+	ok(w, toSiteResp(*s))
 }
 
 func (a *API) deleteSite(w http.ResponseWriter, r *http.Request) {
 	key := chi.URLParam(r, "key")
 	if key == "" { fail(w, http.StatusBadRequest, nil); return }
-	if err := store.DeleteSite(r.Context(), a.db, key); err != nil { fail(w, http.StatusInternalServerError, err); return }
+	if !a.guardManaged(w, r, key) { return }
+	if wantsHardDelete(r) {
+		if !a.isAdmin(r) { fail(w, http.StatusForbidden, errAdminOnly); return }
+		err := a.repos.Sites.Purge(r.Context(), key)
+		a.validators.Invalidate(key)
+		if err != nil { failStore(w, err); return }
+		ok(w, map[string]string{"status":"purged"})
+		return
+	}
+	ver, good := a.ifMatch(w, r)
+	if !good { return }
+	err := a.repos.Sites.Delete(r.Context(), key, ver)
+	a.validators.Invalidate(key)
+	if err != nil {
+		if errors.Is(err, store.ErrVersionMismatch) { a.siteMismatch(w, r, key); return }
+		failStore(w, err); return
+	}
 	ok(w, map[string]string{"status":"deleted"})
 }
+
+func (a *API) restoreSite(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	err := a.repos.Sites.Restore(r.Context(), key)
+	a.validators.Invalidate(key)
+	if err != nil { failStore(w, err); return }
+	s, err := a.repos.Sites.Get(r.Context(), key)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	if s == nil { ok(w, nil); return }
+	setETag(w, s.Version)
+	ok(w, toSiteResp(*s))
+}
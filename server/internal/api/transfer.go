@@ -0,0 +1,58 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"mss/internal/bundle"
+)
+
+// passphraseHeader carries the bundle passphrase; it is kept out of the URL
+// so it does not end up in access logs.
+const passphraseHeader = "X-MSS-Passphrase"
+
+// maxImportBytes bounds the size of an uploaded bundle.
+const maxImportBytes = 64 << 20
+
+// exportVault streams every live row as a bundle file. Bundles hold plain
+// passwords, so this is admin-only; send X-MSS-Passphrase to seal the file.
+func (a *API) exportVault(w http.ResponseWriter, r *http.Request) {
+	if !a.isAdmin(r) { fail(w, http.StatusForbidden, errAdminOnly); return }
+	b, err := bundle.Export(r.Context(), a.repos)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	pass := r.Header.Get(passphraseHeader)
+	data, err := bundle.Encode(b, pass)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	name := "mss-export-" + time.Now().UTC().Format("20060102-150405") + ".json"
+	if pass != "" { name += ".enc" }
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(data)
+}
+
+// importVault merges an uploaded bundle. ?strategy=skip|overwrite|rename
+// resolves clashes by site key and account id; ?dryRun=1 only reports.
+func (a *API) importVault(w http.ResponseWriter, r *http.Request) {
+	if !a.isAdmin(r) { fail(w, http.StatusForbidden, errAdminOnly); return }
+	strategy, err := bundle.ParseStrategy(r.URL.Query().Get("strategy"))
+	if err != nil { fail(w, http.StatusBadRequest, err); return }
+	dry := r.URL.Query().Get("dryRun")
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil { fail(w, http.StatusBadRequest, err); return }
+	b, err := bundle.Decode(data, r.Header.Get(passphraseHeader))
+	if err != nil {
+		if errors.Is(err, bundle.ErrPassphraseRequired) || errors.Is(err, bundle.ErrBadPassphrase) { fail(w, http.StatusUnauthorized, err); return }
+		fail(w, http.StatusBadRequest, err); return
+	}
+	rep, err := bundle.Import(r.Context(), a.repos, b, bundle.Options{Strategy: strategy, DryRun: dry == "1" || dry == "true", Managed: a.opts.ManagedSites})
+	a.validators.Reset()
+	if err != nil {
+		if errors.Is(err, bundle.ErrInvalid) { fail(w, http.StatusBadRequest, err); return }
+		failStore(w, err); return
+	}
+	ok(w, rep)
+}
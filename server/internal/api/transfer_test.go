@@ -0,0 +1,30 @@
+package api_test
+
+import (
+	"net/http"
+	"testing"
+
+	"mss/internal/api"
+	"mss/internal/bundle"
+)
+
+func TestExportImport(t *testing.T) {
+	src := newClient(t, api.Options{})
+	src.site("gh", map[string]interface{}{"field": "email", "type": "email"})
+	src.account("gh", map[string]interface{}{"username": "alice", "password": "pw", "props": map[string]interface{}{"email": "a@x.io"}})
+	sealed := src.must(http.StatusOK, "GET", "/export", nil, "X-MSS-Passphrase", "secret").Body
+
+	dst := newClient(t, api.Options{})
+	dst.must(http.StatusUnauthorized, "POST", "/import", sealed)
+	dst.must(http.StatusUnauthorized, "POST", "/import", sealed, "X-MSS-Passphrase", "wrong")
+	dst.must(http.StatusBadRequest, "POST", "/import?strategy=merge", sealed, "X-MSS-Passphrase", "secret")
+	var rep bundle.Report
+	dst.must(http.StatusOK, "POST", "/import?dryRun=1", sealed, "X-MSS-Passphrase", "secret").into(t, &rep)
+	if !rep.DryRun || rep.Accounts.Created != 1 { t.Fatalf("dry run: %+v", rep) }
+	dst.must(http.StatusNotFound, "GET", "/sites/gh", nil)
+	dst.must(http.StatusOK, "POST", "/import", sealed, "X-MSS-Passphrase", "secret").into(t, &rep)
+	if rep.Sites.Created != 1 || rep.Schemas.Created != 1 || rep.Accounts.Created != 1 { t.Fatalf("import: %+v", rep) }
+	var list struct{ Accounts []map[string]interface{} }
+	dst.must(http.StatusOK, "GET", "/sites/gh/accounts", nil).into(t, &list)
+	if len(list.Accounts) != 1 || list.Accounts[0]["username"] != "alice" { t.Fatalf("accounts: %v", list.Accounts) }
+}
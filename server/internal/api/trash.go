@@ -0,0 +1,33 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var errAdminOnly = errors.New("admin token required")
+
+func (a *API) listTrash(w http.ResponseWriter, r *http.Request) {
+	t, err := a.repos.Trash.List(r.Context())
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	// trash is for picking what to restore; never echo secrets from it
+	for i := range t.Accounts { t.Accounts[i].Password = ""; t.Accounts[i].Extra = "" }
+	ok(w, t)
+}
+
+// purgeTrash permanently removes trashed rows. ?olderThan=<seconds> keeps
+// anything trashed more recently; without it the whole trash is emptied.
+func (a *API) purgeTrash(w http.ResponseWriter, r *http.Request) {
+	if !a.isAdmin(r) { fail(w, http.StatusForbidden, errAdminOnly); return }
+	before := time.Now().Unix() + 1
+	if v := r.URL.Query().Get("olderThan"); v != "" {
+		secs, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || secs < 0 { fail(w, http.StatusBadRequest, errors.New("olderThan must be a non-negative number of seconds")); return }
+		before = time.Now().Unix() - secs
+	}
+	res, err := a.repos.Trash.PurgeBefore(r.Context(), before)
+	if err != nil { fail(w, http.StatusInternalServerError, err); return }
+	ok(w, res)
+}
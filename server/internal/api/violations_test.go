@@ -0,0 +1,30 @@
+package api_test
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"mss/internal/api"
+	"mss/internal/validation"
+)
+
+func TestViolationDetails(t *testing.T) {
+	c := newClient(t, api.Options{})
+	c.site("gh",
+		map[string]interface{}{"field": "email", "type": "email", "required": true},
+		map[string]interface{}{"field": "seats", "type": "integer", "max": 5},
+		map[string]interface{}{"field": "plan", "type": "enum", "choices": []string{"free", "pro"}},
+	)
+	r := c.must(http.StatusBadRequest, "POST", "/sites/gh/accounts", map[string]interface{}{"username": "alice", "props": map[string]interface{}{"seats": 9, "plan": "gold"}})
+	got := map[string]string{}
+	for _, d := range r.Details {
+		if d.Message == "" { t.Errorf("%s: no message", d.Field) }
+		got[d.Field] = d.Code
+	}
+	want := map[string]string{"props.email": validation.CodeRequired, "props.seats": validation.CodeMax, "props.plan": validation.CodeChoice}
+	if !reflect.DeepEqual(got, want) { t.Fatalf("details: %+v", r.Details) }
+	for _, d := range r.Details {
+		if d.Field == "props.seats" && d.Expected != 5.0 { t.Errorf("seats expected %v", d.Expected) }
+	}
+}
@@ -0,0 +1,199 @@
+// Package backup takes online snapshots of the SQLite database, prunes them
+// by a daily/weekly retention policy and restores them after verification.
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"mss/internal/secret"
+)
+
+const (
+	namePrefix  = "mss-"
+	stampLayout = "20060102-150405"
+	plainExt    = ".db"
+	sealedExt   = ".db.enc"
+)
+
+// magic starts every encrypted backup; the rest is secret.Box output.
+var magic = []byte("MSSBAK1\n")
+
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+var (
+	ErrKeyRequired = errors.New("backup is encrypted; set MSS_BACKUP_KEY")
+	ErrBadKey      = errors.New("backup cannot be decrypted with MSS_BACKUP_KEY")
+	ErrNotBackup   = errors.New("not an mss backup or SQLite database")
+)
+
+// Info describes one backup file.
+type Info struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	CreatedAt int64  `json:"createdAt"`
+	Encrypted bool   `json:"encrypted"`
+	mod       time.Time
+}
+
+// Retention keeps the newest backup of each of the last Daily days and
+// Weekly ISO weeks that have one. Zero for both disables pruning.
+type Retention struct {
+	Daily  int
+	Weekly int
+}
+
+type Manager struct {
+	db   *sqlx.DB
+	dir  string
+	box  *secret.Box // nil writes plain files
+	keep Retention
+	mu   sync.Mutex
+}
+
+func NewManager(db *sqlx.DB, dir string, box *secret.Box, keep Retention) *Manager {
+	return &Manager{db: db, dir: dir, box: box, keep: keep}
+}
+
+func (m *Manager) Dir() string { return m.dir }
+
+// Create writes a consistent copy of the live database with VACUUM INTO,
+// which is safe under WAL and needs no downtime.
+func (m *Manager) Create(ctx context.Context) (*Info, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := os.MkdirAll(m.dir, 0o700); err != nil { return nil, err }
+	ext := plainExt
+	if m.box != nil { ext = sealedExt }
+	base := namePrefix + time.Now().UTC().Format(stampLayout)
+	name := base + ext
+	for n := 2; exists(filepath.Join(m.dir, name)); n++ { name = fmt.Sprintf("%s-%d%s", base, n, ext) }
+	tmp := filepath.Join(m.dir, "."+name+".tmp")
+	_ = os.Remove(tmp)
+	if _, err := m.db.ExecContext(ctx, `VACUUM INTO ?`, tmp); err != nil { _ = os.Remove(tmp); return nil, fmt.Errorf("vacuum into: %w", err) }
+	if m.box != nil {
+		if err := sealFile(tmp, m.box); err != nil { _ = os.Remove(tmp); return nil, err }
+	}
+	_ = os.Chmod(tmp, 0o600)
+	path := filepath.Join(m.dir, name)
+	if err := os.Rename(tmp, path); err != nil { _ = os.Remove(tmp); return nil, err }
+	fi, err := os.Stat(path)
+	if err != nil { return nil, err }
+	return infoOf(fi), nil
+}
+
+// List returns the backups in the directory, newest first.
+func (m *Manager) List() ([]Info, error) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		if os.IsNotExist(err) { return []Info{}, nil }
+		return nil, err
+	}
+	out := []Info{}
+	for _, e := range entries {
+		if e.IsDir() || !isBackupName(e.Name()) { continue }
+		fi, err := e.Info()
+		if err != nil { continue }
+		out = append(out, *infoOf(fi))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].mod.After(out[j].mod) })
+	return out, nil
+}
+
+// Prune deletes backups outside the retention policy and returns them.
+// The newest backup is always kept.
+func (m *Manager) Prune() ([]Info, error) {
+	if m.keep.Daily <= 0 && m.keep.Weekly <= 0 { return nil, nil }
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	all, err := m.List()
+	if err != nil { return nil, err }
+	days := map[string]bool{}
+	weeks := map[string]bool{}
+	var removed []Info
+	for i, b := range all {
+		t := time.Unix(b.CreatedAt, 0).UTC()
+		keep := i == 0
+		if d := t.Format("2006-01-02"); !days[d] && len(days) < m.keep.Daily {
+			days[d] = true
+			keep = true
+		}
+		y, wk := t.ISOWeek()
+		if w := fmt.Sprintf("%d-%02d", y, wk); !weeks[w] && len(weeks) < m.keep.Weekly {
+			weeks[w] = true
+			keep = true
+		}
+		if keep { continue }
+		if err := os.Remove(filepath.Join(m.dir, b.Name)); err != nil { return removed, err }
+		removed = append(removed, b)
+	}
+	return removed, nil
+}
+
+// Run takes a backup every interval and prunes old ones. A backup is taken
+// at start when the newest one is older than interval.
+func (m *Manager) Run(ctx context.Context, interval time.Duration) {
+	run := func() {
+		b, err := m.Create(ctx)
+		if err != nil { log.Printf("backup: failed: %v", err); return }
+		log.Printf("backup: wrote %s (%d bytes)", b.Name, b.Size)
+		removed, err := m.Prune()
+		if err != nil { log.Printf("backup: prune failed: %v", err) }
+		for _, r := range removed { log.Printf("backup: pruned %s", r.Name) }
+	}
+	if list, err := m.List(); err == nil && (len(list) == 0 || time.Since(time.Unix(list[0].CreatedAt, 0)) >= interval) { run() }
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			run()
+		}
+	}
+}
+
+func sealFile(path string, box *secret.Box) error {
+	data, err := os.ReadFile(path)
+	if err != nil { return err }
+	return os.WriteFile(path, append(append([]byte{}, magic...), box.Seal(data)...), 0o600)
+}
+
+// openFile returns the SQLite bytes of a plain or encrypted backup.
+func openFile(path string, box *secret.Box) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil { return nil, err }
+	if bytes.HasPrefix(data, magic) {
+		if box == nil { return nil, ErrKeyRequired }
+		plain, err := box.Open(data[len(magic):])
+		if err != nil { return nil, ErrBadKey }
+		data = plain
+	}
+	if !bytes.HasPrefix(data, sqliteHeader) { return nil, ErrNotBackup }
+	return data, nil
+}
+
+func isBackupName(name string) bool {
+	return strings.HasPrefix(name, namePrefix) && (strings.HasSuffix(name, plainExt) || strings.HasSuffix(name, sealedExt))
+}
+
+func infoOf(fi os.FileInfo) *Info {
+	return &Info{Name: fi.Name(), Size: fi.Size(), CreatedAt: fi.ModTime().Unix(), Encrypted: strings.HasSuffix(fi.Name(), sealedExt), mod: fi.ModTime()}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
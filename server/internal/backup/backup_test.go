@@ -0,0 +1,94 @@
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"mss/internal/backup"
+	"mss/internal/migrate"
+	"mss/internal/secret"
+	"mss/internal/store"
+)
+
+func TestCreateAndRestore(t *testing.T) {
+	ctx, dir := context.Background(), t.TempDir()
+	dbPath := filepath.Join(dir, "mss.db")
+	db, err := store.Open(dbPath)
+	if err != nil { t.Fatal(err) }
+	defer db.Close()
+	if _, err := migrate.Apply(ctx, db, migrate.Options{}); err != nil { t.Fatal(err) }
+	if _, err := db.Exec(`INSERT INTO sites (key, name) VALUES ('gh', 'GitHub')`); err != nil { t.Fatal(err) }
+	box, err := secret.NewBox(bytes.Repeat([]byte{1}, 32))
+	if err != nil { t.Fatal(err) }
+	other, err := secret.NewBox(bytes.Repeat([]byte{2}, 32))
+	if err != nil { t.Fatal(err) }
+
+	plain, err := backup.NewManager(db, filepath.Join(dir, "plain"), nil, backup.Retention{}).Create(ctx)
+	if err != nil { t.Fatal(err) }
+	sealedMgr := backup.NewManager(db, filepath.Join(dir, "sealed"), box, backup.Retention{})
+	sealed, err := sealedMgr.Create(ctx)
+	if err != nil { t.Fatal(err) }
+	if plain.Encrypted || !sealed.Encrypted { t.Fatalf("encrypted: %+v %+v", plain, sealed) }
+	src := filepath.Join(sealedMgr.Dir(), sealed.Name)
+	if data, _ := os.ReadFile(src); bytes.Contains(data, []byte("GitHub")) { t.Fatal("sealed backup holds plain text") }
+
+	target := filepath.Join(dir, "restored.db")
+	if _, err := backup.Restore(ctx, src, target, nil, true); !errors.Is(err, backup.ErrKeyRequired) { t.Fatalf("no key: %v", err) }
+	if _, err := backup.Restore(ctx, src, target, other, true); !errors.Is(err, backup.ErrBadKey) { t.Fatalf("wrong key: %v", err) }
+	junk := filepath.Join(dir, "junk")
+	if err := os.WriteFile(junk, []byte("hello"), 0o600); err != nil { t.Fatal(err) }
+	if _, err := backup.Restore(ctx, junk, target, box, true); !errors.Is(err, backup.ErrNotBackup) { t.Fatalf("junk: %v", err) }
+
+	all, err := migrate.Versions()
+	if err != nil { t.Fatal(err) }
+	res, err := backup.Restore(ctx, src, target, box, true)
+	if err != nil { t.Fatal(err) }
+	if res.SchemaVersion != all[len(all)-1] || len(res.Pending) != 0 { t.Fatalf("verify: %+v", res) }
+	if _, err := os.Stat(target); !os.IsNotExist(err) { t.Fatalf("verify only wrote %s", target) }
+
+	// restoring over an existing database keeps the old one aside
+	if err := os.WriteFile(target, []byte("old"), 0o600); err != nil { t.Fatal(err) }
+	res, err = backup.Restore(ctx, filepath.Join(dir, "plain", plain.Name), target, nil, false)
+	if err != nil { t.Fatal(err) }
+	if old, err := os.ReadFile(res.Previous); err != nil || string(old) != "old" { t.Fatalf("previous %q: %q %v", res.Previous, old, err) }
+	restored, err := store.Open(target)
+	if err != nil { t.Fatal(err) }
+	defer restored.Close()
+	var name string
+	if err := restored.Get(&name, `SELECT name FROM sites WHERE key = 'gh'`); err != nil || name != "GitHub" { t.Fatalf("restored site: %q %v", name, err) }
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	day := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC) // a Wednesday
+	name := func(at time.Time) string { return "mss-" + at.Format("20060102-150405") + ".db" }
+	// one backup a day for three weeks, two on the newest day
+	for i := 0; i < 21; i++ { touch(t, dir, name(day.AddDate(0, 0, -i)), day.AddDate(0, 0, -i)) }
+	touch(t, dir, name(day.Add(-time.Hour)), day.Add(-time.Hour))
+	touch(t, dir, "notes.txt", day.AddDate(0, 0, -30))
+	m := backup.NewManager(nil, dir, nil, backup.Retention{Daily: 3, Weekly: 2})
+	removed, err := m.Prune()
+	if err != nil { t.Fatal(err) }
+	if len(removed) != 18 { t.Fatalf("removed %d", len(removed)) }
+	left, err := m.List()
+	if err != nil { t.Fatal(err) }
+	// the newest of each of the last three days, plus last week's Sunday
+	var got []string
+	for _, b := range left { got = append(got, b.Name) }
+	want := []string{name(day), name(day.AddDate(0, 0, -1)), name(day.AddDate(0, 0, -2)), name(day.AddDate(0, 0, -3))}
+	if !reflect.DeepEqual(got, want) { t.Fatalf("left %q, want %q", got, want) }
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil { t.Fatal("prune removed a file that is not a backup") }
+}
+
+func touch(t *testing.T, dir, name string, mod time.Time) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("x"), 0o600); err != nil { t.Fatal(err) }
+	if err := os.Chtimes(path, mod, mod); err != nil { t.Fatal(err) }
+}
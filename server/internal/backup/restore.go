@@ -0,0 +1,81 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "modernc.org/sqlite"
+
+	"mss/internal/migrate"
+	"mss/internal/secret"
+)
+
+// RestoreResult reports a verified (and possibly installed) backup.
+type RestoreResult struct {
+	// SchemaVersion is the newest migration applied in the backup.
+	SchemaVersion string `json:"schemaVersion"`
+	// Pending lists migrations the backup predates; they run on the next
+	// start with MSS_AUTO_MIGRATE=1.
+	Pending []string `json:"pending"`
+	// Previous is where the replaced database was moved, if there was one.
+	Previous string `json:"previous,omitempty"`
+}
+
+// Restore verifies src (integrity check and a schema this binary knows) and,
+// unless verifyOnly, swaps it in for dbPath. The old database and its WAL
+// files are kept next to it with a ".pre-restore-<time>" suffix. The server
+// must not be running.
+func Restore(ctx context.Context, src, dbPath string, box *secret.Box, verifyOnly bool) (*RestoreResult, error) {
+	data, err := openFile(src, box)
+	if err != nil { return nil, err }
+	tmp := dbPath + ".restore-tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil { return nil, err }
+	defer func() { _ = os.Remove(tmp) }()
+	res, err := verify(ctx, tmp)
+	if err != nil { return nil, err }
+	if verifyOnly { return res, nil }
+
+	if exists(dbPath) {
+		res.Previous = dbPath + ".pre-restore-" + time.Now().UTC().Format(stampLayout)
+		if err := os.Rename(dbPath, res.Previous); err != nil { return nil, err }
+		for _, suffix := range []string{"-wal", "-shm"} {
+			if exists(dbPath + suffix) {
+				if err := os.Rename(dbPath+suffix, res.Previous+suffix); err != nil { return nil, err }
+			}
+		}
+	}
+	if err := os.Rename(tmp, dbPath); err != nil { return nil, err }
+	return res, nil
+}
+
+func verify(ctx context.Context, path string) (*RestoreResult, error) {
+	db, err := sqlx.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil { return nil, err }
+	defer func() { _ = db.Close() }()
+
+	var problems []string
+	if err := db.SelectContext(ctx, &problems, `PRAGMA integrity_check`); err != nil { return nil, fmt.Errorf("integrity check: %w", err) }
+	if len(problems) != 1 || problems[0] != "ok" { return nil, fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; ")) }
+
+	var applied []string
+	if err := db.SelectContext(ctx, &applied, `SELECT version FROM schema_migrations ORDER BY version`); err != nil { return nil, fmt.Errorf("read schema version: %w", err) }
+	known, err := migrate.Versions()
+	if err != nil { return nil, err }
+	have := map[string]bool{}
+	for _, v := range known { have[v] = true }
+	done := map[string]bool{}
+	for _, v := range applied {
+		if !have[v] { return nil, fmt.Errorf("backup has schema version %s, which this binary does not know; restore it with a newer mss-server", v) }
+		done[v] = true
+	}
+	res := &RestoreResult{Pending: []string{}}
+	if len(applied) > 0 { res.SchemaVersion = applied[len(applied)-1] }
+	for _, v := range known {
+		if !done[v] { res.Pending = append(res.Pending, v) }
+	}
+	return res, nil
+}
@@ -0,0 +1,184 @@
+// Package bundle moves a whole vault (sites, field schemas, accounts and
+// active accounts) between instances as a versioned JSON document, optionally
+// sealed with a passphrase.
+package bundle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"mss/internal/secret"
+	"mss/internal/store"
+)
+
+const (
+	Format          = "mss-bundle"
+	EncryptedFormat = "mss-bundle+enc"
+	Version         = 1
+)
+
+var (
+	ErrPassphraseRequired = errors.New("bundle is encrypted: passphrase required")
+	ErrBadPassphrase      = errors.New("bundle could not be decrypted: wrong passphrase or corrupted data")
+	// ErrInvalid wraps every error caused by the bundle's content rather than the store.
+	ErrInvalid = errors.New("invalid bundle")
+)
+
+// Bundle is the plain export document. Only live (non-trashed) rows are
+// included; timestamps and versions are not carried over.
+type Bundle struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	ExportedAt int64     `json:"exportedAt"`
+	Sites      []Site    `json:"sites"`
+	Schemas    []Field   `json:"schemas"`
+	Accounts   []Account `json:"accounts"`
+	Active     []Active  `json:"active"`
+}
+
+type Site struct {
+	Key      string `json:"key"`
+	Name     string `json:"name"`
+	LoginURL string `json:"loginUrl,omitempty"`
+	// AdditionalProps is omitted for the default, allow.
+	AdditionalProps string `json:"additionalProps,omitempty"`
+	// AccountRules are the username and password rules, if any.
+	AccountRules json.RawMessage `json:"accountRules,omitempty"`
+}
+
+type Field struct {
+	SiteKey   string          `json:"siteKey"`
+	Field     string          `json:"field"`
+	Type      string          `json:"type"`
+	Required  bool            `json:"required,omitempty"`
+	Default   string          `json:"default,omitempty"`
+	Regex     string          `json:"regex,omitempty"`
+	Choices   json.RawMessage `json:"choices,omitempty"`
+	Secret    bool            `json:"secret,omitempty"`
+	Order     int             `json:"order,omitempty"`
+	UIHint    string          `json:"uiHint,omitempty"`
+	Min       *float64        `json:"min,omitempty"`
+	Max       *float64        `json:"max,omitempty"`
+	MinLength *int            `json:"minLength,omitempty"`
+	MaxLength *int            `json:"maxLength,omitempty"`
+	Unique    bool            `json:"unique,omitempty"`
+	Items     json.RawMessage `json:"items,omitempty"`
+	Fields    json.RawMessage `json:"fields,omitempty"`
+}
+
+type Account struct {
+	ID       string                 `json:"id"`
+	SiteKey  string                 `json:"siteKey"`
+	Username string                 `json:"username"`
+	Password string                 `json:"password,omitempty"`
+	Props    map[string]interface{} `json:"props,omitempty"`
+}
+
+type Active struct {
+	SiteKey   string `json:"siteKey"`
+	AccountID string `json:"accountId"`
+}
+
+// sealed is the on-disk shape of an encrypted bundle: the plain document,
+// AES-256-GCM sealed under an argon2id-derived key.
+type sealed struct {
+	Format  string     `json:"format"`
+	Version int        `json:"version"`
+	KDF     secret.KDF `json:"kdf"`
+	Cipher  string     `json:"cipher"`
+	Data    []byte     `json:"data"`
+}
+
+// Export reads every live row from repos into a Bundle.
+func Export(ctx context.Context, repos store.Repos) (*Bundle, error) {
+	b := &Bundle{Format: Format, Version: Version, ExportedAt: time.Now().Unix(),
+		Sites: []Site{}, Schemas: []Field{}, Accounts: []Account{}, Active: []Active{}}
+	sites, err := repos.Sites.List(ctx)
+	if err != nil { return nil, err }
+	for _, s := range sites {
+		site := Site{Key: s.Key, Name: s.Name, LoginURL: s.LoginURL}
+		if s.AdditionalProps != store.PropsAllow { site.AdditionalProps = s.AdditionalProps }
+		if s.AccountRules != "" && s.AccountRules != "{}" { site.AccountRules = json.RawMessage(s.AccountRules) }
+		b.Sites = append(b.Sites, site)
+		fields, err := repos.Schemas.List(ctx, s.Key)
+		if err != nil { return nil, err }
+		for _, f := range fields { b.Schemas = append(b.Schemas, fieldFromStore(f)) }
+		accs, err := repos.Accounts.List(ctx, s.Key)
+		if err != nil { return nil, err }
+		for _, a := range accs {
+			acc := Account{ID: a.ID, SiteKey: a.SiteKey, Username: a.Username, Password: a.Password}
+			if a.Extra != "" {
+				if err := json.Unmarshal([]byte(a.Extra), &acc.Props); err != nil { return nil, fmt.Errorf("account %s: bad extra: %w", a.ID, err) }
+			}
+			b.Accounts = append(b.Accounts, acc)
+		}
+		act, err := repos.Active.Get(ctx, s.Key)
+		if err != nil { return nil, err }
+		if act.AccountID != nil { b.Active = append(b.Active, Active{SiteKey: s.Key, AccountID: *act.AccountID}) }
+	}
+	return b, nil
+}
+
+// Encode serialises b, sealing it when passphrase is non-empty.
+func Encode(b *Bundle, passphrase string) ([]byte, error) {
+	plain, err := json.MarshalIndent(b, "", "  ")
+	if err != nil { return nil, err }
+	if passphrase == "" { return plain, nil }
+	kdf := secret.NewKDF()
+	box, err := secret.PassphraseBox(passphrase, kdf)
+	if err != nil { return nil, err }
+	return json.MarshalIndent(sealed{Format: EncryptedFormat, Version: Version, KDF: kdf, Cipher: "aes-256-gcm", Data: box.Seal(plain)}, "", "  ")
+}
+
+// Decode parses a plain or sealed bundle. Sealed bundles need passphrase.
+func Decode(data []byte, passphrase string) (*Bundle, error) {
+	var head struct {
+		Format  string `json:"format"`
+		Version int    `json:"version"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil { return nil, fmt.Errorf("%w: %v", ErrInvalid, err) }
+	if head.Version != Version { return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalid, head.Version) }
+	switch head.Format {
+	case Format:
+	case EncryptedFormat:
+		if passphrase == "" { return nil, ErrPassphraseRequired }
+		var s sealed
+		if err := json.Unmarshal(data, &s); err != nil { return nil, fmt.Errorf("%w: %v", ErrInvalid, err) }
+		if s.Cipher != "aes-256-gcm" { return nil, fmt.Errorf("%w: unsupported cipher %q", ErrInvalid, s.Cipher) }
+		box, err := secret.PassphraseBox(passphrase, s.KDF)
+		if err != nil { return nil, err }
+		plain, err := box.Open(s.Data)
+		if err != nil { return nil, ErrBadPassphrase }
+		return Decode(plain, "")
+	default:
+		return nil, fmt.Errorf("%w: unsupported format %q", ErrInvalid, head.Format)
+	}
+	var b Bundle
+	if err := json.Unmarshal(data, &b); err != nil { return nil, fmt.Errorf("%w: %v", ErrInvalid, err) }
+	return &b, nil
+}
+
+func fieldFromStore(f store.SiteFieldSchema) Field {
+	out := Field{SiteKey: f.SiteKey, Field: f.Field, Type: f.Type, Required: f.Required != 0, Default: f.DefaultValue,
+		Regex: f.Regex, Secret: f.Secret != 0, Order: f.Order, UIHint: f.UIHint,
+		Min: f.Min, Max: f.Max, MinLength: f.MinLength, MaxLength: f.MaxLength, Unique: f.Unique != 0}
+	if f.Choices != "" && json.Valid([]byte(f.Choices)) { out.Choices = json.RawMessage(f.Choices) }
+	if f.Items != "" && json.Valid([]byte(f.Items)) { out.Items = json.RawMessage(f.Items) }
+	if f.Fields != "" && json.Valid([]byte(f.Fields)) { out.Fields = json.RawMessage(f.Fields) }
+	return out
+}
+
+func (f Field) toStore(siteKey string) store.SiteFieldSchema {
+	out := store.SiteFieldSchema{SiteKey: siteKey, Field: f.Field, Type: f.Type, DefaultValue: f.Default,
+		Regex: f.Regex, Order: f.Order, UIHint: f.UIHint, Min: f.Min, Max: f.Max, MinLength: f.MinLength, MaxLength: f.MaxLength}
+	if f.Required { out.Required = 1 }
+	if f.Secret { out.Secret = 1 }
+	if f.Unique { out.Unique = 1 }
+	if len(f.Choices) > 0 && string(f.Choices) != "null" { out.Choices = string(f.Choices) }
+	if len(f.Items) > 0 && string(f.Items) != "null" { out.Items = string(f.Items) }
+	if len(f.Fields) > 0 && string(f.Fields) != "null" { out.Fields = string(f.Fields) }
+	return out
+}
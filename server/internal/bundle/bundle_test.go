@@ -0,0 +1,135 @@
+package bundle_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"mss/internal/bundle"
+	"mss/internal/store"
+)
+
+func seed(t *testing.T) store.Repos {
+	t.Helper()
+	ctx, r := context.Background(), store.NewMemory(store.RevisionSecrets{})
+	must := func(err error) { t.Helper(); if err != nil { t.Fatal(err) } }
+	must(r.Sites.Create(ctx, &store.Site{Key: "gh", Name: "GitHub", AdditionalProps: store.PropsReject}))
+	must(r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "gh", Field: "email", Type: "email", Required: 1, Unique: 1}, 0))
+	must(r.Accounts.Create(ctx, &store.Account{ID: "a1", SiteKey: "gh", Username: "alice", Password: "pw", Extra: `{"email":"a@x.io"}`}))
+	id := "a1"
+	must(r.Active.Set(ctx, "gh", &id, 0))
+	return r
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	b, err := bundle.Export(ctx, seed(t))
+	if err != nil { t.Fatal(err) }
+	data, err := bundle.Encode(b, "secret")
+	if err != nil { t.Fatal(err) }
+	if _, err := bundle.Decode(data, ""); !errors.Is(err, bundle.ErrPassphraseRequired) { t.Fatalf("no passphrase: %v", err) }
+	if _, err := bundle.Decode(data, "wrong"); !errors.Is(err, bundle.ErrBadPassphrase) { t.Fatalf("wrong passphrase: %v", err) }
+	got, err := bundle.Decode(data, "secret")
+	if err != nil { t.Fatal(err) }
+	dst := store.NewMemory(store.RevisionSecrets{})
+	rep, err := bundle.Import(ctx, dst, got, bundle.Options{})
+	if err != nil { t.Fatal(err) }
+	want := bundle.Counts{Created: 1}
+	if rep.Sites != want || rep.Schemas != want || rep.Accounts != want || rep.Active != want { t.Fatalf("report: %+v", rep) }
+	again, err := bundle.Export(ctx, dst)
+	if err != nil { t.Fatal(err) }
+	again.ExportedAt = b.ExportedAt
+	if !reflect.DeepEqual(again, b) { t.Fatalf("round trip:\n got %+v\nwant %+v", again, b) }
+}
+
+func TestStrategies(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		strategy bundle.Strategy
+		sites    bundle.Counts
+		accounts bundle.Counts
+		username string
+	}{
+		{bundle.Skip, bundle.Counts{Skipped: 1}, bundle.Counts{Skipped: 1}, "alice"},
+		{bundle.Overwrite, bundle.Counts{Updated: 1}, bundle.Counts{Updated: 1}, "bob"},
+		{bundle.Rename, bundle.Counts{Renamed: 1}, bundle.Counts{Renamed: 1}, "alice"},
+	} {
+		r := seed(t)
+		b, err := bundle.Export(ctx, r)
+		if err != nil { t.Fatal(err) }
+		b.Sites[0].Name = "GitHub 2"
+		b.Accounts[0].Username = "bob"
+		rep, err := bundle.Import(ctx, r, b, bundle.Options{Strategy: tc.strategy})
+		if err != nil { t.Fatalf("%s: %v", tc.strategy, err) }
+		if rep.Sites != tc.sites || rep.Accounts != tc.accounts { t.Errorf("%s: sites %+v accounts %+v", tc.strategy, rep.Sites, rep.Accounts) }
+		acc, err := r.Accounts.Get(ctx, "gh", "a1")
+		if err != nil || acc == nil { t.Fatalf("%s: %v", tc.strategy, err) }
+		if acc.Username != tc.username { t.Errorf("%s: username %q, want %q", tc.strategy, acc.Username, tc.username) }
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+	b, err := bundle.Export(ctx, seed(t))
+	if err != nil { t.Fatal(err) }
+	dst := store.NewMemory(store.RevisionSecrets{})
+	rep, err := bundle.Import(ctx, dst, b, bundle.Options{DryRun: true})
+	if err != nil { t.Fatal(err) }
+	if !rep.DryRun || rep.Accounts.Created != 1 { t.Fatalf("report: %+v", rep) }
+	if s, _ := dst.Sites.Get(ctx, "gh"); s != nil { t.Fatal("dry run wrote the site") }
+}
+
+func TestInvalidAccountsAreSkipped(t *testing.T) {
+	ctx := context.Background()
+	r := seed(t)
+	b := &bundle.Bundle{
+		Sites: []bundle.Site{{Key: "gh", Name: "GitHub"}},
+		Accounts: []bundle.Account{
+			{ID: "a2", SiteKey: "gh", Username: "carol", Props: map[string]interface{}{"email": "c@x.io"}},
+			{ID: "a3", SiteKey: "gh", Username: "dave"},
+			{ID: "a4", SiteKey: "gh", Username: "erin", Props: map[string]interface{}{"email": "a@x.io"}},
+			{ID: "a5", SiteKey: "gh", Username: "fred", Props: map[string]interface{}{"email": "c@x.io"}},
+			{ID: "a6", SiteKey: "gh", Username: "gina", Props: map[string]interface{}{"email": "g@x.io", "nick": "g"}},
+		},
+		Active: []bundle.Active{{SiteKey: "gh", AccountID: "a3"}},
+	}
+	rep, err := bundle.Import(ctx, r, b, bundle.Options{Strategy: bundle.Overwrite})
+	if err != nil { t.Fatal(err) }
+	if rep.Accounts != (bundle.Counts{Created: 1, Skipped: 4}) { t.Fatalf("accounts: %+v", rep.Accounts) }
+	skipped := map[string]bool{}
+	for _, c := range rep.Conflicts {
+		if c.Kind == "account" && c.Action == "skipped" && c.Reason != "" { skipped[c.Key] = true }
+	}
+	for _, id := range []string{"a3", "a4", "a5", "a6"} {
+		if !skipped[id] { t.Errorf("%s not reported as skipped: %+v", id, rep.Conflicts) }
+		if acc, _ := r.Accounts.Get(ctx, "gh", id); acc != nil { t.Errorf("%s was written", id) }
+	}
+	if rep.Active != (bundle.Counts{Skipped: 1}) { t.Errorf("active: %+v", rep.Active) }
+}
+
+func TestManagedSites(t *testing.T) {
+	ctx := context.Background()
+	for _, mode := range []string{"reject", "flag"} {
+		r := seed(t)
+		if err := r.Managed.Put(ctx, &store.ManagedSite{SiteKey: "gh", Source: "sites.yaml"}); err != nil { t.Fatal(err) }
+		b, err := bundle.Export(ctx, r)
+		if err != nil { t.Fatal(err) }
+		b.Sites[0].Name = "Changed"
+		b.Schemas = append(b.Schemas, bundle.Field{SiteKey: "gh", Field: "team", Type: "string"})
+		b.Accounts[0].Username = "bob"
+		rep, err := bundle.Import(ctx, r, b, bundle.Options{Strategy: bundle.Overwrite, Managed: mode})
+		if err != nil { t.Fatalf("%s: %v", mode, err) }
+		site, _ := r.Sites.Get(ctx, "gh")
+		team, _ := r.Schemas.Get(ctx, "gh", "team")
+		acc, _ := r.Accounts.Get(ctx, "gh", "a1")
+		if acc.Username != "bob" { t.Errorf("%s: accounts of a managed site must still import", mode) }
+		if mode == "reject" {
+			if site.Name != "GitHub" || team != nil { t.Errorf("reject: site %+v, team %+v", site, team) }
+			if rep.Sites.Skipped != 1 || rep.Schemas.Skipped != 2 || len(rep.Warnings) != 0 { t.Errorf("reject: %+v", rep) }
+			continue
+		}
+		if site.Name != "Changed" || team == nil { t.Errorf("flag: site %+v, team %+v", site, team) }
+		if len(rep.Warnings) != 1 { t.Errorf("flag: warnings %q", rep.Warnings) }
+	}
+}
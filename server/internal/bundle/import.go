@@ -0,0 +1,360 @@
+package bundle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"mss/internal/store"
+	"mss/internal/validation"
+)
+
+// Strategy decides what happens when an imported site key or account id
+// already exists in the target store.
+type Strategy string
+
+const (
+	// Skip keeps the existing row and drops the imported one.
+	Skip Strategy = "skip"
+	// Overwrite replaces the existing row with the imported one.
+	Overwrite Strategy = "overwrite"
+	// Rename imports the row under a fresh site key or account id.
+	Rename Strategy = "rename"
+)
+
+// ParseStrategy validates s; empty means Skip.
+func ParseStrategy(s string) (Strategy, error) {
+	switch Strategy(s) {
+	case "":
+		return Skip, nil
+	case Skip, Overwrite, Rename:
+		return Strategy(s), nil
+	}
+	return "", fmt.Errorf("unknown strategy %q (want skip, overwrite or rename)", s)
+}
+
+type Options struct {
+	Strategy Strategy
+	// DryRun applies the bundle inside a transaction that is always rolled
+	// back, so the report is exact but nothing is written.
+	DryRun bool
+	// Managed decides what overwriting a site owned by declarative config
+	// does: "flag" writes it and reports a warning, anything else keeps the
+	// site and its schema as the config left them.
+	Managed string
+}
+
+// Conflict records one existing row the import collided with and what was done.
+type Conflict struct {
+	Kind      string `json:"kind"` // site, schema, account, active
+	SiteKey   string `json:"siteKey"`
+	Key       string `json:"key"` // site key, field name or account id
+	Action    string `json:"action"` // skipped, overwritten, renamed
+	RenamedTo string `json:"renamedTo,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type Counts struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+	Renamed int `json:"renamed"`
+}
+
+type Report struct {
+	Strategy  Strategy   `json:"strategy"`
+	DryRun    bool       `json:"dryRun"`
+	Sites     Counts     `json:"sites"`
+	Schemas   Counts     `json:"schemas"`
+	Accounts  Counts     `json:"accounts"`
+	Active    Counts     `json:"active"`
+	Conflicts []Conflict `json:"conflicts"`
+	Warnings  []string   `json:"warnings,omitempty"`
+}
+
+var errDryRun = errors.New("dry run")
+
+// Import merges b into repos in a single transaction; any error rolls back
+// the whole import.
+func Import(ctx context.Context, repos store.Repos, b *Bundle, opts Options) (*Report, error) {
+	if opts.Strategy == "" { opts.Strategy = Skip }
+	if err := b.check(); err != nil { return nil, fmt.Errorf("%w: %v", ErrInvalid, err) }
+	var rep *Report
+	err := repos.Tx.InTx(ctx, func(tx store.Repos) error {
+		im := &importer{tx: tx, opts: opts, rep: &Report{Strategy: opts.Strategy, DryRun: opts.DryRun, Conflicts: []Conflict{}},
+			sites: map[string]string{}, accounts: map[string]string{}, batches: map[string]*validation.Batch{}, flagged: map[string]bool{}}
+		if err := im.run(ctx, b); err != nil { return err }
+		rep = im.rep
+		if opts.DryRun { return errDryRun }
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) { return nil, err }
+	return rep, nil
+}
+
+// check rejects bundles that are not self-consistent before anything is written.
+func (b *Bundle) check() error {
+	sites := make(map[string]bool, len(b.Sites))
+	for i, s := range b.Sites {
+		if s.Key == "" { return fmt.Errorf("sites[%d]: key required", i) }
+		if sites[s.Key] { return fmt.Errorf("sites[%d]: duplicate key %q", i, s.Key) }
+		sites[s.Key] = true
+		switch s.AdditionalProps {
+		case "", store.PropsAllow, store.PropsWarn, store.PropsReject:
+		default:
+			return fmt.Errorf("sites[%d]: additionalProps %q must be allow, warn or reject", i, s.AdditionalProps)
+		}
+		if len(s.AccountRules) > 0 {
+			ar, err := validation.ParseAccountRules(string(s.AccountRules))
+			if err == nil { err = ar.Check() }
+			if err != nil { return fmt.Errorf("sites[%d]: %v", i, err) }
+			b.Sites[i].AccountRules = json.RawMessage(ar.Encode())
+		}
+	}
+	for i, f := range b.Schemas {
+		if !sites[f.SiteKey] { return fmt.Errorf("schemas[%d]: unknown site %q", i, f.SiteKey) }
+		if f.Field == "" { return fmt.Errorf("schemas[%d]: field required", i) }
+		if err := validation.CheckField(f.toStore(f.SiteKey)); err != nil { return fmt.Errorf("schemas[%d]: %v", i, err) }
+	}
+	ids := make(map[string]bool, len(b.Accounts))
+	for i, a := range b.Accounts {
+		if !sites[a.SiteKey] { return fmt.Errorf("accounts[%d]: unknown site %q", i, a.SiteKey) }
+		if a.ID == "" { continue }
+		if ids[a.ID] { return fmt.Errorf("accounts[%d]: duplicate id %q", i, a.ID) }
+		ids[a.ID] = true
+	}
+	for i, a := range b.Active {
+		if !sites[a.SiteKey] { return fmt.Errorf("active[%d]: unknown site %q", i, a.SiteKey) }
+	}
+	return nil
+}
+
+type importer struct {
+	tx   store.Repos
+	opts Options
+	rep  *Report
+	// sites maps bundle site keys to target keys ("" = site was not imported).
+	sites map[string]string
+	// accounts maps "site\x00id" from the bundle to the target account id.
+	accounts map[string]string
+	// batches validates the accounts of each target site, loaded once the
+	// site's schemas are imported.
+	batches map[string]*validation.Batch
+	// flagged holds managed sites already warned about.
+	flagged map[string]bool
+}
+
+func (im *importer) conflict(c Conflict) { im.rep.Conflicts = append(im.rep.Conflicts, c) }
+
+// writable applies Options.Managed before a site or schema write to siteKey.
+// A refused write is recorded as a skipped conflict.
+func (im *importer) writable(ctx context.Context, kind, siteKey, key string) (bool, error) {
+	m, err := im.tx.Managed.Get(ctx, siteKey)
+	if err != nil || m == nil { return err == nil, err }
+	if im.opts.Managed == "flag" {
+		if !im.flagged[siteKey] {
+			im.flagged[siteKey] = true
+			im.rep.Warnings = append(im.rep.Warnings, fmt.Sprintf("site %s is managed by %s; this change is drift until the config is updated", siteKey, m.Source))
+		}
+		return true, nil
+	}
+	im.conflict(Conflict{Kind: kind, SiteKey: siteKey, Key: key, Action: "skipped", Reason: fmt.Sprintf("site is managed by %s; change the config and re-apply it", m.Source)})
+	return false, nil
+}
+
+// valid checks row against the rules of its site. Invalid accounts are
+// skipped and reported; the error is for failures to read the store.
+func (im *importer) valid(ctx context.Context, row store.Account, key string, props map[string]interface{}) (bool, error) {
+	b := im.batches[row.SiteKey]
+	if b == nil {
+		v, err := validation.Load(ctx, im.tx, row.SiteKey)
+		if err != nil { return false, err }
+		b = v.Batch()
+		im.batches[row.SiteKey] = b
+	}
+	if props == nil { props = map[string]interface{}{} }
+	warnings, err := b.ValidateAccount(ctx, im.tx, row, props)
+	var verrs validation.Errors
+	if errors.As(err, &verrs) {
+		im.rep.Accounts.Skipped++
+		im.conflict(Conflict{Kind: "account", SiteKey: row.SiteKey, Key: key, Action: "skipped", Reason: err.Error()})
+		return false, nil
+	}
+	if err != nil { return false, err }
+	for _, w := range warnings { im.rep.Warnings = append(im.rep.Warnings, fmt.Sprintf("account %s/%s: %s", row.SiteKey, row.ID, w)) }
+	return true, nil
+}
+
+// write stores row through fn once it validates; false means it was skipped.
+func (im *importer) write(ctx context.Context, row store.Account, key string, props map[string]interface{}, fn func() error) (bool, error) {
+	ok, err := im.valid(ctx, row, key, props)
+	if !ok || err != nil { return false, err }
+	if err := fn(); err != nil { return false, err }
+	im.batches[row.SiteKey].Claim(row)
+	return true, nil
+}
+
+func (im *importer) run(ctx context.Context, b *Bundle) error {
+	for _, s := range b.Sites {
+		if err := im.site(ctx, s); err != nil { return fmt.Errorf("site %s: %w", s.Key, err) }
+	}
+	for _, f := range b.Schemas {
+		if err := im.field(ctx, f); err != nil { return fmt.Errorf("schema %s/%s: %w", f.SiteKey, f.Field, err) }
+	}
+	for _, a := range b.Accounts {
+		if err := im.account(ctx, a); err != nil { return fmt.Errorf("account %s/%s: %w", a.SiteKey, a.ID, err) }
+	}
+	for _, a := range b.Active {
+		if err := im.active(ctx, a); err != nil { return fmt.Errorf("active %s: %w", a.SiteKey, err) }
+	}
+	return nil
+}
+
+func (im *importer) site(ctx context.Context, s Site) error {
+	row := store.Site{Key: s.Key, Name: s.Name, LoginURL: s.LoginURL, AdditionalProps: s.AdditionalProps, AccountRules: string(s.AccountRules)}
+	cur, err := im.tx.Sites.Get(ctx, s.Key)
+	if err != nil { return err }
+	if cur == nil {
+		err := im.tx.Sites.Create(ctx, &row)
+		if err == nil {
+			im.sites[s.Key] = s.Key
+			im.rep.Sites.Created++
+			return nil
+		}
+		if !errors.Is(err, store.ErrConflict) { return err }
+	}
+	// cur == nil here means the key is held by a site in trash
+	switch {
+	case im.opts.Strategy == Rename:
+		for n := 2; ; n++ {
+			row.Key = fmt.Sprintf("%s-%d", s.Key, n)
+			err := im.tx.Sites.Create(ctx, &row)
+			if errors.Is(err, store.ErrConflict) { continue }
+			if err != nil { return err }
+			break
+		}
+		im.sites[s.Key] = row.Key
+		im.rep.Sites.Renamed++
+		im.conflict(Conflict{Kind: "site", SiteKey: s.Key, Key: s.Key, Action: "renamed", RenamedTo: row.Key})
+	case cur == nil:
+		// a trashed site can be neither merged into nor overwritten
+		im.sites[s.Key] = ""
+		im.rep.Sites.Skipped++
+		im.conflict(Conflict{Kind: "site", SiteKey: s.Key, Key: s.Key, Action: "skipped", Reason: "site key is in trash; its schemas and accounts were not imported"})
+	case im.opts.Strategy == Overwrite:
+		ok, err := im.writable(ctx, "site", s.Key, s.Key)
+		if err != nil { return err }
+		im.sites[s.Key] = s.Key
+		if !ok { im.rep.Sites.Skipped++; return nil }
+		if err := im.tx.Sites.Update(ctx, &row, 0); err != nil { return err }
+		im.rep.Sites.Updated++
+		im.conflict(Conflict{Kind: "site", SiteKey: s.Key, Key: s.Key, Action: "overwritten"})
+	default:
+		// skip keeps the site but still merges its schemas and accounts
+		im.sites[s.Key] = s.Key
+		im.rep.Sites.Skipped++
+		im.conflict(Conflict{Kind: "site", SiteKey: s.Key, Key: s.Key, Action: "skipped"})
+	}
+	return nil
+}
+
+func (im *importer) field(ctx context.Context, f Field) error {
+	target := im.sites[f.SiteKey]
+	if target == "" { im.rep.Schemas.Skipped++; return nil }
+	row := f.toStore(target)
+	cur, err := im.tx.Schemas.Get(ctx, target, f.Field)
+	if err != nil { return err }
+	if cur != nil && im.opts.Strategy != Overwrite {
+		// field names are referenced by props, so they are never renamed
+		im.rep.Schemas.Skipped++
+		im.conflict(Conflict{Kind: "schema", SiteKey: target, Key: f.Field, Action: "skipped"})
+		return nil
+	}
+	ok, err := im.writable(ctx, "schema", target, f.Field)
+	if err != nil { return err }
+	if !ok { im.rep.Schemas.Skipped++; return nil }
+	if cur == nil {
+		if err := im.tx.Schemas.Upsert(ctx, &row, 0); err != nil { return err }
+		im.rep.Schemas.Created++
+		return nil
+	}
+	if err := im.tx.Schemas.Upsert(ctx, &row, 0); err != nil { return err }
+	im.rep.Schemas.Updated++
+	im.conflict(Conflict{Kind: "schema", SiteKey: target, Key: f.Field, Action: "overwritten"})
+	return nil
+}
+
+func (im *importer) account(ctx context.Context, a Account) error {
+	target := im.sites[a.SiteKey]
+	if target == "" { im.rep.Accounts.Skipped++; return nil }
+	row := store.Account{ID: a.ID, SiteKey: target, Username: a.Username, Password: a.Password}
+	if row.ID == "" { row.ID = store.GenerateID("acc") }
+	if a.Props != nil {
+		b, err := json.Marshal(a.Props)
+		if err != nil { return err }
+		row.Extra = string(b)
+	}
+	ref := a.SiteKey + "\x00" + a.ID
+	cur, err := im.tx.Accounts.Get(ctx, target, row.ID)
+	if err != nil { return err }
+	if cur == nil {
+		ok, err := im.write(ctx, row, a.ID, a.Props, func() error { return im.tx.Accounts.Create(ctx, &row) })
+		if err == nil && !ok { return nil }
+		if err == nil {
+			im.accounts[ref] = row.ID
+			im.rep.Accounts.Created++
+			return nil
+		}
+		if !errors.Is(err, store.ErrConflict) { return err }
+	}
+	// cur == nil here means the id is taken by a trashed account or another site
+	switch {
+	case im.opts.Strategy == Rename:
+		row.ID = store.GenerateID("acc")
+		ok, err := im.write(ctx, row, a.ID, a.Props, func() error { return im.tx.Accounts.Create(ctx, &row) })
+		if !ok || err != nil { return err }
+		im.accounts[ref] = row.ID
+		im.rep.Accounts.Renamed++
+		im.conflict(Conflict{Kind: "account", SiteKey: target, Key: a.ID, Action: "renamed", RenamedTo: row.ID})
+	case cur == nil:
+		im.rep.Accounts.Skipped++
+		im.conflict(Conflict{Kind: "account", SiteKey: target, Key: a.ID, Action: "skipped", Reason: "id is used by another site or an account in trash"})
+	case im.opts.Strategy == Overwrite:
+		ok, err := im.write(ctx, row, a.ID, a.Props, func() error { return im.tx.Accounts.Update(ctx, &row, 0) })
+		if !ok || err != nil { return err }
+		im.accounts[ref] = row.ID
+		im.rep.Accounts.Updated++
+		im.conflict(Conflict{Kind: "account", SiteKey: target, Key: a.ID, Action: "overwritten"})
+	default:
+		im.accounts[ref] = row.ID
+		im.rep.Accounts.Skipped++
+		im.conflict(Conflict{Kind: "account", SiteKey: target, Key: a.ID, Action: "skipped"})
+	}
+	return nil
+}
+
+func (im *importer) active(ctx context.Context, a Active) error {
+	target := im.sites[a.SiteKey]
+	id := im.accounts[a.SiteKey+"\x00"+a.AccountID]
+	if target == "" || id == "" { im.rep.Active.Skipped++; return nil }
+	cur, err := im.tx.Active.Get(ctx, target)
+	if err != nil { return err }
+	switch {
+	case cur.AccountID != nil && *cur.AccountID == id:
+		im.rep.Active.Skipped++
+		return nil
+	case cur.AccountID != nil && im.opts.Strategy != Overwrite:
+		im.rep.Active.Skipped++
+		im.conflict(Conflict{Kind: "active", SiteKey: target, Key: *cur.AccountID, Action: "skipped"})
+		return nil
+	}
+	if err := im.tx.Active.Set(ctx, target, &id, 0); err != nil { return err }
+	if cur.AccountID != nil {
+		im.rep.Active.Updated++
+		im.conflict(Conflict{Kind: "active", SiteKey: target, Key: *cur.AccountID, Action: "overwritten"})
+	} else {
+		im.rep.Active.Created++
+	}
+	return nil
+}
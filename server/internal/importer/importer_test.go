@@ -0,0 +1,100 @@
+package importer_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"mss/internal/importer"
+	"mss/internal/store"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		format importer.Format
+		data   string
+		want   []importer.Entry
+	}{
+		{importer.Chrome, "\xef\xbb\xbfname,url,username,password,note\nGitHub,https://www.GitHub.com/login,alice,pw1,\n,androidapp://x,bob,pw2,n\n",
+			[]importer.Entry{
+				{Name: "GitHub", URL: "https://www.GitHub.com/login", Host: "github.com", Username: "alice", Password: "pw1"},
+				{URL: "androidapp://x", Username: "bob", Password: "pw2"},
+			}},
+		{importer.Firefox, `"url","username","password","httpRealm","formActionOrigin","guid","timeCreated","timeLastUsed","timePasswordChanged"` + "\n" +
+			`"https://accounts.example.com","carol","p,w","","https://accounts.example.com","{1}","1","1","1"` + "\n",
+			[]importer.Entry{{URL: "https://accounts.example.com", Host: "accounts.example.com", Username: "carol", Password: "p,w"}}},
+		{importer.Bitwarden, `{"encrypted":false,"items":[
+			{"type":1,"name":"GitLab","login":{"username":"dave","password":"pw3","uris":[{"uri":"androidapp://gl"},{"uri":"gitlab.com/users/sign_in"}]}},
+			{"type":2,"name":"note"},
+			{"type":3,"name":"card","login":null}]}`,
+			[]importer.Entry{{Name: "GitLab", URL: "gitlab.com/users/sign_in", Host: "gitlab.com", Username: "dave", Password: "pw3"}}},
+	} {
+		got, err := importer.Parse(tc.format, []byte(tc.data))
+		if err != nil { t.Fatalf("%s: %v", tc.format, err) }
+		if !reflect.DeepEqual(got, tc.want) { t.Errorf("%s:\n got %+v\nwant %+v", tc.format, got, tc.want) }
+	}
+	if _, err := importer.Parse(importer.Chrome, []byte("name,url\nx,y\n")); err == nil { t.Error("chrome without username column parsed") }
+	if _, err := importer.Parse(importer.Bitwarden, []byte(`{"encrypted":true,"items":[]}`)); err == nil { t.Error("encrypted bitwarden export parsed") }
+	if _, err := importer.ParseFormat("lastpass"); err == nil { t.Error("unknown format accepted") }
+}
+
+func TestPlanAndApply(t *testing.T) {
+	ctx, r := context.Background(), store.NewMemory(store.RevisionSecrets{})
+	must := func(err error) { t.Helper(); if err != nil { t.Fatal(err) } }
+	must(r.Sites.Create(ctx, &store.Site{Key: "gh", Name: "GitHub", LoginURL: "https://github.com/login"}))
+	must(r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "gh", Field: "plan", Type: "string", DefaultValue: `"free"`}, 0))
+	must(r.Accounts.Create(ctx, &store.Account{ID: "a1", SiteKey: "gh", Username: "alice", Password: "old"}))
+	must(r.Accounts.Create(ctx, &store.Account{ID: "a2", SiteKey: "gh", Username: "bob", Password: "same"}))
+	entries := []importer.Entry{
+		{URL: "https://github.com/", Host: "github.com", Username: "alice", Password: "stale"},
+		{URL: "https://github.com/", Host: "github.com", Username: "alice", Password: "new"},
+		{URL: "https://github.com/", Host: "github.com", Username: "bob", Password: "same"},
+		{URL: "https://github.com/", Host: "github.com", Username: "carol", Password: "pw"},
+		{Name: "Example", URL: "https://accounts.example.com/in", Host: "accounts.example.com", Username: "dave", Password: "pw"},
+		{URL: "https://skip.me/", Host: "skip.me", Username: "erin", Password: "pw"},
+		{URL: "androidapp://x", Username: "fred", Password: "pw"},
+	}
+	overrides := []importer.Override{{Host: "skip.me", Skip: true}}
+
+	p, err := importer.Plan(ctx, r, entries, overrides)
+	must(err)
+	want := importer.Totals{Entries: 7, Sites: 2, NewSites: 1, Create: 2, Update: 1, Unchanged: 1, Skipped: 2}
+	if p.Totals != want { t.Fatalf("totals: %+v", p.Totals) }
+	if len(p.Groups) != 3 || p.Groups[0].SiteKey != "accounts-example" || !p.Groups[0].NewSite || p.Groups[0].SiteName != "Example" ||
+		p.Groups[0].LoginURL != "https://accounts.example.com/" || p.Groups[1].SiteKey != "gh" || !p.Groups[2].Skip {
+		t.Fatalf("groups: %+v", p.Groups)
+	}
+	if a := p.Groups[1].Accounts[0]; a.Username != "alice" || a.Action != "update" || a.Duplicates != 1 { t.Fatalf("alice: %+v", a) }
+	if s, _ := r.Sites.Get(ctx, "accounts-example"); s != nil { t.Fatal("plan wrote a site") }
+
+	p, err = importer.Apply(ctx, r, entries, overrides)
+	must(err)
+	if p.Totals != want { t.Fatalf("apply totals: %+v", p.Totals) }
+	alice, err := r.Accounts.Get(ctx, "gh", "a1")
+	must(err)
+	if alice.Password != "new" { t.Errorf("alice: %+v", alice) }
+	accs, err := r.Accounts.List(ctx, "gh")
+	must(err)
+	var carol *store.Account
+	for i := range accs {
+		if accs[i].Username == "carol" { carol = &accs[i] }
+	}
+	if carol == nil || carol.Extra != `{"plan":"free"}` { t.Errorf("carol: %+v", carol) }
+	if s, _ := r.Sites.Get(ctx, "accounts-example"); s == nil { t.Error("new site not created") }
+	if s, _ := r.Sites.Get(ctx, "skip"); s != nil { t.Error("skipped host created a site") }
+
+	// a second run finds nothing left to do
+	p, err = importer.Plan(ctx, r, entries, overrides)
+	must(err)
+	if p.Totals.Create != 0 || p.Totals.Update != 0 || p.Totals.NewSites != 0 { t.Fatalf("second plan: %+v", p.Totals) }
+
+	bad := []importer.Override{{Host: "github.com", SiteKey: "new"}, {Host: "accounts.example.com", SiteKey: "new"}}
+	if _, err := importer.Plan(ctx, r, entries, bad); !errors.Is(err, importer.ErrBadOverride) { t.Fatalf("shared new key: %v", err) }
+
+	// a new account cannot fill a required prop, so it is skipped
+	must(r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "gh", Field: "team", Type: "string", Required: 1}, 0))
+	p, err = importer.Plan(ctx, r, []importer.Entry{{URL: "https://github.com/", Host: "github.com", Username: "gina", Password: "pw"}}, nil)
+	must(err)
+	if p.Totals.Create != 0 || p.Totals.Skipped != 1 || len(p.Skipped) != 1 || p.Skipped[0].Username != "gina" { t.Fatalf("required prop: %+v", p) }
+}
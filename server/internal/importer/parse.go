@@ -0,0 +1,124 @@
+// Package importer reads password exports from browsers and password
+// managers, groups the logins by host and plans how they map onto sites.
+package importer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+type Format string
+
+const (
+	Chrome    Format = "chrome"
+	Edge      Format = "edge"
+	Firefox   Format = "firefox"
+	Bitwarden Format = "bitwarden"
+)
+
+// ParseFormat validates a format name.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case Chrome, Edge, Firefox, Bitwarden:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown format %q (want chrome, edge, firefox or bitwarden)", s)
+}
+
+// Entry is one login read from an export.
+type Entry struct {
+	Name     string
+	URL      string
+	Host     string
+	Username string
+	Password string
+}
+
+// Parse reads every login from an export file.
+func Parse(f Format, data []byte) ([]Entry, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	switch f {
+	case Chrome, Edge:
+		// name,url,username,password[,note]
+		return parseLoginCSV(data, "name")
+	case Firefox:
+		// "url","username","password","httpRealm","formActionOrigin","guid",...
+		return parseLoginCSV(data, "")
+	case Bitwarden:
+		return parseBitwarden(data)
+	}
+	return nil, fmt.Errorf("unknown format %q", f)
+}
+
+func parseLoginCSV(data []byte, nameCol string) ([]Entry, error) {
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.FieldsPerRecord = -1
+	rows, err := cr.ReadAll()
+	if err != nil { return nil, err }
+	if len(rows) == 0 { return nil, errors.New("empty file") }
+	col := map[string]int{}
+	for i, h := range rows[0] { col[strings.ToLower(strings.TrimSpace(h))] = i }
+	for _, need := range []string{"url", "username", "password"} {
+		if _, ok := col[need]; !ok { return nil, fmt.Errorf("missing %q column; is this the right format?", need) }
+	}
+	get := func(rec []string, name string) string {
+		i, ok := col[name]
+		if !ok || i >= len(rec) { return "" }
+		return rec[i]
+	}
+	out := make([]Entry, 0, len(rows)-1)
+	for _, rec := range rows[1:] {
+		e := Entry{URL: get(rec, "url"), Username: get(rec, "username"), Password: get(rec, "password")}
+		if nameCol != "" { e.Name = get(rec, nameCol) }
+		e.Host = HostOf(e.URL)
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func parseBitwarden(data []byte) ([]Entry, error) {
+	var doc struct {
+		Encrypted bool `json:"encrypted"`
+		Items     []struct {
+			Type  int    `json:"type"`
+			Name  string `json:"name"`
+			Login *struct {
+				Username string `json:"username"`
+				Password string `json:"password"`
+				URIs     []struct {
+					URI string `json:"uri"`
+				} `json:"uris"`
+			} `json:"login"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil { return nil, fmt.Errorf("invalid bitwarden export: %w", err) }
+	if doc.Encrypted { return nil, errors.New("encrypted bitwarden exports are not supported; export as unencrypted JSON") }
+	var out []Entry
+	for _, it := range doc.Items {
+		// type 1 is a login; cards, identities and notes have no credentials
+		if it.Type != 1 || it.Login == nil { continue }
+		e := Entry{Name: it.Name, Username: it.Login.Username, Password: it.Login.Password}
+		for _, u := range it.Login.URIs {
+			if h := HostOf(u.URI); h != "" { e.URL, e.Host = u.URI, h; break }
+		}
+		if e.URL == "" && len(it.Login.URIs) > 0 { e.URL = it.Login.URIs[0].URI }
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// HostOf returns the lower-cased host of a web URL without a leading "www.",
+// or "" for non-web URIs such as androidapp://.
+func HostOf(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" { return "" }
+	if !strings.Contains(raw, "://") { raw = "https://" + raw }
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") { return "" }
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
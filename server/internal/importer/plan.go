@@ -0,0 +1,322 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"mss/internal/store"
+	"mss/internal/validation"
+)
+
+// Group is every login for one host and the site it lands in.
+type Group struct {
+	Host     string    `json:"host"`
+	SiteKey  string    `json:"siteKey"`
+	SiteName string    `json:"siteName"`
+	LoginURL string    `json:"loginUrl,omitempty"`
+	NewSite  bool      `json:"newSite"`
+	Skip     bool      `json:"skip,omitempty"`
+	Accounts []Planned `json:"accounts"`
+}
+
+// Planned is what will happen to one username within a group. Passwords
+// never leave the server, so previews can be shown as-is.
+type Planned struct {
+	Username   string `json:"username"`
+	Action     string `json:"action"` // create, update (password changed) or unchanged
+	AccountID  string `json:"accountId,omitempty"`
+	Duplicates int    `json:"duplicates,omitempty"` // extra entries for the same username; the last one wins
+	password   string
+	entry      Entry                  // the entry that wins
+	props      map[string]interface{} // schema defaults for a create
+}
+
+// Skipped is an entry that cannot be imported.
+type Skipped struct {
+	Name     string `json:"name,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Username string `json:"username,omitempty"`
+	Reason   string `json:"reason"`
+	// Details are the violations when the account fails the site's
+	// validation.
+	Details []validation.Violation `json:"details,omitempty"`
+}
+
+type Totals struct {
+	Entries   int `json:"entries"`
+	Sites     int `json:"sites"`
+	NewSites  int `json:"newSites"`
+	Create    int `json:"create"`
+	Update    int `json:"update"`
+	Unchanged int `json:"unchanged"`
+	Skipped   int `json:"skipped"`
+}
+
+type Preview struct {
+	Groups  []Group   `json:"groups"`
+	Skipped []Skipped `json:"skipped"`
+	Totals  Totals    `json:"totals"`
+}
+
+// ErrBadOverride marks overrides that cannot be applied to the current sites.
+var ErrBadOverride = errors.New("invalid override")
+
+// Override adjusts one host's group before it is applied: skip it, or send
+// it to another (existing or new) site key and name.
+type Override struct {
+	Host     string `json:"host"`
+	Skip     bool   `json:"skip,omitempty"`
+	SiteKey  string `json:"siteKey,omitempty"`
+	SiteName string `json:"siteName,omitempty"`
+}
+
+type hostGroup struct {
+	host    string
+	entries []Entry
+}
+
+// group buckets entries by host and sets aside those that cannot be imported.
+func group(entries []Entry) ([]hostGroup, []Skipped) {
+	idx := map[string]int{}
+	var groups []hostGroup
+	skipped := []Skipped{}
+	for _, e := range entries {
+		switch {
+		case e.Host == "":
+			skipped = append(skipped, Skipped{Name: e.Name, URL: e.URL, Username: e.Username, Reason: "no web address"})
+			continue
+		case strings.TrimSpace(e.Username) == "":
+			skipped = append(skipped, Skipped{Name: e.Name, URL: e.URL, Reason: "no username"})
+			continue
+		}
+		i, ok := idx[e.Host]
+		if !ok {
+			i = len(groups)
+			idx[e.Host] = i
+			groups = append(groups, hostGroup{host: e.Host})
+		}
+		groups[i].entries = append(groups[i].entries, e)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].host < groups[j].host })
+	return groups, skipped
+}
+
+// Plan matches entries to sites by the host of sites.login_url and proposes
+// a new site for every unmatched host. Accounts to create or update are
+// validated as the API would (schema defaults, required props, username and
+// password rules); those that fail are moved to Skipped. It only reads from
+// repos.
+func Plan(ctx context.Context, repos store.Repos, entries []Entry, overrides []Override) (*Preview, error) {
+	sites, err := repos.Sites.List(ctx)
+	if err != nil { return nil, err }
+	trash, err := repos.Trash.List(ctx)
+	if err != nil { return nil, err }
+	byHost := map[string]store.Site{}
+	taken := map[string]bool{}
+	live := map[string]store.Site{}
+	for _, s := range sites {
+		live[s.Key] = s
+		taken[s.Key] = true
+		if h := HostOf(s.LoginURL); h != "" {
+			if _, dup := byHost[h]; !dup { byHost[h] = s }
+		}
+	}
+	for _, s := range trash.Sites { taken[s.Key] = true }
+	proposed := map[string]bool{}
+	ov := map[string]Override{}
+	for _, o := range overrides { ov[HostOf(o.Host)] = o }
+
+	groups, skipped := group(entries)
+	p := &Preview{Groups: []Group{}, Skipped: skipped}
+	p.Totals.Entries = len(entries)
+	p.Totals.Skipped = len(skipped)
+	for _, hg := range groups {
+		g := Group{Host: hg.host, Accounts: []Planned{}}
+		o := ov[hg.host]
+		switch site, matched := byHost[hg.host]; {
+		case o.SiteKey != "":
+			g.SiteKey = o.SiteKey
+			if s, ok := live[o.SiteKey]; ok {
+				g.SiteName, g.LoginURL = s.Name, s.LoginURL
+			} else {
+				if proposed[o.SiteKey] { return nil, fmt.Errorf("%w: %s: new site key %q is used by another host", ErrBadOverride, hg.host, o.SiteKey) }
+				if taken[o.SiteKey] { return nil, fmt.Errorf("%w: %s: site key %q is in trash", ErrBadOverride, hg.host, o.SiteKey) }
+				g.NewSite = true
+			}
+		case matched:
+			g.SiteKey, g.SiteName, g.LoginURL = site.Key, site.Name, site.LoginURL
+		default:
+			g.SiteKey = proposeKey(hg.host, taken)
+			g.NewSite = true
+		}
+		if g.NewSite {
+			taken[g.SiteKey] = true
+			proposed[g.SiteKey] = true
+			g.SiteName = firstNonEmpty(o.SiteName, hg.entries[0].Name, hg.host)
+			g.LoginURL = origin(hg.entries[0].URL)
+		}
+		if o.Skip {
+			g.Skip = true
+			p.Totals.Skipped += len(hg.entries)
+			p.Groups = append(p.Groups, g)
+			continue
+		}
+
+		existing := map[string]store.Account{}
+		if !g.NewSite {
+			accs, err := repos.Accounts.List(ctx, g.SiteKey)
+			if err != nil { return nil, err }
+			for _, a := range accs {
+				if _, dup := existing[a.Username]; !dup { existing[a.Username] = a }
+			}
+		}
+		pos := map[string]int{}
+		for _, e := range hg.entries {
+			u := strings.TrimSpace(e.Username)
+			if i, ok := pos[u]; ok {
+				g.Accounts[i].Duplicates++
+				g.Accounts[i].password, g.Accounts[i].entry = e.Password, e
+				continue
+			}
+			pos[u] = len(g.Accounts)
+			g.Accounts = append(g.Accounts, Planned{Username: u, password: e.Password, entry: e})
+		}
+		v := validation.Compile(g.SiteKey, nil)
+		if !g.NewSite {
+			if v, err = validation.Load(ctx, repos, g.SiteKey); err != nil { return nil, err }
+		}
+		batch := v.Batch()
+		kept := g.Accounts[:0]
+		for _, pa := range g.Accounts {
+			cur, ok := existing[pa.Username]
+			switch {
+			case !ok:
+				pa.Action = "create"
+			case cur.Password == pa.password:
+				pa.Action, pa.AccountID = "unchanged", cur.ID
+			default:
+				pa.Action, pa.AccountID = "update", cur.ID
+			}
+			if pa.Action != "unchanged" {
+				acc := store.Account{ID: pa.AccountID, SiteKey: g.SiteKey, Username: pa.Username, Password: pa.password}
+				// a password update leaves the props alone, so only the account rules apply
+				var props map[string]interface{}
+				if pa.Action == "create" {
+					props = v.Normalize(map[string]interface{}{})
+					pa.props = props
+				}
+				_, err := batch.ValidateAccount(ctx, repos, acc, props)
+				var verrs validation.Errors
+				if errors.As(err, &verrs) {
+					p.Skipped = append(p.Skipped, Skipped{Name: pa.entry.Name, URL: pa.entry.URL, Username: pa.Username, Reason: err.Error(), Details: verrs})
+					p.Totals.Skipped += 1 + pa.Duplicates
+					continue
+				}
+				if err != nil { return nil, err }
+				if len(props) > 0 {
+					b, _ := json.Marshal(props)
+					acc.Extra = string(b)
+				}
+				if pa.Action == "create" { batch.Claim(acc) }
+			}
+			switch pa.Action {
+			case "create":
+				p.Totals.Create++
+			case "update":
+				p.Totals.Update++
+			default:
+				p.Totals.Unchanged++
+			}
+			kept = append(kept, pa)
+		}
+		g.Accounts = kept
+		p.Totals.Sites++
+		if g.NewSite { p.Totals.NewSites++ }
+		p.Groups = append(p.Groups, g)
+	}
+	return p, nil
+}
+
+// Apply re-plans against the current state and writes the result in one
+// transaction: new sites are created, new usernames added with the schema
+// defaults and changed passwords updated. Existing props are left untouched.
+func Apply(ctx context.Context, repos store.Repos, entries []Entry, overrides []Override) (*Preview, error) {
+	var p *Preview
+	err := repos.Tx.InTx(ctx, func(tx store.Repos) error {
+		var err error
+		p, err = Plan(ctx, tx, entries, overrides)
+		if err != nil { return err }
+		for gi := range p.Groups {
+			g := &p.Groups[gi]
+			if g.Skip { continue }
+			if g.NewSite {
+				if err := tx.Sites.Create(ctx, &store.Site{Key: g.SiteKey, Name: g.SiteName, LoginURL: g.LoginURL}); err != nil {
+					return fmt.Errorf("site %s: %w", g.SiteKey, err)
+				}
+			}
+			for i := range g.Accounts {
+				pa := &g.Accounts[i]
+				switch pa.Action {
+				case "create":
+					acc := store.Account{ID: store.GenerateID("acc"), SiteKey: g.SiteKey, Username: pa.Username, Password: pa.password}
+					if len(pa.props) > 0 {
+						b, _ := json.Marshal(pa.props)
+						acc.Extra = string(b)
+					}
+					if err := tx.Accounts.Create(ctx, &acc); err != nil { return fmt.Errorf("%s/%s: %w", g.SiteKey, pa.Username, err) }
+					pa.AccountID = acc.ID
+				case "update":
+					cur, err := tx.Accounts.Get(ctx, g.SiteKey, pa.AccountID)
+					if err != nil { return err }
+					if cur == nil { return fmt.Errorf("%s/%s: %w", g.SiteKey, pa.Username, store.ErrNotFound) }
+					cur.Password = pa.password
+					if err := tx.Accounts.Update(ctx, cur, 0); err != nil { return fmt.Errorf("%s/%s: %w", g.SiteKey, pa.Username, err) }
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
+	return p, nil
+}
+
+// proposeKey derives a site key from host ("accounts.example.com" becomes
+// "accounts-example") that is not yet taken.
+func proposeKey(host string, taken map[string]bool) string {
+	labels := strings.Split(host, ".")
+	if len(labels) > 1 { labels = labels[:len(labels)-1] }
+	var b strings.Builder
+	for _, r := range strings.Join(labels, "-") {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+	base := strings.Trim(b.String(), "-")
+	if base == "" { base = "site" }
+	key := base
+	for n := 2; taken[key]; n++ { key = fmt.Sprintf("%s-%d", base, n) }
+	return key
+}
+
+// origin reduces a login URL to scheme://host/.
+func origin(raw string) string {
+	if !strings.Contains(raw, "://") { raw = "https://" + raw }
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" { return "" }
+	return u.Scheme + "://" + u.Host + "/"
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if strings.TrimSpace(v) != "" { return v }
+	}
+	return ""
+}
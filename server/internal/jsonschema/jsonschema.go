@@ -0,0 +1,385 @@
+// Package jsonschema converts site field schemas to and from JSON Schema
+// (draft 2020-12) documents, so standard validators and form generators can
+// work with a site's props.
+//
+// Each schema field becomes a property. Field types JSON Schema cannot tell
+// apart (datetime, date, duration, url, email, enum, json) are marked with
+// x-mss-type, uniqueness and UI hints travel as x-mss-unique and
+// x-mss-uiHint, and properties are listed in field order, so a rendered
+// document parses back to the same fields.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"mss/internal/store"
+	"mss/internal/validation"
+)
+
+// Draft is the $schema of rendered documents.
+const Draft = "https://json-schema.org/draft/2020-12/schema"
+
+// ErrInvalid marks documents that cannot be turned into field definitions.
+var ErrInvalid = errors.New("invalid json schema")
+
+// durationPattern matches Go durations such as 90s or 1h30m.
+const durationPattern = `^[-+]?([0-9]*(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+$`
+
+// Render builds the JSON Schema document for a site and its fields.
+func Render(site store.Site, fields []store.SiteFieldSchema) map[string]interface{} {
+	props := &properties{byName: map[string]interface{}{}}
+	required := []string{}
+	for _, f := range fields {
+		rule, err := validation.RuleFromSchema(f)
+		if err != nil { continue }
+		p := renderRule(rule)
+		if f.DefaultValue != "" {
+			var def interface{}
+			if json.Unmarshal([]byte(f.DefaultValue), &def) == nil && def != nil { p["default"] = def }
+		}
+		if f.Secret != 0 { p["writeOnly"] = true }
+		if f.Unique != 0 { p["x-mss-unique"] = true }
+		if f.UIHint != "" { p["x-mss-uiHint"] = f.UIHint }
+		props.add(f.Field, p)
+		if f.Required != 0 { required = append(required, f.Field) }
+	}
+	doc := map[string]interface{}{
+		"$schema":    Draft,
+		"title":      site.Name,
+		"type":       "object",
+		"properties": props,
+	}
+	if len(required) > 0 { doc["required"] = required }
+	switch site.AdditionalProps {
+	case store.PropsReject:
+		doc["additionalProperties"] = false
+	case store.PropsWarn:
+		doc["x-mss-additionalProps"] = store.PropsWarn
+	}
+	return doc
+}
+
+func renderRule(r validation.Rule) map[string]interface{} {
+	p := map[string]interface{}{}
+	switch r.Type {
+	case "string", "number", "integer", "boolean":
+		p["type"] = r.Type
+	case "datetime":
+		p["type"], p["format"] = "string", "date-time"
+	case "date":
+		p["type"], p["format"] = "string", "date"
+	case "url":
+		p["type"], p["format"] = "string", "uri"
+	case "email":
+		p["type"], p["format"] = "string", "email"
+	case "duration":
+		p["type"], p["pattern"] = "string", durationPattern
+	case "json":
+		p["type"] = []string{"object", "array"}
+	case "array":
+		p["type"] = "array"
+		if r.Items != nil { p["items"] = renderRule(*r.Items) }
+	case "object":
+		p["type"] = "object"
+		if len(r.Fields) > 0 {
+			sub := &properties{byName: map[string]interface{}{}}
+			var req []string
+			for _, f := range r.Fields {
+				sub.add(f.Field, renderRule(f))
+				if f.Required { req = append(req, f.Field) }
+			}
+			p["properties"] = sub
+			if len(req) > 0 { p["required"] = req }
+		}
+	}
+	switch r.Type {
+	case "string", "number", "integer", "boolean", "array", "object":
+	default:
+		p["x-mss-type"] = r.Type
+	}
+	if len(r.Choices) > 0 { p["enum"] = r.Choices }
+	if r.Regex != "" { p["pattern"] = r.Regex }
+	if r.Min != nil { p["minimum"] = *r.Min }
+	if r.Max != nil { p["maximum"] = *r.Max }
+	lo, hi := "minLength", "maxLength"
+	if r.Type == "array" { lo, hi = "minItems", "maxItems" }
+	if r.MinLength != nil { p[lo] = *r.MinLength }
+	if r.MaxLength != nil { p[hi] = *r.MaxLength }
+	return p
+}
+
+// properties is a properties object that marshals in insertion order.
+type properties struct {
+	names  []string
+	byName map[string]interface{}
+}
+
+func (p *properties) add(name string, schema interface{}) {
+	if _, dup := p.byName[name]; !dup { p.names = append(p.names, name) }
+	p.byName[name] = schema
+}
+
+func (p *properties) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range p.names {
+		if i > 0 { buf.WriteByte(',') }
+		k, _ := json.Marshal(name)
+		v, err := json.Marshal(p.byName[name])
+		if err != nil { return nil, err }
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Document is a parsed JSON Schema: the fields it defines, in document
+// order, and the site mode its additionalProperties implies ("" when the
+// document does not say).
+type Document struct {
+	Fields          []store.SiteFieldSchema
+	AdditionalProps string
+}
+
+// IsDocument reports whether a schema POST body is a JSON Schema document
+// rather than the {"fields": [...]} form.
+func IsDocument(body []byte) bool {
+	var probe map[string]json.RawMessage
+	if json.Unmarshal(body, &probe) != nil { return false }
+	_, schema := probe["$schema"]
+	_, props := probe["properties"]
+	return schema || props
+}
+
+// Parse reads a JSON Schema document into field definitions of siteKey.
+// Keywords that fields cannot express are rejected rather than dropped, so
+// nothing a document asks for goes unenforced.
+func Parse(siteKey string, data []byte) (*Document, error) {
+	bad := func(format string, args ...interface{}) error { return fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, args...)) }
+	var root node
+	if err := json.Unmarshal(data, &root); err != nil { return nil, bad("%v", err) }
+	if s, found := root["$schema"]; found && string(s) != `"`+Draft+`"` { return nil, bad("$schema must be %q", Draft) }
+	if t := root.str("type"); t != "" && t != "object" { return nil, bad("top-level type must be object") }
+	if err := root.only("", "$schema", "$id", "title", "description", "$comment", "type", "properties", "required", "additionalProperties", "x-mss-additionalProps"); err != nil { return nil, err }
+	doc := &Document{}
+	if raw, found := root["additionalProperties"]; found {
+		var allow bool
+		if json.Unmarshal(raw, &allow) != nil { return nil, bad("additionalProperties must be a boolean") }
+		doc.AdditionalProps = store.PropsAllow
+		if !allow { doc.AdditionalProps = store.PropsReject }
+	}
+	if m := root.str("x-mss-additionalProps"); m != "" {
+		if !validation.ValidPropsMode(m) { return nil, bad("x-mss-additionalProps %q must be allow, warn or reject", m) }
+		if doc.AdditionalProps == store.PropsReject && m != store.PropsReject { return nil, bad("additionalProperties false contradicts x-mss-additionalProps %q", m) }
+		doc.AdditionalProps = m
+	}
+	names, props, err := root.properties("")
+	if err != nil { return nil, err }
+	required, err := root.required(props)
+	if err != nil { return nil, err }
+	for i, name := range names {
+		p := props[name]
+		rule, err := p.rule(name)
+		if err != nil { return nil, err }
+		if err := p.only(name, append(ruleKeywords, "default", "writeOnly", "x-mss-unique", "x-mss-uiHint")...); err != nil { return nil, err }
+		f := store.SiteFieldSchema{SiteKey: siteKey, Field: name, Type: rule.Type, Regex: rule.Regex,
+			Min: rule.Min, Max: rule.Max, MinLength: rule.MinLength, MaxLength: rule.MaxLength, Order: i + 1}
+		if required[name] { f.Required = 1 }
+		if len(rule.Choices) > 0 {
+			b, _ := json.Marshal(rule.Choices)
+			f.Choices = string(b)
+		}
+		if rule.Items != nil {
+			b, _ := json.Marshal(rule.Items)
+			f.Items = string(b)
+		}
+		if len(rule.Fields) > 0 {
+			b, _ := json.Marshal(rule.Fields)
+			f.Fields = string(b)
+		}
+		if def, found := p["default"]; found && string(def) != "null" { f.DefaultValue = string(def) }
+		if p.flag("writeOnly") { f.Secret = 1 }
+		if p.flag("x-mss-unique") { f.Unique = 1 }
+		f.UIHint = p.str("x-mss-uiHint")
+		if err := validation.CheckField(f); err != nil { return nil, err }
+		doc.Fields = append(doc.Fields, f)
+	}
+	return doc, nil
+}
+
+// ruleKeywords are what a (sub)property may use to describe its rule.
+var ruleKeywords = []string{"type", "format", "enum", "pattern", "minimum", "maximum", "minLength", "maxLength",
+	"minItems", "maxItems", "items", "properties", "required", "x-mss-type", "title", "description", "$comment"}
+
+// node is one schema object with its keywords undecoded.
+type node map[string]json.RawMessage
+
+func (n node) str(key string) string {
+	var s string
+	if raw, found := n[key]; found { _ = json.Unmarshal(raw, &s) }
+	return s
+}
+
+func (n node) flag(key string) bool {
+	var b bool
+	if raw, found := n[key]; found { _ = json.Unmarshal(raw, &b) }
+	return b
+}
+
+// only rejects keywords of the property at path ("" for the document
+// itself) that are not in keys.
+func (n node) only(path string, keys ...string) error {
+	allowed := map[string]bool{}
+	for _, k := range keys { allowed[k] = true }
+	var extra []string
+	for k := range n {
+		if !allowed[k] { extra = append(extra, k) }
+	}
+	if len(extra) == 0 { return nil }
+	sort.Strings(extra)
+	if path == "" { return fmt.Errorf("%w: unsupported keyword %q", ErrInvalid, extra[0]) }
+	return fmt.Errorf("%w: property %q: unsupported keyword %q", ErrInvalid, path, extra[0])
+}
+
+// properties decodes n's properties keeping their document order. path
+// names n in errors ("" for the document itself).
+func (n node) properties(path string) ([]string, map[string]node, error) {
+	raw, found := n["properties"]
+	if !found { return nil, map[string]node{}, nil }
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') { return nil, nil, fmt.Errorf("%w: properties must be an object", ErrInvalid) }
+	var names []string
+	props := map[string]node{}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil { return nil, nil, fmt.Errorf("%w: %v", ErrInvalid, err) }
+		name := t.(string)
+		if name == "" && path == "" { return nil, nil, fmt.Errorf("%w: property names must not be empty", ErrInvalid) }
+		if name == "" { return nil, nil, fmt.Errorf("%w: property %q: property names must not be empty", ErrInvalid, path) }
+		var p node
+		if err := dec.Decode(&p); err != nil { return nil, nil, fmt.Errorf("%w: property %q must be an object", ErrInvalid, name) }
+		if _, dup := props[name]; !dup { names = append(names, name) }
+		props[name] = p
+	}
+	return names, props, nil
+}
+
+func (n node) required(props map[string]node) (map[string]bool, error) {
+	out := map[string]bool{}
+	raw, found := n["required"]
+	if !found { return out, nil }
+	var names []string
+	if err := json.Unmarshal(raw, &names); err != nil { return nil, fmt.Errorf("%w: required must be a list of names", ErrInvalid) }
+	for _, name := range names {
+		if _, declared := props[name]; !declared { return nil, fmt.Errorf("%w: required %q is not a property", ErrInvalid, name) }
+		out[name] = true
+	}
+	return out, nil
+}
+
+// rule reads the type and constraints of property name.
+func (n node) rule(name string) (validation.Rule, error) {
+	bad := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: property %q: %s", ErrInvalid, name, fmt.Sprintf(format, args...))
+	}
+	r := validation.Rule{Field: name, Regex: n.str("pattern")}
+	if raw, found := n["enum"]; found {
+		if err := json.Unmarshal(raw, &r.Choices); err != nil || len(r.Choices) == 0 { return r, bad("enum must be a non-empty list") }
+	}
+	num := func(key string) (*float64, error) {
+		raw, found := n[key]
+		if !found { return nil, nil }
+		var v float64
+		if err := json.Unmarshal(raw, &v); err != nil { return nil, bad("%s must be a number", key) }
+		return &v, nil
+	}
+	count := func(key string) (*int, error) {
+		raw, found := n[key]
+		if !found { return nil, nil }
+		var v int
+		if err := json.Unmarshal(raw, &v); err != nil { return nil, bad("%s must be an integer", key) }
+		return &v, nil
+	}
+	var err error
+	if r.Min, err = num("minimum"); err != nil { return r, err }
+	if r.Max, err = num("maximum"); err != nil { return r, err }
+
+	var types []string
+	if raw, found := n["type"]; found {
+		var one string
+		if json.Unmarshal(raw, &one) == nil {
+			types = []string{one}
+		} else if err := json.Unmarshal(raw, &types); err != nil {
+			return r, bad("type must be a string or a list of strings")
+		}
+	}
+	sort.Strings(types)
+	format := n.str("format")
+	switch {
+	case len(types) == 2 && types[0] == "array" && types[1] == "object":
+		r.Type = "json"
+	case len(types) > 1:
+		return r, bad("type list %v is not supported", types)
+	case len(types) == 0 && len(r.Choices) > 0:
+		r.Type = "enum"
+	case len(types) == 0:
+		return r, bad("type required")
+	case types[0] == "string":
+		r.Type = map[string]string{"": "string", "date-time": "datetime", "date": "date", "uri": "url", "email": "email"}[format]
+		if r.Type == "" { return r, bad("format %q is not supported", format) }
+	case types[0] == "number", types[0] == "integer", types[0] == "boolean", types[0] == "array", types[0] == "object":
+		r.Type = types[0]
+	default:
+		return r, bad("type %q is not supported", types[0])
+	}
+	if format != "" && (len(types) != 1 || types[0] != "string") { return r, bad("format needs type string") }
+	if t := n.str("x-mss-type"); t != "" {
+		if !validation.ValidType(t) { return r, bad("x-mss-type %q is unknown", t) }
+		if t == "duration" && r.Regex == durationPattern { r.Regex = "" }
+		r.Type = t
+	}
+
+	lo, hi := "minLength", "maxLength"
+	if r.Type == "array" {
+		lo, hi = "minItems", "maxItems"
+		if _, found := n["minLength"]; found { return r, bad("use minItems for arrays") }
+		if _, found := n["maxLength"]; found { return r, bad("use maxItems for arrays") }
+	} else {
+		if _, found := n["minItems"]; found { return r, bad("minItems needs type array") }
+		if _, found := n["maxItems"]; found { return r, bad("maxItems needs type array") }
+	}
+	if r.MinLength, err = count(lo); err != nil { return r, err }
+	if r.MaxLength, err = count(hi); err != nil { return r, err }
+
+	if raw, found := n["items"]; found {
+		var item node
+		if err := json.Unmarshal(raw, &item); err != nil { return r, bad("items must be a schema object") }
+		if err := item.only(name+"[]", ruleKeywords...); err != nil { return r, err }
+		ir, err := item.rule(name + "[]")
+		if err != nil { return r, err }
+		ir.Field = ""
+		r.Items = &ir
+	}
+	if _, found := n["properties"]; found {
+		names, props, err := n.properties(name)
+		if err != nil { return r, err }
+		req, err := n.required(props)
+		if err != nil { return r, err }
+		for _, sub := range names {
+			if err := props[sub].only(name+"."+sub, ruleKeywords...); err != nil { return r, err }
+			sr, err := props[sub].rule(name + "." + sub)
+			if err != nil { return r, err }
+			sr.Field, sr.Required = sub, req[sub]
+			r.Fields = append(r.Fields, sr)
+		}
+	} else if _, found := n["required"]; found {
+		return r, bad("required needs properties")
+	}
+	return r, nil
+}
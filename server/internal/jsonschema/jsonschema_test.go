@@ -0,0 +1,65 @@
+package jsonschema_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"mss/internal/jsonschema"
+	"mss/internal/store"
+	"mss/internal/validation"
+)
+
+func f64(v float64) *float64 { return &v }
+func intp(v int) *int        { return &v }
+
+func TestRoundTrip(t *testing.T) {
+	site := store.Site{Key: "s", Name: "S", AdditionalProps: store.PropsWarn}
+	fields := []store.SiteFieldSchema{
+		{Field: "email", Type: "email", Required: 1, Unique: 1, UIHint: "email"},
+		{Field: "age", Type: "integer", Min: f64(18), Max: f64(130)},
+		{Field: "plan", Type: "enum", Choices: `["free","pro"]`, DefaultValue: `"free"`},
+		{Field: "code", Type: "string", Regex: "^[A-Z]+$", MinLength: intp(2), MaxLength: intp(8)},
+		{Field: "token", Type: "string", Secret: 1},
+		{Field: "ttl", Type: "duration"},
+		{Field: "since", Type: "date"},
+		{Field: "meta", Type: "json"},
+		{Field: "tags", Type: "array", Items: `{"type":"string","minLength":1}`, MinLength: intp(1)},
+		{Field: "addr", Type: "object", Fields: `[{"field":"city","type":"string","required":true},{"field":"zip","type":"string"}]`},
+	}
+	for i := range fields {
+		fields[i].SiteKey, fields[i].Order = "s", i+1
+		if err := validation.CheckField(fields[i]); err != nil { t.Fatal(err) }
+	}
+	raw, err := json.Marshal(jsonschema.Render(site, fields))
+	if err != nil { t.Fatal(err) }
+	if !jsonschema.IsDocument(raw) { t.Fatal("rendered document not recognised") }
+	doc, err := jsonschema.Parse("s", raw)
+	if err != nil { t.Fatalf("parse rendered: %v\n%s", err, raw) }
+	if doc.AdditionalProps != store.PropsWarn { t.Fatalf("mode: %q", doc.AdditionalProps) }
+	if len(doc.Fields) != len(fields) { t.Fatalf("got %d fields, want %d", len(doc.Fields), len(fields)) }
+	for i, want := range fields {
+		got := doc.Fields[i]
+		wr, _ := validation.RuleFromSchema(want)
+		gr, _ := validation.RuleFromSchema(got)
+		if !reflect.DeepEqual(gr, wr) { t.Errorf("%s rule:\n got %+v\nwant %+v", want.Field, gr, wr) }
+		if got.Field != want.Field || got.Order != want.Order || got.Required != want.Required || got.Secret != want.Secret ||
+			got.Unique != want.Unique || got.UIHint != want.UIHint || got.DefaultValue != want.DefaultValue {
+			t.Errorf("%s:\n got %+v\nwant %+v", want.Field, got, want)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for name, doc := range map[string]string{
+		"empty name":        `{"properties":{"":{"type":"string"}}}`,
+		"empty nested name": `{"properties":{"a":{"type":"object","properties":{"":{"type":"string"}}}}}`,
+		"unknown keyword":   `{"properties":{"a":{"type":"string","const":"x"}}}`,
+		"other draft":       `{"$schema":"http://json-schema.org/draft-07/schema#","properties":{}}`,
+		"required missing":  `{"properties":{"a":{"type":"string"}},"required":["b"]}`,
+		"type list":         `{"properties":{"a":{"type":["string","number"]}}}`,
+	} {
+		if _, err := jsonschema.Parse("s", []byte(doc)); !errors.Is(err, jsonschema.ErrInvalid) { t.Errorf("%s: %v", name, err) }
+	}
+}
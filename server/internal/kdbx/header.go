@@ -0,0 +1,82 @@
+package kdbx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Limits on the key-derivation cost a file may ask for. The KDF runs before
+// the password can be checked, so an uploaded file must not be able to make
+// the server burn gigabytes of memory or minutes of CPU.
+const (
+	maxArgon2Memory     = 1 << 30 // bytes
+	maxArgon2Iterations = 100
+	maxAESRounds        = 200_000_000
+)
+
+var errNotKDBX = errors.New("not a KeePass KDBX file")
+
+// checkKDF reads the outer header of a KDBX 4 file and rejects KDF
+// parameters above the limits. KDBX 3 files are refused outright.
+func checkKDF(data []byte) error {
+	if len(data) < 12 { return errNotKDBX }
+	if binary.LittleEndian.Uint32(data[0:4]) != 0x9AA2D903 || binary.LittleEndian.Uint32(data[4:8]) != 0xB54BFB67 { return errNotKDBX }
+	if major := binary.LittleEndian.Uint16(data[10:12]); major != 4 {
+		return fmt.Errorf("KDBX %d.x is not supported; save the database as KDBX 4", major)
+	}
+	r := bytes.NewReader(data[12:])
+	for {
+		var id uint8
+		var size uint32
+		if err := binary.Read(r, binary.LittleEndian, &id); err != nil { return errNotKDBX }
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil { return errNotKDBX }
+		if int64(size) > int64(r.Len()) { return errNotKDBX }
+		field := make([]byte, size)
+		_, _ = r.Read(field)
+		switch id {
+		case 0: // end of header
+			return nil
+		case 11: // KdfParameters
+			return checkKDFParams(field)
+		}
+	}
+}
+
+// checkKDFParams walks the KDF variant dictionary.
+func checkKDFParams(d []byte) error {
+	if len(d) < 2 { return errNotKDBX }
+	d = d[2:] // version
+	for len(d) > 0 {
+		typ := d[0]
+		if typ == 0 { return nil }
+		if len(d) < 5 { return errNotKDBX }
+		klen := int(binary.LittleEndian.Uint32(d[1:5]))
+		if klen < 0 || len(d) < 5+klen+4 { return errNotKDBX }
+		key := string(d[5 : 5+klen])
+		d = d[5+klen:]
+		vlen := int(binary.LittleEndian.Uint32(d[0:4]))
+		if vlen < 0 || len(d) < 4+vlen { return errNotKDBX }
+		val := d[4 : 4+vlen]
+		d = d[4+vlen:]
+		var n uint64
+		switch len(val) {
+		case 4:
+			n = uint64(binary.LittleEndian.Uint32(val))
+		case 8:
+			n = binary.LittleEndian.Uint64(val)
+		default:
+			continue
+		}
+		switch {
+		case key == "M" && n > maxArgon2Memory:
+			return fmt.Errorf("argon2 memory %d MiB exceeds the %d MiB limit", n>>20, maxArgon2Memory>>20)
+		case key == "I" && n > maxArgon2Iterations:
+			return fmt.Errorf("argon2 iterations %d exceed the limit of %d", n, maxArgon2Iterations)
+		case key == "R" && n > maxAESRounds:
+			return fmt.Errorf("AES-KDF rounds %d exceed the limit of %d", n, maxAESRounds)
+		}
+	}
+	return nil
+}
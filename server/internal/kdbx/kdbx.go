@@ -0,0 +1,394 @@
+// Package kdbx reads and writes KeePass KDBX 4 databases. Groups map to
+// sites, entries to accounts, custom strings to props and protected custom
+// strings to secret schema fields.
+package kdbx
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+
+	"mss/internal/store"
+	"mss/internal/validation"
+)
+
+const (
+	// siteKeyMarker in group notes records the site key, so renamed groups
+	// still land on the right site when re-imported.
+	siteKeyMarker = "mss-site-key:"
+	// idKey is the entry custom-data item holding the account id.
+	idKey = "mss.id"
+	// jsonKey is the entry custom-data item listing, as a JSON array, the
+	// props whose text is the JSON encoding of a non-string value, so
+	// numbers, booleans, objects and arrays survive a round trip into a site
+	// that does not declare them.
+	jsonKey = "mss.json"
+	// propPrefix escapes props whose names clash with KeePass standard fields.
+	propPrefix = "props."
+)
+
+// standard entry fields; everything else is a custom string.
+var standard = map[string]bool{"Title": true, "UserName": true, "Password": true, "URL": true, "Notes": true}
+
+var (
+	ErrInvalid     = errors.New("invalid kdbx file")
+	ErrBadPassword = errors.New("wrong kdbx password")
+)
+
+type Cipher string
+
+const (
+	ChaCha20 Cipher = "chacha20"
+	AES      Cipher = "aes"
+)
+
+// ParseCipher validates a payload cipher name; empty means ChaCha20.
+func ParseCipher(s string) (Cipher, error) {
+	switch c := Cipher(strings.ToLower(s)); c {
+	case "":
+		return ChaCha20, nil
+	case ChaCha20, AES:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown cipher %q (want chacha20 or aes)", s)
+}
+
+// Export writes every live site as a group of a KDBX 4 database protected
+// by password (Argon2d KDF).
+func Export(ctx context.Context, repos store.Repos, out io.Writer, password string, cipher Cipher) error {
+	if password == "" { return errors.New("kdbx password required") }
+	db := gokeepasslib.NewDatabase(gokeepasslib.WithDatabaseKDBXVersion4())
+	db.Credentials = gokeepasslib.NewPasswordCredentials(password)
+	fh := db.Header.FileHeaders
+	// KeePass's own Argon2d defaults; the library's 1 GiB is too heavy for a server
+	fh.KdfParameters.Memory = 64 << 20
+	fh.KdfParameters.Iterations = 2
+	if cipher == AES {
+		fh.CipherID = gokeepasslib.CipherAES
+		fh.EncryptionIV = make([]byte, 16)
+		_, _ = rand.Read(fh.EncryptionIV)
+	}
+	db.Content.Meta.DatabaseName = "mss"
+
+	root := gokeepasslib.NewGroup()
+	root.Name = "mss"
+	sites, err := repos.Sites.List(ctx)
+	if err != nil { return err }
+	for _, s := range sites {
+		g, err := exportSite(ctx, repos, s)
+		if err != nil { return err }
+		root.Groups = append(root.Groups, g)
+	}
+	db.Content.Root = &gokeepasslib.RootData{Groups: []gokeepasslib.Group{root}}
+	if err := db.LockProtectedEntries(); err != nil { return err }
+	return gokeepasslib.NewEncoder(out).Encode(db)
+}
+
+func exportSite(ctx context.Context, repos store.Repos, s store.Site) (gokeepasslib.Group, error) {
+	g := gokeepasslib.NewGroup()
+	g.Name = s.Name
+	if g.Name == "" { g.Name = s.Key }
+	g.Notes = siteKeyMarker + " " + s.Key
+	schemas, err := repos.Schemas.List(ctx, s.Key)
+	if err != nil { return g, err }
+	secret := map[string]bool{}
+	for _, f := range schemas { secret[f.Field] = f.Secret != 0 }
+	accs, err := repos.Accounts.List(ctx, s.Key)
+	if err != nil { return g, err }
+	for _, a := range accs {
+		e := gokeepasslib.NewEntry()
+		e.Values = append(e.Values,
+			value("Title", a.Username, false),
+			value("UserName", a.Username, false),
+			value("Password", a.Password, true),
+			value("URL", s.LoginURL, false),
+		)
+		var props map[string]interface{}
+		if a.Extra != "" { _ = json.Unmarshal([]byte(a.Extra), &props) }
+		var typed []string
+		for k, v := range props {
+			name := k
+			if standard[k] || strings.HasPrefix(k, propPrefix) { name = propPrefix + k }
+			e.Values = append(e.Values, value(name, validation.FormatValue(v), secret[k]))
+			if _, text := v.(string); !text && v != nil { typed = append(typed, k) }
+		}
+		e.CustomData = append(e.CustomData, gokeepasslib.CustomData{Key: idKey, Value: a.ID})
+		if len(typed) > 0 {
+			sort.Strings(typed)
+			b, _ := json.Marshal(typed)
+			e.CustomData = append(e.CustomData, gokeepasslib.CustomData{Key: jsonKey, Value: string(b)})
+		}
+		g.Entries = append(g.Entries, e)
+	}
+	return g, nil
+}
+
+func value(key, content string, protected bool) gokeepasslib.ValueData {
+	return gokeepasslib.ValueData{Key: key, Value: gokeepasslib.V{Content: content, Protected: w.NewBoolWrapper(protected)}}
+}
+
+// Open decrypts a KDBX 4 file.
+func Open(data []byte, password string) (*gokeepasslib.Database, error) {
+	if err := checkKDF(data); err != nil { return nil, fmt.Errorf("%w: %v", ErrInvalid, err) }
+	db := gokeepasslib.NewDatabase()
+	db.Credentials = gokeepasslib.NewPasswordCredentials(password)
+	if err := gokeepasslib.NewDecoder(bytes.NewReader(data)).Decode(db); err != nil {
+		// the library reports a failed HMAC check only through its message
+		if strings.HasPrefix(err.Error(), "Wrong password") { return nil, ErrBadPassword }
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if err := db.UnlockProtectedEntries(); err != nil { return nil, fmt.Errorf("%w: %v", ErrInvalid, err) }
+	return db, nil
+}
+
+type Counts struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+}
+
+type Skipped struct {
+	Group  string `json:"group"`
+	Title  string `json:"title,omitempty"`
+	Reason string `json:"reason"`
+}
+
+type Report struct {
+	DryRun   bool      `json:"dryRun"`
+	Sites    Counts    `json:"sites"` // updated = merged into an existing site
+	Accounts Counts    `json:"accounts"`
+	Schemas  Counts    `json:"schemas"`
+	Skipped  []Skipped `json:"skipped"`
+	// Warnings are props problems that did not stop an entry, prefixed
+	// with the entry title.
+	Warnings []string `json:"warnings,omitempty"`
+	// Attachments counts binary attachments, which are not imported.
+	Attachments int `json:"attachments"`
+}
+
+var errDryRun = errors.New("dry run")
+
+// Import merges a decrypted database into repos in one transaction. Every
+// group that holds entries becomes (or merges into) a site; entries are
+// matched by their mss id, then by username.
+func Import(ctx context.Context, repos store.Repos, db *gokeepasslib.Database, dryRun bool) (*Report, error) {
+	var rep *Report
+	err := repos.Tx.InTx(ctx, func(tx store.Repos) error {
+		im := &importer{tx: tx, rep: &Report{DryRun: dryRun, Skipped: []Skipped{}}, sites: map[string]bool{}}
+		if db.Content.Meta != nil && bool(db.Content.Meta.RecycleBinEnabled.Bool) { im.recycle = db.Content.Meta.RecycleBinUUID }
+		if db.Content.Root != nil {
+			for _, g := range db.Content.Root.Groups {
+				if err := im.group(ctx, g); err != nil { return err }
+			}
+		}
+		rep = im.rep
+		if dryRun { return errDryRun }
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) { return nil, err }
+	return rep, nil
+}
+
+type importer struct {
+	tx      store.Repos
+	rep     *Report
+	recycle gokeepasslib.UUID
+	sites   map[string]bool // site keys already resolved in this import
+}
+
+func (im *importer) group(ctx context.Context, g gokeepasslib.Group) error {
+	if g.UUID.Compare(im.recycle) { return nil }
+	if len(g.Entries) > 0 {
+		if err := im.site(ctx, g); err != nil { return fmt.Errorf("group %q: %w", g.Name, err) }
+	}
+	for _, sub := range g.Groups {
+		if err := im.group(ctx, sub); err != nil { return err }
+	}
+	return nil
+}
+
+func (im *importer) site(ctx context.Context, g gokeepasslib.Group) error {
+	key := siteKeyFromNotes(g.Notes)
+	if key == "" { key = slug(g.Name) }
+	if !im.sites[key] {
+		cur, err := im.tx.Sites.Get(ctx, key)
+		if err != nil { return err }
+		if cur == nil {
+			s := store.Site{Key: key, Name: g.Name, LoginURL: firstURL(g.Entries)}
+			if err := im.tx.Sites.Create(ctx, &s); err != nil {
+				if errors.Is(err, store.ErrConflict) { return fmt.Errorf("site key %q is in trash; restore or purge it first: %w", key, err) }
+				return err
+			}
+			im.rep.Sites.Created++
+		} else {
+			im.rep.Sites.Updated++
+		}
+		im.sites[key] = true
+	}
+
+	// protected custom strings become secret schema fields
+	for _, e := range g.Entries {
+		for _, v := range e.Values {
+			if standard[v.Key] || !bool(v.Value.Protected.Bool) { continue }
+			if err := im.secretField(ctx, key, propName(v.Key)); err != nil { return err }
+		}
+	}
+	v, err := validation.Load(ctx, im.tx, key)
+	if err != nil { return err }
+	batch := v.Batch()
+	accs, err := im.tx.Accounts.List(ctx, key)
+	if err != nil { return err }
+	byID := map[string]store.Account{}
+	byUsername := map[string]store.Account{}
+	for _, a := range accs {
+		byID[a.ID] = a
+		if _, dup := byUsername[a.Username]; !dup { byUsername[a.Username] = a }
+	}
+	for _, e := range g.Entries {
+		if err := im.entry(ctx, g, key, e, v, batch, byID, byUsername); err != nil { return fmt.Errorf("entry %q: %w", e.GetTitle(), err) }
+	}
+	return nil
+}
+
+func (im *importer) secretField(ctx context.Context, siteKey, field string) error {
+	cur, err := im.tx.Schemas.Get(ctx, siteKey, field)
+	if err != nil { return err }
+	if cur != nil && cur.Secret != 0 { return nil }
+	f := store.SiteFieldSchema{SiteKey: siteKey, Field: field, Type: "string", Secret: 1}
+	if cur != nil {
+		f = *cur
+		f.Secret = 1
+	}
+	if err := im.tx.Schemas.Upsert(ctx, &f, 0); err != nil { return err }
+	if cur == nil { im.rep.Schemas.Created++ } else { im.rep.Schemas.Updated++ }
+	return nil
+}
+
+func (im *importer) entry(ctx context.Context, g gokeepasslib.Group, siteKey string, e gokeepasslib.Entry, v *validation.Validator, batch *validation.Batch, byID, byUsername map[string]store.Account) error {
+	im.rep.Attachments += len(e.Binaries)
+	username := strings.TrimSpace(e.GetContent("UserName"))
+	if username == "" { username = strings.TrimSpace(e.GetTitle()) }
+	if username == "" {
+		im.rep.Skipped = append(im.rep.Skipped, Skipped{Group: g.Name, Reason: "no username or title"})
+		return nil
+	}
+	props := map[string]interface{}{}
+	var existing *store.Account
+	var wantID string
+	typed := map[string]bool{}
+	for _, cd := range e.CustomData {
+		switch cd.Key {
+		case idKey:
+			wantID = cd.Value
+		case jsonKey:
+			var names []string
+			_ = json.Unmarshal([]byte(cd.Value), &names)
+			for _, n := range names { typed[n] = true }
+		}
+	}
+	if a, ok := byID[wantID]; ok && wantID != "" {
+		existing = &a
+	} else if a, ok := byUsername[username]; ok {
+		existing = &a
+	}
+	if existing != nil && existing.Extra != "" { _ = json.Unmarshal([]byte(existing.Extra), &props) }
+	types := map[string]string{}
+	for _, f := range v.Schemas { types[f.Field] = f.Type }
+	for _, ev := range e.Values {
+		if standard[ev.Key] { continue }
+		name := propName(ev.Key)
+		typ := types[name]
+		if typ == "" && typed[name] {
+			var val interface{}
+			if err := json.Unmarshal([]byte(ev.Value.Content), &val); err != nil { return fmt.Errorf("field %q: %v", ev.Key, err) }
+			props[name] = val
+			continue
+		}
+		if typ == "" { typ = "string" }
+		val, err := validation.CoerceString(ev.Value.Content, typ)
+		if err != nil { return fmt.Errorf("field %q: %v", ev.Key, err) }
+		if val == nil { delete(props, name); continue }
+		props[name] = val
+	}
+	if notes := strings.TrimSpace(e.GetContent("Notes")); notes != "" { props["notes"] = notes }
+	self := ""
+	if existing != nil { self = existing.ID }
+	props = v.Normalize(props)
+	acc := store.Account{ID: self, SiteKey: siteKey, Username: username, Password: e.GetPassword()}
+	warnings, err := batch.ValidateAccount(ctx, im.tx, acc, props)
+	if err != nil { return err }
+	for _, w := range warnings { im.rep.Warnings = append(im.rep.Warnings, fmt.Sprintf("entry %q: %s", e.GetTitle(), w)) }
+
+	if len(props) > 0 {
+		b, _ := json.Marshal(props)
+		acc.Extra = string(b)
+	}
+	if existing != nil {
+		acc.ID = existing.ID
+		if err := im.tx.Accounts.Update(ctx, &acc, 0); err != nil { return err }
+		im.rep.Accounts.Updated++
+	} else {
+		acc.ID = wantID
+		if acc.ID == "" { acc.ID = store.GenerateID("acc") }
+		err := im.tx.Accounts.Create(ctx, &acc)
+		if errors.Is(err, store.ErrConflict) {
+			// the id belongs to another site or a trashed account
+			acc.ID = store.GenerateID("acc")
+			err = im.tx.Accounts.Create(ctx, &acc)
+		}
+		if err != nil { return err }
+		im.rep.Accounts.Created++
+	}
+	batch.Claim(acc)
+	byID[acc.ID] = acc
+	byUsername[acc.Username] = acc
+	return nil
+}
+
+func propName(key string) string {
+	if strings.HasPrefix(key, propPrefix) && len(key) > len(propPrefix) { return strings.TrimPrefix(key, propPrefix) }
+	return key
+}
+
+func siteKeyFromNotes(notes string) string {
+	for _, line := range strings.Split(notes, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, siteKeyMarker) { return strings.TrimSpace(strings.TrimPrefix(line, siteKeyMarker)) }
+	}
+	return ""
+}
+
+func firstURL(entries []gokeepasslib.Entry) string {
+	for _, e := range entries {
+		if u := strings.TrimSpace(e.GetContent("URL")); u != "" {
+			if p, err := url.Parse(u); err == nil && p.Scheme != "" { return u }
+		}
+	}
+	return ""
+}
+
+// slug turns a group name into a site key.
+func slug(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+	s := strings.Trim(b.String(), "-")
+	for strings.Contains(s, "--") { s = strings.ReplaceAll(s, "--", "-") }
+	if s == "" { s = "keepass" }
+	return s
+}
@@ -0,0 +1,65 @@
+package kdbx_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"mss/internal/kdbx"
+	"mss/internal/store"
+)
+
+func props(t *testing.T, a store.Account) map[string]interface{} {
+	t.Helper()
+	out := map[string]interface{}{}
+	if a.Extra != "" {
+		if err := json.Unmarshal([]byte(a.Extra), &out); err != nil { t.Fatal(err) }
+	}
+	return out
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx, src := context.Background(), store.NewMemory(store.RevisionSecrets{})
+	must := func(err error) { t.Helper(); if err != nil { t.Fatal(err) } }
+	must(src.Sites.Create(ctx, &store.Site{Key: "gh", Name: "GitHub", LoginURL: "https://github.com/login"}))
+	must(src.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "gh", Field: "age", Type: "integer"}, 0))
+	must(src.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "gh", Field: "token", Type: "string", Secret: 1}, 0))
+	want := []store.Account{
+		{ID: "a1", SiteKey: "gh", Username: "alice", Password: "pw1",
+			Extra: `{"age":30,"token":"t0k","n":5,"on":true,"obj":{"a":[1,"x"]},"text":"5","Title":"clash","notes":"hi"}`},
+		{ID: "a2", SiteKey: "gh", Username: "bob", Password: "pw2"},
+	}
+	for i := range want { must(src.Accounts.Create(ctx, &want[i])) }
+
+	var buf bytes.Buffer
+	must(kdbx.Export(ctx, src, &buf, "master", kdbx.ChaCha20))
+	if _, err := kdbx.Open(buf.Bytes(), "wrong"); !errors.Is(err, kdbx.ErrBadPassword) { t.Fatalf("wrong password: %v", err) }
+	db, err := kdbx.Open(buf.Bytes(), "master")
+	must(err)
+
+	dst := store.NewMemory(store.RevisionSecrets{})
+	rep, err := kdbx.Import(ctx, dst, db, false)
+	must(err)
+	if rep.Sites.Created != 1 || rep.Accounts.Created != 2 || rep.Schemas.Created != 1 || len(rep.Skipped) != 0 { t.Fatalf("report: %+v", rep) }
+	site, err := dst.Sites.Get(ctx, "gh")
+	must(err)
+	if site == nil || site.Name != "GitHub" || site.LoginURL != "https://github.com/login" { t.Fatalf("site: %+v", site) }
+	token, err := dst.Schemas.Get(ctx, "gh", "token")
+	must(err)
+	if token == nil || token.Secret == 0 { t.Fatalf("secret field: %+v", token) }
+	for _, w := range want {
+		got, err := dst.Accounts.Get(ctx, "gh", w.ID)
+		must(err)
+		if got == nil { t.Fatalf("%s not imported", w.ID) }
+		if got.Username != w.Username || got.Password != w.Password { t.Errorf("%s: %+v", w.ID, got) }
+		if p, q := props(t, *got), props(t, w); !reflect.DeepEqual(p, q) { t.Errorf("%s props:\n got %#v\nwant %#v", w.ID, p, q) }
+	}
+
+	// importing the same file again matches every entry by its id
+	rep, err = kdbx.Import(ctx, dst, db, false)
+	must(err)
+	if rep.Sites.Updated != 1 || rep.Accounts.Updated != 2 || rep.Accounts.Created != 0 { t.Fatalf("re-import: %+v", rep) }
+}
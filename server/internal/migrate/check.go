@@ -0,0 +1,131 @@
+package migrate
+
+import (
+    "context"
+    "fmt"
+    "strings"
+
+    "github.com/jmoiron/sqlx"
+)
+
+// VerifyError is a migration that broke a post-migration check. Version
+// names the step that failed, or every version applied when the check ran
+// after commit.
+type VerifyError struct {
+    Version  string `json:"version"`
+    Check    string `json:"check"` // integrity_check, foreign_key_check or fingerprint
+    Detail   string `json:"detail"`
+    Snapshot string `json:"snapshot,omitempty"` // restored snapshot, if any
+}
+
+func (e *VerifyError) Error() string {
+    s := fmt.Sprintf("migration %s failed %s: %s", e.Version, e.Check, e.Detail)
+    if e.Snapshot != "" { s += "; database restored from " + e.Snapshot }
+    return s
+}
+
+// integrityProblems runs PRAGMA integrity_check and returns its complaints.
+func integrityProblems(ctx context.Context, q sqlx.QueryerContext) ([]string, error) {
+    var out []string
+    if err := sqlx.SelectContext(ctx, q, &out, `PRAGMA integrity_check`); err != nil { return nil, err }
+    if len(out) == 1 && out[0] == "ok" { return nil, nil }
+    return out, nil
+}
+
+// fkViolations runs PRAGMA foreign_key_check and describes each violation.
+func fkViolations(ctx context.Context, q sqlx.QueryerContext) ([]string, error) {
+    rows, err := q.QueryxContext(ctx, `PRAGMA foreign_key_check`)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    var out []string
+    for rows.Next() {
+        var table, parent string
+        var rowid, fkid interface{}
+        if err := rows.Scan(&table, &rowid, &parent, &fkid); err != nil { return nil, err }
+        out = append(out, fmt.Sprintf("%s row %v references a missing %s", table, rowid, parent))
+    }
+    return out, rows.Err()
+}
+
+// fingerprint describes the schema structurally (columns with type, not
+// null and primary key position, and indexed columns) so that equivalent
+// schemas match regardless of how their SQL was written. The migration
+// ledger and lease tables are left out.
+func fingerprint(ctx context.Context, q sqlx.QueryerContext) ([]string, error) {
+    const user = `m.name NOT LIKE 'sqlite\_%' ESCAPE '\' AND m.name NOT LIKE 'schema\_%' ESCAPE '\' AND m.tbl_name NOT LIKE 'schema\_%' ESCAPE '\'`
+    var cols []struct {
+        Table   string `db:"tbl"`
+        Column  string `db:"col"`
+        Type    string `db:"typ"`
+        NotNull int    `db:"nn"`
+        PK      int    `db:"pk"`
+    }
+    if err := sqlx.SelectContext(ctx, q, &cols, `SELECT m.name AS tbl, p.name AS col, p.type AS typ, p."notnull" AS nn, p.pk AS pk
+        FROM sqlite_master m, pragma_table_info(m.name) p WHERE m.type = 'table' AND `+user+` ORDER BY m.name, p.cid`); err != nil { return nil, err }
+    var idx []struct {
+        Name   string `db:"name"`
+        Table  string `db:"tbl"`
+        Column string `db:"col"`
+    }
+    if err := sqlx.SelectContext(ctx, q, &idx, `SELECT m.name AS name, m.tbl_name AS tbl, COALESCE(i.name, '') AS col
+        FROM sqlite_master m, pragma_index_info(m.name) i WHERE m.type = 'index' AND `+user+` ORDER BY m.name, i.seqno`); err != nil { return nil, err }
+    out := make([]string, 0, len(cols)+len(idx))
+    for _, c := range cols { out = append(out, fmt.Sprintf("table %s column %s %s notnull=%d pk=%d", c.Table, c.Column, strings.ToUpper(c.Type), c.NotNull, c.PK)) }
+    for i := 0; i < len(idx); {
+        j, names := i, []string{}
+        for ; j < len(idx) && idx[j].Name == idx[i].Name; j++ { names = append(names, idx[j].Column) }
+        out = append(out, fmt.Sprintf("index %s on %s(%s)", idx[i].Name, idx[i].Table, strings.Join(names, ",")))
+        i = j
+    }
+    return out, nil
+}
+
+// fingerprintDiff describes the first difference between two fingerprints,
+// or returns "" when they match.
+func fingerprintDiff(want, got []string) string {
+    w, g := map[string]bool{}, map[string]bool{}
+    for _, l := range want { w[l] = true }
+    for _, l := range got { g[l] = true }
+    for _, l := range want {
+        if !g[l] { return "missing " + l }
+    }
+    for _, l := range got {
+        if !w[l] { return "unexpected " + l }
+    }
+    return ""
+}
+
+// reference is an in-memory database kept at the schema a fresh install
+// would have, to compare fingerprints against.
+type reference struct {
+    db *sqlx.DB
+    tx *sqlx.Tx
+}
+
+func newReference(ctx context.Context, scripts []script, applied map[string]struct{}) (*reference, error) {
+    db, err := sqlx.Open("sqlite", ":memory:")
+    if err != nil { return nil, err }
+    db.SetMaxOpenConns(1)
+    tx, err := db.BeginTxx(ctx, nil)
+    if err != nil { _ = db.Close(); return nil, err }
+    ref := &reference{db: db, tx: tx}
+    for _, s := range scripts {
+        if _, ok := applied[s.version]; !ok { continue }
+        if err := s.run(ctx, tx, func(int, int) {}); err != nil { ref.close(); return nil, fmt.Errorf("reference %s: %w", s.name, err) }
+    }
+    return ref, nil
+}
+
+// check compares the fingerprint of q with the reference.
+func (r *reference) check(ctx context.Context, q sqlx.QueryerContext) (string, error) {
+    want, err := fingerprint(ctx, r.tx)
+    if err != nil { return "", err }
+    got, err := fingerprint(ctx, q)
+    if err != nil { return "", err }
+    return fingerprintDiff(want, got), nil
+}
+
+func (r *reference) close() {
+    _ = r.tx.Rollback()
+    _ = r.db.Close()
+}
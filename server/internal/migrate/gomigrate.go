@@ -0,0 +1,51 @@
+package migrate
+
+import (
+    "context"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+)
+
+// Func is a Go migration step. It runs inside the migration transaction,
+// together with the SQL scripts around it, and should report progress for
+// long row rewrites.
+type Func func(ctx context.Context, tx *sqlx.Tx, progress Progress) error
+
+// Progress reports done out of total units (total 0 when unknown).
+type Progress func(done, total int)
+
+// GoMigration is a data migration SQL cannot express, such as encrypting
+// existing passwords or reshaping accounts.extra. Its version shares the
+// ledger and ordering with NNNN_name.sql files and must not collide with
+// them.
+type GoMigration struct {
+    Version string
+    Name    string
+    Up      Func
+    Down    Func // optional; without it the version cannot be rolled back
+}
+
+var goMigrations []GoMigration
+
+// Register adds a Go migration. Call it from an init function in this
+// package, next to the sql/ directory.
+func Register(m GoMigration) {
+    if m.Version == "" || m.Name == "" || m.Up == nil { panic("migrate: Register needs Version, Name and Up") }
+    goMigrations = append(goMigrations, m)
+}
+
+// goName is how a Go migration appears in status output and errors. Its
+// checksum covers only this name, since code cannot be hashed.
+func goName(m GoMigration) string { return "go:" + m.Name }
+
+// throttled reports to fn at most once a second, plus the final call.
+func throttled(version string, fn func(version string, done, total int)) Progress {
+    if fn == nil { return func(int, int) {} }
+    var last time.Time
+    return func(done, total int) {
+        if (total == 0 || done < total) && time.Since(last) < time.Second { return }
+        last = time.Now()
+        fn(version, done, total)
+    }
+}
@@ -0,0 +1,163 @@
+package migrate
+
+import (
+    "context"
+    "crypto/rand"
+    "database/sql"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+    "modernc.org/sqlite"
+    sqlite3 "modernc.org/sqlite/lib"
+)
+
+// DefaultLeaseTTL is how long a lease lasts without a heartbeat.
+const DefaultLeaseTTL = 30 * time.Second
+
+// ErrLocked means another process holds the migration lease; the details
+// come in a *LockedError.
+var ErrLocked = errors.New("migrations are locked by another process")
+
+// ErrLeaseLost means the lease expired and was taken over while migrating.
+var ErrLeaseLost = errors.New("migration lease was lost to another process")
+
+// LeaseInfo describes the current holder of the migration lease.
+type LeaseInfo struct {
+    Holder     string `json:"holder" db:"holder"` // host:pid:nonce
+    AcquiredAt int64  `json:"acquiredAt" db:"acquired_at"`
+    ExpiresAt  int64  `json:"expiresAt" db:"expires_at"`
+}
+
+// LockedError is returned when the lease stayed taken for the whole wait.
+type LockedError struct {
+    Lease  LeaseInfo
+    Waited time.Duration
+}
+
+func (e *LockedError) Error() string {
+    s := fmt.Sprintf("migrations are being run by %s since %s (lease expires %s)", e.Lease.Holder,
+        time.Unix(e.Lease.AcquiredAt, 0).UTC().Format(time.RFC3339), time.Unix(e.Lease.ExpiresAt, 0).UTC().Format(time.RFC3339))
+    if e.Waited > 0 { s += fmt.Sprintf("; gave up after waiting %s", e.Waited) }
+    return s
+}
+
+func (e *LockedError) Is(target error) bool { return target == ErrLocked }
+
+// lease is a held migration lease, kept alive by a heartbeat until release.
+// The row lives in schema_lock, next to the ledger, so every process
+// sharing the database file sees it.
+type lease struct {
+    db     *sqlx.DB
+    holder string
+    ttl    time.Duration
+    stop   chan struct{}
+    wg     sync.WaitGroup
+}
+
+// acquireLease takes the lease, retrying for up to wait while another
+// process holds it. An expired lease is taken over.
+func acquireLease(ctx context.Context, db *sqlx.DB, ttl, wait time.Duration) (*lease, error) {
+    if ttl <= 0 { ttl = DefaultLeaseTTL }
+    if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_lock(
+        id INTEGER PRIMARY KEY CHECK (id = 1),
+        holder TEXT NOT NULL,
+        acquired_at INTEGER NOT NULL,
+        expires_at INTEGER NOT NULL
+    )`); err != nil && !isBusy(err) { return nil, err }
+    l := &lease{db: db, holder: newHolder(), ttl: ttl, stop: make(chan struct{})}
+    start := time.Now()
+    for {
+        ok, err := l.try(ctx)
+        if err != nil && !isBusy(err) { return nil, err }
+        if ok { break }
+        if time.Since(start) >= wait {
+            info, err := currentLease(ctx, db)
+            if err != nil { return nil, err }
+            if info == nil { info = &LeaseInfo{Holder: "another process (database busy)"} }
+            return nil, &LockedError{Lease: *info, Waited: wait}
+        }
+        select {
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        case <-time.After(time.Second):
+        }
+    }
+    l.wg.Add(1)
+    go l.heartbeat()
+    return l, nil
+}
+
+func (l *lease) try(ctx context.Context) (bool, error) {
+    now := time.Now().Unix()
+    res, err := l.db.ExecContext(ctx, `INSERT INTO schema_lock(id, holder, acquired_at, expires_at) VALUES(1, ?, ?, ?)
+        ON CONFLICT(id) DO UPDATE SET holder = excluded.holder, acquired_at = excluded.acquired_at, expires_at = excluded.expires_at
+        WHERE schema_lock.expires_at < excluded.acquired_at`, l.holder, now, l.expiry())
+    if err != nil { return false, err }
+    n, err := res.RowsAffected()
+    return n == 1, err
+}
+
+func (l *lease) expiry() int64 { return time.Now().Add(l.ttl).Unix() }
+
+// heartbeat extends the lease every third of its TTL. While the migration
+// transaction holds the write lock the update fails as busy; extend, run
+// inside that transaction, covers that stretch.
+func (l *lease) heartbeat() {
+    defer l.wg.Done()
+    tick := time.NewTicker(l.ttl / 3)
+    defer tick.Stop()
+    for {
+        select {
+        case <-l.stop:
+            return
+        case <-tick.C:
+            _, _ = l.db.Exec(`UPDATE schema_lock SET expires_at = ? WHERE id = 1 AND holder = ?`, l.expiry(), l.holder)
+        }
+    }
+}
+
+// extend renews the lease inside tx and fails with ErrLeaseLost if another
+// process took it over, so a stale holder cannot commit.
+func (l *lease) extend(ctx context.Context, tx *sqlx.Tx) error {
+    res, err := tx.ExecContext(ctx, `UPDATE schema_lock SET expires_at = ? WHERE id = 1 AND holder = ?`, l.expiry(), l.holder)
+    if err != nil { return err }
+    if n, err := res.RowsAffected(); err != nil || n != 1 { return ErrLeaseLost }
+    return nil
+}
+
+func (l *lease) release() {
+    close(l.stop)
+    l.wg.Wait()
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    _, _ = l.db.ExecContext(ctx, `DELETE FROM schema_lock WHERE id = 1 AND holder = ?`, l.holder)
+}
+
+// currentLease returns the live lease, or nil when none is held.
+func currentLease(ctx context.Context, q sqlx.QueryerContext) (*LeaseInfo, error) {
+    var exists int
+    if err := sqlx.GetContext(ctx, q, &exists, `SELECT COUNT(1) FROM sqlite_master WHERE type='table' AND name='schema_lock'`); err != nil { return nil, err }
+    if exists == 0 { return nil, nil }
+    var info LeaseInfo
+    err := sqlx.GetContext(ctx, q, &info, `SELECT holder, acquired_at, expires_at FROM schema_lock WHERE id = 1 AND expires_at >= ?`, time.Now().Unix())
+    if errors.Is(err, sql.ErrNoRows) { return nil, nil }
+    if err != nil { return nil, err }
+    return &info, nil
+}
+
+func newHolder() string {
+    host, _ := os.Hostname()
+    b := make([]byte, 4)
+    _, _ = rand.Read(b)
+    return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+func isBusy(err error) bool {
+    var se *sqlite.Error
+    return errors.As(err, &se) && se.Code()&0xff == sqlite3.SQLITE_BUSY
+}
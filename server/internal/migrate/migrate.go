@@ -2,6 +2,8 @@ package migrate
 
 import (
     "context"
+    "errors"
+    "fmt"
     "sort"
     "strings"
     "time"
@@ -19,6 +21,13 @@ import (
 //go:embed sql/*.sql
 var sqlFS embed.FS
 
+// downSuffix marks rollback scripts: NNNN_name.down.sql undoes NNNN_name.sql.
+const downSuffix = ".down.sql"
+
+// ErrNoDown is returned when a rollback would cross a migration without a
+// down script or Down function.
+var ErrNoDown = errors.New("migration has no down script")
+
 func versionFromName(name string) string {
     n := name
     if i := strings.IndexByte(n, '_'); i >= 0 { n = n[:i] }
@@ -32,62 +41,269 @@ func listSQLNames() ([]string, error) {
     names := make([]string, 0, len(entries))
     for _, e := range entries {
         if e.IsDir() { continue }
-        if !strings.HasSuffix(e.Name(), ".sql") { continue }
+        if !strings.HasSuffix(e.Name(), ".sql") || strings.HasSuffix(e.Name(), downSuffix) { continue }
         names = append(names, e.Name())
     }
     sort.Strings(names)
     return names, nil
 }
 
-func Apply(ctx context.Context, db *sqlx.DB) error {
-    names, err := listSQLNames()
-    if err != nil { return err }
+// downScripts maps versions to their rollback: a down SQL file or the Down
+// of a Go migration.
+func downScripts() (map[string]script, error) {
+    entries, err := fs.ReadDir(sqlFS, "sql")
+    if err != nil { return nil, err }
+    out := make(map[string]script)
+    for _, e := range entries {
+        if e.IsDir() || !strings.HasSuffix(e.Name(), downSuffix) { continue }
+        b, err := sqlFS.ReadFile("sql/" + e.Name())
+        if err != nil { return nil, err }
+        v := versionFromName(e.Name())
+        out[v] = script{version: v, name: e.Name(), body: b}
+    }
+    for _, m := range goMigrations {
+        if m.Down != nil { out[m.Version] = script{version: m.Version, name: goName(m), fn: m.Down} }
+    }
+    return out, nil
+}
+
+// run executes one migration step inside tx.
+func (s script) run(ctx context.Context, tx *sqlx.Tx, progress Progress) error {
+    if s.fn != nil { return s.fn(ctx, tx, progress) }
+    _, err := tx.ExecContext(ctx, string(s.body))
+    return err
+}
+
+// Options control Apply.
+type Options struct {
+    // Force applies even when applied scripts were modified or are missing,
+    // recording the current checksums, and skips the schema fingerprint
+    // comparison. Duplicate versions are always refused.
+    Force bool
+    // To stops after this version; empty applies everything pending.
+    To string
+    // Progress, if set, receives progress from Go migrations, at most
+    // once a second per migration.
+    Progress func(version string, done, total int)
+    // Snapshots is how many pre-migration snapshots to keep next to the
+    // database file; 0 takes none.
+    Snapshots int
+    // Logf, if set, receives notes such as the snapshot written.
+    Logf func(format string, args ...interface{})
+    // Wait is how long to wait for another process's migration lease
+    // before failing with a *LockedError; 0 fails at once.
+    Wait time.Duration
+    // LeaseTTL is how long the lease outlives a stopped heartbeat, so a
+    // crashed migrator blocks others only briefly; 0 means DefaultLeaseTTL.
+    LeaseTTL time.Duration
+}
+
+// Apply runs pending migrations (up to opts.To) in one transaction after
+// checking the ledger against the embedded scripts; disagreements return a
+// *DriftError. It returns the versions applied.
+//
+// An existing database is first snapshotted. After each step the schema
+// must match what a fresh install reaches at that version and no new
+// foreign key violations may appear; after commit PRAGMA integrity_check
+// and foreign_key_check must pass. Failures return a *VerifyError naming
+// the version; failures after commit restore the snapshot.
+//
+// Processes sharing the database file take turns through a lease; see
+// Options.Wait.
+func Apply(ctx context.Context, db *sqlx.DB, opts Options) ([]string, error) {
+    logf := opts.Logf
+    if logf == nil { logf = func(string, ...interface{}) {} }
+    dups, err := duplicates()
+    if err != nil { return nil, err }
+    if len(dups) > 0 { return nil, &DriftError{Issues: dups} }
+    scripts, err := upScripts()
+    if err != nil { return nil, err }
+    if err := checkVersion(scripts, opts.To); err != nil { return nil, err }
+    l, err := acquireLease(ctx, db, opts.LeaseTTL, opts.Wait)
+    if err != nil { return nil, err }
+    defer l.release()
+
+    rows, err := readLedger(ctx, db)
+    if err != nil { return nil, err }
+    if issues := compare(rows, scripts); len(issues) > 0 && !opts.Force { return nil, &DriftError{Issues: issues} }
+    var snap string
+    if opts.Snapshots > 0 && len(rows) > 0 && len(pendingScripts(scripts, ledgerSet(rows), opts.To)) > 0 {
+        file, err := dbFile(ctx, db)
+        if err != nil { return nil, err }
+        if file != "" {
+            snap, err = snapshot(ctx, db, file, opts.Snapshots)
+            if snap == "" { return nil, err }
+            if err != nil { logf("migrate: %v", err) }
+            logf("migrate: snapshot written to %s", snap)
+        }
+    }
 
     tx, err := db.BeginTxx(ctx, nil)
-    if err != nil { return err }
-    // ensure ledger
-    if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations(
-        version TEXT PRIMARY KEY,
-        applied_at INTEGER NOT NULL
-    )`); err != nil { _ = tx.Rollback(); return err }
+    if err != nil { return nil, err }
+    defer func() { _ = tx.Rollback() }()
+    if err := ensureLedger(ctx, tx); err != nil { return nil, err }
+    if rows, err = readLedger(ctx, tx); err != nil { return nil, err }
+    if issues := compare(rows, scripts); len(issues) > 0 && !opts.Force { return nil, &DriftError{Issues: issues} }
 
-    var applied []string
-    if err := tx.SelectContext(ctx, &applied, `SELECT version FROM schema_migrations`); err != nil { _ = tx.Rollback(); return err }
-    done := make(map[string]struct{}, len(applied))
-    for _, v := range applied { done[v] = struct{}{} }
-
-    for _, name := range names {
-        v := versionFromName(name)
-        if _, ok := done[v]; ok { continue }
-        b, err := sqlFS.ReadFile("sql/" + name)
-        if err != nil { _ = tx.Rollback(); return err }
-        if _, err := tx.ExecContext(ctx, string(b)); err != nil { _ = tx.Rollback(); return err }
-        if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations(version, applied_at) VALUES(?, ?)`, v, time.Now().Unix()); err != nil { _ = tx.Rollback(); return err }
+    sums := make(map[string]string, len(scripts))
+    for _, s := range scripts { sums[s.version] = s.sum }
+    done := ledgerSet(rows)
+    for _, r := range rows {
+        // backfill ledgers from before checksums, and accept forced edits
+        if sum, ok := sums[r.Version]; ok && r.Checksum.String != sum {
+            if _, err := tx.ExecContext(ctx, `UPDATE schema_migrations SET checksum = ? WHERE version = ?`, sum, r.Version); err != nil { return nil, err }
+        }
+    }
+    pending := pendingScripts(scripts, done, opts.To)
+    ran := []string{}
+    if len(pending) == 0 {
+        if err := l.extend(ctx, tx); err != nil { return nil, err }
+        if err := tx.Commit(); err != nil { return nil, err }
+        return ran, nil
+    }
+
+    var ref *reference
+    if !opts.Force {
+        if ref, err = newReference(ctx, scripts, done); err != nil { return nil, err }
+        defer ref.close()
+        diff, err := ref.check(ctx, tx)
+        if err != nil { return nil, err }
+        if diff != "" && len(rows) > 0 { return nil, &VerifyError{Version: rows[len(rows)-1].Version, Check: "fingerprint", Detail: "schema already differs from a fresh install before migrating: " + diff} }
+    }
+    fkBefore, err := fkViolations(ctx, tx)
+    if err != nil { return nil, err }
+
+    for _, s := range pending {
+        if err := s.run(ctx, tx, throttled(s.version, opts.Progress)); err != nil { return nil, fmt.Errorf("%s: %w", s.name, err) }
+        if ref != nil {
+            if err := s.run(ctx, ref.tx, func(int, int) {}); err != nil { return nil, fmt.Errorf("reference %s: %w", s.name, err) }
+            diff, err := ref.check(ctx, tx)
+            if err != nil { return nil, err }
+            if diff != "" { return nil, &VerifyError{Version: s.version, Check: "fingerprint", Detail: diff} }
+        }
+        fk, err := fkViolations(ctx, tx)
+        if err != nil { return nil, err }
+        if len(fk) > len(fkBefore) { return nil, &VerifyError{Version: s.version, Check: "foreign_key_check", Detail: fmt.Sprintf("%d new violations, e.g. %s", len(fk)-len(fkBefore), fk[len(fk)-1])} }
+        if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations(version, applied_at, checksum) VALUES(?, ?, ?)`, s.version, time.Now().Unix(), s.sum); err != nil { return nil, err }
+        ran = append(ran, s.version)
+    }
+    if err := l.extend(ctx, tx); err != nil { return nil, err }
+    if err := tx.Commit(); err != nil { return nil, err }
+
+    verr := &VerifyError{Version: strings.Join(ran, ",")}
+    if bad, err := integrityProblems(ctx, db); err != nil || len(bad) > 0 {
+        verr.Check, verr.Detail = "integrity_check", strings.Join(bad, "; ")
+        if err != nil { verr.Detail = err.Error() }
+    } else if fk, err := fkViolations(ctx, db); err != nil || len(fk) > len(fkBefore) {
+        verr.Check = "foreign_key_check"
+        if err != nil { verr.Detail = err.Error() } else { verr.Detail = fmt.Sprintf("%d new violations, e.g. %s", len(fk)-len(fkBefore), fk[len(fk)-1]) }
     }
-    if err := tx.Commit(); err != nil { return err }
-    return nil
+    if verr.Check == "" { return ran, nil }
+    if snap == "" { return nil, verr }
+    if err := restoreSnapshot(ctx, db, snap); err != nil { return nil, fmt.Errorf("%v; restoring %s failed: %w", verr, snap, err) }
+    verr.Snapshot = snap
+    return nil, verr
 }
 
-// Pending returns the list of migration versions that have not been applied yet.
+func ledgerSet(rows []ledgerRow) map[string]struct{} {
+    out := make(map[string]struct{}, len(rows))
+    for _, r := range rows { out[r.Version] = struct{}{} }
+    return out
+}
+
+// pendingScripts returns the scripts not in done, in order, up to and
+// including version to (all when empty).
+func pendingScripts(scripts []script, done map[string]struct{}, to string) []script {
+    var out []script
+    for _, s := range scripts {
+        if to != "" && s.version > to { break }
+        if _, ok := done[s.version]; !ok { out = append(out, s) }
+    }
+    return out
+}
+
+func checkVersion(scripts []script, v string) error {
+    if v == "" { return nil }
+    for _, s := range scripts {
+        if s.version == v { return nil }
+    }
+    return fmt.Errorf("unknown migration version %s", v)
+}
+
+// Pending returns the list of migration versions that have not been applied
+// yet. If the ledger disagrees with the embedded scripts it returns the list
+// together with a *DriftError.
 func Pending(ctx context.Context, db *sqlx.DB) ([]string, error) {
-    names, err := listSQLNames()
+    scripts, err := upScripts()
+    if err != nil { return nil, err }
+    // if ledger not exists, consider none applied (do not create it here)
+    rows, err := readLedger(ctx, db)
     if err != nil { return nil, err }
-    // ensure ledger table existence check (do not create it here)
-    // if ledger not exists, consider none applied
-    var exists int
-    if err := db.GetContext(ctx, &exists, `SELECT COUNT(1) FROM sqlite_master WHERE type='table' AND name='schema_migrations'`); err != nil {
-        return nil, err
-    }
     appliedSet := make(map[string]struct{})
-    if exists > 0 {
-        var applied []string
-        if err := db.SelectContext(ctx, &applied, `SELECT version FROM schema_migrations`); err != nil { return nil, err }
-        for _, v := range applied { appliedSet[v] = struct{}{} }
-    }
+    for _, r := range rows { appliedSet[r.Version] = struct{}{} }
     pend := make([]string, 0)
-    for _, name := range names {
-        v := versionFromName(name)
-        if _, ok := appliedSet[v]; !ok { pend = append(pend, v) }
+    for _, s := range scripts {
+        if _, ok := appliedSet[s.version]; !ok { pend = append(pend, s.version) }
     }
+    issues, err := duplicates()
+    if err != nil { return nil, err }
+    if issues = append(issues, compare(rows, scripts)...); len(issues) > 0 { return pend, &DriftError{Issues: issues} }
     return pend, nil
 }
+
+// Versions returns every migration version known to this binary, in order.
+func Versions() ([]string, error) {
+    scripts, err := upScripts()
+    if err != nil { return nil, err }
+    out := make([]string, 0, len(scripts))
+    for _, s := range scripts { out = append(out, s.version) }
+    return out, nil
+}
+
+// Down rolls back applied migrations newer than to, newest first, in one
+// transaction, removing their ledger rows. An empty to rolls back only the
+// latest migration and "0" rolls back all of them. Nothing runs if any of
+// the affected versions lacks a down script. It returns the versions rolled
+// back.
+func Down(ctx context.Context, db *sqlx.DB, to string) ([]string, error) {
+    dups, err := duplicates()
+    if err != nil { return nil, err }
+    if len(dups) > 0 { return nil, &DriftError{Issues: dups} }
+    downs, err := downScripts()
+    if err != nil { return nil, err }
+    l, err := acquireLease(ctx, db, 0, 0)
+    if err != nil { return nil, err }
+    defer l.release()
+    tx, err := db.BeginTxx(ctx, nil)
+    if err != nil { return nil, err }
+    defer func() { _ = tx.Rollback() }()
+
+    var applied []string
+    if err := tx.SelectContext(ctx, &applied, `SELECT version FROM schema_migrations ORDER BY version DESC`); err != nil { return nil, err }
+    if len(applied) == 0 { return nil, nil }
+    var targets []string
+    switch {
+    case to == "":
+        targets = applied[:1]
+    case to == "0":
+        targets = applied
+    default:
+        found := false
+        for _, v := range applied {
+            if v == to { found = true; break }
+            targets = append(targets, v)
+        }
+        if !found { return nil, fmt.Errorf("version %s is not applied", to) }
+    }
+    for _, v := range targets {
+        if _, ok := downs[v]; !ok { return nil, fmt.Errorf("%w: %s", ErrNoDown, v) }
+    }
+
+    for _, v := range targets {
+        if err := downs[v].run(ctx, tx, func(int, int) {}); err != nil { return nil, fmt.Errorf("down %s: %w", v, err) }
+        if _, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = ?`, v); err != nil { return nil, err }
+    }
+    if err := l.extend(ctx, tx); err != nil { return nil, err }
+    if err := tx.Commit(); err != nil { return nil, err }
+    return targets, nil
+}
@@ -0,0 +1,212 @@
+package migrate
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "testing"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+
+    "mss/internal/store"
+)
+
+func openDB(t *testing.T, path string) *sqlx.DB {
+    t.Helper()
+    db, err := store.Open(path)
+    if err != nil { t.Fatal(err) }
+    t.Cleanup(func() { db.Close() })
+    return db
+}
+
+func tableExists(t *testing.T, db *sqlx.DB, name string) bool {
+    t.Helper()
+    var n int
+    if err := db.Get(&n, `SELECT COUNT(1) FROM sqlite_master WHERE type='table' AND name=?`, name); err != nil { t.Fatal(err) }
+    return n > 0
+}
+
+// register adds m for the length of the test.
+func register(t *testing.T, m GoMigration) {
+    t.Helper()
+    n := len(goMigrations)
+    Register(m)
+    t.Cleanup(func() { goMigrations = goMigrations[:n] })
+}
+
+func TestApplyAndDown(t *testing.T) {
+    ctx := context.Background()
+    db := openDB(t, filepath.Join(t.TempDir(), "mss.db"))
+    all, err := Versions()
+    if err != nil { t.Fatal(err) }
+    latest := all[len(all)-1]
+
+    ran, err := Apply(ctx, db, Options{To: all[0]})
+    if err != nil { t.Fatal(err) }
+    if len(ran) != 1 || ran[0] != all[0] { t.Fatalf("apply to %s: %v", all[0], ran) }
+    pending, err := Pending(ctx, db)
+    if err != nil { t.Fatal(err) }
+    if len(pending) != len(all)-1 { t.Fatalf("pending: %v", pending) }
+
+    ran, err = Apply(ctx, db, Options{})
+    if err != nil { t.Fatal(err) }
+    if len(ran) != len(all)-1 || ran[len(ran)-1] != latest { t.Fatalf("apply: %v", ran) }
+    if ran, err := Apply(ctx, db, Options{}); err != nil || len(ran) != 0 { t.Fatalf("second apply: %v %v", ran, err) }
+
+    back, err := Down(ctx, db, "")
+    if err != nil { t.Fatal(err) }
+    if len(back) != 1 || back[0] != latest { t.Fatalf("down: %v", back) }
+    if pending, _ := Pending(ctx, db); len(pending) != 1 || pending[0] != latest { t.Fatalf("pending after down: %v", pending) }
+    // the reference check must accept a schema rebuilt after a rollback
+    if ran, err := Apply(ctx, db, Options{}); err != nil || len(ran) != 1 { t.Fatalf("reapply: %v %v", ran, err) }
+
+    back, err = Down(ctx, db, "0")
+    if err != nil { t.Fatal(err) }
+    if len(back) != len(all) { t.Fatalf("down to 0: %v", back) }
+    if tableExists(t, db, "sites") || tableExists(t, db, "accounts") { t.Fatal("tables left after rolling everything back") }
+    if _, err := Down(ctx, db, "9999"); err != nil { t.Fatalf("down on empty ledger: %v", err) }
+}
+
+func TestDrift(t *testing.T) {
+    ctx := context.Background()
+    db := openDB(t, filepath.Join(t.TempDir(), "mss.db"))
+    if _, err := Apply(ctx, db, Options{}); err != nil { t.Fatal(err) }
+    if issues, err := Verify(ctx, db); err != nil || len(issues) != 0 { t.Fatalf("clean ledger: %v %v", issues, err) }
+
+    db.MustExec(`UPDATE schema_migrations SET checksum = 'edited' WHERE version = '0001'`)
+    db.MustExec(`INSERT INTO schema_migrations(version, applied_at, checksum) VALUES('9999', 0, 'x')`)
+    issues, err := Verify(ctx, db)
+    if err != nil { t.Fatal(err) }
+    if len(issues) != 2 || issues[0].Kind != "modified" || issues[1].Kind != "missing" { t.Fatalf("issues: %v", issues) }
+
+    _, err = Apply(ctx, db, Options{})
+    var drift *DriftError
+    if !errors.Is(err, ErrDrift) || !errors.As(err, &drift) || len(drift.Issues) != 2 { t.Fatalf("apply over drift: %v", err) }
+    if _, err := Down(ctx, db, ""); err == nil || !errors.Is(err, ErrNoDown) { t.Fatalf("down of an unknown version: %v", err) }
+
+    // Force records the current checksum; the unknown version stays missing
+    if _, err := Apply(ctx, db, Options{Force: true}); err != nil { t.Fatal(err) }
+    issues, _ = Verify(ctx, db)
+    if len(issues) != 1 || issues[0].Version != "9999" { t.Fatalf("after force: %v", issues) }
+}
+
+func TestLease(t *testing.T) {
+    ctx := context.Background()
+    path := filepath.Join(t.TempDir(), "mss.db")
+    a, b := openDB(t, path), openDB(t, path)
+
+    held, err := acquireLease(ctx, a, time.Minute, 0)
+    if err != nil { t.Fatal(err) }
+    _, err = acquireLease(ctx, b, time.Minute, 0)
+    var locked *LockedError
+    if !errors.Is(err, ErrLocked) || !errors.As(err, &locked) || locked.Lease.Holder != held.holder { t.Fatalf("second lease: %v", err) }
+    if _, err := Apply(ctx, b, Options{}); !errors.Is(err, ErrLocked) { t.Fatalf("apply while locked: %v", err) }
+    st, err := Inspect(ctx, b)
+    if err != nil { t.Fatal(err) }
+    if st.Lease == nil || st.Lease.Holder != held.holder { t.Fatalf("status lease: %+v", st.Lease) }
+    held.release()
+    if _, err := Apply(ctx, b, Options{}); err != nil { t.Fatalf("apply after release: %v", err) }
+
+    // an expired lease is taken over, and its old holder can no longer commit
+    stale, err := acquireLease(ctx, a, time.Minute, 0)
+    if err != nil { t.Fatal(err) }
+    close(stale.stop)
+    stale.wg.Wait()
+    a.MustExec(`UPDATE schema_lock SET expires_at = 0`)
+    fresh, err := acquireLease(ctx, b, time.Minute, 0)
+    if err != nil { t.Fatalf("take over expired lease: %v", err) }
+    defer fresh.release()
+    tx, err := a.BeginTxx(ctx, nil)
+    if err != nil { t.Fatal(err) }
+    defer tx.Rollback()
+    if err := stale.extend(ctx, tx); !errors.Is(err, ErrLeaseLost) { t.Fatalf("extend lost lease: %v", err) }
+}
+
+func TestGoMigration(t *testing.T) {
+    ctx := context.Background()
+    db := openDB(t, filepath.Join(t.TempDir(), "mss.db"))
+    register(t, GoMigration{Version: "0002a", Name: "seed_sites",
+        Up: func(ctx context.Context, tx *sqlx.Tx, progress Progress) error {
+            for i := 1; i <= 3; i++ {
+                if _, err := tx.ExecContext(ctx, `INSERT INTO sites(key, name) VALUES(?, ?)`, fmt.Sprintf("s%d", i), "S"); err != nil { return err }
+                progress(i, 3)
+            }
+            return nil
+        },
+        Down: func(ctx context.Context, tx *sqlx.Tx, progress Progress) error {
+            _, err := tx.ExecContext(ctx, `DELETE FROM sites WHERE key LIKE 's_'`)
+            return err
+        },
+    })
+    type call struct {
+        version     string
+        done, total int
+    }
+    var calls []call
+    ran, err := Apply(ctx, db, Options{To: "0003", Progress: func(v string, done, total int) { calls = append(calls, call{v, done, total}) }})
+    if err != nil { t.Fatal(err) }
+    if want := []string{"0001", "0002", "0002a", "0003"}; !reflect.DeepEqual(ran, want) { t.Fatalf("order: %v", ran) }
+    // the first report goes through, the rest of the second is throttled
+    if want := []call{{"0002a", 1, 3}, {"0002a", 3, 3}}; !reflect.DeepEqual(calls, want) { t.Fatalf("progress: %v", calls) }
+    var sum string
+    if err := db.Get(&sum, `SELECT checksum FROM schema_migrations WHERE version = '0002a'`); err != nil { t.Fatal(err) }
+    if sum != Checksum([]byte("go:seed_sites")) { t.Fatalf("checksum: %q", sum) }
+    var n int
+    if err := db.Get(&n, `SELECT COUNT(1) FROM sites`); err != nil || n != 3 { t.Fatalf("sites: %d %v", n, err) }
+
+    back, err := Down(ctx, db, "0002")
+    if err != nil { t.Fatal(err) }
+    if want := []string{"0003", "0002a"}; !reflect.DeepEqual(back, want) { t.Fatalf("down: %v", back) }
+    if err := db.Get(&n, `SELECT COUNT(1) FROM sites`); err != nil || n != 0 { t.Fatalf("sites after down: %d %v", n, err) }
+    if err := db.Get(&n, `SELECT COUNT(1) FROM schema_migrations WHERE version = '0002a'`); err != nil || n != 0 { t.Fatalf("ledger after down: %d %v", n, err) }
+}
+
+func TestSnapshotRestore(t *testing.T) {
+    ctx := context.Background()
+    path := filepath.Join(t.TempDir(), "mss.db")
+    db := openDB(t, path)
+    all, err := Versions()
+    if err != nil { t.Fatal(err) }
+    if _, err := Apply(ctx, db, Options{To: all[0]}); err != nil { t.Fatal(err) }
+    db.MustExec(`INSERT INTO sites(key, name) VALUES('gh', 'GitHub')`)
+    // older snapshots, of which only the newest survives next to the new one
+    for i, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, time.Hour} {
+        old := fmt.Sprintf("%s%sold-%d", path, snapshotTag, i)
+        if err := os.WriteFile(old, nil, 0o600); err != nil { t.Fatal(err) }
+        at := time.Now().Add(-age)
+        if err := os.Chtimes(old, at, at); err != nil { t.Fatal(err) }
+    }
+    // a row that breaks its CHECK constraint is only caught by the
+    // integrity check after commit
+    register(t, GoMigration{Version: "9000", Name: "broken",
+        Up: func(ctx context.Context, tx *sqlx.Tx, progress Progress) error {
+            for _, q := range []string{`CREATE TABLE broken(n INTEGER CHECK (n > 0))`, `PRAGMA ignore_check_constraints = ON`,
+                `INSERT INTO broken VALUES(-1)`, `PRAGMA ignore_check_constraints = OFF`} {
+                if _, err := tx.ExecContext(ctx, q); err != nil { return err }
+            }
+            return nil
+        },
+    })
+
+    _, err = Apply(ctx, db, Options{Snapshots: 2})
+    var verr *VerifyError
+    if !errors.As(err, &verr) || verr.Check != "integrity_check" { t.Fatalf("apply: %v", err) }
+    if verr.Snapshot == "" || !fileExists(verr.Snapshot) { t.Fatalf("snapshot %q not kept", verr.Snapshot) }
+    var versions []string
+    if err := db.Select(&versions, `SELECT version FROM schema_migrations`); err != nil { t.Fatal(err) }
+    if !reflect.DeepEqual(versions, []string{all[0]}) { t.Fatalf("ledger after restore: %v", versions) }
+    if tableExists(t, db, "broken") { t.Fatal("migrated table survived the restore") }
+    var name string
+    if err := db.Get(&name, `SELECT name FROM sites WHERE key = 'gh'`); err != nil || name != "GitHub" { t.Fatalf("data after restore: %q %v", name, err) }
+
+    left, err := filepath.Glob(path + snapshotTag + "*")
+    if err != nil { t.Fatal(err) }
+    want := []string{path + snapshotTag + "old-2", verr.Snapshot}
+    sort.Strings(want)
+    if !reflect.DeepEqual(left, want) { t.Fatalf("snapshots kept: %v, want %v", left, want) }
+}
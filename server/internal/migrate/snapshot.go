@@ -0,0 +1,87 @@
+package migrate
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+    "modernc.org/sqlite"
+)
+
+const snapshotTag = ".pre-migrate-"
+
+// dbFile returns the main database file of db, or "" for in-memory ones.
+func dbFile(ctx context.Context, db *sqlx.DB) (string, error) {
+    rows, err := db.QueryxContext(ctx, `PRAGMA database_list`)
+    if err != nil { return "", err }
+    defer rows.Close()
+    for rows.Next() {
+        var seq int
+        var name string
+        var file sql.NullString
+        if err := rows.Scan(&seq, &name, &file); err != nil { return "", err }
+        if name == "main" { return file.String, nil }
+    }
+    return "", rows.Err()
+}
+
+// snapshot copies the database to <file>.pre-migrate-<time> with VACUUM
+// INTO and keeps the newest keep snapshots.
+func snapshot(ctx context.Context, db *sqlx.DB, file string, keep int) (string, error) {
+    base := file + snapshotTag + time.Now().UTC().Format("20060102-150405")
+    path := base
+    for n := 2; fileExists(path); n++ { path = fmt.Sprintf("%s-%d", base, n) }
+    if _, err := db.ExecContext(ctx, `VACUUM INTO ?`, path); err != nil { _ = os.Remove(path); return "", fmt.Errorf("snapshot: %w", err) }
+    _ = os.Chmod(path, 0o600)
+    if err := rotateSnapshots(file, keep); err != nil { return path, fmt.Errorf("rotate snapshots: %w", err) }
+    return path, nil
+}
+
+func rotateSnapshots(file string, keep int) error {
+    matches, err := filepath.Glob(file + snapshotTag + "*")
+    if err != nil { return err }
+    type snap struct {
+        path string
+        mod  time.Time
+    }
+    var all []snap
+    for _, m := range matches {
+        if strings.HasSuffix(m, "-wal") || strings.HasSuffix(m, "-shm") { continue }
+        fi, err := os.Stat(m)
+        if err != nil { continue }
+        all = append(all, snap{m, fi.ModTime()})
+    }
+    sort.Slice(all, func(i, j int) bool { return all[i].mod.After(all[j].mod) })
+    for i := keep; i < len(all); i++ {
+        if err := os.Remove(all[i].path); err != nil { return err }
+    }
+    return nil
+}
+
+// restoreSnapshot copies a snapshot back over the live database through
+// SQLite's backup API, so open connections see the restored contents.
+func restoreSnapshot(ctx context.Context, db *sqlx.DB, path string) error {
+    conn, err := db.Conn(ctx)
+    if err != nil { return err }
+    defer conn.Close()
+    return conn.Raw(func(dc interface{}) error {
+        r, ok := dc.(interface{ NewRestore(string) (*sqlite.Backup, error) })
+        if !ok { return errors.New("driver cannot restore") }
+        b, err := r.NewRestore("file:" + path + "?mode=ro")
+        if err != nil { return err }
+        if _, err := b.Step(-1); err != nil { _ = b.Finish(); return err }
+        return b.Finish()
+    })
+}
+
+func fileExists(path string) bool {
+    _, err := os.Stat(path)
+    return err == nil
+}
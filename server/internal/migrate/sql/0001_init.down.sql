@@ -0,0 +1,5 @@
+-- drop the initial schema (children first)
+DROP TABLE IF EXISTS active_accounts;
+DROP INDEX IF EXISTS idx_accounts_site_key_username;
+DROP TABLE IF EXISTS accounts;
+DROP TABLE IF EXISTS sites;
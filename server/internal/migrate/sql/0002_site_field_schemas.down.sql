@@ -0,0 +1,2 @@
+-- drop site field schemas
+DROP TABLE IF EXISTS site_field_schemas;
@@ -0,0 +1,12 @@
+-- undo soft delete: trashed rows are purged, not restored
+DELETE FROM site_field_schemas WHERE deleted_at IS NOT NULL;
+DELETE FROM accounts WHERE deleted_at IS NOT NULL;
+DELETE FROM sites WHERE deleted_at IS NOT NULL;
+
+DROP INDEX IF EXISTS idx_site_field_schemas_deleted_at;
+DROP INDEX IF EXISTS idx_accounts_deleted_at;
+DROP INDEX IF EXISTS idx_sites_deleted_at;
+
+ALTER TABLE site_field_schemas DROP COLUMN deleted_at;
+ALTER TABLE accounts DROP COLUMN deleted_at;
+ALTER TABLE sites DROP COLUMN deleted_at;
@@ -0,0 +1,10 @@
+-- soft delete: rows are moved to trash by setting deleted_at and purged later
+PRAGMA foreign_keys = ON;
+
+ALTER TABLE sites ADD COLUMN deleted_at INTEGER NULL;
+ALTER TABLE accounts ADD COLUMN deleted_at INTEGER NULL;
+ALTER TABLE site_field_schemas ADD COLUMN deleted_at INTEGER NULL;
+
+CREATE INDEX IF NOT EXISTS idx_sites_deleted_at ON sites(deleted_at);
+CREATE INDEX IF NOT EXISTS idx_accounts_deleted_at ON accounts(deleted_at);
+CREATE INDEX IF NOT EXISTS idx_site_field_schemas_deleted_at ON site_field_schemas(deleted_at);
@@ -0,0 +1,2 @@
+-- drop account revision history
+DROP TABLE IF EXISTS account_revisions;
@@ -0,0 +1,16 @@
+-- account revision history: one row per superseded account state
+PRAGMA foreign_keys = ON;
+
+CREATE TABLE IF NOT EXISTS account_revisions (
+  account_id TEXT NOT NULL,
+  rev INTEGER NOT NULL, -- 1-based, per account
+  site_key TEXT NOT NULL,
+  username TEXT NOT NULL,
+  password TEXT,
+  extra TEXT,
+  secrets TEXT NOT NULL DEFAULT 'plain', -- plain|redacted|encrypted
+  updated_at INTEGER NOT NULL, -- when this state was written
+  recorded_at INTEGER NOT NULL, -- when this state was superseded
+  PRIMARY KEY(account_id, rev),
+  FOREIGN KEY(account_id) REFERENCES accounts(id) ON DELETE CASCADE
+);
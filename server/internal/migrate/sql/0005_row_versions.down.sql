@@ -0,0 +1,5 @@
+-- drop row versions
+ALTER TABLE active_accounts DROP COLUMN version;
+ALTER TABLE site_field_schemas DROP COLUMN version;
+ALTER TABLE accounts DROP COLUMN version;
+ALTER TABLE sites DROP COLUMN version;
@@ -0,0 +1,7 @@
+-- optimistic concurrency: every write bumps version; API exposes it as ETag
+PRAGMA foreign_keys = ON;
+
+ALTER TABLE sites ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE accounts ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE site_field_schemas ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE active_accounts ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,2 @@
+-- drop site pack records; the sites themselves stay
+DROP TABLE IF EXISTS site_packs;
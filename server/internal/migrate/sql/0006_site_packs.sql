@@ -0,0 +1,11 @@
+-- site packs: which pack (name@version) defined a site, with its manifest
+PRAGMA foreign_keys = ON;
+
+CREATE TABLE IF NOT EXISTS site_packs (
+  site_key TEXT PRIMARY KEY,
+  name TEXT NOT NULL,
+  version TEXT NOT NULL,
+  manifest TEXT NOT NULL, -- the installed pack document, JSON
+  installed_at INTEGER NOT NULL DEFAULT (CAST(strftime('%s','now') AS INTEGER)),
+  FOREIGN KEY(site_key) REFERENCES sites(key) ON DELETE CASCADE
+);
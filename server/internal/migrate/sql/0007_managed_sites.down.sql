@@ -0,0 +1,2 @@
+-- drop config ownership; the sites themselves stay
+DROP TABLE IF EXISTS managed_sites;
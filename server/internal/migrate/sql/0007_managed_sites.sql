@@ -0,0 +1,10 @@
+-- sites owned by declarative config (mss-server apply / MSS_CONFIG_DIR)
+PRAGMA foreign_keys = ON;
+
+CREATE TABLE IF NOT EXISTS managed_sites (
+  site_key TEXT PRIMARY KEY,
+  source TEXT NOT NULL, -- config file or directory that owns the site
+  spec TEXT NOT NULL, -- desired site and fields as last applied, JSON
+  applied_at INTEGER NOT NULL DEFAULT (CAST(strftime('%s','now') AS INTEGER)),
+  FOREIGN KEY(site_key) REFERENCES sites(key) ON DELETE CASCADE
+);
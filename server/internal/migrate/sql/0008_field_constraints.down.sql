@@ -0,0 +1,8 @@
+-- drop field constraints
+ALTER TABLE site_field_schemas DROP COLUMN fields;
+ALTER TABLE site_field_schemas DROP COLUMN items;
+ALTER TABLE site_field_schemas DROP COLUMN is_unique;
+ALTER TABLE site_field_schemas DROP COLUMN max_length;
+ALTER TABLE site_field_schemas DROP COLUMN min_length;
+ALTER TABLE site_field_schemas DROP COLUMN max;
+ALTER TABLE site_field_schemas DROP COLUMN min;
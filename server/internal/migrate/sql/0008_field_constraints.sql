@@ -0,0 +1,10 @@
+-- field constraints: numeric bounds, lengths, uniqueness and nested types
+PRAGMA foreign_keys = ON;
+
+ALTER TABLE site_field_schemas ADD COLUMN min REAL NULL;
+ALTER TABLE site_field_schemas ADD COLUMN max REAL NULL;
+ALTER TABLE site_field_schemas ADD COLUMN min_length INTEGER NULL;
+ALTER TABLE site_field_schemas ADD COLUMN max_length INTEGER NULL;
+ALTER TABLE site_field_schemas ADD COLUMN is_unique INTEGER NOT NULL DEFAULT 0; -- 0/1
+ALTER TABLE site_field_schemas ADD COLUMN items TEXT NOT NULL DEFAULT ''; -- JSON rule for array elements
+ALTER TABLE site_field_schemas ADD COLUMN fields TEXT NOT NULL DEFAULT ''; -- JSON rules for object subfields
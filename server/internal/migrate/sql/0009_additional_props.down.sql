@@ -0,0 +1,2 @@
+-- drop the per-site additional props mode
+ALTER TABLE sites DROP COLUMN additional_props;
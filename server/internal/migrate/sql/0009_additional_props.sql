@@ -0,0 +1,4 @@
+-- per-site handling of props the field schema does not declare
+PRAGMA foreign_keys = ON;
+
+ALTER TABLE sites ADD COLUMN additional_props TEXT NOT NULL DEFAULT 'allow'; -- allow|warn|reject
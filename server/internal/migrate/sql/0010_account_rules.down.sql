@@ -0,0 +1,2 @@
+-- drop the per-site account rules
+ALTER TABLE sites DROP COLUMN account_rules;
@@ -0,0 +1,4 @@
+-- per-site rules for account usernames and passwords
+PRAGMA foreign_keys = ON;
+
+ALTER TABLE sites ADD COLUMN account_rules TEXT NOT NULL DEFAULT ''; -- JSON {"username": rule, "password": rule}
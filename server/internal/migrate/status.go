@@ -0,0 +1,107 @@
+package migrate
+
+import (
+    "context"
+    "errors"
+    "sort"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+)
+
+// VersionStatus is one migration as seen by Inspect.
+type VersionStatus struct {
+    Version   string `json:"version"`
+    Name      string `json:"name"`                // script file; empty when missing
+    AppliedAt int64  `json:"appliedAt,omitempty"` // 0 while pending
+    HasDown   bool   `json:"hasDown"`
+}
+
+// Status is the ledger merged with the embedded scripts.
+type Status struct {
+    Versions []VersionStatus `json:"versions"`
+    Issues   []Issue         `json:"issues"`
+    Lease    *LeaseInfo      `json:"lease"` // nil unless a migration is running
+}
+
+// Inspect reports every known or applied version and any drift without
+// changing the database.
+func Inspect(ctx context.Context, db *sqlx.DB) (*Status, error) {
+    scripts, err := upScripts()
+    if err != nil { return nil, err }
+    downs, err := downScripts()
+    if err != nil { return nil, err }
+    rows, err := readLedger(ctx, db)
+    if err != nil { return nil, err }
+    issues, err := Verify(ctx, db)
+    if err != nil { return nil, err }
+    lease, err := currentLease(ctx, db)
+    if err != nil { return nil, err }
+
+    byVersion := map[string]*VersionStatus{}
+    st := &Status{Issues: issues, Lease: lease}
+    for _, s := range scripts {
+        _, down := downs[s.version]
+        st.Versions = append(st.Versions, VersionStatus{Version: s.version, Name: s.name, HasDown: down})
+    }
+    for i := range st.Versions { byVersion[st.Versions[i].Version] = &st.Versions[i] }
+    for _, r := range rows {
+        if v, ok := byVersion[r.Version]; ok { v.AppliedAt = r.AppliedAt; continue }
+        st.Versions = append(st.Versions, VersionStatus{Version: r.Version, AppliedAt: r.AppliedAt})
+    }
+    sort.SliceStable(st.Versions, func(i, j int) bool { return st.Versions[i].Version < st.Versions[j].Version })
+    if st.Issues == nil { st.Issues = []Issue{} }
+    return st, nil
+}
+
+// Step is a migration Apply would run.
+type Step struct {
+    Version string `json:"version"`
+    Name    string `json:"name"`
+    SQL     string `json:"sql"` // empty for Go migrations
+    Go      bool   `json:"go"`
+}
+
+// Plan returns the scripts Apply would run, up to and including version to
+// (all pending when empty), without running them.
+func Plan(ctx context.Context, db *sqlx.DB, to string) ([]Step, error) {
+    scripts, err := upScripts()
+    if err != nil { return nil, err }
+    if err := checkVersion(scripts, to); err != nil { return nil, err }
+    rows, err := readLedger(ctx, db)
+    if err != nil { return nil, err }
+    done := make(map[string]struct{}, len(rows))
+    for _, r := range rows { done[r.Version] = struct{}{} }
+    out := []Step{}
+    for _, s := range pendingScripts(scripts, done, to) { out = append(out, Step{Version: s.version, Name: s.name, SQL: string(s.body), Go: s.fn != nil}) }
+    return out, nil
+}
+
+// Baseline records every version up to and including version as applied
+// without running the scripts, for databases whose schema was created some
+// other way. It returns the versions recorded.
+func Baseline(ctx context.Context, db *sqlx.DB, version string) ([]string, error) {
+    scripts, err := upScripts()
+    if err != nil { return nil, err }
+    if version == "" { return nil, errors.New("baseline needs a version") }
+    if err := checkVersion(scripts, version); err != nil { return nil, err }
+    l, err := acquireLease(ctx, db, 0, 0)
+    if err != nil { return nil, err }
+    defer l.release()
+    tx, err := db.BeginTxx(ctx, nil)
+    if err != nil { return nil, err }
+    defer func() { _ = tx.Rollback() }()
+    if err := ensureLedger(ctx, tx); err != nil { return nil, err }
+    rows, err := readLedger(ctx, tx)
+    if err != nil { return nil, err }
+    done := make(map[string]struct{}, len(rows))
+    for _, r := range rows { done[r.Version] = struct{}{} }
+    marked := []string{}
+    for _, s := range pendingScripts(scripts, done, version) {
+        if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations(version, applied_at, checksum) VALUES(?, ?, ?)`, s.version, time.Now().Unix(), s.sum); err != nil { return nil, err }
+        marked = append(marked, s.version)
+    }
+    if err := l.extend(ctx, tx); err != nil { return nil, err }
+    if err := tx.Commit(); err != nil { return nil, err }
+    return marked, nil
+}
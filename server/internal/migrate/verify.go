@@ -0,0 +1,178 @@
+package migrate
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io/fs"
+    "sort"
+    "strings"
+
+    "github.com/jmoiron/sqlx"
+)
+
+// ErrDrift means the schema_migrations ledger and the embedded scripts
+// disagree; the details come in a *DriftError.
+var ErrDrift = errors.New("migration ledger does not match the embedded scripts")
+
+// Issue is one disagreement between the ledger and the embedded scripts.
+type Issue struct {
+    Kind    string `json:"kind"` // modified, missing or duplicate
+    Version string `json:"version"`
+    Detail  string `json:"detail"`
+}
+
+func (i Issue) String() string { return fmt.Sprintf("%s %s: %s", i.Kind, i.Version, i.Detail) }
+
+// DriftError lists every Issue found. errors.Is(err, ErrDrift) holds.
+type DriftError struct{ Issues []Issue }
+
+func (e *DriftError) Error() string {
+    parts := make([]string, len(e.Issues))
+    for i, is := range e.Issues { parts[i] = is.String() }
+    return ErrDrift.Error() + ": " + strings.Join(parts, "; ")
+}
+
+func (e *DriftError) Is(target error) bool { return target == ErrDrift }
+
+// Forceable reports whether Options.Force would get past the issues, i.e.
+// none of them is a duplicate version.
+func (e *DriftError) Forceable() bool {
+    for _, is := range e.Issues {
+        if is.Kind == "duplicate" { return false }
+    }
+    return true
+}
+
+// Checksum is the hex SHA-256 of a script with CRLF line endings folded to
+// LF, so a Windows checkout records the same value.
+func Checksum(b []byte) string {
+    sum := sha256.Sum256(bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n")))
+    return hex.EncodeToString(sum[:])
+}
+
+// script is one up migration: an embedded SQL file or a Go migration.
+type script struct {
+    version string
+    name    string
+    body    []byte
+    fn      Func // set for Go migrations
+    sum     string
+}
+
+func upScripts() ([]script, error) {
+    names, err := listSQLNames()
+    if err != nil { return nil, err }
+    out := make([]script, 0, len(names)+len(goMigrations))
+    for _, name := range names {
+        b, err := sqlFS.ReadFile("sql/" + name)
+        if err != nil { return nil, err }
+        out = append(out, script{version: versionFromName(name), name: name, body: b, sum: Checksum(b)})
+    }
+    for _, m := range goMigrations {
+        out = append(out, script{version: m.Version, name: goName(m), fn: m.Up, sum: Checksum([]byte(goName(m)))})
+    }
+    sort.SliceStable(out, func(i, j int) bool { return out[i].version < out[j].version })
+    return out, nil
+}
+
+// duplicates reports versions with two up scripts or two down scripts,
+// e.g. 0003_a.sql and 0003_b.sql, or a SQL file and a Go migration. Their
+// order would be ambiguous, so they are refused even when forced.
+func duplicates() ([]Issue, error) {
+    entries, err := fs.ReadDir(sqlFS, "sql")
+    if err != nil { return nil, err }
+    first := map[string]string{}
+    var out []Issue
+    add := func(version, key, name string) {
+        if prev, dup := first[key]; dup {
+            out = append(out, Issue{Kind: "duplicate", Version: version, Detail: prev + " and " + name + " share a version"})
+            return
+        }
+        first[key] = name
+    }
+    for _, e := range entries {
+        name := e.Name()
+        if e.IsDir() || !strings.HasSuffix(name, ".sql") { continue }
+        key := versionFromName(name)
+        if strings.HasSuffix(name, downSuffix) { key += downSuffix }
+        add(versionFromName(name), key, name)
+    }
+    for _, m := range goMigrations {
+        add(m.Version, m.Version, goName(m))
+        if m.Down != nil { add(m.Version, m.Version+downSuffix, goName(m)) }
+    }
+    return out, nil
+}
+
+type ledgerRow struct {
+    Version   string         `db:"version"`
+    AppliedAt int64          `db:"applied_at"`
+    Checksum  sql.NullString `db:"checksum"`
+}
+
+// readLedger returns the applied versions in order, or none when the ledger
+// does not exist. Ledgers from before checksums read as NULL checksums.
+func readLedger(ctx context.Context, q sqlx.QueryerContext) ([]ledgerRow, error) {
+    var exists int
+    if err := sqlx.GetContext(ctx, q, &exists, `SELECT COUNT(1) FROM sqlite_master WHERE type='table' AND name='schema_migrations'`); err != nil { return nil, err }
+    if exists == 0 { return nil, nil }
+    var hasSum int
+    if err := sqlx.GetContext(ctx, q, &hasSum, `SELECT COUNT(1) FROM pragma_table_info('schema_migrations') WHERE name='checksum'`); err != nil { return nil, err }
+    query := `SELECT version, applied_at, NULL AS checksum FROM schema_migrations ORDER BY version`
+    if hasSum > 0 { query = `SELECT version, applied_at, checksum FROM schema_migrations ORDER BY version` }
+    var rows []ledgerRow
+    if err := sqlx.SelectContext(ctx, q, &rows, query); err != nil { return nil, err }
+    return rows, nil
+}
+
+// compare checks applied versions against the scripts. Rows without a
+// checksum are trusted; Apply records one for them.
+func compare(rows []ledgerRow, scripts []script) []Issue {
+    sums := make(map[string]string, len(scripts))
+    for _, s := range scripts { sums[s.version] = s.sum }
+    var out []Issue
+    for _, r := range rows {
+        sum, ok := sums[r.Version]
+        switch {
+        case !ok:
+            out = append(out, Issue{Kind: "missing", Version: r.Version, Detail: "applied, but this binary has no script for it"})
+        case r.Checksum.Valid && r.Checksum.String != sum:
+            out = append(out, Issue{Kind: "modified", Version: r.Version, Detail: "script changed after it was applied"})
+        }
+    }
+    return out
+}
+
+// Verify compares the ledger with the embedded scripts without changing
+// anything.
+func Verify(ctx context.Context, db *sqlx.DB) ([]Issue, error) {
+    issues, err := duplicates()
+    if err != nil { return nil, err }
+    scripts, err := upScripts()
+    if err != nil { return nil, err }
+    rows, err := readLedger(ctx, db)
+    if err != nil { return nil, err }
+    issues = append(issues, compare(rows, scripts)...)
+    sort.SliceStable(issues, func(i, j int) bool { return issues[i].Version < issues[j].Version })
+    return issues, nil
+}
+
+// ensureLedger creates schema_migrations, adding the checksum column to
+// ledgers created before it existed.
+func ensureLedger(ctx context.Context, tx *sqlx.Tx) error {
+    if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations(
+        version TEXT PRIMARY KEY,
+        applied_at INTEGER NOT NULL,
+        checksum TEXT
+    )`); err != nil { return err }
+    var hasSum int
+    if err := tx.GetContext(ctx, &hasSum, `SELECT COUNT(1) FROM pragma_table_info('schema_migrations') WHERE name='checksum'`); err != nil { return err }
+    if hasSum > 0 { return nil }
+    _, err := tx.ExecContext(ctx, `ALTER TABLE schema_migrations ADD COLUMN checksum TEXT`)
+    return err
+}
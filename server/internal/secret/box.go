@@ -0,0 +1,78 @@
+// Package secret seals sensitive values at rest with AES-256-GCM.
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// prefix marks values produced by Box.SealString so callers can tell sealed
+// and plain values apart when both can appear in the same column.
+const prefix = "enc:v1:"
+
+var ErrMalformed = errors.New("secret: malformed sealed value")
+
+type Box struct {
+	aead cipher.AEAD
+}
+
+// NewBox builds a Box from a 32-byte key.
+func NewBox(key []byte) (*Box, error) {
+	if len(key) != 32 { return nil, errors.New("secret: key must be 32 bytes") }
+	block, err := aes.NewCipher(key)
+	if err != nil { return nil, err }
+	aead, err := cipher.NewGCM(block)
+	if err != nil { return nil, err }
+	return &Box{aead: aead}, nil
+}
+
+// ErrKeyFormat is returned by ParseKey for anything but a base64-encoded
+// 32-byte key. Passphrases are not accepted: there is nowhere to keep the
+// salt a proper KDF needs, and a bare hash is too cheap to guess.
+var ErrKeyFormat = errors.New("secret: key must be 32 random bytes in base64 (e.g. openssl rand -base64 32)")
+
+// ParseKey decodes a base64-encoded 32-byte key. Empty input yields a nil
+// Box.
+func ParseKey(s string) (*Box, error) {
+	s = strings.TrimSpace(s)
+	if s == "" { return nil, nil }
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != 32 { return nil, ErrKeyFormat }
+	return NewBox(b)
+}
+
+// Seal encrypts plain and returns nonce||ciphertext.
+func (b *Box) Seal(plain []byte) []byte {
+	nonce := make([]byte, b.aead.NonceSize())
+	_, _ = rand.Read(nonce)
+	return b.aead.Seal(nonce, nonce, plain, nil)
+}
+
+// Open reverses Seal.
+func (b *Box) Open(sealed []byte) ([]byte, error) {
+	n := b.aead.NonceSize()
+	if len(sealed) < n { return nil, ErrMalformed }
+	return b.aead.Open(nil, sealed[:n], sealed[n:], nil)
+}
+
+// SealString encrypts s into a printable "enc:v1:<base64>" value.
+func (b *Box) SealString(s string) string {
+	return prefix + base64.StdEncoding.EncodeToString(b.Seal([]byte(s)))
+}
+
+// OpenString reverses SealString.
+func (b *Box) OpenString(s string) (string, error) {
+	if !IsSealed(s) { return "", ErrMalformed }
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, prefix))
+	if err != nil { return "", ErrMalformed }
+	out, err := b.Open(raw)
+	if err != nil { return "", err }
+	return string(out), nil
+}
+
+// IsSealed reports whether s looks like the output of SealString.
+func IsSealed(s string) bool { return strings.HasPrefix(s, prefix) }
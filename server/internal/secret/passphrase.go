@@ -0,0 +1,35 @@
+package secret
+
+import (
+	"crypto/rand"
+	"errors"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// KDF describes how a Box key was derived from a passphrase. It is stored
+// next to the ciphertext so the same key can be derived again on open.
+type KDF struct {
+	Name    string `json:"name"`
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"t"`
+	Memory  uint32 `json:"m"` // KiB
+	Threads uint8  `json:"p"`
+}
+
+// NewKDF returns argon2id parameters with a fresh random salt.
+func NewKDF() KDF {
+	salt := make([]byte, 16)
+	_, _ = rand.Read(salt)
+	return KDF{Name: "argon2id", Salt: salt, Time: 3, Memory: 64 * 1024, Threads: 4}
+}
+
+// PassphraseBox stretches passphrase with argon2id into a Box.
+func PassphraseBox(passphrase string, k KDF) (*Box, error) {
+	if passphrase == "" { return nil, errors.New("secret: empty passphrase") }
+	if k.Name != "argon2id" { return nil, errors.New("secret: unsupported kdf " + k.Name) }
+	if len(k.Salt) < 8 || k.Time == 0 || k.Memory == 0 || k.Threads == 0 { return nil, errors.New("secret: invalid kdf parameters") }
+	// refuse parameters that would let a crafted file exhaust memory
+	if k.Memory > 1024*1024 || k.Time > 16 { return nil, errors.New("secret: kdf parameters too large") }
+	return NewBox(argon2.IDKey([]byte(passphrase), k.Salt, k.Time, k.Memory, k.Threads, 32))
+}
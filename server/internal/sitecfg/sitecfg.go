@@ -0,0 +1,331 @@
+// Package sitecfg reconciles sites and their field schemas with declarative
+// config files, as used by `mss-server apply` and MSS_CONFIG_DIR.
+package sitecfg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"mss/internal/sitepack"
+	"mss/internal/store"
+	"mss/internal/validation"
+)
+
+var ErrInvalid = errors.New("invalid site config")
+
+// Config is the desired state: every site listed is created or updated to
+// match, and its schema holds exactly the listed fields.
+type Config struct {
+	Sites []SiteSpec `json:"sites"`
+}
+
+type SiteSpec struct {
+	Key      string `json:"key"`
+	Name     string `json:"name"`
+	LoginURL string `json:"loginUrl,omitempty"`
+	// AdditionalProps is allow (the default), warn or reject.
+	AdditionalProps string                   `json:"additionalProps,omitempty"`
+	AccountRules    *validation.AccountRules `json:"accountRules,omitempty"`
+	Fields          []sitepack.Field         `json:"fields,omitempty"`
+}
+
+// Load reads and merges config files. A directory contributes its *.yaml,
+// *.yml and *.json files (not recursively).
+func Load(paths ...string) (*Config, error) {
+	files, err := configFiles(paths)
+	if err != nil { return nil, err }
+	cfg := &Config{Sites: []SiteSpec{}}
+	from := map[string]string{}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil { return nil, err }
+		var part Config
+		if err := sitepack.Decode(data, &part); err != nil { return nil, fmt.Errorf("%w: %s: %v", ErrInvalid, f, err) }
+		for _, s := range part.Sites {
+			if prev, dup := from[s.Key]; dup { return nil, fmt.Errorf("%w: site %q defined in both %s and %s", ErrInvalid, s.Key, prev, f) }
+			from[s.Key] = f
+			cfg.Sites = append(cfg.Sites, s)
+		}
+	}
+	if err := cfg.Validate(); err != nil { return nil, err }
+	return cfg, nil
+}
+
+func configFiles(paths []string) ([]string, error) {
+	var out []string
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil { return nil, err }
+		if !fi.IsDir() { out = append(out, p); continue }
+		entries, err := os.ReadDir(p)
+		if err != nil { return nil, err }
+		for _, e := range entries {
+			switch strings.ToLower(filepath.Ext(e.Name())) {
+			case ".yaml", ".yml", ".json":
+				if !e.IsDir() { out = append(out, filepath.Join(p, e.Name())) }
+			}
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (c *Config) Validate() error {
+	seen := map[string]bool{}
+	for _, s := range c.Sites {
+		if s.Key == "" || s.Name == "" { return fmt.Errorf("%w: every site needs a key and a name", ErrInvalid) }
+		if seen[s.Key] { return fmt.Errorf("%w: site %q listed twice", ErrInvalid, s.Key) }
+		seen[s.Key] = true
+		if s.AdditionalProps != "" && !validation.ValidPropsMode(s.AdditionalProps) {
+			return fmt.Errorf("%w: site %q: additionalProps %q must be allow, warn or reject", ErrInvalid, s.Key, s.AdditionalProps)
+		}
+		if s.AccountRules != nil {
+			if err := s.AccountRules.Check(); err != nil { return fmt.Errorf("%w: site %q: accountRules: %v", ErrInvalid, s.Key, err) }
+		}
+		if err := sitepack.ValidateFields(s.Fields); err != nil { return fmt.Errorf("%w: site %q: %v", ErrInvalid, s.Key, err) }
+	}
+	return nil
+}
+
+// Change is one step of a plan.
+type Change struct {
+	Action  string   `json:"action"` // create, update or delete
+	Kind    string   `json:"kind"`   // site or field
+	SiteKey string   `json:"siteKey"`
+	Field   string   `json:"field,omitempty"`
+	Changed []string `json:"changed,omitempty"` // attributes that differ, for updates
+}
+
+func (c Change) String() string {
+	sym := map[string]string{"create": "+", "update": "~", "delete": "-"}[c.Action]
+	target := c.SiteKey
+	if c.Kind == "field" { target += "." + c.Field }
+	s := fmt.Sprintf("%s %s %s", sym, c.Kind, target)
+	if len(c.Changed) > 0 { s += " (" + strings.Join(c.Changed, ", ") + ")" }
+	return s
+}
+
+type Plan struct {
+	Source  string   `json:"source"`
+	DryRun  bool     `json:"dryRun"`
+	Changes []Change `json:"changes"`
+	// Adopted are existing sites this source takes ownership of.
+	Adopted []string `json:"adopted"`
+	// Impact covers every existing site the plan changes.
+	Impact []Impact `json:"impact"`
+}
+
+// Impact is what a plan does to the accounts of one site, checked as a
+// schema write through the API is: Violations are only those the plan
+// introduces; Preexisting counts accounts that were already invalid.
+type Impact struct {
+	SiteKey     string                        `json:"siteKey"`
+	Checked     int                           `json:"checked"`
+	Violations  []validation.AccountViolation `json:"violations"`
+	Preexisting int                           `json:"preexisting"`
+}
+
+// step is a change together with what it writes.
+type step struct {
+	Change
+	site  store.Site
+	field store.SiteFieldSchema
+}
+
+var errDryRun = errors.New("dry run")
+
+// Apply brings the store in line with cfg in one transaction and records
+// source as the owner of every site in it. Sites source owned before but
+// no longer lists are moved to trash. Sites owned by another source are
+// refused with ErrConflict.
+func Apply(ctx context.Context, repos store.Repos, cfg *Config, source string, dryRun bool) (*Plan, error) {
+	if err := cfg.Validate(); err != nil { return nil, err }
+	plan := &Plan{Source: source, DryRun: dryRun, Changes: []Change{}, Adopted: []string{}, Impact: []Impact{}}
+	err := repos.Tx.InTx(ctx, func(tx store.Repos) error {
+		owned, err := tx.Managed.List(ctx)
+		if err != nil { return err }
+		mine := map[string]bool{}
+		for _, m := range owned {
+			if m.Source == source { mine[m.SiteKey] = true }
+		}
+		listed := map[string]bool{}
+		var steps []step
+		for _, spec := range cfg.Sites {
+			listed[spec.Key] = true
+			m, err := tx.Managed.Get(ctx, spec.Key)
+			if err != nil { return err }
+			if m != nil && m.Source != source { return fmt.Errorf("%w: site %q is managed by %s", store.ErrConflict, spec.Key, m.Source) }
+			s, err := planSite(ctx, tx, spec)
+			if err != nil { return err }
+			if m == nil && (len(s) == 0 || s[0].Kind != "site" || s[0].Action != "create") { plan.Adopted = append(plan.Adopted, spec.Key) }
+			steps = append(steps, s...)
+		}
+		var release []string
+		for key := range mine {
+			if !listed[key] { release = append(release, key) }
+		}
+		sort.Strings(release)
+		for _, key := range release {
+			site, err := tx.Sites.Get(ctx, key)
+			if err != nil { return err }
+			if site != nil { steps = append(steps, step{Change: Change{Action: "delete", Kind: "site", SiteKey: key}}) }
+		}
+		// sites created or moved to trash have no accounts to check
+		var touched []string
+		before := map[string][]validation.AccountViolation{}
+		for _, st := range steps {
+			if _, seen := before[st.SiteKey]; seen || st.Kind == "site" && st.Action == "delete" || created(steps, st.SiteKey) { continue }
+			_, found, err := validation.CheckAccounts(ctx, tx, st.SiteKey)
+			if err != nil { return err }
+			touched, before[st.SiteKey] = append(touched, st.SiteKey), found
+		}
+
+		for _, st := range steps {
+			plan.Changes = append(plan.Changes, st.Change)
+			if err := run(ctx, tx, st); err != nil { return fmt.Errorf("%s: %w", st.Change, err) }
+		}
+		for _, key := range touched {
+			checked, after, err := validation.CheckAccounts(ctx, tx, key)
+			if err != nil { return err }
+			plan.Impact = append(plan.Impact, Impact{SiteKey: key, Checked: checked, Violations: validation.Introduced(before[key], after), Preexisting: len(before[key])})
+		}
+		for _, key := range release {
+			if err := tx.Managed.Release(ctx, key); err != nil { return err }
+		}
+		for _, spec := range cfg.Sites {
+			b, err := json.Marshal(spec)
+			if err != nil { return err }
+			if err := tx.Managed.Put(ctx, &store.ManagedSite{SiteKey: spec.Key, Source: source, Spec: string(b)}); err != nil { return err }
+		}
+		if dryRun { return errDryRun }
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) { return nil, err }
+	return plan, nil
+}
+
+// created reports whether steps create site key.
+func created(steps []step, key string) bool {
+	for _, st := range steps {
+		if st.Kind == "site" && st.Action == "create" && st.SiteKey == key { return true }
+	}
+	return false
+}
+
+// planSite diffs one desired site against the store.
+func planSite(ctx context.Context, repos store.Repos, spec SiteSpec) ([]step, error) {
+	var steps []step
+	want := store.Site{Key: spec.Key, Name: spec.Name, LoginURL: spec.LoginURL, AdditionalProps: spec.AdditionalProps}
+	if want.AdditionalProps == "" { want.AdditionalProps = store.PropsAllow }
+	want.AccountRules = spec.AccountRules.Encode()
+	site, err := repos.Sites.Get(ctx, spec.Key)
+	if err != nil { return nil, err }
+	var existing []store.SiteFieldSchema
+	if site == nil {
+		steps = append(steps, step{Change: Change{Action: "create", Kind: "site", SiteKey: spec.Key}, site: want})
+	} else {
+		var changed []string
+		if site.Name != want.Name { changed = append(changed, "name") }
+		if site.LoginURL != want.LoginURL { changed = append(changed, "loginUrl") }
+		if site.AdditionalProps != want.AdditionalProps { changed = append(changed, "additionalProps") }
+		if current, _ := validation.ParseAccountRules(site.AccountRules); current.Encode() != want.AccountRules { changed = append(changed, "accountRules") }
+		if len(changed) > 0 { steps = append(steps, step{Change: Change{Action: "update", Kind: "site", SiteKey: spec.Key, Changed: changed}, site: want}) }
+		if existing, err = repos.Schemas.List(ctx, spec.Key); err != nil { return nil, err }
+	}
+	cur := map[string]store.SiteFieldSchema{}
+	for _, f := range existing { cur[f.Field] = f }
+	declared := map[string]bool{}
+	for _, f := range spec.Fields {
+		declared[f.Name] = true
+		row := f.ToStore(spec.Key)
+		old, ok := cur[f.Name]
+		switch {
+		case !ok:
+			steps = append(steps, step{Change: Change{Action: "create", Kind: "field", SiteKey: spec.Key, Field: f.Name}, field: row})
+		case !sitepack.SameField(old, row):
+			steps = append(steps, step{Change: Change{Action: "update", Kind: "field", SiteKey: spec.Key, Field: f.Name, Changed: fieldDiff(old, row)}, field: row})
+		}
+	}
+	for _, f := range existing {
+		if !declared[f.Field] { steps = append(steps, step{Change: Change{Action: "delete", Kind: "field", SiteKey: spec.Key, Field: f.Field}}) }
+	}
+	return steps, nil
+}
+
+func run(ctx context.Context, tx store.Repos, st step) error {
+	switch {
+	case st.Kind == "site" && st.Action == "create":
+		err := tx.Sites.Create(ctx, &st.site)
+		if errors.Is(err, store.ErrConflict) { return fmt.Errorf("site is in trash; restore or purge it first: %w", err) }
+		return err
+	case st.Kind == "site" && st.Action == "update":
+		return tx.Sites.Update(ctx, &st.site, 0)
+	case st.Kind == "site" && st.Action == "delete":
+		return tx.Sites.Delete(ctx, st.SiteKey, 0)
+	case st.Kind == "field" && st.Action == "delete":
+		return tx.Schemas.Delete(ctx, st.SiteKey, st.Field, 0)
+	default:
+		return tx.Schemas.Upsert(ctx, &st.field, 0)
+	}
+}
+
+func fieldDiff(a, b store.SiteFieldSchema) []string {
+	var out []string
+	add := func(name string, differ bool) { if differ { out = append(out, name) } }
+	add("type", a.Type != b.Type)
+	add("required", a.Required != b.Required)
+	add("default", !sameJSON(a.DefaultValue, b.DefaultValue))
+	add("regex", a.Regex != b.Regex)
+	add("choices", !sameJSON(a.Choices, b.Choices))
+	add("secret", a.Secret != b.Secret)
+	add("order", a.Order != b.Order)
+	add("uiHint", a.UIHint != b.UIHint)
+	add("min", !reflect.DeepEqual(a.Min, b.Min))
+	add("max", !reflect.DeepEqual(a.Max, b.Max))
+	add("minLength", !reflect.DeepEqual(a.MinLength, b.MinLength))
+	add("maxLength", !reflect.DeepEqual(a.MaxLength, b.MaxLength))
+	add("unique", a.Unique != b.Unique)
+	add("items", !sameJSON(a.Items, b.Items))
+	add("fields", !sameJSON(a.Fields, b.Fields))
+	return out
+}
+
+func sameJSON(a, b string) bool {
+	if a == b { return true }
+	var x, y interface{}
+	if json.Unmarshal([]byte(a), &x) != nil || json.Unmarshal([]byte(b), &y) != nil { return false }
+	return reflect.DeepEqual(x, y)
+}
+
+// Drift is how a managed site differs from its last applied spec.
+type Drift struct {
+	SiteKey string   `json:"siteKey"`
+	Source  string   `json:"source"`
+	Changes []Change `json:"changes"` // what re-applying would do
+}
+
+// Detect reports managed sites whose live definition no longer matches
+// the config, e.g. after API edits allowed with MSS_MANAGED_SITES=flag.
+func Detect(ctx context.Context, repos store.Repos) ([]Drift, error) {
+	owned, err := repos.Managed.List(ctx)
+	if err != nil { return nil, err }
+	out := []Drift{}
+	for _, m := range owned {
+		var spec SiteSpec
+		if err := json.Unmarshal([]byte(m.Spec), &spec); err != nil { return nil, fmt.Errorf("stored spec for %s: %w", m.SiteKey, err) }
+		steps, err := planSite(ctx, repos, spec)
+		if err != nil { return nil, err }
+		if len(steps) == 0 { continue }
+		d := Drift{SiteKey: m.SiteKey, Source: m.Source}
+		for _, st := range steps { d.Changes = append(d.Changes, st.Change) }
+		out = append(out, d)
+	}
+	return out, nil
+}
@@ -0,0 +1,118 @@
+package sitecfg_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"mss/internal/sitecfg"
+	"mss/internal/sitepack"
+	"mss/internal/store"
+)
+
+func changes(p *sitecfg.Plan) []string {
+	out := []string{}
+	for _, c := range p.Changes { out = append(out, c.String()) }
+	return out
+}
+
+func TestPlanAndApply(t *testing.T) {
+	ctx, r := context.Background(), store.NewMemory(store.RevisionSecrets{})
+	cfg := &sitecfg.Config{Sites: []sitecfg.SiteSpec{{Key: "gh", Name: "GitHub", Fields: []sitepack.Field{{Name: "email", Type: "email"}}}}}
+	p, err := sitecfg.Apply(ctx, r, cfg, "a.yaml", true)
+	if err != nil { t.Fatal(err) }
+	if want := []string{"+ site gh", "+ field gh.email"}; !reflect.DeepEqual(changes(p), want) { t.Fatalf("dry run: %q", changes(p)) }
+	if s, _ := r.Sites.Get(ctx, "gh"); s != nil { t.Fatal("dry run wrote the site") }
+	if _, err := sitecfg.Apply(ctx, r, cfg, "a.yaml", false); err != nil { t.Fatal(err) }
+	m, err := r.Managed.Get(ctx, "gh")
+	if err != nil || m == nil || m.Source != "a.yaml" { t.Fatalf("owner: %+v %v", m, err) }
+	p, err = sitecfg.Apply(ctx, r, cfg, "a.yaml", false)
+	if err != nil { t.Fatal(err) }
+	if len(p.Changes) != 0 || len(p.Adopted) != 0 { t.Fatalf("re-apply: %+v", p) }
+
+	cfg.Sites[0].Name = "GitHub.com"
+	cfg.Sites[0].Fields = []sitepack.Field{{Name: "team", Type: "string"}}
+	p, err = sitecfg.Apply(ctx, r, cfg, "a.yaml", false)
+	if err != nil { t.Fatal(err) }
+	if want := []string{"~ site gh (name)", "+ field gh.team", "- field gh.email"}; !reflect.DeepEqual(changes(p), want) { t.Fatalf("update: %q", changes(p)) }
+}
+
+func TestImpact(t *testing.T) {
+	ctx, r := context.Background(), store.NewMemory(store.RevisionSecrets{})
+	cfg := &sitecfg.Config{Sites: []sitecfg.SiteSpec{{Key: "gh", Name: "GitHub", Fields: []sitepack.Field{{Name: "email", Type: "string"}}}}}
+	if _, err := sitecfg.Apply(ctx, r, cfg, "a.yaml", false); err != nil { t.Fatal(err) }
+	for _, a := range []store.Account{
+		{ID: "a1", SiteKey: "gh", Username: "alice", Extra: `{"email":"a@x.io"}`},
+		{ID: "a2", SiteKey: "gh", Username: "bob", Extra: `{"email":"not an email"}`},
+		{ID: "a3", SiteKey: "gh", Username: "carol"},
+	} {
+		if err := r.Accounts.Create(ctx, &a); err != nil { t.Fatal(err) }
+	}
+	cfg.Sites[0].Fields[0] = sitepack.Field{Name: "email", Type: "email", Required: true}
+	p, err := sitecfg.Apply(ctx, r, cfg, "a.yaml", true)
+	if err != nil { t.Fatal(err) }
+	if len(p.Impact) != 1 { t.Fatalf("impact: %+v", p.Impact) }
+	im := p.Impact[0]
+	if im.SiteKey != "gh" || im.Checked != 3 || im.Preexisting != 0 || len(im.Violations) != 2 { t.Fatalf("impact: %+v", im) }
+	if im.Violations[0].ID != "a2" || im.Violations[1].ID != "a3" { t.Fatalf("violations: %+v", im.Violations) }
+
+	// violations that were there before the change are only counted
+	if _, err := sitecfg.Apply(ctx, r, cfg, "a.yaml", false); err != nil { t.Fatal(err) }
+	cfg.Sites[0].Name = "GitHub.com"
+	p, err = sitecfg.Apply(ctx, r, cfg, "a.yaml", false)
+	if err != nil { t.Fatal(err) }
+	if len(p.Impact) != 1 || p.Impact[0].Preexisting != 2 || len(p.Impact[0].Violations) != 0 { t.Fatalf("impact: %+v", p.Impact) }
+}
+
+func TestAdoptReleaseAndRefuse(t *testing.T) {
+	ctx, r := context.Background(), store.NewMemory(store.RevisionSecrets{})
+	if err := r.Sites.Create(ctx, &store.Site{Key: "gl", Name: "GitLab"}); err != nil { t.Fatal(err) }
+	cfg := &sitecfg.Config{Sites: []sitecfg.SiteSpec{{Key: "gh", Name: "GitHub"}, {Key: "gl", Name: "GitLab"}}}
+	p, err := sitecfg.Apply(ctx, r, cfg, "a.yaml", false)
+	if err != nil { t.Fatal(err) }
+	if !reflect.DeepEqual(p.Adopted, []string{"gl"}) { t.Fatalf("adopted: %q", p.Adopted) }
+
+	other := &sitecfg.Config{Sites: []sitecfg.SiteSpec{{Key: "gh", Name: "Mine"}}}
+	if _, err := sitecfg.Apply(ctx, r, other, "b.yaml", false); !errors.Is(err, store.ErrConflict) { t.Fatalf("other source: %v", err) }
+	if s, _ := r.Sites.Get(ctx, "gh"); s.Name != "GitHub" { t.Fatalf("refused apply wrote %+v", s) }
+
+	cfg.Sites = cfg.Sites[:1]
+	p, err = sitecfg.Apply(ctx, r, cfg, "a.yaml", false)
+	if err != nil { t.Fatal(err) }
+	if want := []string{"- site gl"}; !reflect.DeepEqual(changes(p), want) { t.Fatalf("release: %q", changes(p)) }
+	if s, _ := r.Sites.Get(ctx, "gl"); s != nil { t.Fatal("released site is still live") }
+	trash, err := r.Trash.List(ctx)
+	if err != nil || len(trash.Sites) != 1 || trash.Sites[0].Key != "gl" { t.Fatalf("trash: %+v %v", trash, err) }
+	if m, _ := r.Managed.Get(ctx, "gl"); m != nil { t.Fatalf("released site still owned: %+v", m) }
+}
+
+func TestDetect(t *testing.T) {
+	ctx, r := context.Background(), store.NewMemory(store.RevisionSecrets{})
+	cfg := &sitecfg.Config{Sites: []sitecfg.SiteSpec{{Key: "gh", Name: "GitHub", Fields: []sitepack.Field{{Name: "email", Type: "email"}}}}}
+	if _, err := sitecfg.Apply(ctx, r, cfg, "a.yaml", false); err != nil { t.Fatal(err) }
+	drift, err := sitecfg.Detect(ctx, r)
+	if err != nil || len(drift) != 0 { t.Fatalf("fresh apply drifts: %+v %v", drift, err) }
+	if err := r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "gh", Field: "email", Type: "string"}, 0); err != nil { t.Fatal(err) }
+	drift, err = sitecfg.Detect(ctx, r)
+	if err != nil { t.Fatal(err) }
+	if len(drift) != 1 || drift[0].SiteKey != "gh" || drift[0].Source != "a.yaml" || len(drift[0].Changes) != 1 || drift[0].Changes[0].String() != "~ field gh.email (type)" {
+		t.Fatalf("drift: %+v", drift)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	ctx, r, dir := context.Background(), store.NewMemory(store.RevisionSecrets{}), t.TempDir()
+	write := func(doc string) { t.Helper(); if err := os.WriteFile(filepath.Join(dir, "sites.yaml"), []byte(doc), 0o644); err != nil { t.Fatal(err) } }
+	write("sites:\n  - key: gh\n    name: GitHub\n")
+	applied := 0
+	w := sitecfg.NewWatcher(r, dir, func() { applied++ })
+	p, err := w.Sync(ctx)
+	if err != nil || p == nil || len(p.Changes) != 1 { t.Fatalf("first sync: %+v %v", p, err) }
+	if p, err := w.Sync(ctx); err != nil || p != nil { t.Fatalf("unchanged dir: %+v %v", p, err) }
+	write("sites:\n  - key: gh\n    name: GitHub.com\n")
+	if p, err := w.Sync(ctx); err != nil || p == nil || len(p.Changes) != 1 { t.Fatalf("changed dir: %+v %v", p, err) }
+	if applied != 2 { t.Fatalf("onApply ran %d times, want 2", applied) }
+}
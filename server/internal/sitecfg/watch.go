@@ -0,0 +1,87 @@
+package sitecfg
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"mss/internal/store"
+)
+
+// Watcher re-applies a config directory whenever its files change. It
+// polls, so it also works on volumes without inotify.
+type Watcher struct {
+	repos   store.Repos
+	dir     string
+	last    []byte // digest of the last applied contents
+	onApply func() // called after each successful apply
+}
+
+// NewWatcher watches dir. onApply, if not nil, runs after every successful
+// apply, e.g. to drop caches of site definitions.
+func NewWatcher(repos store.Repos, dir string, onApply func()) *Watcher {
+	if abs, err := filepath.Abs(dir); err == nil { dir = abs }
+	return &Watcher{repos: repos, dir: dir, onApply: onApply}
+}
+
+// Sync applies the directory if it changed since the last successful
+// apply. It returns a nil plan when nothing changed.
+func (w *Watcher) Sync(ctx context.Context) (*Plan, error) {
+	sum, err := w.digest()
+	if err != nil { return nil, err }
+	if bytes.Equal(sum, w.last) { return nil, nil }
+	cfg, err := Load(w.dir)
+	if err != nil { return nil, err }
+	plan, err := Apply(ctx, w.repos, cfg, w.dir, false)
+	if err != nil { return nil, err }
+	w.last = sum
+	if w.onApply != nil { w.onApply() }
+	return plan, nil
+}
+
+// Run calls Sync every interval until ctx ends, logging plans and errors.
+func (w *Watcher) Run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			plan, err := w.Sync(ctx)
+			if err != nil { log.Printf("config: apply %s failed: %v", w.dir, err); continue }
+			LogPlan(plan)
+		}
+	}
+}
+
+// LogPlan writes a non-empty plan to the log, one change per line.
+func LogPlan(plan *Plan) {
+	if plan == nil { return }
+	if len(plan.Changes) == 0 && len(plan.Adopted) == 0 { log.Printf("config: %s applied, no changes", plan.Source); return }
+	for _, key := range plan.Adopted { log.Printf("config: %s adopts site %s", plan.Source, key) }
+	for _, c := range plan.Changes { log.Printf("config: %s", c) }
+	for _, im := range plan.Impact {
+		for _, v := range im.Violations { log.Printf("config: warning: site %s: %s", im.SiteKey, v) }
+	}
+	log.Printf("config: %s applied, %d changes", plan.Source, len(plan.Changes))
+}
+
+func (w *Watcher) digest() ([]byte, error) {
+	files, err := configFiles([]string{w.dir})
+	if err != nil { return nil, err }
+	h := sha256.New()
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil { return nil, err }
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+		h.Write(data)
+		h.Write([]byte{0})
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,200 @@
+package sitepack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"mss/internal/store"
+	"mss/internal/validation"
+)
+
+type Options struct {
+	// Force adopts a site not installed from this pack and allows downgrades.
+	Force  bool
+	DryRun bool
+}
+
+// FieldChanges lists field names by what installing did to them.
+type FieldChanges struct {
+	Created   []string `json:"created"`
+	Updated   []string `json:"updated"`
+	Unchanged []string `json:"unchanged"`
+	// Removed are fields the previous pack version defined and this one
+	// drops; they go to trash. Fields added by hand are never removed.
+	Removed []string `json:"removed"`
+}
+
+type Result struct {
+	DryRun   bool   `json:"dryRun"`
+	SiteKey  string `json:"siteKey"`
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Previous string `json:"previous,omitempty"` // version installed before
+	// Action is install, upgrade, reinstall, downgrade or adopt.
+	Action string       `json:"action"`
+	Site   string       `json:"site"` // created, updated or unchanged
+	Fields FieldChanges `json:"fields"`
+}
+
+var errDryRun = errors.New("dry run")
+
+// Install creates or upgrades the site described by p in one transaction.
+// Existing sites must have been installed from a pack of the same name at
+// an equal or older version unless opts.Force is set.
+func Install(ctx context.Context, repos store.Repos, p *Pack, opts Options) (*Result, error) {
+	if err := p.Validate(); err != nil { return nil, err }
+	key := p.Site.Key
+	res := &Result{DryRun: opts.DryRun, SiteKey: key, Name: p.Name, Version: p.Version, Action: "install",
+		Fields: FieldChanges{Created: []string{}, Updated: []string{}, Unchanged: []string{}, Removed: []string{}}}
+	err := repos.Tx.InTx(ctx, func(tx store.Repos) error {
+		site, err := tx.Sites.Get(ctx, key)
+		if err != nil { return err }
+		cur, err := tx.Packs.Get(ctx, key)
+		if err != nil { return err }
+		var prev *Pack
+		if cur != nil {
+			prev = &Pack{}
+			if err := json.Unmarshal([]byte(cur.Manifest), prev); err != nil { return fmt.Errorf("stored pack for %s: %w", key, err) }
+			res.Previous = cur.Version
+		}
+		rules := ""
+		if p.Site.AccountRules != nil { rules = p.Site.AccountRules.Encode() }
+		if site == nil {
+			if err := tx.Sites.Create(ctx, &store.Site{Key: key, Name: p.Site.Name, LoginURL: p.Site.LoginURL, AdditionalProps: p.Site.AdditionalProps, AccountRules: rules}); err != nil {
+				if errors.Is(err, store.ErrConflict) { return fmt.Errorf("site %q is in trash; restore or purge it first: %w", key, err) }
+				return err
+			}
+			res.Site = "created"
+		} else {
+			if err := checkUpgrade(res, cur, p, opts.Force); err != nil { return err }
+			res.Site = "unchanged"
+			modeChanged := p.Site.AdditionalProps != "" && site.AdditionalProps != p.Site.AdditionalProps
+			current, _ := validation.ParseAccountRules(site.AccountRules)
+			rulesChanged := rules != "" && rules != current.Encode()
+			if site.Name != p.Site.Name || site.LoginURL != p.Site.LoginURL || modeChanged || rulesChanged {
+				site.Name, site.LoginURL, site.AdditionalProps, site.AccountRules = p.Site.Name, p.Site.LoginURL, p.Site.AdditionalProps, rules
+				if err := tx.Sites.Update(ctx, site, 0); err != nil { return err }
+				res.Site = "updated"
+			}
+		}
+
+		want := map[string]bool{}
+		for _, f := range p.Fields {
+			want[f.Name] = true
+			row := f.ToStore(key)
+			old, err := tx.Schemas.Get(ctx, key, f.Name)
+			if err != nil { return err }
+			if old != nil && SameField(*old, row) { res.Fields.Unchanged = append(res.Fields.Unchanged, f.Name); continue }
+			if err := tx.Schemas.Upsert(ctx, &row, 0); err != nil { return fmt.Errorf("field %s: %w", f.Name, err) }
+			if old == nil { res.Fields.Created = append(res.Fields.Created, f.Name) } else { res.Fields.Updated = append(res.Fields.Updated, f.Name) }
+		}
+		if prev != nil {
+			for _, f := range prev.Fields {
+				if want[f.Name] { continue }
+				old, err := tx.Schemas.Get(ctx, key, f.Name)
+				if err != nil { return err }
+				if old == nil { continue }
+				if err := tx.Schemas.Delete(ctx, key, f.Name, 0); err != nil { return fmt.Errorf("field %s: %w", f.Name, err) }
+				res.Fields.Removed = append(res.Fields.Removed, f.Name)
+			}
+		}
+
+		doc := *p
+		doc.Format = Format
+		manifest, err := json.Marshal(doc)
+		if err != nil { return err }
+		if err := tx.Packs.Put(ctx, &store.SitePack{SiteKey: key, Name: p.Name, Version: p.Version, Manifest: string(manifest)}); err != nil { return err }
+		if opts.DryRun { return errDryRun }
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) { return nil, err }
+	return res, nil
+}
+
+// checkUpgrade decides the action for an existing site and refuses
+// adoptions, pack swaps and downgrades unless forced.
+func checkUpgrade(res *Result, cur *store.SitePack, p *Pack, force bool) error {
+	switch {
+	case cur == nil:
+		res.Action = "adopt"
+		if !force { return fmt.Errorf("%w: site %q exists and was not installed from a pack; use force to adopt it", store.ErrConflict, p.Site.Key) }
+	case cur.Name != p.Name:
+		res.Action = "adopt"
+		if !force { return fmt.Errorf("%w: site %q was installed from pack %q; use force to replace it", store.ErrConflict, p.Site.Key, cur.Name) }
+	default:
+		switch c := compareVersions(p.Version, cur.Version); {
+		case c > 0:
+			res.Action = "upgrade"
+		case c == 0:
+			res.Action = "reinstall"
+		default:
+			res.Action = "downgrade"
+			if !force { return fmt.Errorf("%w: site %q has %s@%s installed; use force to downgrade to %s", store.ErrConflict, p.Site.Key, cur.Name, cur.Version, p.Version) }
+		}
+	}
+	return nil
+}
+
+// SameField reports whether two schema rows define the same field.
+func SameField(a, b store.SiteFieldSchema) bool {
+	return a.Type == b.Type && a.Required == b.Required && a.Regex == b.Regex && a.Secret == b.Secret &&
+		a.Order == b.Order && a.UIHint == b.UIHint && sameJSON(a.DefaultValue, b.DefaultValue) && sameJSON(a.Choices, b.Choices) &&
+		sameBound(a.Min, b.Min) && sameBound(a.Max, b.Max) && sameLen(a.MinLength, b.MinLength) && sameLen(a.MaxLength, b.MaxLength) &&
+		a.Unique == b.Unique && sameJSON(a.Items, b.Items) && sameJSON(a.Fields, b.Fields)
+}
+
+func sameBound(a, b *float64) bool { return (a == nil) == (b == nil) && (a == nil || *a == *b) }
+
+func sameLen(a, b *int) bool { return (a == nil) == (b == nil) && (a == nil || *a == *b) }
+
+func sameJSON(a, b string) bool {
+	if a == b { return true }
+	var x, y interface{}
+	if json.Unmarshal([]byte(a), &x) != nil || json.Unmarshal([]byte(b), &y) != nil { return false }
+	return reflect.DeepEqual(x, y)
+}
+
+// Export builds a pack from a site's current definition. Name, version,
+// login recipe and probes come from the installed pack; sites without one
+// export as <slug of key>@0.
+func Export(ctx context.Context, repos store.Repos, key string) (*Pack, error) {
+	site, err := repos.Sites.Get(ctx, key)
+	if err != nil { return nil, err }
+	if site == nil { return nil, store.ErrNotFound }
+	p := &Pack{Format: Format, Name: slug(key), Version: "0"}
+	cur, err := repos.Packs.Get(ctx, key)
+	if err != nil { return nil, err }
+	if cur != nil {
+		var installed Pack
+		if err := json.Unmarshal([]byte(cur.Manifest), &installed); err != nil { return nil, fmt.Errorf("stored pack for %s: %w", key, err) }
+		p.Name, p.Version, p.Description, p.Login, p.Probes = installed.Name, installed.Version, installed.Description, installed.Login, installed.Probes
+	}
+	p.Site = Site{Key: site.Key, Name: site.Name, LoginURL: site.LoginURL}
+	if site.AdditionalProps != store.PropsAllow { p.Site.AdditionalProps = site.AdditionalProps }
+	if ar, err := validation.ParseAccountRules(site.AccountRules); err == nil && !ar.Empty() { p.Site.AccountRules = ar }
+	fields, err := repos.Schemas.List(ctx, key)
+	if err != nil { return nil, err }
+	for _, f := range fields { p.Fields = append(p.Fields, FieldFromStore(f)) }
+	return p, nil
+}
+
+// slug turns a site key into a valid pack name.
+func slug(key string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(key) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+	s := strings.Trim(b.String(), "-_")
+	for strings.Contains(s, "--") { s = strings.ReplaceAll(s, "--", "-") }
+	if s == "" { s = "site" }
+	return s
+}
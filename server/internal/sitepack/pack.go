@@ -0,0 +1,222 @@
+// Package sitepack reads, installs and exports site packs: one YAML or JSON
+// document holding a site's metadata, field schema (with defaults), login
+// recipe and probes.
+package sitepack
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"mss/internal/store"
+	"mss/internal/validation"
+)
+
+// Format tags pack documents; it is optional on input.
+const Format = "mss-site-pack"
+
+// ErrInvalid marks documents that are not a valid pack.
+var ErrInvalid = errors.New("invalid site pack")
+
+type Pack struct {
+	Format      string  `json:"format,omitempty" yaml:"format,omitempty"`
+	Name        string  `json:"name" yaml:"name"`
+	Version     string  `json:"version" yaml:"version"`
+	Description string  `json:"description,omitempty" yaml:"description,omitempty"`
+	Site        Site    `json:"site" yaml:"site"`
+	Fields      []Field `json:"fields,omitempty" yaml:"fields,omitempty"`
+	// Login is the login recipe and Probes the session checks. Clients
+	// interpret both; the server only stores and returns them.
+	Login  interface{} `json:"login,omitempty" yaml:"login,omitempty"`
+	Probes interface{} `json:"probes,omitempty" yaml:"probes,omitempty"`
+}
+
+type Site struct {
+	Key      string `json:"key" yaml:"key"`
+	Name     string `json:"name" yaml:"name"`
+	LoginURL string `json:"loginUrl,omitempty" yaml:"loginUrl,omitempty"`
+	// AdditionalProps is allow, warn or reject; empty leaves an existing
+	// site's mode alone.
+	AdditionalProps string `json:"additionalProps,omitempty" yaml:"additionalProps,omitempty"`
+	// AccountRules are the username and password rules; omitted leaves an
+	// existing site's rules alone.
+	AccountRules *validation.AccountRules `json:"accountRules,omitempty" yaml:"accountRules,omitempty"`
+}
+
+type Field struct {
+	Name      string            `json:"name" yaml:"name"`
+	Type      string            `json:"type" yaml:"type"`
+	Required  bool              `json:"required,omitempty" yaml:"required,omitempty"`
+	Default   interface{}       `json:"default,omitempty" yaml:"default,omitempty"`
+	Regex     string            `json:"regex,omitempty" yaml:"regex,omitempty"`
+	Choices   []interface{}     `json:"choices,omitempty" yaml:"choices,omitempty"`
+	Secret    bool              `json:"secret,omitempty" yaml:"secret,omitempty"`
+	Order     int               `json:"order,omitempty" yaml:"order,omitempty"`
+	UIHint    string            `json:"uiHint,omitempty" yaml:"uiHint,omitempty"`
+	Min       *float64          `json:"min,omitempty" yaml:"min,omitempty"`
+	Max       *float64          `json:"max,omitempty" yaml:"max,omitempty"`
+	MinLength *int              `json:"minLength,omitempty" yaml:"minLength,omitempty"`
+	MaxLength *int              `json:"maxLength,omitempty" yaml:"maxLength,omitempty"`
+	Unique    bool              `json:"unique,omitempty" yaml:"unique,omitempty"`
+	Items     *validation.Rule  `json:"items,omitempty" yaml:"items,omitempty"`
+	Fields    []validation.Rule `json:"fields,omitempty" yaml:"fields,omitempty"`
+}
+
+var (
+	nameRe    = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	versionRe = regexp.MustCompile(`^\d+(\.\d+)*$`)
+)
+
+// Decode reads a JSON or YAML document into v, rejecting unknown fields.
+// YAML goes through JSON so both produce the same values (numbers become
+// float64).
+func Decode(data []byte, v interface{}) error {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 { return errors.New("empty document") }
+	if trimmed[0] != '{' {
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil { return err }
+		b, err := json.Marshal(doc)
+		if err != nil { return err }
+		data = b
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// Parse reads a pack from JSON or YAML and validates it.
+func Parse(data []byte) (*Pack, error) {
+	var p Pack
+	if err := Decode(data, &p); err != nil { return nil, fmt.Errorf("%w: %v", ErrInvalid, err) }
+	if err := p.Validate(); err != nil { return nil, err }
+	return &p, nil
+}
+
+// Validate checks names, versions and that every default and choice fits
+// its field type.
+func (p *Pack) Validate() error {
+	bad := func(format string, args ...interface{}) error { return fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, args...)) }
+	if p.Format != "" && p.Format != Format { return bad("format %q, want %q", p.Format, Format) }
+	if !nameRe.MatchString(p.Name) { return bad("name %q must be lower-case letters, digits, - or _", p.Name) }
+	if !versionRe.MatchString(p.Version) { return bad("version %q must be dotted numbers like 1.2.0", p.Version) }
+	if p.Site.Key == "" || p.Site.Name == "" { return bad("site.key and site.name are required") }
+	if p.Site.AdditionalProps != "" && !validation.ValidPropsMode(p.Site.AdditionalProps) {
+		return bad("site.additionalProps %q must be allow, warn or reject", p.Site.AdditionalProps)
+	}
+	if p.Site.AccountRules != nil {
+		if err := p.Site.AccountRules.Check(); err != nil { return bad("site.accountRules: %v", err) }
+	}
+	if err := ValidateFields(p.Fields); err != nil { return err }
+	if p.Login != nil {
+		if _, ok := p.Login.(map[string]interface{}); !ok { return bad("login must be an object") }
+	}
+	if p.Probes != nil {
+		if _, ok := p.Probes.([]interface{}); !ok { return bad("probes must be a list") }
+	}
+	return nil
+}
+
+// ValidateFields checks that field names are unique and that every type,
+// constraint, default and choice is valid.
+func ValidateFields(fields []Field) error {
+	bad := func(format string, args ...interface{}) error { return fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, args...)) }
+	seen := map[string]bool{}
+	for _, f := range fields {
+		if f.Name == "" { return bad("field without a name") }
+		if seen[f.Name] { return bad("field %q listed twice", f.Name) }
+		seen[f.Name] = true
+		if !validation.ValidType(f.Type) { return bad("field %q: unknown type %q", f.Name, f.Type) }
+		if err := validation.CheckField(f.ToStore("")); err != nil { return fmt.Errorf("%w: %v", ErrInvalid, err) }
+	}
+	return nil
+}
+
+// YAML renders p as a YAML document.
+func (p *Pack) YAML() ([]byte, error) { return yaml.Marshal(p) }
+
+// ToStore converts f to a schema row of siteKey.
+func (f Field) ToStore(siteKey string) store.SiteFieldSchema {
+	out := store.SiteFieldSchema{SiteKey: siteKey, Field: f.Name, Type: f.Type, Regex: f.Regex, Order: f.Order, UIHint: f.UIHint}
+	if f.Required { out.Required = 1 }
+	if f.Secret { out.Secret = 1 }
+	if f.Unique { out.Unique = 1 }
+	out.Min, out.Max, out.MinLength, out.MaxLength = f.Min, f.Max, f.MinLength, f.MaxLength
+	if f.Items != nil {
+		if b, err := json.Marshal(f.Items); err == nil { out.Items = string(b) }
+	}
+	if len(f.Fields) > 0 {
+		if b, err := json.Marshal(f.Fields); err == nil { out.Fields = string(b) }
+	}
+	if f.Default != nil {
+		if b, err := json.Marshal(f.Default); err == nil { out.DefaultValue = string(b) }
+	}
+	if len(f.Choices) > 0 {
+		if b, err := json.Marshal(f.Choices); err == nil { out.Choices = string(b) }
+	}
+	return out
+}
+
+// FieldFromStore converts a schema row to a pack field.
+func FieldFromStore(s store.SiteFieldSchema) Field {
+	f := Field{Name: s.Field, Type: s.Type, Required: s.Required != 0, Regex: s.Regex, Secret: s.Secret != 0, Order: s.Order, UIHint: s.UIHint}
+	if s.DefaultValue != "" { _ = json.Unmarshal([]byte(s.DefaultValue), &f.Default) }
+	if s.Choices != "" { _ = json.Unmarshal([]byte(s.Choices), &f.Choices) }
+	f.Min, f.Max, f.MinLength, f.MaxLength, f.Unique = s.Min, s.Max, s.MinLength, s.MaxLength, s.Unique != 0
+	if rule, err := validation.RuleFromSchema(s); err == nil { f.Items, f.Fields = rule.Items, rule.Fields }
+	return f
+}
+
+// compareVersions orders dotted numeric versions ("1.10" > "1.9").
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) { x, _ = strconv.Atoi(as[i]) }
+		if i < len(bs) { y, _ = strconv.Atoi(bs[i]) }
+		if x != y {
+			if x < y { return -1 }
+			return 1
+		}
+	}
+	return 0
+}
+
+//go:embed packs/*.yaml
+var builtinFS embed.FS
+
+// Builtins returns the packs shipped with the server, sorted by name.
+func Builtins() ([]*Pack, error) {
+	names, err := fs.Glob(builtinFS, "packs/*.yaml")
+	if err != nil { return nil, err }
+	out := make([]*Pack, 0, len(names))
+	for _, n := range names {
+		data, err := builtinFS.ReadFile(n)
+		if err != nil { return nil, err }
+		p, err := Parse(data)
+		if err != nil { return nil, fmt.Errorf("%s: %w", n, err) }
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// Builtin returns the shipped pack called name, or nil.
+func Builtin(name string) (*Pack, error) {
+	all, err := Builtins()
+	if err != nil { return nil, err }
+	for _, p := range all {
+		if p.Name == name { return p, nil }
+	}
+	return nil, nil
+}
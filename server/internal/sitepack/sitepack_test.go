@@ -0,0 +1,95 @@
+package sitepack_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"mss/internal/sitepack"
+	"mss/internal/store"
+)
+
+func TestBuiltins(t *testing.T) {
+	all, err := sitepack.Builtins()
+	if err != nil { t.Fatal(err) }
+	if len(all) == 0 { t.Fatal("no built-in packs") }
+	for i := 1; i < len(all); i++ {
+		if all[i-1].Name >= all[i].Name { t.Fatalf("not sorted: %s, %s", all[i-1].Name, all[i].Name) }
+	}
+	if p, err := sitepack.Builtin("github"); err != nil || p == nil || p.Site.Key != "github" { t.Fatalf("github: %+v %v", p, err) }
+	if p, err := sitepack.Builtin("nope"); err != nil || p != nil { t.Fatalf("nope: %+v %v", p, err) }
+}
+
+func TestParse(t *testing.T) {
+	yaml := "name: gh\nversion: 1.2.0\nsite: {key: gh, name: GitHub}\nfields:\n  - {name: seats, type: integer, default: 1}\n"
+	p, err := sitepack.Parse([]byte(yaml))
+	if err != nil { t.Fatal(err) }
+	j, err := sitepack.Parse([]byte(`{"name":"gh","version":"1.2.0","site":{"key":"gh","name":"GitHub"},"fields":[{"name":"seats","type":"integer","default":1}]}`))
+	if err != nil { t.Fatal(err) }
+	if !reflect.DeepEqual(p, j) { t.Fatalf("yaml %+v != json %+v", p, j) }
+	for _, bad := range []string{
+		"name: GH\nversion: 1\nsite: {key: gh, name: GitHub}\n",
+		"name: gh\nversion: v1\nsite: {key: gh, name: GitHub}\n",
+		"name: gh\nversion: 1\nsite: {key: gh}\n",
+		"name: gh\nversion: 1\nsite: {key: gh, name: GitHub}\nextra: 1\n",
+		"name: gh\nversion: 1\nsite: {key: gh, name: GitHub}\nfields: [{name: a, type: string}, {name: a, type: string}]\n",
+		"name: gh\nversion: 1\nsite: {key: gh, name: GitHub}\nfields: [{name: a, type: integer, default: x}]\n",
+	} {
+		if _, err := sitepack.Parse([]byte(bad)); !errors.Is(err, sitepack.ErrInvalid) { t.Errorf("%q: %v", bad, err) }
+	}
+}
+
+func pack(version string, fields ...string) *sitepack.Pack {
+	p := &sitepack.Pack{Name: "gh", Version: version, Site: sitepack.Site{Key: "gh", Name: "GitHub"}}
+	for _, f := range fields { p.Fields = append(p.Fields, sitepack.Field{Name: f, Type: "string"}) }
+	return p
+}
+
+func TestInstall(t *testing.T) {
+	ctx, r := context.Background(), store.NewMemory(store.RevisionSecrets{})
+	res, err := sitepack.Install(ctx, r, pack("1.0", "email", "team"), sitepack.Options{DryRun: true})
+	if err != nil || res.Site != "created" || len(res.Fields.Created) != 2 { t.Fatalf("dry run: %+v %v", res, err) }
+	if s, _ := r.Sites.Get(ctx, "gh"); s != nil { t.Fatal("dry run wrote the site") }
+	if _, err := sitepack.Install(ctx, r, pack("1.0", "email", "team"), sitepack.Options{}); err != nil { t.Fatal(err) }
+	res, err = sitepack.Install(ctx, r, pack("1.0", "email", "team"), sitepack.Options{})
+	if err != nil || res.Action != "reinstall" || res.Site != "unchanged" || len(res.Fields.Unchanged) != 2 { t.Fatalf("reinstall: %+v %v", res, err) }
+
+	// an upgrade drops the pack's old fields but keeps those added by hand
+	if err := r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "gh", Field: "mine", Type: "string"}, 0); err != nil { t.Fatal(err) }
+	res, err = sitepack.Install(ctx, r, pack("1.10", "email", "org"), sitepack.Options{})
+	if err != nil { t.Fatal(err) }
+	want := sitepack.FieldChanges{Created: []string{"org"}, Updated: []string{}, Unchanged: []string{"email"}, Removed: []string{"team"}}
+	if res.Action != "upgrade" || res.Previous != "1.0" || !reflect.DeepEqual(res.Fields, want) { t.Fatalf("upgrade: %+v", res) }
+	if f, _ := r.Schemas.Get(ctx, "gh", "mine"); f == nil { t.Fatal("upgrade removed a field added by hand") }
+
+	if _, err := sitepack.Install(ctx, r, pack("1.9"), sitepack.Options{}); !errors.Is(err, store.ErrConflict) { t.Fatalf("downgrade: %v", err) }
+	if res, err := sitepack.Install(ctx, r, pack("1.9", "email", "org"), sitepack.Options{Force: true}); err != nil || res.Action != "downgrade" { t.Fatalf("forced downgrade: %+v %v", res, err) }
+	other := pack("1.0")
+	other.Name = "github"
+	if _, err := sitepack.Install(ctx, r, other, sitepack.Options{}); !errors.Is(err, store.ErrConflict) { t.Fatalf("pack swap: %v", err) }
+
+	if err := r.Sites.Create(ctx, &store.Site{Key: "gl", Name: "GitLab"}); err != nil { t.Fatal(err) }
+	gl := pack("1.0")
+	gl.Site.Key = "gl"
+	if _, err := sitepack.Install(ctx, r, gl, sitepack.Options{}); !errors.Is(err, store.ErrConflict) { t.Fatalf("adopt: %v", err) }
+	if res, err := sitepack.Install(ctx, r, gl, sitepack.Options{Force: true}); err != nil || res.Action != "adopt" { t.Fatalf("forced adopt: %+v %v", res, err) }
+}
+
+func TestExport(t *testing.T) {
+	ctx, r := context.Background(), store.NewMemory(store.RevisionSecrets{})
+	if _, err := sitepack.Install(ctx, r, pack("2.1", "email"), sitepack.Options{}); err != nil { t.Fatal(err) }
+	p, err := sitepack.Export(ctx, r, "gh")
+	if err != nil { t.Fatal(err) }
+	if p.Name != "gh" || p.Version != "2.1" || len(p.Fields) != 1 { t.Fatalf("installed: %+v", p) }
+
+	// a site not installed from a pack exports under a slug of its key
+	if err := r.Sites.Create(ctx, &store.Site{Key: "My.Site!", Name: "Mine"}); err != nil { t.Fatal(err) }
+	p, err = sitepack.Export(ctx, r, "My.Site!")
+	if err != nil { t.Fatal(err) }
+	if p.Name != "my-site" || p.Version != "0" { t.Fatalf("slug: %+v", p) }
+	data, err := p.YAML()
+	if err != nil { t.Fatal(err) }
+	if _, err := sitepack.Parse(data); err != nil { t.Fatalf("exported pack does not parse: %v\n%s", err, data) }
+	if _, err := sitepack.Export(ctx, r, "nope"); !errors.Is(err, store.ErrNotFound) { t.Fatalf("missing site: %v", err) }
+}
@@ -3,34 +3,90 @@ package store
 import (
 	"context"
 	"database/sql"
-	"github.com/jmoiron/sqlx"
 )
 
-func ListAccounts(ctx context.Context, db *sqlx.DB, siteKey string) ([]Account, error) {
+func ListAccounts(ctx context.Context, db DBTX, siteKey string) ([]Account, error) {
 	var items []Account
-	err := db.SelectContext(ctx, &items, `SELECT id, site_key, username, password, extra, created_at, updated_at FROM accounts WHERE site_key = ? ORDER BY username`, siteKey)
+	err := db.SelectContext(ctx, &items, `SELECT id, site_key, username, password, extra, created_at, updated_at, deleted_at, version FROM accounts WHERE site_key = ? AND deleted_at IS NULL ORDER BY username`, siteKey)
 	if err != nil { return nil, err }
 	return items, nil
 }
 
-func CreateAccount(ctx context.Context, db *sqlx.DB, a *Account) error {
-	_, err := db.ExecContext(ctx, `INSERT INTO accounts(id, site_key, username, password, extra) VALUES(?,?,?,?,?)`, a.ID, a.SiteKey, a.Username, a.Password, a.Extra)
-	return err
+// CreateAccount inserts an account; it fails with ErrNotFound when the site
+// does not exist or is in trash.
+func CreateAccount(ctx context.Context, db DBTX, a *Account) error {
+	res, err := db.ExecContext(ctx, `INSERT INTO accounts(id, site_key, username, password, extra)
+		SELECT ?,?,?,?,? WHERE EXISTS(SELECT 1 FROM sites WHERE key = ? AND deleted_at IS NULL)`, a.ID, a.SiteKey, a.Username, a.Password, a.Extra, a.SiteKey)
+	if err != nil { return uniqueToConflict(err) }
+	if n, _ := res.RowsAffected(); n == 0 { return ErrNotFound }
+	return nil
 }
 
-func UpdateAccount(ctx context.Context, db *sqlx.DB, a *Account) error {
-	_, err := db.ExecContext(ctx, `UPDATE accounts SET username = ?, password = ?, extra = ?, updated_at = CAST(strftime('%s','now') AS INTEGER) WHERE id = ? AND site_key = ?`, a.Username, a.Password, a.Extra, a.ID, a.SiteKey)
-	return err
+// GetAccount returns a live account, or nil when missing or in trash.
+func GetAccount(ctx context.Context, db DBTX, siteKey, id string) (*Account, error) {
+	var a Account
+	err := db.GetContext(ctx, &a, `SELECT id, site_key, username, password, extra, created_at, updated_at, deleted_at, version FROM accounts WHERE id = ? AND site_key = ? AND deleted_at IS NULL`, id, siteKey)
+	if err != nil {
+		if err == sql.ErrNoRows { return nil, nil }
+		return nil, err
+	}
+	return &a, nil
 }
 
-func DeleteAccount(ctx context.Context, db *sqlx.DB, siteKey string, id string) error {
-	_, err := db.ExecContext(ctx, `DELETE FROM accounts WHERE id = ? AND site_key = ?`, id, siteKey)
-	return err
+// UpdateAccount overwrites an account, first recording its current state in
+// account_revisions, and bumps its version. A non-zero ifVersion makes the
+// write conditional. a is refreshed from the stored row. secrets says how the
+// revision keeps the overwritten secrets.
+func UpdateAccount(ctx context.Context, db DBTX, a *Account, ifVersion int64, secrets RevisionSecrets) error {
+	return withTx(ctx, db, func(tx DBTX) error {
+		var prior Account
+		if err := tx.GetContext(ctx, &prior, `SELECT id, site_key, username, password, extra, created_at, updated_at, deleted_at, version FROM accounts WHERE id = ? AND site_key = ? AND deleted_at IS NULL`, a.ID, a.SiteKey); err != nil {
+			return notFound(err)
+		}
+		if ifVersion != 0 && prior.Version != ifVersion { return ErrVersionMismatch }
+		if err := recordRevision(ctx, tx, prior, secrets); err != nil { return err }
+		if _, err := tx.ExecContext(ctx, `UPDATE accounts SET username = ?, password = ?, extra = ?, updated_at = CAST(strftime('%s','now') AS INTEGER), version = version + 1 WHERE id = ? AND site_key = ?`, a.Username, a.Password, a.Extra, a.ID, a.SiteKey); err != nil { return err }
+		return tx.GetContext(ctx, a, `SELECT id, site_key, username, password, extra, created_at, updated_at, deleted_at, version FROM accounts WHERE id = ?`, a.ID)
+	})
 }
 
-func GetActiveAccountID(ctx context.Context, db *sqlx.DB, siteKey string) (*string, error) {
+// DeleteAccount moves an account to trash; ifVersion as in UpdateAccount.
+func DeleteAccount(ctx context.Context, db DBTX, siteKey string, id string, ifVersion int64) error {
+	res, err := db.ExecContext(ctx, `UPDATE accounts SET deleted_at = ?, version = version + 1 WHERE id = ? AND site_key = ? AND deleted_at IS NULL AND (? = 0 OR version = ?)`, nowUnix(), id, siteKey, ifVersion, ifVersion)
+	if err != nil { return err }
+	if n, _ := res.RowsAffected(); n == 0 {
+		return missOrMismatch(ctx, db, `SELECT COUNT(1) FROM accounts WHERE id = ? AND site_key = ? AND deleted_at IS NULL`, id, siteKey)
+	}
+	return nil
+}
+
+// RestoreAccount takes an account out of trash. Accounts of a trashed site
+// cannot be restored on their own; restore the site instead.
+func RestoreAccount(ctx context.Context, db DBTX, siteKey string, id string) error {
+	s, err := GetSite(ctx, db, siteKey)
+	if err != nil { return err }
+	if s == nil { return ErrConflict }
+	res, err := db.ExecContext(ctx, `UPDATE accounts SET deleted_at = NULL, version = version + 1 WHERE id = ? AND site_key = ? AND deleted_at IS NOT NULL`, id, siteKey)
+	if err != nil { return err }
+	if n, _ := res.RowsAffected(); n == 0 { return ErrNotFound }
+	return nil
+}
+
+// PurgeAccount permanently removes an account, trashed or not.
+func PurgeAccount(ctx context.Context, db DBTX, siteKey string, id string) error {
+	res, err := db.ExecContext(ctx, `DELETE FROM accounts WHERE id = ? AND site_key = ?`, id, siteKey)
+	if err != nil { return err }
+	if n, _ := res.RowsAffected(); n == 0 { return ErrNotFound }
+	return nil
+}
+
+// GetActiveAccountID returns the active account of a site, ignoring a mapping
+// that points at a trashed account.
+func GetActiveAccountID(ctx context.Context, db DBTX, siteKey string) (*string, error) {
 	var id sql.NullString
-	err := db.GetContext(ctx, &id, `SELECT account_id FROM active_accounts WHERE site_key = ?`, siteKey)
+	err := db.GetContext(ctx, &id, `SELECT aa.account_id FROM active_accounts aa
+		LEFT JOIN accounts a ON a.id = aa.account_id
+		WHERE aa.site_key = ? AND a.deleted_at IS NULL`, siteKey)
 	if err != nil {
 		if err == sql.ErrNoRows { return nil, nil }
 		return nil, err
@@ -40,11 +96,46 @@ func GetActiveAccountID(ctx context.Context, db *sqlx.DB, siteKey string) (*stri
 	return &v, nil
 }
 
-func SetActiveAccountID(ctx context.Context, db *sqlx.DB, siteKey string, accountID *string) error {
+// GetActiveAccount returns the active mapping of a site with its version. A
+// site that never had one yields a zero-version mapping with a nil AccountID.
+func GetActiveAccount(ctx context.Context, db DBTX, siteKey string) (*ActiveAccount, error) {
+	m := ActiveAccount{SiteKey: siteKey}
+	err := db.GetContext(ctx, &m, `SELECT site_key, account_id, version FROM active_accounts WHERE site_key = ?`, siteKey)
+	if err != nil && err != sql.ErrNoRows { return nil, err }
+	id, err := GetActiveAccountID(ctx, db, siteKey)
+	if err != nil { return nil, err }
+	m.AccountID = id
+	return &m, nil
+}
+
+// VersionAbsent as ifVersion makes a conditional write succeed only while
+// the row does not exist yet; it is what If-Match: "0" asks for, 0 being the
+// version reported for a site with no active mapping.
+const VersionAbsent int64 = -1
+
+// SetActiveAccountID points a site at an account. With a non-zero ifVersion
+// only an existing mapping at that version is updated; VersionAbsent only
+// creates the mapping.
+func SetActiveAccountID(ctx context.Context, db DBTX, siteKey string, accountID *string, ifVersion int64) error {
     var v interface{}
     if accountID != nil { v = *accountID } else { v = nil }
+    if ifVersion == VersionAbsent {
+        res, err := db.ExecContext(ctx, `INSERT INTO active_accounts(site_key, account_id, updated_at)
+            VALUES(?, ?, CAST(strftime('%s','now') AS INTEGER))
+            ON CONFLICT(site_key) DO NOTHING`, siteKey, v)
+        if err != nil { return err }
+        if n, _ := res.RowsAffected(); n == 0 { return ErrVersionMismatch }
+        return nil
+    }
+    if ifVersion != 0 {
+        res, err := db.ExecContext(ctx, `UPDATE active_accounts SET account_id = ?, updated_at = CAST(strftime('%s','now') AS INTEGER), version = version + 1
+            WHERE site_key = ? AND version = ?`, v, siteKey, ifVersion)
+        if err != nil { return err }
+        if n, _ := res.RowsAffected(); n == 0 { return ErrVersionMismatch }
+        return nil
+    }
     _, err := db.ExecContext(ctx, `INSERT INTO active_accounts(site_key, account_id, updated_at)
         VALUES(?, ?, CAST(strftime('%s','now') AS INTEGER))
-        ON CONFLICT(site_key) DO UPDATE SET account_id = excluded.account_id, updated_at = excluded.updated_at`, siteKey, v)
+        ON CONFLICT(site_key) DO UPDATE SET account_id = excluded.account_id, updated_at = excluded.updated_at, version = active_accounts.version + 1`, siteKey, v)
     return err
 }
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var (
+	// ErrNotFound is returned when the target row does not exist (or is in trash).
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a write would clash with existing state,
+	// e.g. restoring an account whose site is still in trash.
+	ErrConflict = errors.New("conflict")
+	// ErrVersionMismatch is returned when a conditional write names a version
+	// other than the stored one.
+	ErrVersionMismatch = errors.New("version mismatch")
+)
+
+// missOrMismatch resolves a conditional write that touched no rows: countQuery
+// counts live rows for the key, so zero means ErrNotFound and anything else
+// means the row is at another version.
+func missOrMismatch(ctx context.Context, q sqlx.QueryerContext, countQuery string, args ...interface{}) error {
+	var n int
+	if err := sqlx.GetContext(ctx, q, &n, countQuery, args...); err != nil { return err }
+	if n == 0 { return ErrNotFound }
+	return ErrVersionMismatch
+}
+
+// uniqueToConflict turns a primary-key/unique violation into ErrConflict so
+// both backends report duplicate keys the same way.
+func uniqueToConflict(err error) error {
+	var se *sqlite.Error
+	if errors.As(err, &se) {
+		switch se.Code() {
+		case sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY, sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+			return ErrConflict
+		}
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// ListManagedSites returns every site owned by declarative config.
+func ListManagedSites(ctx context.Context, db DBTX) ([]ManagedSite, error) {
+	items := []ManagedSite{}
+	err := db.SelectContext(ctx, &items, `SELECT site_key, source, spec, applied_at FROM managed_sites ORDER BY site_key`)
+	return items, err
+}
+
+// GetManagedSite returns the config ownership of a site, or nil.
+func GetManagedSite(ctx context.Context, db DBTX, siteKey string) (*ManagedSite, error) {
+	var m ManagedSite
+	err := db.GetContext(ctx, &m, `SELECT site_key, source, spec, applied_at FROM managed_sites WHERE site_key = ?`, siteKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) { return nil, nil }
+		return nil, err
+	}
+	return &m, nil
+}
+
+// PutManagedSite marks a live site as owned by m.Source.
+func PutManagedSite(ctx context.Context, db DBTX, m *ManagedSite) error {
+	var n int
+	if err := db.GetContext(ctx, &n, `SELECT COUNT(1) FROM sites WHERE key = ? AND deleted_at IS NULL`, m.SiteKey); err != nil { return err }
+	if n == 0 { return ErrNotFound }
+	m.AppliedAt = nowUnix()
+	_, err := db.ExecContext(ctx, `INSERT INTO managed_sites(site_key, source, spec, applied_at) VALUES(?,?,?,?)
+		ON CONFLICT(site_key) DO UPDATE SET source = excluded.source, spec = excluded.spec, applied_at = excluded.applied_at`,
+		m.SiteKey, m.Source, m.Spec, m.AppliedAt)
+	return err
+}
+
+// ReleaseManagedSite drops config ownership of a site.
+func ReleaseManagedSite(ctx context.Context, db DBTX, siteKey string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM managed_sites WHERE site_key = ?`, siteKey)
+	return err
+}
@@ -0,0 +1,577 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Memory is an in-process backend with the same semantics as the SQLite one
+// (soft delete, versions, revisions). Data is lost when the process exits.
+//
+// Transactions hold the store lock for their whole duration and work on a
+// clone of the state that replaces the original only on success.
+type Memory struct {
+	mu      *sync.Mutex
+	inTx    bool // views handed to InTx callbacks; the lock is already held
+	st      *memState
+	secrets RevisionSecrets
+}
+
+type memState struct {
+	sites     map[string]*Site
+	accounts  map[string]*Account
+	schemas   map[string]map[string]*SiteFieldSchema
+	active    map[string]*ActiveAccount
+	revisions map[string][]AccountRevision
+	packs     map[string]*SitePack
+	managed   map[string]*ManagedSite
+}
+
+// NewMemory returns repositories backed by a fresh Memory store; secrets
+// says how account revisions keep overwritten secrets.
+func NewMemory(secrets RevisionSecrets) Repos {
+	return (&Memory{mu: &sync.Mutex{}, secrets: secrets, st: &memState{
+		sites:     map[string]*Site{},
+		accounts:  map[string]*Account{},
+		schemas:   map[string]map[string]*SiteFieldSchema{},
+		active:    map[string]*ActiveAccount{},
+		revisions: map[string][]AccountRevision{},
+		packs:     map[string]*SitePack{},
+		managed:   map[string]*ManagedSite{},
+	}}).repos()
+}
+
+func (m *Memory) repos() Repos {
+	return Repos{
+		Sites:    memSites{m},
+		Accounts: memAccounts{m},
+		Schemas:  memSchemas{m},
+		Active:   memActive{m},
+		Packs:    memPacks{m},
+		Managed:  memManaged{m},
+		Trash:    memTrash{m},
+		Tx:       memTx{m},
+	}
+}
+
+// lock acquires the store lock unless m is a transaction view.
+func (m *Memory) lock() func() {
+	if m.inTx { return func() {} }
+	m.mu.Lock()
+	return m.mu.Unlock
+}
+
+func (st *memState) clone() *memState {
+	c := &memState{
+		sites:     make(map[string]*Site, len(st.sites)),
+		accounts:  make(map[string]*Account, len(st.accounts)),
+		schemas:   make(map[string]map[string]*SiteFieldSchema, len(st.schemas)),
+		active:    make(map[string]*ActiveAccount, len(st.active)),
+		revisions: make(map[string][]AccountRevision, len(st.revisions)),
+		packs:     make(map[string]*SitePack, len(st.packs)),
+		managed:   make(map[string]*ManagedSite, len(st.managed)),
+	}
+	for k, v := range st.sites { s := copySite(v); c.sites[k] = &s }
+	for k, v := range st.accounts { a := copyAccount(v); c.accounts[k] = &a }
+	for k, fields := range st.schemas {
+		c.schemas[k] = make(map[string]*SiteFieldSchema, len(fields))
+		for f, v := range fields { sc := copySchema(v); c.schemas[k][f] = &sc }
+	}
+	for k, v := range st.active {
+		aa := *v
+		if v.AccountID != nil { id := *v.AccountID; aa.AccountID = &id }
+		c.active[k] = &aa
+	}
+	for k, v := range st.revisions { c.revisions[k] = append([]AccountRevision(nil), v...) }
+	for k, v := range st.packs { p := *v; c.packs[k] = &p }
+	for k, v := range st.managed { ms := *v; c.managed[k] = &ms }
+	return c
+}
+
+type memTx struct{ m *Memory }
+
+func (r memTx) InTx(ctx context.Context, fn func(tx Repos) error) error {
+	defer r.m.lock()()
+	view := &Memory{mu: r.m.mu, inTx: true, st: r.m.st.clone(), secrets: r.m.secrets}
+	if err := fn(view.repos()); err != nil { return err }
+	*r.m.st = *view.st
+	return nil
+}
+
+func copyStamp(p *int64) *int64 {
+	if p == nil { return nil }
+	v := *p
+	return &v
+}
+
+func stamp(v int64) *int64 { return &v }
+
+func (m *Memory) liveSite(key string) *Site {
+	s, ok := m.st.sites[key]
+	if !ok || s.DeletedAt != nil { return nil }
+	return s
+}
+
+func (m *Memory) liveAccount(siteKey, id string) *Account {
+	a, ok := m.st.accounts[id]
+	if !ok || a.SiteKey != siteKey || a.DeletedAt != nil { return nil }
+	return a
+}
+
+func (m *Memory) liveSchema(siteKey, field string) *SiteFieldSchema {
+	s, ok := m.st.schemas[siteKey][field]
+	if !ok || s.DeletedAt != nil { return nil }
+	return s
+}
+
+// dropAccount removes an account the way ON DELETE CASCADE / SET NULL would.
+func (m *Memory) dropAccount(id string) {
+	delete(m.st.accounts, id)
+	delete(m.st.revisions, id)
+	for _, aa := range m.st.active {
+		if aa.AccountID != nil && *aa.AccountID == id { aa.AccountID = nil }
+	}
+}
+
+func (m *Memory) dropSite(key string) {
+	for id, a := range m.st.accounts {
+		if a.SiteKey == key { m.dropAccount(id) }
+	}
+	delete(m.st.schemas, key)
+	delete(m.st.active, key)
+	delete(m.st.packs, key)
+	delete(m.st.managed, key)
+	delete(m.st.sites, key)
+}
+
+type memSites struct{ m *Memory }
+
+func (r memSites) List(ctx context.Context) ([]Site, error) {
+	defer r.m.lock()()
+	items := []Site{}
+	for _, s := range r.m.st.sites {
+		if s.DeletedAt == nil { items = append(items, copySite(s)) }
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	return items, nil
+}
+
+func copySite(s *Site) Site {
+	c := *s
+	c.DeletedAt = copyStamp(s.DeletedAt)
+	return c
+}
+
+func (r memSites) Get(ctx context.Context, key string) (*Site, error) {
+	defer r.m.lock()()
+	s := r.m.liveSite(key)
+	if s == nil { return nil, nil }
+	c := copySite(s)
+	return &c, nil
+}
+
+func (r memSites) Create(ctx context.Context, s *Site) error {
+	defer r.m.lock()()
+	if _, ok := r.m.st.sites[s.Key]; ok { return ErrConflict }
+	now := nowUnix()
+	mode := s.AdditionalProps
+	if mode == "" { mode = PropsAllow }
+	r.m.st.sites[s.Key] = &Site{Key: s.Key, Name: s.Name, LoginURL: s.LoginURL, AdditionalProps: mode, AccountRules: s.AccountRules, Created: now, Updated: now, Version: 1}
+	return nil
+}
+
+func (r memSites) Update(ctx context.Context, s *Site, ifVersion int64) error {
+	defer r.m.lock()()
+	cur := r.m.liveSite(s.Key)
+	if cur == nil { return ErrNotFound }
+	if ifVersion != 0 && cur.Version != ifVersion { return ErrVersionMismatch }
+	cur.Name, cur.LoginURL = s.Name, s.LoginURL
+	if s.AdditionalProps != "" { cur.AdditionalProps = s.AdditionalProps }
+	if s.AccountRules != "" { cur.AccountRules = s.AccountRules }
+	cur.Updated = nowUnix()
+	cur.Version++
+	*s = copySite(cur)
+	return nil
+}
+
+func (r memSites) Delete(ctx context.Context, key string, ifVersion int64) error {
+	defer r.m.lock()()
+	cur := r.m.liveSite(key)
+	if cur == nil { return ErrNotFound }
+	if ifVersion != 0 && cur.Version != ifVersion { return ErrVersionMismatch }
+	now := nowUnix()
+	cur.DeletedAt = stamp(now)
+	cur.Version++
+	for _, a := range r.m.st.accounts {
+		if a.SiteKey == key && a.DeletedAt == nil { a.DeletedAt = stamp(now); a.Version++ }
+	}
+	for _, f := range r.m.st.schemas[key] {
+		if f.DeletedAt == nil { f.DeletedAt = stamp(now); f.Version++ }
+	}
+	return nil
+}
+
+func (r memSites) Restore(ctx context.Context, key string) error {
+	defer r.m.lock()()
+	cur, ok := r.m.st.sites[key]
+	if !ok || cur.DeletedAt == nil { return ErrNotFound }
+	deletedAt := *cur.DeletedAt
+	cur.DeletedAt = nil
+	cur.Version++
+	for _, a := range r.m.st.accounts {
+		if a.SiteKey == key && a.DeletedAt != nil && *a.DeletedAt == deletedAt { a.DeletedAt = nil; a.Version++ }
+	}
+	for _, f := range r.m.st.schemas[key] {
+		if f.DeletedAt != nil && *f.DeletedAt == deletedAt { f.DeletedAt = nil; f.Version++ }
+	}
+	return nil
+}
+
+func (r memSites) Purge(ctx context.Context, key string) error {
+	defer r.m.lock()()
+	if _, ok := r.m.st.sites[key]; !ok { return ErrNotFound }
+	r.m.dropSite(key)
+	return nil
+}
+
+type memAccounts struct{ m *Memory }
+
+func copyAccount(a *Account) Account {
+	c := *a
+	c.DeletedAt = copyStamp(a.DeletedAt)
+	return c
+}
+
+func (r memAccounts) List(ctx context.Context, siteKey string) ([]Account, error) {
+	defer r.m.lock()()
+	items := []Account{}
+	for _, a := range r.m.st.accounts {
+		if a.SiteKey == siteKey && a.DeletedAt == nil { items = append(items, copyAccount(a)) }
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Username != items[j].Username { return items[i].Username < items[j].Username }
+		return items[i].ID < items[j].ID
+	})
+	return items, nil
+}
+
+func (r memAccounts) Get(ctx context.Context, siteKey, id string) (*Account, error) {
+	defer r.m.lock()()
+	a := r.m.liveAccount(siteKey, id)
+	if a == nil { return nil, nil }
+	c := copyAccount(a)
+	return &c, nil
+}
+
+func (r memAccounts) Create(ctx context.Context, a *Account) error {
+	defer r.m.lock()()
+	if r.m.liveSite(a.SiteKey) == nil { return ErrNotFound }
+	if _, ok := r.m.st.accounts[a.ID]; ok { return ErrConflict }
+	now := nowUnix()
+	r.m.st.accounts[a.ID] = &Account{ID: a.ID, SiteKey: a.SiteKey, Username: a.Username, Password: a.Password, Extra: a.Extra, Created: now, Updated: now, Version: 1}
+	return nil
+}
+
+func (r memAccounts) Update(ctx context.Context, a *Account, ifVersion int64) error {
+	defer r.m.lock()()
+	cur := r.m.liveAccount(a.SiteKey, a.ID)
+	if cur == nil { return ErrNotFound }
+	if ifVersion != 0 && cur.Version != ifVersion { return ErrVersionMismatch }
+	var secretFields []string
+	for _, f := range r.m.st.schemas[a.SiteKey] {
+		if f.Secret != 0 && f.DeletedAt == nil { secretFields = append(secretFields, f.Field) }
+	}
+	rev := r.m.secrets.seal(*cur, secretFields, nowUnix())
+	rev.Rev = int64(len(r.m.st.revisions[a.ID])) + 1
+	r.m.st.revisions[a.ID] = append(r.m.st.revisions[a.ID], rev)
+	cur.Username, cur.Password, cur.Extra = a.Username, a.Password, a.Extra
+	cur.Updated = nowUnix()
+	cur.Version++
+	*a = copyAccount(cur)
+	return nil
+}
+
+func (r memAccounts) Delete(ctx context.Context, siteKey, id string, ifVersion int64) error {
+	defer r.m.lock()()
+	cur := r.m.liveAccount(siteKey, id)
+	if cur == nil { return ErrNotFound }
+	if ifVersion != 0 && cur.Version != ifVersion { return ErrVersionMismatch }
+	cur.DeletedAt = stamp(nowUnix())
+	cur.Version++
+	return nil
+}
+
+func (r memAccounts) Restore(ctx context.Context, siteKey, id string) error {
+	defer r.m.lock()()
+	if r.m.liveSite(siteKey) == nil { return ErrConflict }
+	cur, ok := r.m.st.accounts[id]
+	if !ok || cur.SiteKey != siteKey || cur.DeletedAt == nil { return ErrNotFound }
+	cur.DeletedAt = nil
+	cur.Version++
+	return nil
+}
+
+func (r memAccounts) Purge(ctx context.Context, siteKey, id string) error {
+	defer r.m.lock()()
+	cur, ok := r.m.st.accounts[id]
+	if !ok || cur.SiteKey != siteKey { return ErrNotFound }
+	r.m.dropAccount(id)
+	return nil
+}
+
+func (r memAccounts) Revisions(ctx context.Context, siteKey, id string) ([]AccountRevision, error) {
+	defer r.m.lock()()
+	items := []AccountRevision{}
+	revs := r.m.st.revisions[id]
+	for i := len(revs) - 1; i >= 0; i-- {
+		if revs[i].SiteKey != siteKey { continue }
+		rv := revs[i]
+		if err := r.m.secrets.open(&rv); err != nil { return nil, err }
+		items = append(items, rv)
+	}
+	return items, nil
+}
+
+func (r memAccounts) Revision(ctx context.Context, siteKey, id string, rev int64) (*AccountRevision, error) {
+	defer r.m.lock()()
+	for _, rv := range r.m.st.revisions[id] {
+		if rv.Rev != rev || rv.SiteKey != siteKey { continue }
+		if err := r.m.secrets.open(&rv); err != nil { return nil, err }
+		return &rv, nil
+	}
+	return nil, ErrNotFound
+}
+
+type memSchemas struct{ m *Memory }
+
+func copySchema(s *SiteFieldSchema) SiteFieldSchema {
+	c := *s
+	c.DeletedAt = copyStamp(s.DeletedAt)
+	if s.Min != nil { v := *s.Min; c.Min = &v }
+	if s.Max != nil { v := *s.Max; c.Max = &v }
+	if s.MinLength != nil { v := *s.MinLength; c.MinLength = &v }
+	if s.MaxLength != nil { v := *s.MaxLength; c.MaxLength = &v }
+	return c
+}
+
+func sortSchemas(items []SiteFieldSchema) {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Order != items[j].Order { return items[i].Order < items[j].Order }
+		return items[i].Field < items[j].Field
+	})
+}
+
+func (r memSchemas) List(ctx context.Context, siteKey string) ([]SiteFieldSchema, error) {
+	defer r.m.lock()()
+	items := []SiteFieldSchema{}
+	for _, f := range r.m.st.schemas[siteKey] {
+		if f.DeletedAt == nil { items = append(items, copySchema(f)) }
+	}
+	sortSchemas(items)
+	return items, nil
+}
+
+func (r memSchemas) Get(ctx context.Context, siteKey, field string) (*SiteFieldSchema, error) {
+	defer r.m.lock()()
+	f := r.m.liveSchema(siteKey, field)
+	if f == nil { return nil, nil }
+	c := copySchema(f)
+	return &c, nil
+}
+
+func (r memSchemas) Upsert(ctx context.Context, s *SiteFieldSchema, ifVersion int64) error {
+	defer r.m.lock()()
+	if _, ok := r.m.st.sites[s.SiteKey]; !ok { return ErrNotFound }
+	cur, exists := r.m.st.schemas[s.SiteKey][s.Field]
+	if ifVersion != 0 {
+		if !exists || cur.DeletedAt != nil { return ErrNotFound }
+		if cur.Version != ifVersion { return ErrVersionMismatch }
+	}
+	next := copySchema(s)
+	next.DeletedAt = nil
+	next.Version = 1
+	if exists { next.Version = cur.Version + 1 }
+	if r.m.st.schemas[s.SiteKey] == nil { r.m.st.schemas[s.SiteKey] = map[string]*SiteFieldSchema{} }
+	r.m.st.schemas[s.SiteKey][s.Field] = &next
+	return nil
+}
+
+func (r memSchemas) Delete(ctx context.Context, siteKey, field string, ifVersion int64) error {
+	defer r.m.lock()()
+	cur := r.m.liveSchema(siteKey, field)
+	if cur == nil { return ErrNotFound }
+	if ifVersion != 0 && cur.Version != ifVersion { return ErrVersionMismatch }
+	cur.DeletedAt = stamp(nowUnix())
+	cur.Version++
+	return nil
+}
+
+func (r memSchemas) Restore(ctx context.Context, siteKey, field string) error {
+	defer r.m.lock()()
+	if r.m.liveSite(siteKey) == nil { return ErrConflict }
+	cur, ok := r.m.st.schemas[siteKey][field]
+	if !ok || cur.DeletedAt == nil { return ErrNotFound }
+	cur.DeletedAt = nil
+	cur.Version++
+	return nil
+}
+
+func (r memSchemas) Purge(ctx context.Context, siteKey, field string) error {
+	defer r.m.lock()()
+	if _, ok := r.m.st.schemas[siteKey][field]; !ok { return ErrNotFound }
+	delete(r.m.st.schemas[siteKey], field)
+	return nil
+}
+
+type memActive struct{ m *Memory }
+
+func (r memActive) Get(ctx context.Context, siteKey string) (*ActiveAccount, error) {
+	defer r.m.lock()()
+	out := ActiveAccount{SiteKey: siteKey}
+	aa, ok := r.m.st.active[siteKey]
+	if !ok { return &out, nil }
+	out.Version = aa.Version
+	if aa.AccountID != nil {
+		if a, ok := r.m.st.accounts[*aa.AccountID]; ok && a.DeletedAt == nil {
+			id := *aa.AccountID
+			out.AccountID = &id
+		}
+	}
+	return &out, nil
+}
+
+func (r memActive) Set(ctx context.Context, siteKey string, accountID *string, ifVersion int64) error {
+	defer r.m.lock()()
+	if _, ok := r.m.st.sites[siteKey]; !ok { return ErrNotFound }
+	if accountID != nil {
+		if _, ok := r.m.st.accounts[*accountID]; !ok { return ErrNotFound }
+	}
+	var id *string
+	if accountID != nil { v := *accountID; id = &v }
+	cur, ok := r.m.st.active[siteKey]
+	if ifVersion == VersionAbsent && ok { return ErrVersionMismatch }
+	if ifVersion > 0 && (!ok || cur.Version != ifVersion) { return ErrVersionMismatch }
+	if !ok {
+		r.m.st.active[siteKey] = &ActiveAccount{SiteKey: siteKey, AccountID: id, Version: 1}
+		return nil
+	}
+	cur.AccountID = id
+	cur.Version++
+	return nil
+}
+
+type memPacks struct{ m *Memory }
+
+func (r memPacks) List(ctx context.Context) ([]SitePack, error) {
+	defer r.m.lock()()
+	items := []SitePack{}
+	for k, p := range r.m.st.packs {
+		if r.m.liveSite(k) != nil { items = append(items, *p) }
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].SiteKey < items[j].SiteKey })
+	return items, nil
+}
+
+func (r memPacks) Get(ctx context.Context, siteKey string) (*SitePack, error) {
+	defer r.m.lock()()
+	p, ok := r.m.st.packs[siteKey]
+	if !ok || r.m.liveSite(siteKey) == nil { return nil, nil }
+	out := *p
+	return &out, nil
+}
+
+func (r memPacks) Put(ctx context.Context, p *SitePack) error {
+	defer r.m.lock()()
+	if r.m.liveSite(p.SiteKey) == nil { return ErrNotFound }
+	p.InstalledAt = nowUnix()
+	v := *p
+	r.m.st.packs[p.SiteKey] = &v
+	return nil
+}
+
+type memManaged struct{ m *Memory }
+
+func (r memManaged) List(ctx context.Context) ([]ManagedSite, error) {
+	defer r.m.lock()()
+	items := []ManagedSite{}
+	for _, ms := range r.m.st.managed { items = append(items, *ms) }
+	sort.Slice(items, func(i, j int) bool { return items[i].SiteKey < items[j].SiteKey })
+	return items, nil
+}
+
+func (r memManaged) Get(ctx context.Context, siteKey string) (*ManagedSite, error) {
+	defer r.m.lock()()
+	ms, ok := r.m.st.managed[siteKey]
+	if !ok { return nil, nil }
+	out := *ms
+	return &out, nil
+}
+
+func (r memManaged) Put(ctx context.Context, ms *ManagedSite) error {
+	defer r.m.lock()()
+	if r.m.liveSite(ms.SiteKey) == nil { return ErrNotFound }
+	ms.AppliedAt = nowUnix()
+	v := *ms
+	r.m.st.managed[ms.SiteKey] = &v
+	return nil
+}
+
+func (r memManaged) Release(ctx context.Context, siteKey string) error {
+	defer r.m.lock()()
+	delete(r.m.st.managed, siteKey)
+	return nil
+}
+
+type memTrash struct{ m *Memory }
+
+func (r memTrash) List(ctx context.Context) (*Trash, error) {
+	defer r.m.lock()()
+	t := &Trash{Sites: []Site{}, Accounts: []Account{}, Schemas: []SiteFieldSchema{}}
+	for _, s := range r.m.st.sites {
+		if s.DeletedAt != nil { t.Sites = append(t.Sites, copySite(s)) }
+	}
+	for _, a := range r.m.st.accounts {
+		if a.DeletedAt != nil { t.Accounts = append(t.Accounts, copyAccount(a)) }
+	}
+	for _, fields := range r.m.st.schemas {
+		for _, f := range fields {
+			if f.DeletedAt != nil { t.Schemas = append(t.Schemas, copySchema(f)) }
+		}
+	}
+	sort.Slice(t.Sites, func(i, j int) bool {
+		a, b := t.Sites[i], t.Sites[j]
+		if *a.DeletedAt != *b.DeletedAt { return *a.DeletedAt > *b.DeletedAt }
+		return a.Key < b.Key
+	})
+	sort.Slice(t.Accounts, func(i, j int) bool {
+		a, b := t.Accounts[i], t.Accounts[j]
+		if *a.DeletedAt != *b.DeletedAt { return *a.DeletedAt > *b.DeletedAt }
+		if a.SiteKey != b.SiteKey { return a.SiteKey < b.SiteKey }
+		return a.Username < b.Username
+	})
+	sort.Slice(t.Schemas, func(i, j int) bool {
+		a, b := t.Schemas[i], t.Schemas[j]
+		if *a.DeletedAt != *b.DeletedAt { return *a.DeletedAt > *b.DeletedAt }
+		if a.SiteKey != b.SiteKey { return a.SiteKey < b.SiteKey }
+		return a.Field < b.Field
+	})
+	return t, nil
+}
+
+func (r memTrash) PurgeBefore(ctx context.Context, before int64) (PurgeResult, error) {
+	defer r.m.lock()()
+	var res PurgeResult
+	for key, s := range r.m.st.sites {
+		if s.DeletedAt != nil && *s.DeletedAt < before { r.m.dropSite(key); res.Sites++ }
+	}
+	for id, a := range r.m.st.accounts {
+		if a.DeletedAt != nil && *a.DeletedAt < before { r.m.dropAccount(id); res.Accounts++ }
+	}
+	for _, fields := range r.m.st.schemas {
+		for name, f := range fields {
+			if f.DeletedAt != nil && *f.DeletedAt < before { delete(fields, name); res.Schemas++ }
+		}
+	}
+	return res, nil
+}
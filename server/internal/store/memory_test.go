@@ -0,0 +1,12 @@
+package store_test
+
+import (
+	"testing"
+
+	"mss/internal/store"
+	"mss/internal/store/storetest"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, secrets store.RevisionSecrets) store.Repos { return store.NewMemory(secrets) })
+}
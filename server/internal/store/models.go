@@ -4,29 +4,94 @@ type Site struct {
 	Key      string `db:"key" json:"key"`
 	Name     string `db:"name" json:"name"`
 	LoginURL string `db:"login_url" json:"loginUrl"`
-	Created  int64  `db:"created_at" json:"createdAt"`
-	Updated  int64  `db:"updated_at" json:"updatedAt"`
+	// AdditionalProps is what validation does with props the site's schema
+	// does not declare: PropsAllow, PropsWarn or PropsReject.
+	AdditionalProps string `db:"additional_props" json:"additionalProps"`
+	// AccountRules is the JSON of validation.AccountRules; the API renders
+	// it as an object.
+	AccountRules    string `db:"account_rules" json:"-"`
+	Created         int64  `db:"created_at" json:"createdAt"`
+	Updated         int64  `db:"updated_at" json:"updatedAt"`
+	DeletedAt       *int64 `db:"deleted_at" json:"deletedAt,omitempty"`
+	Version         int64  `db:"version" json:"version"`
 }
 
+// Site.AdditionalProps modes.
+const (
+	PropsAllow  = "allow"
+	PropsWarn   = "warn"
+	PropsReject = "reject"
+)
+
 type Account struct {
-	ID       string `db:"id" json:"id"`
-	SiteKey  string `db:"site_key" json:"siteKey"`
-	Username string `db:"username" json:"username"`
-	Password string `db:"password" json:"password"`
-	Extra    string `db:"extra" json:"extra"`
-	Created  int64  `db:"created_at" json:"createdAt"`
-	Updated  int64  `db:"updated_at" json:"updatedAt"`
+	ID        string `db:"id" json:"id"`
+	SiteKey   string `db:"site_key" json:"siteKey"`
+	Username  string `db:"username" json:"username"`
+	Password  string `db:"password" json:"password"`
+	Extra     string `db:"extra" json:"extra"`
+	Created   int64  `db:"created_at" json:"createdAt"`
+	Updated   int64  `db:"updated_at" json:"updatedAt"`
+	DeletedAt *int64 `db:"deleted_at" json:"deletedAt,omitempty"`
+	Version   int64  `db:"version" json:"version"`
 }
 
 type SiteFieldSchema struct {
-	SiteKey      string `db:"site_key" json:"siteKey"`
-	Field        string `db:"field" json:"field"`
-	Type         string `db:"type" json:"type"`
-	Required     int    `db:"required" json:"required"` // 0/1
-	DefaultValue string `db:"default_value" json:"default"`
-	Regex        string `db:"regex" json:"regex"`
-	Choices      string `db:"choices" json:"choices"` // JSON array
-	Secret       int    `db:"secret" json:"secret"`   // 0/1
-	Order        int    `db:"order" json:"order"`
-	UIHint       string `db:"ui_hint" json:"uiHint"`
+	SiteKey      string   `db:"site_key" json:"siteKey"`
+	Field        string   `db:"field" json:"field"`
+	Type         string   `db:"type" json:"type"`
+	Required     int      `db:"required" json:"required"` // 0/1
+	DefaultValue string   `db:"default_value" json:"default"`
+	Regex        string   `db:"regex" json:"regex"`
+	Choices      string   `db:"choices" json:"choices"` // JSON array
+	Secret       int      `db:"secret" json:"secret"`   // 0/1
+	Order        int      `db:"order" json:"order"`
+	UIHint       string   `db:"ui_hint" json:"uiHint"`
+	Min          *float64 `db:"min" json:"min,omitempty"`
+	Max          *float64 `db:"max" json:"max,omitempty"`
+	MinLength    *int     `db:"min_length" json:"minLength,omitempty"`
+	MaxLength    *int     `db:"max_length" json:"maxLength,omitempty"`
+	Unique       int      `db:"is_unique" json:"unique"` // 0/1
+	Items        string   `db:"items" json:"items"`      // JSON rule for array elements
+	Fields       string   `db:"fields" json:"fields"`    // JSON rules for object subfields
+	DeletedAt    *int64   `db:"deleted_at" json:"deletedAt,omitempty"`
+	Version      int64    `db:"version" json:"version"`
+}
+
+// ActiveAccount is the per-site active account mapping.
+type ActiveAccount struct {
+	SiteKey   string  `db:"site_key" json:"siteKey"`
+	AccountID *string `db:"account_id" json:"accountId"`
+	Version   int64   `db:"version" json:"version"`
+}
+
+// SitePack records the site pack (name@version) a site was installed from.
+type SitePack struct {
+	SiteKey     string `db:"site_key" json:"siteKey"`
+	Name        string `db:"name" json:"name"`
+	Version     string `db:"version" json:"version"`
+	Manifest    string `db:"manifest" json:"-"` // the installed pack document, JSON
+	InstalledAt int64  `db:"installed_at" json:"installedAt"`
+}
+
+// ManagedSite marks a site as owned by declarative config; Spec is the
+// desired definition as last applied.
+type ManagedSite struct {
+	SiteKey   string `db:"site_key" json:"siteKey"`
+	Source    string `db:"source" json:"source"`
+	Spec      string `db:"spec" json:"-"`
+	AppliedAt int64  `db:"applied_at" json:"appliedAt"`
+}
+
+// Trash groups soft-deleted rows that can still be restored.
+type Trash struct {
+	Sites    []Site            `json:"sites"`
+	Accounts []Account         `json:"accounts"`
+	Schemas  []SiteFieldSchema `json:"schemas"`
+}
+
+// PurgeResult reports how many trashed rows a purge removed for good.
+type PurgeResult struct {
+	Sites    int64 `json:"sites"`
+	Accounts int64 `json:"accounts"`
+	Schemas  int64 `json:"schemas"`
 }
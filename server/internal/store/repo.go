@@ -0,0 +1,85 @@
+package store
+
+import "context"
+
+// SiteRepo stores sites. Get returns nil, nil for a missing or trashed site.
+type SiteRepo interface {
+	List(ctx context.Context) ([]Site, error)
+	Get(ctx context.Context, key string) (*Site, error)
+	Create(ctx context.Context, s *Site) error
+	Update(ctx context.Context, s *Site, ifVersion int64) error
+	Delete(ctx context.Context, key string, ifVersion int64) error
+	Restore(ctx context.Context, key string) error
+	Purge(ctx context.Context, key string) error
+}
+
+// AccountRepo stores accounts and their revision history.
+type AccountRepo interface {
+	List(ctx context.Context, siteKey string) ([]Account, error)
+	Get(ctx context.Context, siteKey, id string) (*Account, error)
+	Create(ctx context.Context, a *Account) error
+	Update(ctx context.Context, a *Account, ifVersion int64) error
+	Delete(ctx context.Context, siteKey, id string, ifVersion int64) error
+	Restore(ctx context.Context, siteKey, id string) error
+	Purge(ctx context.Context, siteKey, id string) error
+	Revisions(ctx context.Context, siteKey, id string) ([]AccountRevision, error)
+	Revision(ctx context.Context, siteKey, id string, rev int64) (*AccountRevision, error)
+}
+
+// SchemaRepo stores per-site field schemas.
+type SchemaRepo interface {
+	List(ctx context.Context, siteKey string) ([]SiteFieldSchema, error)
+	Get(ctx context.Context, siteKey, field string) (*SiteFieldSchema, error)
+	Upsert(ctx context.Context, s *SiteFieldSchema, ifVersion int64) error
+	Delete(ctx context.Context, siteKey, field string, ifVersion int64) error
+	Restore(ctx context.Context, siteKey, field string) error
+	Purge(ctx context.Context, siteKey, field string) error
+}
+
+// ActiveRepo stores the active account of each site.
+type ActiveRepo interface {
+	Get(ctx context.Context, siteKey string) (*ActiveAccount, error)
+	Set(ctx context.Context, siteKey string, accountID *string, ifVersion int64) error
+}
+
+// PackRepo records which site pack each site was installed from. Get
+// returns nil, nil when the site has none or is trashed.
+type PackRepo interface {
+	List(ctx context.Context) ([]SitePack, error)
+	Get(ctx context.Context, siteKey string) (*SitePack, error)
+	Put(ctx context.Context, p *SitePack) error
+}
+
+// ManagedRepo records which sites declarative config owns. Ownership
+// survives trashing the site and ends with Release or a purge.
+type ManagedRepo interface {
+	List(ctx context.Context) ([]ManagedSite, error)
+	Get(ctx context.Context, siteKey string) (*ManagedSite, error)
+	Put(ctx context.Context, m *ManagedSite) error
+	Release(ctx context.Context, siteKey string) error
+}
+
+// TrashRepo lists and purges soft-deleted rows.
+type TrashRepo interface {
+	List(ctx context.Context) (*Trash, error)
+	PurgeBefore(ctx context.Context, before int64) (PurgeResult, error)
+}
+
+// Transactor runs fn with repos bound to one transaction: an error from fn
+// rolls back everything it did. Calling InTx on transaction-bound repos nests
+// (savepoint semantics), so one item can fail without aborting the outer work.
+type Transactor interface {
+	InTx(ctx context.Context, fn func(tx Repos) error) error
+}
+
+// Repos bundles one backend's repositories. Build it with NewSQLite or NewMemory.
+type Repos struct {
+	Sites    SiteRepo
+	Accounts AccountRepo
+	Schemas  SchemaRepo
+	Active   ActiveRepo
+	Packs    PackRepo
+	Managed  ManagedRepo
+	Trash    TrashRepo
+	Tx       Transactor
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"mss/internal/secret"
+)
+
+// How secrets of a superseded account state are kept in account_revisions.
+const (
+	SecretsPlain     = "plain"
+	SecretsRedacted  = "redacted"
+	SecretsEncrypted = "encrypted"
+)
+
+// RedactedValue replaces secret props in redacted revisions.
+const RedactedValue = "***"
+
+type AccountRevision struct {
+	AccountID string `db:"account_id" json:"accountId"`
+	Rev       int64  `db:"rev" json:"rev"`
+	SiteKey   string `db:"site_key" json:"siteKey"`
+	Username  string `db:"username" json:"username"`
+	Password  string `db:"password" json:"password"`
+	Extra     string `db:"extra" json:"extra"`
+	Secrets   string `db:"secrets" json:"secrets"`
+	Updated   int64  `db:"updated_at" json:"updatedAt"`
+	Recorded  int64  `db:"recorded_at" json:"recordedAt"`
+}
+
+// RevisionSecrets is how account updates keep secrets of the state they
+// overwrite. The zero value redacts them.
+type RevisionSecrets struct {
+	Mode string // SecretsPlain, SecretsRedacted or SecretsEncrypted; "" is SecretsRedacted
+	// Box seals revisions in encrypted mode and opens revisions recorded
+	// earlier in that mode.
+	Box *secret.Box
+}
+
+// Check rejects an unknown mode and encrypted mode without a box.
+func (s RevisionSecrets) Check() error {
+	switch s.Mode {
+	case "", SecretsPlain, SecretsRedacted:
+	case SecretsEncrypted:
+		if s.Box == nil { return errors.New("revision secrets: encrypted mode needs a key") }
+	default:
+		return errors.New("revision secrets: unknown mode " + s.Mode)
+	}
+	return nil
+}
+
+// seal turns a superseded account state into a revision row. secretFields
+// lists the site's live secret props.
+func (s RevisionSecrets) seal(prior Account, secretFields []string, recorded int64) AccountRevision {
+	rev := AccountRevision{
+		AccountID: prior.ID, SiteKey: prior.SiteKey, Username: prior.Username,
+		Password: prior.Password, Extra: prior.Extra, Secrets: SecretsPlain,
+		Updated: prior.Updated, Recorded: recorded,
+	}
+	switch s.Mode {
+	case "", SecretsRedacted:
+		rev.Password = ""
+		rev.Extra = redactExtra(prior.Extra, secretFields)
+		rev.Secrets = SecretsRedacted
+	case SecretsEncrypted:
+		box := s.Box
+		if rev.Password != "" { rev.Password = box.SealString(rev.Password) }
+		if rev.Extra != "" { rev.Extra = box.SealString(rev.Extra) }
+		rev.Secrets = SecretsEncrypted
+	}
+	return rev
+}
+
+// recordRevision stores prior as the next revision of its account. Must run
+// in the same tx as the overwrite.
+func recordRevision(ctx context.Context, tx DBTX, prior Account, secrets RevisionSecrets) error {
+	var fields []string
+	if err := tx.SelectContext(ctx, &fields, `SELECT field FROM site_field_schemas WHERE site_key = ? AND secret = 1 AND deleted_at IS NULL`, prior.SiteKey); err != nil { return err }
+	rev := secrets.seal(prior, fields, nowUnix())
+	_, err := tx.ExecContext(ctx, `INSERT INTO account_revisions(account_id, rev, site_key, username, password, extra, secrets, updated_at, recorded_at)
+		SELECT ?, COALESCE(MAX(rev), 0) + 1, ?, ?, ?, ?, ?, ?, ? FROM account_revisions WHERE account_id = ?`,
+		rev.AccountID, rev.SiteKey, rev.Username, rev.Password, rev.Extra, rev.Secrets, rev.Updated, rev.Recorded, rev.AccountID)
+	return err
+}
+
+// redactExtra masks the secret props of extra. Extra that is not a JSON
+// object is kept as it is rather than lost.
+func redactExtra(extra string, secretFields []string) string {
+	if extra == "" || len(secretFields) == 0 { return extra }
+	var props map[string]interface{}
+	if err := json.Unmarshal([]byte(extra), &props); err != nil { return extra }
+	for _, f := range secretFields {
+		if _, ok := props[f]; ok { props[f] = RedactedValue }
+	}
+	b, _ := json.Marshal(props)
+	return string(b)
+}
+
+// open decrypts an encrypted revision in place.
+func (s RevisionSecrets) open(r *AccountRevision) error {
+	if r.Secrets != SecretsEncrypted { return nil }
+	box := s.Box
+	if box == nil { return errors.New("revision secrets: encrypted revision but no key configured") }
+	if r.Password != "" {
+		v, err := box.OpenString(r.Password)
+		if err != nil { return err }
+		r.Password = v
+	}
+	if r.Extra != "" {
+		v, err := box.OpenString(r.Extra)
+		if err != nil { return err }
+		r.Extra = v
+	}
+	return nil
+}
+
+// ListAccountRevisions returns the revisions of an account, newest first,
+// with encrypted secrets opened.
+func ListAccountRevisions(ctx context.Context, db DBTX, siteKey, id string, secrets RevisionSecrets) ([]AccountRevision, error) {
+	items := []AccountRevision{}
+	err := db.SelectContext(ctx, &items, `SELECT account_id, rev, site_key, username, password, extra, secrets, updated_at, recorded_at
+		FROM account_revisions WHERE account_id = ? AND site_key = ? ORDER BY rev DESC`, id, siteKey)
+	if err != nil { return nil, err }
+	for i := range items {
+		if err := secrets.open(&items[i]); err != nil { return nil, err }
+	}
+	return items, nil
+}
+
+// GetAccountRevision returns one revision with encrypted secrets opened.
+func GetAccountRevision(ctx context.Context, db DBTX, siteKey, id string, rev int64, secrets RevisionSecrets) (*AccountRevision, error) {
+	var r AccountRevision
+	err := db.GetContext(ctx, &r, `SELECT account_id, rev, site_key, username, password, extra, secrets, updated_at, recorded_at
+		FROM account_revisions WHERE account_id = ? AND site_key = ? AND rev = ?`, id, siteKey, rev)
+	if err != nil { return nil, notFound(err) }
+	if err := secrets.open(&r); err != nil { return nil, err }
+	return &r, nil
+}
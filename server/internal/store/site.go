@@ -4,19 +4,18 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"github.com/jmoiron/sqlx"
 )
 
-func ListSites(ctx context.Context, db *sqlx.DB) ([]Site, error) {
+func ListSites(ctx context.Context, db DBTX) ([]Site, error) {
 	var items []Site
-	err := db.SelectContext(ctx, &items, `SELECT key, name, login_url, created_at, updated_at FROM sites ORDER BY key`)
+	err := db.SelectContext(ctx, &items, `SELECT key, name, login_url, additional_props, account_rules, created_at, updated_at, deleted_at, version FROM sites WHERE deleted_at IS NULL ORDER BY key`)
 	if err != nil { return nil, err }
 	return items, nil
 }
 
-func GetSite(ctx context.Context, db *sqlx.DB, key string) (*Site, error) {
+func GetSite(ctx context.Context, db DBTX, key string) (*Site, error) {
 	var s Site
-	err := db.GetContext(ctx, &s, `SELECT key, name, login_url, created_at, updated_at FROM sites WHERE key = ?`, key)
+	err := db.GetContext(ctx, &s, `SELECT key, name, login_url, additional_props, account_rules, created_at, updated_at, deleted_at, version FROM sites WHERE key = ? AND deleted_at IS NULL`, key)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) { return nil, nil }
 		return nil, err
@@ -2,20 +2,65 @@ package store
 
 import (
 	"context"
-	"github.com/jmoiron/sqlx"
 )
 
-func CreateSite(ctx context.Context, db *sqlx.DB, s *Site) error {
-	_, err := db.ExecContext(ctx, `INSERT INTO sites(key, name, login_url) VALUES(?,?,?)`, s.Key, s.Name, s.LoginURL)
-	return err
+// CreateSite inserts a site; an empty AdditionalProps means PropsAllow.
+func CreateSite(ctx context.Context, db DBTX, s *Site) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO sites(key, name, login_url, additional_props, account_rules) VALUES(?,?,?,COALESCE(NULLIF(?, ''), 'allow'),?)`, s.Key, s.Name, s.LoginURL, s.AdditionalProps, s.AccountRules)
+	return uniqueToConflict(err)
 }
 
-func UpdateSite(ctx context.Context, db *sqlx.DB, s *Site) error {
-	_, err := db.ExecContext(ctx, `UPDATE sites SET name = ?, login_url = ?, updated_at = CAST(strftime('%s','now') AS INTEGER) WHERE key = ?`, s.Name, s.LoginURL, s.Key)
-	return err
+// UpdateSite overwrites a site and bumps its version. A non-zero ifVersion
+// makes the write conditional (ErrVersionMismatch when it differs). An empty
+// AdditionalProps or AccountRules keeps the current value. s is refreshed
+// from the stored row.
+func UpdateSite(ctx context.Context, db DBTX, s *Site, ifVersion int64) error {
+	res, err := db.ExecContext(ctx, `UPDATE sites SET name = ?, login_url = ?, additional_props = COALESCE(NULLIF(?, ''), additional_props), account_rules = COALESCE(NULLIF(?, ''), account_rules), updated_at = CAST(strftime('%s','now') AS INTEGER), version = version + 1
+		WHERE key = ? AND deleted_at IS NULL AND (? = 0 OR version = ?)`, s.Name, s.LoginURL, s.AdditionalProps, s.AccountRules, s.Key, ifVersion, ifVersion)
+	if err != nil { return err }
+	if n, _ := res.RowsAffected(); n == 0 {
+		return missOrMismatch(ctx, db, `SELECT COUNT(1) FROM sites WHERE key = ? AND deleted_at IS NULL`, s.Key)
+	}
+	return db.GetContext(ctx, s, `SELECT key, name, login_url, additional_props, account_rules, created_at, updated_at, deleted_at, version FROM sites WHERE key = ?`, s.Key)
 }
 
-func DeleteSite(ctx context.Context, db *sqlx.DB, key string) error {
-	_, err := db.ExecContext(ctx, `DELETE FROM sites WHERE key = ?`, key)
-	return err
+// DeleteSite moves a site to trash together with its accounts and field schemas.
+// Children are stamped with the same deleted_at so RestoreSite can bring back
+// exactly what was cascaded, leaving items trashed earlier on their own.
+func DeleteSite(ctx context.Context, db DBTX, key string, ifVersion int64) error {
+	return withTx(ctx, db, func(tx DBTX) error {
+		now := nowUnix()
+		res, err := tx.ExecContext(ctx, `UPDATE sites SET deleted_at = ?, version = version + 1 WHERE key = ? AND deleted_at IS NULL AND (? = 0 OR version = ?)`, now, key, ifVersion, ifVersion)
+		if err != nil { return err }
+		if n, _ := res.RowsAffected(); n == 0 {
+			return missOrMismatch(ctx, tx, `SELECT COUNT(1) FROM sites WHERE key = ? AND deleted_at IS NULL`, key)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE accounts SET deleted_at = ?, version = version + 1 WHERE site_key = ? AND deleted_at IS NULL`, now, key); err != nil { return err }
+		_, err = tx.ExecContext(ctx, `UPDATE site_field_schemas SET deleted_at = ?, version = version + 1 WHERE site_key = ? AND deleted_at IS NULL`, now, key)
+		return err
+	})
+}
+
+// RestoreSite takes a site out of trash along with the children that were
+// trashed by the same DeleteSite call.
+func RestoreSite(ctx context.Context, db DBTX, key string) error {
+	return withTx(ctx, db, func(tx DBTX) error {
+		var deletedAt int64
+		if err := tx.GetContext(ctx, &deletedAt, `SELECT deleted_at FROM sites WHERE key = ? AND deleted_at IS NOT NULL`, key); err != nil {
+			return notFound(err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE sites SET deleted_at = NULL, version = version + 1 WHERE key = ?`, key); err != nil { return err }
+		if _, err := tx.ExecContext(ctx, `UPDATE accounts SET deleted_at = NULL, version = version + 1 WHERE site_key = ? AND deleted_at = ?`, key, deletedAt); err != nil { return err }
+		_, err := tx.ExecContext(ctx, `UPDATE site_field_schemas SET deleted_at = NULL, version = version + 1 WHERE site_key = ? AND deleted_at = ?`, key, deletedAt)
+		return err
+	})
+}
+
+// PurgeSite permanently removes a site; accounts, schemas and the active
+// mapping go with it through ON DELETE CASCADE.
+func PurgeSite(ctx context.Context, db DBTX, key string) error {
+	res, err := db.ExecContext(ctx, `DELETE FROM sites WHERE key = ?`, key)
+	if err != nil { return err }
+	if n, _ := res.RowsAffected(); n == 0 { return ErrNotFound }
+	return nil
 }
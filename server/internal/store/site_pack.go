@@ -0,0 +1,39 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// ListSitePacks returns the packs installed on live sites.
+func ListSitePacks(ctx context.Context, db DBTX) ([]SitePack, error) {
+	items := []SitePack{}
+	err := db.SelectContext(ctx, &items, `SELECT p.site_key, p.name, p.version, p.manifest, p.installed_at FROM site_packs p
+		JOIN sites s ON s.key = p.site_key WHERE s.deleted_at IS NULL ORDER BY p.site_key`)
+	return items, err
+}
+
+// GetSitePack returns the pack installed on a live site, or nil.
+func GetSitePack(ctx context.Context, db DBTX, siteKey string) (*SitePack, error) {
+	var p SitePack
+	err := db.GetContext(ctx, &p, `SELECT p.site_key, p.name, p.version, p.manifest, p.installed_at FROM site_packs p
+		JOIN sites s ON s.key = p.site_key WHERE p.site_key = ? AND s.deleted_at IS NULL`, siteKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) { return nil, nil }
+		return nil, err
+	}
+	return &p, nil
+}
+
+// PutSitePack records p as the pack installed on its (live) site.
+func PutSitePack(ctx context.Context, db DBTX, p *SitePack) error {
+	var n int
+	if err := db.GetContext(ctx, &n, `SELECT COUNT(1) FROM sites WHERE key = ? AND deleted_at IS NULL`, p.SiteKey); err != nil { return err }
+	if n == 0 { return ErrNotFound }
+	p.InstalledAt = nowUnix()
+	_, err := db.ExecContext(ctx, `INSERT INTO site_packs(site_key, name, version, manifest, installed_at) VALUES(?,?,?,?,?)
+		ON CONFLICT(site_key) DO UPDATE SET name = excluded.name, version = excluded.version, manifest = excluded.manifest, installed_at = excluded.installed_at`,
+		p.SiteKey, p.Name, p.Version, p.Manifest, p.InstalledAt)
+	return err
+}
@@ -2,20 +2,47 @@ package store
 
 import (
 	"context"
-	"github.com/jmoiron/sqlx"
+	"database/sql"
 )
 
-func GetSiteFieldSchemas(ctx context.Context, db *sqlx.DB, siteKey string) ([]SiteFieldSchema, error) {
+func GetSiteFieldSchemas(ctx context.Context, db DBTX, siteKey string) ([]SiteFieldSchema, error) {
 	var items []SiteFieldSchema
-	err := db.SelectContext(ctx, &items, `SELECT site_key, field, type, required, default_value, regex, choices, secret, "order", ui_hint
-		FROM site_field_schemas WHERE site_key = ? ORDER BY "order", field`, siteKey)
+	err := db.SelectContext(ctx, &items, `SELECT site_key, field, type, required, default_value, regex, choices, secret, "order", ui_hint, min, max, min_length, max_length, is_unique, items, fields, deleted_at, version
+		FROM site_field_schemas WHERE site_key = ? AND deleted_at IS NULL ORDER BY "order", field`, siteKey)
 	if err != nil { return nil, err }
 	return items, nil
 }
 
-func UpsertSiteFieldSchema(ctx context.Context, db *sqlx.DB, s *SiteFieldSchema) error {
-	_, err := db.ExecContext(ctx, `INSERT INTO site_field_schemas(site_key, field, type, required, default_value, regex, choices, secret, "order", ui_hint)
-		VALUES(?,?,?,?,?,?,?,?,?,?)
+// GetSiteFieldSchema returns one live field definition, or nil.
+func GetSiteFieldSchema(ctx context.Context, db DBTX, siteKey, field string) (*SiteFieldSchema, error) {
+	var s SiteFieldSchema
+	err := db.GetContext(ctx, &s, `SELECT site_key, field, type, required, default_value, regex, choices, secret, "order", ui_hint, min, max, min_length, max_length, is_unique, items, fields, deleted_at, version
+		FROM site_field_schemas WHERE site_key = ? AND field = ? AND deleted_at IS NULL`, siteKey, field)
+	if err != nil {
+		if err == sql.ErrNoRows { return nil, nil }
+		return nil, err
+	}
+	return &s, nil
+}
+
+// UpsertSiteFieldSchema creates or replaces a field definition. Writing a
+// field that sits in trash brings it back with the new definition. With a
+// non-zero ifVersion only an existing live field at that version is replaced.
+func UpsertSiteFieldSchema(ctx context.Context, db DBTX, s *SiteFieldSchema, ifVersion int64) error {
+	if ifVersion != 0 {
+		res, err := db.ExecContext(ctx, `UPDATE site_field_schemas SET type = ?, required = ?, default_value = ?, regex = ?, choices = ?, secret = ?, "order" = ?, ui_hint = ?,
+			min = ?, max = ?, min_length = ?, max_length = ?, is_unique = ?, items = ?, fields = ?, version = version + 1
+			WHERE site_key = ? AND field = ? AND deleted_at IS NULL AND version = ?`,
+			s.Type, s.Required, s.DefaultValue, s.Regex, s.Choices, s.Secret, s.Order, s.UIHint,
+			s.Min, s.Max, s.MinLength, s.MaxLength, s.Unique, s.Items, s.Fields, s.SiteKey, s.Field, ifVersion)
+		if err != nil { return err }
+		if n, _ := res.RowsAffected(); n == 0 {
+			return missOrMismatch(ctx, db, `SELECT COUNT(1) FROM site_field_schemas WHERE site_key = ? AND field = ? AND deleted_at IS NULL`, s.SiteKey, s.Field)
+		}
+		return nil
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO site_field_schemas(site_key, field, type, required, default_value, regex, choices, secret, "order", ui_hint, min, max, min_length, max_length, is_unique, items, fields)
+		VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)
 		ON CONFLICT(site_key, field) DO UPDATE SET
 			type=excluded.type,
 			required=excluded.required,
@@ -24,12 +51,48 @@ func UpsertSiteFieldSchema(ctx context.Context, db *sqlx.DB, s *SiteFieldSchema)
 			choices=excluded.choices,
 			secret=excluded.secret,
 			"order"=excluded."order",
-			ui_hint=excluded.ui_hint`,
-		s.SiteKey, s.Field, s.Type, s.Required, s.DefaultValue, s.Regex, s.Choices, s.Secret, s.Order, s.UIHint)
+			ui_hint=excluded.ui_hint,
+			min=excluded.min,
+			max=excluded.max,
+			min_length=excluded.min_length,
+			max_length=excluded.max_length,
+			is_unique=excluded.is_unique,
+			items=excluded.items,
+			fields=excluded.fields,
+			deleted_at=NULL,
+			version=site_field_schemas.version + 1`,
+		s.SiteKey, s.Field, s.Type, s.Required, s.DefaultValue, s.Regex, s.Choices, s.Secret, s.Order, s.UIHint,
+		s.Min, s.Max, s.MinLength, s.MaxLength, s.Unique, s.Items, s.Fields)
 	return err
 }
 
-func DeleteSiteFieldSchema(ctx context.Context, db *sqlx.DB, siteKey, field string) error {
-	_, err := db.ExecContext(ctx, `DELETE FROM site_field_schemas WHERE site_key = ? AND field = ?`, siteKey, field)
-	return err
+// DeleteSiteFieldSchema moves a field definition to trash; ifVersion as in
+// UpsertSiteFieldSchema.
+func DeleteSiteFieldSchema(ctx context.Context, db DBTX, siteKey, field string, ifVersion int64) error {
+	res, err := db.ExecContext(ctx, `UPDATE site_field_schemas SET deleted_at = ?, version = version + 1 WHERE site_key = ? AND field = ? AND deleted_at IS NULL AND (? = 0 OR version = ?)`, nowUnix(), siteKey, field, ifVersion, ifVersion)
+	if err != nil { return err }
+	if n, _ := res.RowsAffected(); n == 0 {
+		return missOrMismatch(ctx, db, `SELECT COUNT(1) FROM site_field_schemas WHERE site_key = ? AND field = ? AND deleted_at IS NULL`, siteKey, field)
+	}
+	return nil
+}
+
+// RestoreSiteFieldSchema takes a field definition out of trash; the site
+// itself must not be in trash.
+func RestoreSiteFieldSchema(ctx context.Context, db DBTX, siteKey, field string) error {
+	s, err := GetSite(ctx, db, siteKey)
+	if err != nil { return err }
+	if s == nil { return ErrConflict }
+	res, err := db.ExecContext(ctx, `UPDATE site_field_schemas SET deleted_at = NULL, version = version + 1 WHERE site_key = ? AND field = ? AND deleted_at IS NOT NULL`, siteKey, field)
+	if err != nil { return err }
+	if n, _ := res.RowsAffected(); n == 0 { return ErrNotFound }
+	return nil
+}
+
+// PurgeSiteFieldSchema permanently removes a field definition.
+func PurgeSiteFieldSchema(ctx context.Context, db DBTX, siteKey, field string) error {
+	res, err := db.ExecContext(ctx, `DELETE FROM site_field_schemas WHERE site_key = ? AND field = ?`, siteKey, field)
+	if err != nil { return err }
+	if n, _ := res.RowsAffected(); n == 0 { return ErrNotFound }
+	return nil
 }
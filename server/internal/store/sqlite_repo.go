@@ -0,0 +1,90 @@
+package store
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// NewSQLite returns repositories backed by the package functions over db;
+// secrets says how account revisions keep overwritten secrets.
+func NewSQLite(db *sqlx.DB, secrets RevisionSecrets) Repos { return sqliteRepos(db, secrets) }
+
+func sqliteRepos(db DBTX, secrets RevisionSecrets) Repos {
+	return Repos{
+		Sites:    sqliteSites{db},
+		Accounts: sqliteAccounts{db, secrets},
+		Schemas:  sqliteSchemas{db},
+		Active:   sqliteActive{db},
+		Packs:    sqlitePacks{db},
+		Managed:  sqliteManaged{db},
+		Trash:    sqliteTrash{db},
+		Tx:       sqliteTx{db, secrets},
+	}
+}
+
+type sqliteTx struct {
+	db      DBTX
+	secrets RevisionSecrets
+}
+
+func (r sqliteTx) InTx(ctx context.Context, fn func(tx Repos) error) error {
+	return withTx(ctx, r.db, func(tx DBTX) error { return fn(sqliteRepos(tx, r.secrets)) })
+}
+
+type sqliteSites struct{ db DBTX }
+
+func (r sqliteSites) List(ctx context.Context) ([]Site, error) { return ListSites(ctx, r.db) }
+func (r sqliteSites) Get(ctx context.Context, key string) (*Site, error) { return GetSite(ctx, r.db, key) }
+func (r sqliteSites) Create(ctx context.Context, s *Site) error { return CreateSite(ctx, r.db, s) }
+func (r sqliteSites) Update(ctx context.Context, s *Site, ifVersion int64) error { return UpdateSite(ctx, r.db, s, ifVersion) }
+func (r sqliteSites) Delete(ctx context.Context, key string, ifVersion int64) error { return DeleteSite(ctx, r.db, key, ifVersion) }
+func (r sqliteSites) Restore(ctx context.Context, key string) error { return RestoreSite(ctx, r.db, key) }
+func (r sqliteSites) Purge(ctx context.Context, key string) error { return PurgeSite(ctx, r.db, key) }
+
+type sqliteAccounts struct {
+	db      DBTX
+	secrets RevisionSecrets
+}
+
+func (r sqliteAccounts) List(ctx context.Context, siteKey string) ([]Account, error) { return ListAccounts(ctx, r.db, siteKey) }
+func (r sqliteAccounts) Get(ctx context.Context, siteKey, id string) (*Account, error) { return GetAccount(ctx, r.db, siteKey, id) }
+func (r sqliteAccounts) Create(ctx context.Context, a *Account) error { return CreateAccount(ctx, r.db, a) }
+func (r sqliteAccounts) Update(ctx context.Context, a *Account, ifVersion int64) error { return UpdateAccount(ctx, r.db, a, ifVersion, r.secrets) }
+func (r sqliteAccounts) Delete(ctx context.Context, siteKey, id string, ifVersion int64) error { return DeleteAccount(ctx, r.db, siteKey, id, ifVersion) }
+func (r sqliteAccounts) Restore(ctx context.Context, siteKey, id string) error { return RestoreAccount(ctx, r.db, siteKey, id) }
+func (r sqliteAccounts) Purge(ctx context.Context, siteKey, id string) error { return PurgeAccount(ctx, r.db, siteKey, id) }
+func (r sqliteAccounts) Revisions(ctx context.Context, siteKey, id string) ([]AccountRevision, error) { return ListAccountRevisions(ctx, r.db, siteKey, id, r.secrets) }
+func (r sqliteAccounts) Revision(ctx context.Context, siteKey, id string, rev int64) (*AccountRevision, error) { return GetAccountRevision(ctx, r.db, siteKey, id, rev, r.secrets) }
+
+type sqliteSchemas struct{ db DBTX }
+
+func (r sqliteSchemas) List(ctx context.Context, siteKey string) ([]SiteFieldSchema, error) { return GetSiteFieldSchemas(ctx, r.db, siteKey) }
+func (r sqliteSchemas) Get(ctx context.Context, siteKey, field string) (*SiteFieldSchema, error) { return GetSiteFieldSchema(ctx, r.db, siteKey, field) }
+func (r sqliteSchemas) Upsert(ctx context.Context, s *SiteFieldSchema, ifVersion int64) error { return UpsertSiteFieldSchema(ctx, r.db, s, ifVersion) }
+func (r sqliteSchemas) Delete(ctx context.Context, siteKey, field string, ifVersion int64) error { return DeleteSiteFieldSchema(ctx, r.db, siteKey, field, ifVersion) }
+func (r sqliteSchemas) Restore(ctx context.Context, siteKey, field string) error { return RestoreSiteFieldSchema(ctx, r.db, siteKey, field) }
+func (r sqliteSchemas) Purge(ctx context.Context, siteKey, field string) error { return PurgeSiteFieldSchema(ctx, r.db, siteKey, field) }
+
+type sqliteActive struct{ db DBTX }
+
+func (r sqliteActive) Get(ctx context.Context, siteKey string) (*ActiveAccount, error) { return GetActiveAccount(ctx, r.db, siteKey) }
+func (r sqliteActive) Set(ctx context.Context, siteKey string, accountID *string, ifVersion int64) error { return SetActiveAccountID(ctx, r.db, siteKey, accountID, ifVersion) }
+
+type sqlitePacks struct{ db DBTX }
+
+func (r sqlitePacks) List(ctx context.Context) ([]SitePack, error) { return ListSitePacks(ctx, r.db) }
+func (r sqlitePacks) Get(ctx context.Context, siteKey string) (*SitePack, error) { return GetSitePack(ctx, r.db, siteKey) }
+func (r sqlitePacks) Put(ctx context.Context, p *SitePack) error { return PutSitePack(ctx, r.db, p) }
+
+type sqliteManaged struct{ db DBTX }
+
+func (r sqliteManaged) List(ctx context.Context) ([]ManagedSite, error) { return ListManagedSites(ctx, r.db) }
+func (r sqliteManaged) Get(ctx context.Context, siteKey string) (*ManagedSite, error) { return GetManagedSite(ctx, r.db, siteKey) }
+func (r sqliteManaged) Put(ctx context.Context, m *ManagedSite) error { return PutManagedSite(ctx, r.db, m) }
+func (r sqliteManaged) Release(ctx context.Context, siteKey string) error { return ReleaseManagedSite(ctx, r.db, siteKey) }
+
+type sqliteTrash struct{ db DBTX }
+
+func (r sqliteTrash) List(ctx context.Context) (*Trash, error) { return ListTrash(ctx, r.db) }
+func (r sqliteTrash) PurgeBefore(ctx context.Context, before int64) (PurgeResult, error) { return PurgeDeleted(ctx, r.db, before) }
@@ -0,0 +1,21 @@
+package store_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"mss/internal/migrate"
+	"mss/internal/store"
+	"mss/internal/store/storetest"
+)
+
+func TestSQLiteConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, secrets store.RevisionSecrets) store.Repos {
+		db, err := store.Open(filepath.Join(t.TempDir(), "mss.db"))
+		if err != nil { t.Fatal(err) }
+		t.Cleanup(func() { db.Close() })
+		if _, err := migrate.Apply(context.Background(), db, migrate.Options{}); err != nil { t.Fatal(err) }
+		return store.NewSQLite(db, secrets)
+	})
+}
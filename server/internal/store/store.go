@@ -1,6 +1,8 @@
 package store
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"time"
 
@@ -19,3 +21,35 @@ func Open(path string) (*sqlx.DB, error) {
 	db.SetConnMaxIdleTime(5 * time.Minute)
 	return db, nil
 }
+
+// DBTX is the query surface shared by *sqlx.DB and *sqlx.Tx, so the package
+// functions work both standalone and inside a caller's transaction.
+type DBTX interface {
+	sqlx.ExtContext
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+}
+
+// withTx runs fn atomically: in a new transaction when db is a *sqlx.DB, or
+// under a savepoint when db is already a transaction.
+func withTx(ctx context.Context, db DBTX, fn func(tx DBTX) error) (err error) {
+	if tx, ok := db.(*sqlx.Tx); ok {
+		if _, err := tx.ExecContext(ctx, `SAVEPOINT mss_sp`); err != nil { return err }
+		if err := fn(tx); err != nil {
+			_, _ = tx.ExecContext(ctx, `ROLLBACK TO mss_sp`)
+			_, _ = tx.ExecContext(ctx, `RELEASE mss_sp`)
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `RELEASE mss_sp`)
+		return err
+	}
+	beginner, ok := db.(interface {
+		BeginTxx(ctx context.Context, opts *sql.TxOptions) (*sqlx.Tx, error)
+	})
+	if !ok { return fmt.Errorf("store: %T cannot begin a transaction", db) }
+	tx, err := beginner.BeginTxx(ctx, nil)
+	if err != nil { return err }
+	defer func() { _ = tx.Rollback() }()
+	if err := fn(tx); err != nil { return err }
+	return tx.Commit()
+}
@@ -0,0 +1,378 @@
+// Package storetest holds the conformance suite every store backend must pass.
+// Call Run from a backend's test with a constructor returning empty repos.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"mss/internal/secret"
+	"mss/internal/store"
+)
+
+// Run exercises repos built by newRepos; each subtest gets a fresh backend.
+// newRepos is called with the zero RevisionSecrets unless a subtest needs
+// another policy.
+func Run(t *testing.T, newRepos func(t *testing.T, secrets store.RevisionSecrets) store.Repos) {
+	plain := func(t *testing.T) store.Repos { return newRepos(t, store.RevisionSecrets{}) }
+	run(t, plain)
+	t.Run("RevisionSecrets", func(t *testing.T) { testRevisionSecrets(t, newRepos) })
+}
+
+func run(t *testing.T, newRepos func(t *testing.T) store.Repos) {
+	t.Run("Sites", func(t *testing.T) { testSites(t, newRepos(t)) })
+	t.Run("SoftDelete", func(t *testing.T) { testSoftDelete(t, newRepos(t)) })
+	t.Run("Accounts", func(t *testing.T) { testAccounts(t, newRepos(t)) })
+	t.Run("Revisions", func(t *testing.T) { testRevisions(t, newRepos(t)) })
+	t.Run("Schemas", func(t *testing.T) { testSchemas(t, newRepos(t)) })
+	t.Run("Active", func(t *testing.T) { testActive(t, newRepos(t)) })
+	t.Run("Purge", func(t *testing.T) { testPurge(t, newRepos(t)) })
+	t.Run("Packs", func(t *testing.T) { testPacks(t, newRepos(t)) })
+	t.Run("Managed", func(t *testing.T) { testManaged(t, newRepos(t)) })
+	t.Run("Transactions", func(t *testing.T) { testTransactions(t, newRepos(t)) })
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil { t.Fatal(err) }
+}
+
+func wantErr(t *testing.T, err, target error) {
+	t.Helper()
+	if !errors.Is(err, target) { t.Fatalf("got error %v, want %v", err, target) }
+}
+
+func seedSite(t *testing.T, r store.Repos, key string) {
+	t.Helper()
+	must(t, r.Sites.Create(context.Background(), &store.Site{Key: key, Name: key + " site"}))
+}
+
+func seedAccount(t *testing.T, r store.Repos, siteKey, id, username string) {
+	t.Helper()
+	must(t, r.Accounts.Create(context.Background(), &store.Account{ID: id, SiteKey: siteKey, Username: username, Password: "pw-" + id}))
+}
+
+func testSites(t *testing.T, r store.Repos) {
+	ctx := context.Background()
+	seedSite(t, r, "b")
+	seedSite(t, r, "a")
+	wantErr(t, r.Sites.Create(ctx, &store.Site{Key: "a", Name: "dup"}), store.ErrConflict)
+
+	sites, err := r.Sites.List(ctx)
+	must(t, err)
+	if len(sites) != 2 || sites[0].Key != "a" || sites[1].Key != "b" { t.Fatalf("list: %+v", sites) }
+
+	s, err := r.Sites.Get(ctx, "a")
+	must(t, err)
+	if s == nil || s.Version != 1 || s.Created == 0 || s.AdditionalProps != store.PropsAllow { t.Fatalf("get: %+v", s) }
+	if s, err := r.Sites.Get(ctx, "missing"); err != nil || s != nil { t.Fatalf("get missing: %+v %v", s, err) }
+
+	upd := &store.Site{Key: "a", Name: "renamed", LoginURL: "https://a.example/login"}
+	must(t, r.Sites.Update(ctx, upd, 1))
+	if upd.Version != 2 || upd.Name != "renamed" { t.Fatalf("update refresh: %+v", upd) }
+	wantErr(t, r.Sites.Update(ctx, &store.Site{Key: "a", Name: "x"}, 1), store.ErrVersionMismatch)
+	wantErr(t, r.Sites.Update(ctx, &store.Site{Key: "missing", Name: "x"}, 0), store.ErrNotFound)
+	must(t, r.Sites.Update(ctx, &store.Site{Key: "a", Name: "unconditional"}, 0))
+
+	// an empty mode keeps the current one
+	strict := &store.Site{Key: "a", Name: "strict", AdditionalProps: store.PropsReject}
+	must(t, r.Sites.Update(ctx, strict, 0))
+	keep := &store.Site{Key: "a", Name: "strict"}
+	must(t, r.Sites.Update(ctx, keep, 0))
+	if strict.AdditionalProps != store.PropsReject || keep.AdditionalProps != store.PropsReject { t.Fatalf("mode: %+v %+v", strict, keep) }
+
+	// so do empty account rules; "{}" clears them
+	rules := `{"username":{"type":"email"}}`
+	must(t, r.Sites.Update(ctx, &store.Site{Key: "a", Name: "strict", AccountRules: rules}, 0))
+	must(t, r.Sites.Update(ctx, &store.Site{Key: "a", Name: "strict"}, 0))
+	if s, _ := r.Sites.Get(ctx, "a"); s == nil || s.AccountRules != rules { t.Fatalf("account rules: %+v", s) }
+	must(t, r.Sites.Update(ctx, &store.Site{Key: "a", Name: "strict", AccountRules: "{}"}, 0))
+	if s, _ := r.Sites.Get(ctx, "a"); s == nil || s.AccountRules != "{}" { t.Fatalf("cleared account rules: %+v", s) }
+}
+
+func testSoftDelete(t *testing.T, r store.Repos) {
+	ctx := context.Background()
+	seedSite(t, r, "s")
+	seedAccount(t, r, "s", "acc1", "alice")
+	seedAccount(t, r, "s", "acc2", "bob")
+	must(t, r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "s", Field: "token", Type: "string"}, 0))
+
+	wantErr(t, r.Sites.Delete(ctx, "s", 9), store.ErrVersionMismatch)
+	must(t, r.Sites.Delete(ctx, "s", 0))
+	wantErr(t, r.Sites.Delete(ctx, "s", 0), store.ErrNotFound)
+	if s, _ := r.Sites.Get(ctx, "s"); s != nil { t.Fatal("trashed site still visible") }
+	if accs, _ := r.Accounts.List(ctx, "s"); len(accs) != 0 { t.Fatalf("trashed accounts visible: %+v", accs) }
+	if fs, _ := r.Schemas.List(ctx, "s"); len(fs) != 0 { t.Fatalf("trashed schema visible: %+v", fs) }
+	wantErr(t, r.Accounts.Create(ctx, &store.Account{ID: "acc3", SiteKey: "s", Username: "carol"}), store.ErrNotFound)
+	wantErr(t, r.Accounts.Restore(ctx, "s", "acc1"), store.ErrConflict)
+
+	trash, err := r.Trash.List(ctx)
+	must(t, err)
+	if len(trash.Sites) != 1 || len(trash.Accounts) != 2 || len(trash.Schemas) != 1 { t.Fatalf("trash: %+v", trash) }
+
+	must(t, r.Sites.Restore(ctx, "s"))
+	wantErr(t, r.Sites.Restore(ctx, "s"), store.ErrNotFound)
+	if accs, _ := r.Accounts.List(ctx, "s"); len(accs) != 2 { t.Fatalf("cascade restore: %+v", accs) }
+	if fs, _ := r.Schemas.List(ctx, "s"); len(fs) != 1 { t.Fatalf("schema restore: %+v", fs) }
+
+	must(t, r.Accounts.Delete(ctx, "s", "acc1", 0))
+	must(t, r.Accounts.Restore(ctx, "s", "acc1"))
+	wantErr(t, r.Accounts.Restore(ctx, "s", "acc1"), store.ErrNotFound)
+	if a, _ := r.Accounts.Get(ctx, "s", "acc1"); a == nil || a.Version != 5 { t.Fatalf("restored account: %+v", a) }
+}
+
+func testAccounts(t *testing.T, r store.Repos) {
+	ctx := context.Background()
+	seedSite(t, r, "s")
+	seedSite(t, r, "other")
+	seedAccount(t, r, "s", "acc2", "zed")
+	seedAccount(t, r, "s", "acc1", "amy")
+	wantErr(t, r.Accounts.Create(ctx, &store.Account{ID: "x", SiteKey: "missing", Username: "u"}), store.ErrNotFound)
+	if err := r.Accounts.Create(ctx, &store.Account{ID: "acc1", SiteKey: "s", Username: "dup"}); err == nil { t.Fatal("duplicate id accepted") }
+
+	accs, err := r.Accounts.List(ctx, "s")
+	must(t, err)
+	if len(accs) != 2 || accs[0].Username != "amy" { t.Fatalf("list order: %+v", accs) }
+	if a, _ := r.Accounts.Get(ctx, "other", "acc1"); a != nil { t.Fatal("account visible under wrong site") }
+
+	a := &store.Account{ID: "acc1", SiteKey: "s", Username: "amy2", Password: "new", Extra: `{"k":1}`}
+	must(t, r.Accounts.Update(ctx, a, 1))
+	if a.Version != 2 || a.Created == 0 { t.Fatalf("update refresh: %+v", a) }
+	wantErr(t, r.Accounts.Update(ctx, &store.Account{ID: "acc1", SiteKey: "s", Username: "x"}, 1), store.ErrVersionMismatch)
+	wantErr(t, r.Accounts.Delete(ctx, "s", "acc1", 1), store.ErrVersionMismatch)
+	wantErr(t, r.Accounts.Delete(ctx, "s", "nope", 0), store.ErrNotFound)
+	must(t, r.Accounts.Purge(ctx, "s", "acc2"))
+	wantErr(t, r.Accounts.Purge(ctx, "s", "acc2"), store.ErrNotFound)
+}
+
+func testRevisions(t *testing.T, r store.Repos) {
+	ctx := context.Background()
+	seedSite(t, r, "s")
+	must(t, r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "s", Field: "token", Type: "string", Secret: 1}, 0))
+	must(t, r.Accounts.Create(ctx, &store.Account{ID: "a", SiteKey: "s", Username: "v1", Password: "p1", Extra: `{"token":"t1","note":"n1"}`}))
+	must(t, r.Accounts.Update(ctx, &store.Account{ID: "a", SiteKey: "s", Username: "v2", Password: "p2", Extra: `{"token":"t2"}`}, 0))
+	must(t, r.Accounts.Update(ctx, &store.Account{ID: "a", SiteKey: "s", Username: "v3", Password: "p3"}, 0))
+
+	revs, err := r.Accounts.Revisions(ctx, "s", "a")
+	must(t, err)
+	if len(revs) != 2 || revs[0].Rev != 2 || revs[1].Rev != 1 || revs[1].Username != "v1" { t.Fatalf("revisions: %+v", revs) }
+	// default policy is redacted
+	if revs[1].Secrets != store.SecretsRedacted || revs[1].Password != "" || revs[1].Extra != `{"note":"n1","token":"***"}` {
+		t.Fatalf("redaction: %+v", revs[1])
+	}
+	rv, err := r.Accounts.Revision(ctx, "s", "a", 2)
+	must(t, err)
+	if rv.Username != "v2" { t.Fatalf("revision 2: %+v", rv) }
+	_, err = r.Accounts.Revision(ctx, "s", "a", 7)
+	wantErr(t, err, store.ErrNotFound)
+	if revs, _ := r.Accounts.Revisions(ctx, "other", "a"); len(revs) != 0 { t.Fatal("revisions visible under wrong site") }
+
+	// extra that is not a JSON object cannot be redacted field by field; it
+	// is kept rather than lost
+	must(t, r.Accounts.Create(ctx, &store.Account{ID: "b", SiteKey: "s", Username: "u", Extra: `not json`}))
+	must(t, r.Accounts.Update(ctx, &store.Account{ID: "b", SiteKey: "s", Username: "u", Extra: `{}`}, 0))
+	if rv, err := r.Accounts.Revision(ctx, "s", "b", 1); err != nil || rv.Extra != `not json` { t.Fatalf("unparsed extra: %+v %v", rv, err) }
+}
+
+func testRevisionSecrets(t *testing.T, newRepos func(t *testing.T, secrets store.RevisionSecrets) store.Repos) {
+	ctx := context.Background()
+	box, err := secret.NewBox([]byte(strings.Repeat("k", 32)))
+	must(t, err)
+	for _, secrets := range []store.RevisionSecrets{{Mode: store.SecretsPlain}, {Mode: store.SecretsEncrypted, Box: box}} {
+		r := newRepos(t, secrets)
+		seedSite(t, r, "s")
+		must(t, r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "s", Field: "token", Type: "string", Secret: 1}, 0))
+		must(t, r.Accounts.Create(ctx, &store.Account{ID: "a", SiteKey: "s", Username: "u", Password: "p1", Extra: `{"token":"t1"}`}))
+		must(t, r.Accounts.Update(ctx, &store.Account{ID: "a", SiteKey: "s", Username: "u", Password: "p2"}, 0))
+		rv, err := r.Accounts.Revision(ctx, "s", "a", 1)
+		must(t, err)
+		if rv.Secrets != secrets.Mode || rv.Password != "p1" || rv.Extra != `{"token":"t1"}` { t.Fatalf("%s: %+v", secrets.Mode, rv) }
+	}
+	if err := (store.RevisionSecrets{Mode: store.SecretsEncrypted}).Check(); err == nil { t.Fatal("encrypted mode without a key accepted") }
+	if err := (store.RevisionSecrets{Mode: "bogus"}).Check(); err == nil { t.Fatal("unknown mode accepted") }
+}
+
+func testSchemas(t *testing.T, r store.Repos) {
+	ctx := context.Background()
+	seedSite(t, r, "s")
+	must(t, r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "s", Field: "b", Type: "string", Order: 1}, 0))
+	must(t, r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "s", Field: "a", Type: "number", Order: 2}, 0))
+	must(t, r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "s", Field: "c", Type: "string", Order: 1}, 0))
+	fs, err := r.Schemas.List(ctx, "s")
+	must(t, err)
+	if len(fs) != 3 || fs[0].Field != "b" || fs[1].Field != "c" || fs[2].Field != "a" { t.Fatalf("order: %+v", fs) }
+
+	must(t, r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "s", Field: "a", Type: "boolean", Order: 2}, 1))
+	wantErr(t, r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "s", Field: "a", Type: "string"}, 1), store.ErrVersionMismatch)
+	wantErr(t, r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "s", Field: "new", Type: "string"}, 1), store.ErrNotFound)
+	f, err := r.Schemas.Get(ctx, "s", "a")
+	must(t, err)
+	if f == nil || f.Type != "boolean" || f.Version != 2 { t.Fatalf("get: %+v", f) }
+
+	must(t, r.Schemas.Delete(ctx, "s", "a", 2))
+	if f, _ := r.Schemas.Get(ctx, "s", "a"); f != nil { t.Fatal("trashed field visible") }
+	// writing a trashed field revives it
+	must(t, r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "s", Field: "a", Type: "json"}, 0))
+	if f, _ := r.Schemas.Get(ctx, "s", "a"); f == nil || f.Type != "json" || f.Version != 4 { t.Fatalf("revive: %+v", f) }
+	must(t, r.Schemas.Delete(ctx, "s", "b", 0))
+	must(t, r.Schemas.Restore(ctx, "s", "b"))
+	must(t, r.Schemas.Purge(ctx, "s", "b"))
+	wantErr(t, r.Schemas.Purge(ctx, "s", "b"), store.ErrNotFound)
+
+	// constraints round-trip, including absent bounds
+	lo, hi, n := 1.5, 9.0, 3
+	must(t, r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "s", Field: "n", Type: "number", Min: &lo, Max: &hi, Unique: 1}, 0))
+	must(t, r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "s", Field: "tags", Type: "array", MaxLength: &n, Items: `{"type":"string"}`}, 0))
+	lo = 0
+	f, err = r.Schemas.Get(ctx, "s", "n")
+	must(t, err)
+	if f == nil || f.Min == nil || *f.Min != 1.5 || f.Max == nil || *f.Max != 9 || f.MinLength != nil || f.Unique != 1 { t.Fatalf("bounds: %+v", f) }
+	f, err = r.Schemas.Get(ctx, "s", "tags")
+	must(t, err)
+	if f == nil || f.MaxLength == nil || *f.MaxLength != 3 || f.Min != nil || f.Items != `{"type":"string"}` { t.Fatalf("lengths: %+v", f) }
+}
+
+func testActive(t *testing.T, r store.Repos) {
+	ctx := context.Background()
+	seedSite(t, r, "s")
+	seedAccount(t, r, "s", "a1", "u1")
+	m, err := r.Active.Get(ctx, "s")
+	must(t, err)
+	if m.AccountID != nil || m.Version != 0 { t.Fatalf("empty mapping: %+v", m) }
+
+	id := "a1"
+	wantErr(t, r.Active.Set(ctx, "s", &id, 1), store.ErrVersionMismatch)
+	must(t, r.Active.Set(ctx, "s", &id, store.VersionAbsent))
+	wantErr(t, r.Active.Set(ctx, "s", &id, store.VersionAbsent), store.ErrVersionMismatch)
+	must(t, r.Active.Set(ctx, "s", &id, 1))
+	m, _ = r.Active.Get(ctx, "s")
+	if m.AccountID == nil || *m.AccountID != "a1" || m.Version != 2 { t.Fatalf("mapping: %+v", m) }
+
+	must(t, r.Accounts.Delete(ctx, "s", "a1", 0))
+	if m, _ := r.Active.Get(ctx, "s"); m.AccountID != nil { t.Fatal("active points at trashed account") }
+	must(t, r.Accounts.Restore(ctx, "s", "a1"))
+	if m, _ := r.Active.Get(ctx, "s"); m.AccountID == nil { t.Fatal("active lost after restore") }
+	must(t, r.Accounts.Purge(ctx, "s", "a1"))
+	if m, _ := r.Active.Get(ctx, "s"); m.AccountID != nil || m.Version != 2 { t.Fatalf("after purge: %+v", m) }
+	must(t, r.Active.Set(ctx, "s", nil, 0))
+	if m, _ := r.Active.Get(ctx, "s"); m.Version != 3 { t.Fatalf("unconditional set: %+v", m) }
+}
+
+func testPurge(t *testing.T, r store.Repos) {
+	ctx := context.Background()
+	seedSite(t, r, "gone")
+	seedAccount(t, r, "gone", "g1", "u")
+	seedSite(t, r, "kept")
+	seedAccount(t, r, "kept", "k1", "u1")
+	seedAccount(t, r, "kept", "k2", "u2")
+	must(t, r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "kept", Field: "f", Type: "string"}, 0))
+	must(t, r.Sites.Delete(ctx, "gone", 0))
+	must(t, r.Accounts.Delete(ctx, "kept", "k1", 0))
+	must(t, r.Schemas.Delete(ctx, "kept", "f", 0))
+
+	res, err := r.Trash.PurgeBefore(ctx, 0)
+	must(t, err)
+	if res != (store.PurgeResult{}) { t.Fatalf("purged too early: %+v", res) }
+	res, err = r.Trash.PurgeBefore(ctx, 1<<62)
+	must(t, err)
+	if res.Sites != 1 || res.Accounts != 1 || res.Schemas != 1 { t.Fatalf("purge counts: %+v", res) }
+	trash, _ := r.Trash.List(ctx)
+	if len(trash.Sites)+len(trash.Accounts)+len(trash.Schemas) != 0 { t.Fatalf("trash not empty: %+v", trash) }
+	wantErr(t, r.Sites.Restore(ctx, "gone"), store.ErrNotFound)
+	if accs, _ := r.Accounts.List(ctx, "kept"); len(accs) != 1 { t.Fatalf("live account purged: %+v", accs) }
+	must(t, r.Sites.Purge(ctx, "kept"))
+	wantErr(t, r.Sites.Purge(ctx, "kept"), store.ErrNotFound)
+}
+
+func testPacks(t *testing.T, r store.Repos) {
+	ctx := context.Background()
+	wantErr(t, r.Packs.Put(ctx, &store.SitePack{SiteKey: "missing", Name: "p", Version: "1", Manifest: "{}"}), store.ErrNotFound)
+	seedSite(t, r, "a")
+	seedSite(t, r, "b")
+	if p, err := r.Packs.Get(ctx, "a"); err != nil || p != nil { t.Fatalf("get before put: %+v %v", p, err) }
+	must(t, r.Packs.Put(ctx, &store.SitePack{SiteKey: "a", Name: "p", Version: "1.0.0", Manifest: `{"v":1}`}))
+	must(t, r.Packs.Put(ctx, &store.SitePack{SiteKey: "a", Name: "p", Version: "1.1.0", Manifest: `{"v":2}`}))
+	must(t, r.Packs.Put(ctx, &store.SitePack{SiteKey: "b", Name: "q", Version: "2", Manifest: "{}"}))
+	p, err := r.Packs.Get(ctx, "a")
+	must(t, err)
+	if p == nil || p.Version != "1.1.0" || p.Manifest != `{"v":2}` || p.InstalledAt == 0 { t.Fatalf("get: %+v", p) }
+	list, err := r.Packs.List(ctx)
+	must(t, err)
+	if len(list) != 2 || list[0].SiteKey != "a" || list[1].SiteKey != "b" { t.Fatalf("list: %+v", list) }
+
+	// a trashed site hides its pack; restoring brings it back, purging drops it
+	must(t, r.Sites.Delete(ctx, "a", 0))
+	if p, err := r.Packs.Get(ctx, "a"); err != nil || p != nil { t.Fatalf("get trashed: %+v %v", p, err) }
+	must(t, r.Sites.Restore(ctx, "a"))
+	if p, err := r.Packs.Get(ctx, "a"); err != nil || p == nil { t.Fatalf("get restored: %+v %v", p, err) }
+	must(t, r.Sites.Purge(ctx, "a"))
+	must(t, r.Sites.Create(ctx, &store.Site{Key: "a", Name: "again"}))
+	if p, err := r.Packs.Get(ctx, "a"); err != nil || p != nil { t.Fatalf("get after purge: %+v %v", p, err) }
+}
+
+func testManaged(t *testing.T, r store.Repos) {
+	ctx := context.Background()
+	wantErr(t, r.Managed.Put(ctx, &store.ManagedSite{SiteKey: "missing", Source: "s", Spec: "{}"}), store.ErrNotFound)
+	seedSite(t, r, "a")
+	seedSite(t, r, "b")
+	must(t, r.Managed.Put(ctx, &store.ManagedSite{SiteKey: "b", Source: "one.yaml", Spec: "{}"}))
+	must(t, r.Managed.Put(ctx, &store.ManagedSite{SiteKey: "a", Source: "one.yaml", Spec: "{}"}))
+	must(t, r.Managed.Put(ctx, &store.ManagedSite{SiteKey: "a", Source: "two.yaml", Spec: `{"x":1}`}))
+	m, err := r.Managed.Get(ctx, "a")
+	must(t, err)
+	if m == nil || m.Source != "two.yaml" || m.Spec != `{"x":1}` || m.AppliedAt == 0 { t.Fatalf("get: %+v", m) }
+	list, err := r.Managed.List(ctx)
+	must(t, err)
+	if len(list) != 2 || list[0].SiteKey != "a" || list[1].SiteKey != "b" { t.Fatalf("list: %+v", list) }
+
+	// ownership survives trash and ends with release or purge
+	must(t, r.Sites.Delete(ctx, "a", 0))
+	if m, err := r.Managed.Get(ctx, "a"); err != nil || m == nil { t.Fatalf("get trashed: %+v %v", m, err) }
+	must(t, r.Managed.Release(ctx, "a"))
+	if m, err := r.Managed.Get(ctx, "a"); err != nil || m != nil { t.Fatalf("get released: %+v %v", m, err) }
+	must(t, r.Sites.Purge(ctx, "b"))
+	if m, err := r.Managed.Get(ctx, "b"); err != nil || m != nil { t.Fatalf("get purged: %+v %v", m, err) }
+}
+
+func testTransactions(t *testing.T, r store.Repos) {
+	ctx := context.Background()
+	seedSite(t, r, "s")
+	boom := errors.New("boom")
+
+	// rollback discards every write, including cascades and revisions
+	err := r.Tx.InTx(ctx, func(tx store.Repos) error {
+		seedAccount(t, tx, "s", "a1", "u1")
+		must(t, tx.Accounts.Update(ctx, &store.Account{ID: "a1", SiteKey: "s", Username: "u1b"}, 0))
+		if a, _ := tx.Accounts.Get(ctx, "s", "a1"); a == nil || a.Username != "u1b" { t.Fatal("write not visible inside tx") }
+		must(t, tx.Sites.Delete(ctx, "s", 0))
+		return boom
+	})
+	wantErr(t, err, boom)
+	if a, _ := r.Accounts.Get(ctx, "s", "a1"); a != nil { t.Fatal("rolled back account persisted") }
+	if s, _ := r.Sites.Get(ctx, "s"); s == nil { t.Fatal("rolled back delete persisted") }
+
+	// nested failure only undoes the inner block
+	err = r.Tx.InTx(ctx, func(tx store.Repos) error {
+		seedAccount(t, tx, "s", "outer", "o")
+		inner := tx.Tx.InTx(ctx, func(tx2 store.Repos) error {
+			seedAccount(t, tx2, "s", "inner", "i")
+			return boom
+		})
+		wantErr(t, inner, boom)
+		return nil
+	})
+	must(t, err)
+	if a, _ := r.Accounts.Get(ctx, "s", "outer"); a == nil { t.Fatal("outer write lost") }
+	if a, _ := r.Accounts.Get(ctx, "s", "inner"); a != nil { t.Fatal("inner rollback ignored") }
+
+	// a failing statement inside the tx does not poison it
+	err = r.Tx.InTx(ctx, func(tx store.Repos) error {
+		wantErr(t, tx.Accounts.Create(ctx, &store.Account{ID: "outer", SiteKey: "s", Username: "dup"}), store.ErrConflict)
+		seedAccount(t, tx, "s", "after", "a")
+		return nil
+	})
+	must(t, err)
+	if a, _ := r.Accounts.Get(ctx, "s", "after"); a == nil { t.Fatal("write after failed statement lost") }
+}
@@ -0,0 +1,47 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+func nowUnix() int64 { return time.Now().Unix() }
+
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) { return ErrNotFound }
+	return err
+}
+
+// ListTrash returns every soft-deleted site, account and schema field,
+// most recently deleted first.
+func ListTrash(ctx context.Context, db DBTX) (*Trash, error) {
+	t := &Trash{Sites: []Site{}, Accounts: []Account{}, Schemas: []SiteFieldSchema{}}
+	if err := db.SelectContext(ctx, &t.Sites, `SELECT key, name, login_url, additional_props, account_rules, created_at, updated_at, deleted_at, version
+		FROM sites WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, key`); err != nil { return nil, err }
+	if err := db.SelectContext(ctx, &t.Accounts, `SELECT id, site_key, username, password, extra, created_at, updated_at, deleted_at, version
+		FROM accounts WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, site_key, username`); err != nil { return nil, err }
+	if err := db.SelectContext(ctx, &t.Schemas, `SELECT site_key, field, type, required, default_value, regex, choices, secret, "order", ui_hint, min, max, min_length, max_length, is_unique, items, fields, deleted_at, version
+		FROM site_field_schemas WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, site_key, field`); err != nil { return nil, err }
+	return t, nil
+}
+
+// PurgeDeleted permanently removes rows that were trashed before the given
+// unix timestamp. Sites go first so their cascaded children are counted there.
+func PurgeDeleted(ctx context.Context, db DBTX, before int64) (PurgeResult, error) {
+	var res PurgeResult
+	err := withTx(ctx, db, func(tx DBTX) error {
+		r, err := tx.ExecContext(ctx, `DELETE FROM sites WHERE deleted_at IS NOT NULL AND deleted_at < ?`, before)
+		if err != nil { return err }
+		res.Sites, _ = r.RowsAffected()
+		r, err = tx.ExecContext(ctx, `DELETE FROM accounts WHERE deleted_at IS NOT NULL AND deleted_at < ?`, before)
+		if err != nil { return err }
+		res.Accounts, _ = r.RowsAffected()
+		r, err = tx.ExecContext(ctx, `DELETE FROM site_field_schemas WHERE deleted_at IS NOT NULL AND deleted_at < ?`, before)
+		if err != nil { return err }
+		res.Schemas, _ = r.RowsAffected()
+		return nil
+	})
+	return res, err
+}
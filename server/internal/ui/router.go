@@ -1,38 +1,46 @@
 package ui
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/jmoiron/sqlx"
 
 	"mss/internal/store"
+	"mss/internal/validation"
 )
 
 type UI struct {
-	db *sqlx.DB
+	repos store.Repos
 	t *template.Template
 }
 
-func NewRouter(db *sqlx.DB) http.Handler {
+func NewRouter(repos store.Repos) http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.Recoverer)
-	ui := &UI{db: db}
+	ui := &UI{repos: repos}
 	ui.t = template.Must(template.ParseFiles(
 		"internal/ui/templates/layout.html",
 		"internal/ui/templates/sites.html",
+		"internal/ui/templates/accounts.html",
 	))
 	r.Get("/", ui.sitesPage)
 	r.Post("/sites", ui.createSite)
+	r.Get("/sites/{key}", ui.accountsPage)
+	r.Post("/sites/{key}/accounts", ui.createAccount)
 	return r
 }
 
 func (u *UI) sitesPage(w http.ResponseWriter, r *http.Request) {
-	sites, err := store.ListSites(r.Context(), u.db)
+	sites, err := u.repos.Sites.List(r.Context())
 	if err != nil { http.Error(w, err.Error(), 500); return }
 	data := map[string]interface{}{
+		"Page":  "sites",
 		"Sites": sites,
 	}
 	_ = u.t.ExecuteTemplate(w, "layout", data)
@@ -40,8 +48,116 @@ func (u *UI) sitesPage(w http.ResponseWriter, r *http.Request) {
 
 func (u *UI) createSite(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil { http.Error(w, err.Error(), 400); return }
-	s := &store.Site{ Key: r.FormValue("key"), Name: r.FormValue("name"), LoginURL: r.FormValue("loginUrl") }
+	s := &store.Site{ Key: r.FormValue("key"), Name: r.FormValue("name"), LoginURL: r.FormValue("loginUrl"), AdditionalProps: r.FormValue("additionalProps") }
 	if s.Key == "" || s.Name == "" { http.Error(w, "key and name required", 400); return }
-	if err := store.CreateSite(r.Context(), u.db, s); err != nil { http.Error(w, err.Error(), 500); return }
+	switch s.AdditionalProps {
+	case "", store.PropsAllow, store.PropsWarn, store.PropsReject:
+	default:
+		http.Error(w, "additionalProps must be allow, warn or reject", 400); return
+	}
+	if err := u.repos.Sites.Create(r.Context(), s); err != nil {
+		if !errors.Is(err, store.ErrConflict) { http.Error(w, err.Error(), 500); return }
+		msg := "site " + s.Key + " already exists"
+		if cur, gerr := u.repos.Sites.Get(r.Context(), s.Key); gerr == nil && cur == nil { msg = "site " + s.Key + " is in trash; restore or purge it first" }
+		http.Error(w, msg, http.StatusConflict); return
+	}
 	http.Redirect(w, r, "/ui/", http.StatusSeeOther)
 }
+
+type accountRow struct {
+	ID       string
+	Username string
+	Props    string
+}
+
+// accountsPage lists a site's accounts with a form for adding one.
+func (u *UI) accountsPage(w http.ResponseWriter, r *http.Request) {
+	u.renderAccounts(w, r, http.StatusOK, map[string]string{}, map[string]string{})
+}
+
+// renderAccounts renders the accounts page of the site in the URL. form
+// refills the inputs and invalid holds a message per form field to
+// highlight, keyed as in validation.Violation.
+func (u *UI) renderAccounts(w http.ResponseWriter, r *http.Request, status int, form map[string]string, invalid map[string]string) {
+	key := chi.URLParam(r, "key")
+	site, err := u.repos.Sites.Get(r.Context(), key)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	if site == nil { http.NotFound(w, r); return }
+	v, err := validation.Load(r.Context(), u.repos, key)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	accs, err := u.repos.Accounts.List(r.Context(), key)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	rows := make([]accountRow, 0, len(accs))
+	for _, acc := range accs {
+		row := accountRow{ID: acc.ID, Username: acc.Username}
+		var props map[string]interface{}
+		if acc.Extra != "" && json.Unmarshal([]byte(acc.Extra), &props) == nil {
+			b, _ := json.Marshal(v.Mask(props))
+			row.Props = string(b)
+		}
+		rows = append(rows, row)
+	}
+	data := map[string]interface{}{
+		"Page":     "accounts",
+		"Site":     site,
+		"Schemas":  v.Schemas,
+		"Accounts": rows,
+		"Form":     form,
+		"Invalid":  invalid,
+	}
+	w.WriteHeader(status)
+	_ = u.t.ExecuteTemplate(w, "layout", data)
+}
+
+var errFormInvalid = errors.New("form has invalid fields")
+
+// createAccount adds an account from the form. Every problem found is shown
+// next to its input rather than only the first.
+func (u *UI) createAccount(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	if err := r.ParseForm(); err != nil { http.Error(w, err.Error(), 400); return }
+	v, err := validation.Load(r.Context(), u.repos, key)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	form := map[string]string{"username": r.FormValue("username")}
+	invalid := map[string]string{}
+	props := map[string]interface{}{}
+	for _, s := range v.Schemas {
+		raw := r.FormValue("props." + s.Field)
+		form["props."+s.Field] = raw
+		val, err := validation.CoerceString(raw, s.Type)
+		if err != nil { invalid["props."+s.Field] = fmt.Sprintf("field '%s': %v", s.Field, err); continue }
+		if val != nil { props[s.Field] = val }
+	}
+	props = v.Normalize(props)
+	acc := store.Account{ID: store.GenerateID("acc"), SiteKey: key, Username: r.FormValue("username"), Password: r.FormValue("password")}
+	if len(props) > 0 {
+		b, _ := json.Marshal(props)
+		acc.Extra = string(b)
+	}
+	err = u.repos.Tx.InTx(r.Context(), func(tx store.Repos) error {
+		_, err := v.ValidateAccount(r.Context(), tx, acc, props)
+		var verrs validation.Errors
+		if errors.As(err, &verrs) {
+			for _, e := range verrs {
+				f := formField(e.Field)
+				if _, seen := invalid[f]; !seen { invalid[f] = e.Message }
+			}
+		} else if err != nil {
+			return err
+		}
+		if len(invalid) > 0 { return errFormInvalid }
+		return tx.Accounts.Create(r.Context(), &acc)
+	})
+	if errors.Is(err, errFormInvalid) { u.renderAccounts(w, r, http.StatusBadRequest, form, invalid); return }
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	http.Redirect(w, r, "/ui/sites/"+key, http.StatusSeeOther)
+}
+
+// formField maps a violation's field to the input it belongs to:
+// props.tags[0] and props.addr.city highlight props.tags and props.addr.
+func formField(field string) string {
+	name := strings.TrimPrefix(field, "props.")
+	if name == field { return field }
+	if i := strings.IndexAny(name, ".["); i > 0 { name = name[:i] }
+	return "props." + name
+}
@@ -0,0 +1,101 @@
+package validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// datetimeLayouts are the spreadsheet-friendly forms accepted for datetime
+// fields; values without a zone are taken as UTC, and all are stored in UTC.
+var datetimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006/01/02 15:04:05",
+	"2006/01/02",
+}
+
+// CoerceString converts a text cell (CSV, form input) into the JSON value a
+// field of type typ stores. An empty cell yields nil, meaning "not set".
+func CoerceString(raw, typ string) (interface{}, error) {
+	if typ != "string" { raw = strings.TrimSpace(raw) }
+	if raw == "" { return nil, nil }
+	switch typ {
+	case "string":
+		return raw, nil
+	case "number":
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil { return nil, fmt.Errorf("%q is not a number", raw) }
+		return f, nil
+	case "integer":
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil || f != math.Trunc(f) { return nil, fmt.Errorf("%q is not an integer", raw) }
+		return f, nil
+	case "boolean":
+		switch strings.ToLower(raw) {
+		case "true", "1", "yes", "y":
+			return true, nil
+		case "false", "0", "no", "n":
+			return false, nil
+		}
+		return nil, fmt.Errorf("%q is not a boolean", raw)
+	case "datetime":
+		for _, l := range datetimeLayouts {
+			if t, err := time.Parse(l, raw); err == nil { return t.UTC().Format(time.RFC3339), nil }
+		}
+		return nil, fmt.Errorf("%q is not a datetime (want RFC3339 or YYYY-MM-DD[ HH:MM[:SS]])", raw)
+	case "date":
+		for _, l := range datetimeLayouts {
+			if t, err := time.Parse(l, raw); err == nil { return t.Format("2006-01-02"), nil }
+		}
+		return nil, fmt.Errorf("%q is not a date (want YYYY-MM-DD)", raw)
+	case "duration":
+		if !isDuration(raw) { return nil, fmt.Errorf("%q is not a duration (want e.g. 90s, 1h30m)", raw) }
+		return raw, nil
+	case "json", "array", "object":
+		var v interface{}
+		if err := json.Unmarshal([]byte(raw), &v); err != nil { return nil, fmt.Errorf("invalid json: %v", err) }
+		return v, nil
+	}
+	return raw, nil
+}
+
+// FormatValue is the inverse of CoerceString, rendering a stored prop as text.
+func FormatValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// Cast converts a stored prop to typ when a field's type changes: values
+// already of the type are kept, scalars go through their text form and
+// CoerceString. ok is false when v cannot be converted.
+func Cast(v interface{}, typ string) (interface{}, bool) {
+	if v == nil || typeMatches(v, typ) { return v, true }
+	switch v.(type) {
+	case string, float64, bool:
+		if textType(typ) || typ == "enum" {
+			if s := FormatValue(v); typeMatches(s, typ) { return s, true }
+			return v, false
+		}
+		c, err := CoerceString(FormatValue(v), typ)
+		if err != nil || c == nil || !typeMatches(c, typ) { return v, false }
+		return c, true
+	}
+	return v, false
+}
@@ -0,0 +1,71 @@
+package validation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"mss/internal/store"
+)
+
+// AccountViolation is a stored account that fails its site's schema, as
+// found when checking what a schema change does to existing accounts.
+type AccountViolation struct {
+	ID       string      `json:"id"`
+	Username string      `json:"username"`
+	Error    string      `json:"error"`
+	Details  []Violation `json:"details,omitempty"`
+}
+
+func (v AccountViolation) String() string {
+	return fmt.Sprintf("account %s (%s): %s", v.ID, v.Username, v.Error)
+}
+
+// CheckAccounts validates the props of every account of the site against
+// its current schema and returns the number checked and the failures.
+func CheckAccounts(ctx context.Context, repos store.Repos, siteKey string) (int, []AccountViolation, error) {
+	v, err := Load(ctx, repos, siteKey)
+	if err != nil { return 0, nil, err }
+	accs, err := repos.Accounts.List(ctx, siteKey)
+	if err != nil { return 0, nil, err }
+	out := []AccountViolation{}
+	for _, acc := range accs {
+		props := map[string]interface{}{}
+		if acc.Extra != "" { _ = json.Unmarshal([]byte(acc.Extra), &props) }
+		_, err := v.Validate(ctx, repos, acc.ID, props)
+		var verrs Errors
+		if errors.As(err, &verrs) {
+			out = append(out, AccountViolation{ID: acc.ID, Username: acc.Username, Error: err.Error(), Details: verrs})
+			continue
+		}
+		if err != nil { return 0, nil, err }
+	}
+	return len(accs), out, nil
+}
+
+// Introduced returns the violations in after that are not in before,
+// matched by account and violation field and code. An account keeps only
+// its new details.
+func Introduced(before, after []AccountViolation) []AccountViolation {
+	seen := map[string]bool{}
+	for _, b := range before {
+		if len(b.Details) == 0 { seen[b.ID+"\x00"+b.Error] = true }
+		for _, d := range b.Details { seen[b.ID+"\x00"+d.Field+"\x00"+d.Code] = true }
+	}
+	out := []AccountViolation{}
+	for _, v := range after {
+		if len(v.Details) == 0 {
+			if !seen[v.ID+"\x00"+v.Error] { out = append(out, v) }
+			continue
+		}
+		var fresh Errors
+		for _, d := range v.Details {
+			if !seen[v.ID+"\x00"+d.Field+"\x00"+d.Code] { fresh = append(fresh, d) }
+		}
+		if len(fresh) == 0 { continue }
+		v.Error, v.Details = fresh.Error(), fresh
+		out = append(out, v)
+	}
+	return out
+}
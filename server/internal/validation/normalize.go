@@ -0,0 +1,44 @@
+package validation
+
+import (
+	"strings"
+
+	"mss/internal/store"
+)
+
+// Normalize returns props with schema defaults filled in for missing or
+// empty fields and declared values in canonical form: text trimmed,
+// datetimes as RFC3339 UTC, dates as YYYY-MM-DD, and numeric or boolean
+// strings converted for number, integer and boolean fields, nested array
+// items and object subfields included. Values that do not convert are left
+// for Validate to reject, undeclared props pass through, and props
+// itself is not modified.
+func Normalize(schemas []store.SiteFieldSchema, props map[string]interface{}) map[string]interface{} {
+	return Compile("", schemas).Normalize(props)
+}
+
+func (r Rule) normalize(v interface{}) interface{} {
+	switch x := v.(type) {
+	case string:
+		switch r.Type {
+		case "string", "url", "email", "enum":
+			return strings.TrimSpace(x)
+		case "number", "integer", "boolean", "datetime", "date", "duration":
+			if c, err := CoerceString(x, r.Type); err == nil && c != nil { return c }
+		}
+	case []interface{}:
+		if r.Items == nil { return v }
+		items := make([]interface{}, len(x))
+		for i, it := range x { items[i] = r.Items.normalize(it) }
+		return items
+	case map[string]interface{}:
+		if len(r.Fields) == 0 { return v }
+		obj := make(map[string]interface{}, len(x))
+		for k, fv := range x { obj[k] = fv }
+		for _, f := range r.Fields {
+			if fv, ok := obj[f.Field]; ok { obj[f.Field] = f.normalize(fv) }
+		}
+		return obj
+	}
+	return v
+}
@@ -0,0 +1,255 @@
+package validation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"time"
+	"unicode/utf8"
+
+	"mss/internal/store"
+)
+
+// ErrInvalidField marks field definitions whose type and constraints do not
+// fit together.
+var ErrInvalidField = errors.New("invalid field definition")
+
+// Rule is the type and constraints of one field. Array elements (Items) and
+// object subfields (Fields) are rules themselves; a schema row keeps them as
+// JSON in its items and fields columns.
+type Rule struct {
+	Field     string        `json:"field,omitempty" yaml:"field,omitempty"`
+	Type      string        `json:"type" yaml:"type"`
+	Required  bool          `json:"required,omitempty" yaml:"required,omitempty"`
+	Regex     string        `json:"regex,omitempty" yaml:"regex,omitempty"`
+	Choices   []interface{} `json:"choices,omitempty" yaml:"choices,omitempty"`
+	Min       *float64      `json:"min,omitempty" yaml:"min,omitempty"`
+	Max       *float64      `json:"max,omitempty" yaml:"max,omitempty"`
+	MinLength *int          `json:"minLength,omitempty" yaml:"minLength,omitempty"`
+	MaxLength *int          `json:"maxLength,omitempty" yaml:"maxLength,omitempty"`
+	Items     *Rule         `json:"items,omitempty" yaml:"items,omitempty"`
+	Fields    []Rule        `json:"fields,omitempty" yaml:"fields,omitempty"`
+	re        *regexp.Regexp // Regex compiled by compile
+}
+
+// RuleFromSchema decodes the rule stored in a schema row.
+func RuleFromSchema(s store.SiteFieldSchema) (Rule, error) {
+	r := Rule{Field: s.Field, Type: s.Type, Required: s.Required != 0, Regex: s.Regex,
+		Min: s.Min, Max: s.Max, MinLength: s.MinLength, MaxLength: s.MaxLength}
+	if s.Choices != "" {
+		if err := json.Unmarshal([]byte(s.Choices), &r.Choices); err != nil { return r, fmt.Errorf("choices: %v", err) }
+	}
+	if s.Items != "" {
+		r.Items = &Rule{}
+		if err := json.Unmarshal([]byte(s.Items), r.Items); err != nil { return r, fmt.Errorf("items: %v", err) }
+	}
+	if s.Fields != "" {
+		if err := json.Unmarshal([]byte(s.Fields), &r.Fields); err != nil { return r, fmt.Errorf("fields: %v", err) }
+	}
+	return r, nil
+}
+
+// compile precompiles the regexes of r and its nested rules.
+func (r *Rule) compile() error {
+	if r.Regex != "" {
+		re, err := regexp.Compile(r.Regex)
+		if err != nil { return fmt.Errorf("regex: %v", err) }
+		r.re = re
+	}
+	if r.Items != nil {
+		if err := r.Items.compile(); err != nil { return fmt.Errorf("items %v", err) }
+	}
+	for i := range r.Fields {
+		if err := r.Fields[i].compile(); err != nil { return fmt.Errorf("subfield '%s' %v", r.Fields[i].Field, err) }
+	}
+	return nil
+}
+
+// CheckField reports a schema row whose constraints contradict each other
+// or its type: min above max, lengths on a number, an enum without
+// choices, a default that breaks the field's own rules and so on.
+func CheckField(s store.SiteFieldSchema) error {
+	bad := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: field '%s' %s", ErrInvalidField, s.Field, fmt.Sprintf(format, args...))
+	}
+	if s.Field == "" { return fmt.Errorf("%w: field name is empty", ErrInvalidField) }
+	r, err := RuleFromSchema(s)
+	if err != nil { return bad("%v", err) }
+	if msg := r.check(); msg != "" { return bad("%s", msg) }
+	if s.Unique != 0 && !scalarType(s.Type) { return bad("unique needs a scalar type, not %s", s.Type) }
+	if s.DefaultValue != "" {
+		var def interface{}
+		if err := json.Unmarshal([]byte(s.DefaultValue), &def); err != nil { return bad("default: %v", err) }
+		if def != nil {
+			if path, msg := r.value(s.Field, def); msg != "" { return bad("default %s", inner(s.Field, path, msg)) }
+		}
+	}
+	return nil
+}
+
+// inner phrases a value problem found at path below the field itself.
+func inner(field, path, msg string) string {
+	if path == field { return msg }
+	return "at '" + path + "' " + msg
+}
+
+// check reports the first inconsistency in r, or "".
+func (r Rule) check() string {
+	if !ValidType(r.Type) { return fmt.Sprintf("has unknown type %q", r.Type) }
+	if (r.Min != nil || r.Max != nil) && !numericType(r.Type) { return fmt.Sprintf("min/max need a number or integer, not %s", r.Type) }
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max { return fmt.Sprintf("min %v is above max %v", *r.Min, *r.Max) }
+	if r.Type == "integer" {
+		if r.Min != nil && *r.Min != math.Trunc(*r.Min) { return fmt.Sprintf("integer min %v has a fraction", *r.Min) }
+		if r.Max != nil && *r.Max != math.Trunc(*r.Max) { return fmt.Sprintf("integer max %v has a fraction", *r.Max) }
+	}
+	if (r.MinLength != nil || r.MaxLength != nil) && !textType(r.Type) && r.Type != "array" {
+		return fmt.Sprintf("minLength/maxLength need a string-like type or array, not %s", r.Type)
+	}
+	if r.MinLength != nil && *r.MinLength < 0 { return "minLength is negative" }
+	if r.MaxLength != nil && *r.MaxLength < 0 { return "maxLength is negative" }
+	if r.MinLength != nil && r.MaxLength != nil && *r.MinLength > *r.MaxLength {
+		return fmt.Sprintf("minLength %d is above maxLength %d", *r.MinLength, *r.MaxLength)
+	}
+	if r.Regex != "" {
+		if !textType(r.Type) { return fmt.Sprintf("regex needs a string-like type, not %s", r.Type) }
+		if _, err := regexp.Compile(r.Regex); err != nil { return fmt.Sprintf("regex: %v", err) }
+	}
+	if r.Type == "enum" && len(r.Choices) == 0 { return "enum needs choices" }
+	if len(r.Choices) > 0 {
+		if !scalarType(r.Type) { return fmt.Sprintf("choices need a scalar type, not %s", r.Type) }
+		for _, c := range r.Choices {
+			if r.Type == "enum" {
+				if !scalarValue(c) { return fmt.Sprintf("choice %v is not a string, number or boolean", c) }
+				continue
+			}
+			if _, msg := r.valueIgnoringChoices("", c); msg != "" { return fmt.Sprintf("choice %v: %s", c, msg) }
+		}
+	}
+	switch {
+	case r.Type == "array" && r.Items == nil:
+		return "array needs items"
+	case r.Type != "array" && r.Items != nil:
+		return fmt.Sprintf("items need type array, not %s", r.Type)
+	case r.Type != "object" && len(r.Fields) > 0:
+		return fmt.Sprintf("fields need type object, not %s", r.Type)
+	}
+	if r.Items != nil {
+		if msg := r.Items.check(); msg != "" { return "items " + msg }
+	}
+	seen := map[string]bool{}
+	for _, f := range r.Fields {
+		if f.Field == "" { return "has a subfield without a name" }
+		if seen[f.Field] { return fmt.Sprintf("lists subfield '%s' twice", f.Field) }
+		seen[f.Field] = true
+		if msg := f.check(); msg != "" { return fmt.Sprintf("subfield '%s' %s", f.Field, msg) }
+	}
+	return ""
+}
+
+// value checks v against r and returns the path of the first offending
+// value and what is wrong with it, or "" when v passes.
+func (r Rule) value(path string, v interface{}) (string, string) {
+	if vs := r.violations(path, v, true); len(vs) > 0 { return vs[0].Field, vs[0].Message }
+	return "", ""
+}
+
+func (r Rule) valueIgnoringChoices(path string, v interface{}) (string, string) {
+	if vs := r.violations(path, v, false); len(vs) > 0 { return vs[0].Field, vs[0].Message }
+	return "", ""
+}
+
+// violations checks v against r and returns every problem found, each with
+// the path of the offending value and a message relative to it. A value of
+// the wrong type is not checked further.
+func (r Rule) violations(path string, v interface{}, choices bool) []Violation {
+	if !typeMatches(v, r.Type) { return []Violation{{Field: path, Code: CodeType, Message: "type mismatch, expect " + r.Type, Expected: r.Type}} }
+	var out []Violation
+	add := func(code, msg string, expected interface{}) {
+		out = append(out, Violation{Field: path, Code: code, Message: msg, Expected: expected})
+	}
+	switch x := v.(type) {
+	case float64:
+		if r.Min != nil && x < *r.Min { add(CodeMin, fmt.Sprintf("is below min %v", *r.Min), *r.Min) }
+		if r.Max != nil && x > *r.Max { add(CodeMax, fmt.Sprintf("is above max %v", *r.Max), *r.Max) }
+	case string:
+		out = append(out, r.length(path, utf8.RuneCountInString(x))...)
+		if r.Regex != "" {
+			re := r.re
+			if re == nil {
+				var err error
+				if re, err = regexp.Compile(r.Regex); err != nil { add(CodeSchema, "has an invalid schema regex", nil); break }
+			}
+			if !re.MatchString(x) { add(CodePattern, "does not match regex", r.Regex) }
+		}
+	case []interface{}:
+		out = append(out, r.length(path, len(x))...)
+		if r.Items != nil {
+			for i, it := range x { out = append(out, r.Items.violations(fmt.Sprintf("%s[%d]", path, i), it, true)...) }
+		}
+	case map[string]interface{}:
+		for _, f := range r.Fields {
+			sub := path + "." + f.Field
+			fv, ok := x[f.Field]
+			if !ok || isEmptyForType(fv, f.Type) {
+				if f.Required { out = append(out, Violation{Field: sub, Code: CodeRequired, Message: "required"}) }
+				continue
+			}
+			out = append(out, f.violations(sub, fv, true)...)
+		}
+	}
+	if choices && len(r.Choices) > 0 && !inChoices(v, r.Choices) { add(CodeChoice, "not in choices", r.Choices) }
+	return out
+}
+
+func (r Rule) length(path string, n int) []Violation {
+	if r.MinLength != nil && n < *r.MinLength {
+		return []Violation{{Field: path, Code: CodeMinLength, Message: fmt.Sprintf("is shorter than minLength %d", *r.MinLength), Expected: *r.MinLength}}
+	}
+	if r.MaxLength != nil && n > *r.MaxLength {
+		return []Violation{{Field: path, Code: CodeMaxLength, Message: fmt.Sprintf("is longer than maxLength %d", *r.MaxLength), Expected: *r.MaxLength}}
+	}
+	return nil
+}
+
+func numericType(typ string) bool { return typ == "number" || typ == "integer" }
+
+// textType reports types stored as free text that length and regex
+// constraints make sense for.
+func textType(typ string) bool { return typ == "string" || typ == "url" || typ == "email" }
+
+// scalarType reports types whose values can be compared for choices and
+// uniqueness.
+func scalarType(typ string) bool {
+	switch typ {
+	case "json", "array", "object":
+		return false
+	}
+	return true
+}
+
+func scalarValue(v interface{}) bool {
+	switch v.(type) {
+	case string, float64, bool:
+		return true
+	}
+	return false
+}
+
+func isURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+func isEmail(s string) bool {
+	a, err := mail.ParseAddress(s)
+	return err == nil && a.Address == s
+}
+
+func isDuration(s string) bool {
+	_, err := time.ParseDuration(s)
+	return err == nil
+}
@@ -1,62 +1,29 @@
 package validation
 
 import (
-	"context"
-	"encoding/json"
-	"fmt"
-	"regexp"
+	"math"
+	"sort"
 	"time"
 
-	"github.com/jmoiron/sqlx"
-
 	"mss/internal/store"
 )
 
-func ValidateProps(ctx context.Context, db *sqlx.DB, siteKey string, props map[string]interface{}) error {
-	schemas, err := store.GetSiteFieldSchemas(ctx, db, siteKey)
-	if err != nil { return err }
-	// build map for quick lookup
-	sm := make(map[string]store.SiteFieldSchema, len(schemas))
-	for _, s := range schemas { sm[s.Field] = s }
-
-	// required check
-	for _, s := range schemas {
-		if s.Required != 0 {
-			v, ok := props[s.Field]
-			if !ok || isEmptyForType(v, s.Type) {
-				return fmt.Errorf("invalid props: field '%s' required", s.Field)
-			}
-		}
+// UndeclaredProps returns the sorted names in props that no schema field
+// declares.
+func UndeclaredProps(schemas []store.SiteFieldSchema, props map[string]interface{}) []string {
+	declared := make(map[string]bool, len(schemas))
+	for _, s := range schemas { declared[s.Field] = true }
+	var out []string
+	for k := range props {
+		if !declared[k] { out = append(out, k) }
 	}
-	// type/regex/choices check on present fields
-	for k, v := range props {
-		s, ok := sm[k]
-		if !ok { continue } // allow extra fields not defined? choose to allow silently
-		if !typeMatches(v, s.Type) {
-			return fmt.Errorf("invalid props: field '%s' type mismatch, expect %s", k, s.Type)
-		}
-		if s.Regex != "" {
-			str, ok := v.(string)
-			if ok {
-				re, err := regexp.Compile(s.Regex)
-				if err != nil { return fmt.Errorf("invalid schema regex for field '%s'", k) }
-				if !re.MatchString(str) { return fmt.Errorf("invalid props: field '%s' does not match regex", k) }
-			}
-		}
-		if s.Choices != "" {
-			var arr []interface{}
-			if err := json.Unmarshal([]byte(s.Choices), &arr); err == nil {
-				if !inChoices(v, arr) { return fmt.Errorf("invalid props: field '%s' not in choices", k) }
-			}
-		}
-	}
-	return nil
+	sort.Strings(out)
+	return out
 }
 
-func MaskSecretProps(ctx context.Context, db *sqlx.DB, siteKey string, props map[string]interface{}) (map[string]interface{}, error) {
-	schemas, err := store.GetSiteFieldSchemas(ctx, db, siteKey)
-	if err != nil { return nil, err }
-	return maskWithSchemas(schemas, props), nil
+// ValidPropsMode reports whether mode is a known Site.AdditionalProps value.
+func ValidPropsMode(mode string) bool {
+	return mode == store.PropsAllow || mode == store.PropsWarn || mode == store.PropsReject
 }
 
 func maskWithSchemas(schemas []store.SiteFieldSchema, props map[string]interface{}) map[string]interface{} {
@@ -72,20 +39,27 @@ func maskWithSchemas(schemas []store.SiteFieldSchema, props map[string]interface
 
 func isEmptyForType(v interface{}, typ string) bool {
 	switch typ {
-	case "string", "datetime":
+	case "string", "datetime", "date", "duration", "url", "email":
 		if s, ok := v.(string); ok { return s == "" }
 		return v == nil
-	case "number":
-		return v == nil
-	case "boolean":
-		return v == nil
-	case "json":
-		return v == nil
 	default:
 		return v == nil
 	}
 }
 
+// ValidType reports whether typ is a known field type.
+func ValidType(typ string) bool {
+	switch typ {
+	case "string", "number", "integer", "boolean", "datetime", "date", "duration",
+		"url", "email", "enum", "json", "array", "object":
+		return true
+	}
+	return false
+}
+
+// MatchesType reports whether a decoded JSON value fits typ.
+func MatchesType(v interface{}, typ string) bool { return typeMatches(v, typ) }
+
 func typeMatches(v interface{}, typ string) bool {
 	switch typ {
 	case "string":
@@ -93,6 +67,8 @@ func typeMatches(v interface{}, typ string) bool {
 	case "number":
 		// encoding/json decodes numbers as float64
 		_, ok := v.(float64); return ok
+	case "integer":
+		f, ok := v.(float64); return ok && f == math.Trunc(f) && !math.IsInf(f, 0)
 	case "boolean":
 		_, ok := v.(bool); return ok
 	case "datetime":
@@ -100,6 +76,23 @@ func typeMatches(v interface{}, typ string) bool {
 		if s == "" { return false }
 		_, err := time.Parse(time.RFC3339, s)
 		return err == nil
+	case "date":
+		s, ok := v.(string); if !ok { return false }
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+	case "duration":
+		s, ok := v.(string); return ok && isDuration(s)
+	case "url":
+		s, ok := v.(string); return ok && isURL(s)
+	case "email":
+		s, ok := v.(string); return ok && isEmail(s)
+	case "enum":
+		// membership is checked against the field's choices
+		return scalarValue(v)
+	case "array":
+		_, ok := v.([]interface{}); return ok
+	case "object":
+		_, ok := v.(map[string]interface{}); return ok
 	case "json":
 		// allow object or array
 		if v == nil { return false }
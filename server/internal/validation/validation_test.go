@@ -0,0 +1,202 @@
+package validation_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"mss/internal/store"
+	"mss/internal/validation"
+)
+
+func f64(v float64) *float64 { return &v }
+func intp(v int) *int        { return &v }
+
+// seed creates site s with the given mode and rules and upserts schemas.
+func seed(t *testing.T, mode, rules string, schemas ...store.SiteFieldSchema) store.Repos {
+	t.Helper()
+	ctx := context.Background()
+	r := store.NewMemory(store.RevisionSecrets{})
+	if err := r.Sites.Create(ctx, &store.Site{Key: "s", Name: "S", AdditionalProps: mode, AccountRules: rules}); err != nil { t.Fatal(err) }
+	for _, s := range schemas {
+		s.SiteKey = "s"
+		if err := r.Schemas.Upsert(ctx, &s, 0); err != nil { t.Fatal(err) }
+	}
+	return r
+}
+
+// load compiles site s from r.
+func load(t *testing.T, r store.Repos) *validation.Validator {
+	t.Helper()
+	v, err := validation.Load(context.Background(), r, "s")
+	if err != nil { t.Fatal(err) }
+	return v
+}
+
+// codes returns field -> code for every violation in err.
+func codes(t *testing.T, err error) map[string]string {
+	t.Helper()
+	var verrs validation.Errors
+	if !errors.As(err, &verrs) { t.Fatalf("want validation.Errors, got %v", err) }
+	out := map[string]string{}
+	for _, v := range verrs { out[v.Field] = v.Code }
+	return out
+}
+
+func TestValidateReportsEveryViolation(t *testing.T) {
+	r := seed(t, store.PropsReject, "",
+		store.SiteFieldSchema{Field: "age", Type: "integer", Min: f64(18)},
+		store.SiteFieldSchema{Field: "plan", Type: "string", Required: 1, Choices: `["a","b"]`},
+		store.SiteFieldSchema{Field: "tags", Type: "array", Items: `{"type":"string","regex":"^[a-z]+$"}`},
+		store.SiteFieldSchema{Field: "code", Type: "string", MinLength: intp(3)},
+		store.SiteFieldSchema{Field: "n", Type: "number"},
+	)
+	props := map[string]interface{}{"age": 3.0, "tags": []interface{}{"ok", "BAD"}, "code": "x", "n": "1", "extra": true}
+	_, err := load(t, r).Validate(context.Background(), r, "", props)
+	want := map[string]string{
+		"props.age": "min", "props.plan": "required", "props.tags[1]": "pattern",
+		"props.code": "minLength", "props.n": "type", "props.extra": "undeclared",
+	}
+	if got := codes(t, err); !reflect.DeepEqual(got, want) { t.Fatalf("violations:\n got %v\nwant %v", got, want) }
+
+	ok := map[string]interface{}{"age": 20.0, "plan": "b", "tags": []interface{}{"ok"}}
+	if _, err := load(t, r).Validate(context.Background(), r, "", ok); err != nil { t.Fatalf("valid props: %v", err) }
+}
+
+func TestAdditionalPropsModes(t *testing.T) {
+	props := map[string]interface{}{"extra": 1.0}
+	ctx := context.Background()
+	validate := func(mode string) ([]string, error) {
+		r := seed(t, mode, "")
+		return load(t, r).Validate(ctx, r, "", props)
+	}
+	if w, err := validate(store.PropsAllow); err != nil || len(w) != 0 { t.Fatalf("allow: %v %v", w, err) }
+	if w, err := validate(store.PropsWarn); err != nil || len(w) != 1 { t.Fatalf("warn: %v %v", w, err) }
+	if _, err := validate(store.PropsReject); codes(t, err)["props.extra"] != "undeclared" { t.Fatalf("reject: %v", err) }
+}
+
+func TestUnique(t *testing.T) {
+	ctx := context.Background()
+	r := seed(t, "", "", store.SiteFieldSchema{Field: "email", Type: "email", Unique: 1})
+	if err := r.Accounts.Create(ctx, &store.Account{ID: "a1", SiteKey: "s", Username: "u1", Extra: `{"email":"x@y.z"}`}); err != nil { t.Fatal(err) }
+	props := map[string]interface{}{"email": "x@y.z"}
+	if _, err := load(t, r).Validate(ctx, r, "a2", props); codes(t, err)["props.email"] != "unique" { t.Fatalf("duplicate: %v", err) }
+	if _, err := load(t, r).Validate(ctx, r, "a1", props); err != nil { t.Fatalf("own value: %v", err) }
+
+	// a batch also compares with the accounts it has claimed
+	b := load(t, r).Batch()
+	other := map[string]interface{}{"email": "b@y.z"}
+	if _, err := b.ValidateAccount(ctx, r, store.Account{ID: "a2", SiteKey: "s", Username: "u2"}, other); err != nil { t.Fatal(err) }
+	b.Claim(store.Account{ID: "a2", SiteKey: "s", Extra: `{"email":"b@y.z"}`})
+	if _, err := b.ValidateAccount(ctx, r, store.Account{ID: "a3", SiteKey: "s", Username: "u3"}, other); codes(t, err)["props.email"] != "unique" { t.Fatalf("duplicate in batch: %v", err) }
+	// a claim replaces the stored row of the same account
+	b.Claim(store.Account{ID: "a1", SiteKey: "s", Extra: `{"email":"c@y.z"}`})
+	if _, err := b.ValidateAccount(ctx, r, store.Account{ID: "a3", SiteKey: "s", Username: "u3"}, props); err != nil { t.Fatalf("value released in batch: %v", err) }
+}
+
+func TestValidateAccountRules(t *testing.T) {
+	ctx := context.Background()
+	r := seed(t, "", `{"username":{"type":"email","required":true},"password":{"type":"string","minLength":8}}`,
+		store.SiteFieldSchema{Field: "plan", Type: "string", Required: 1})
+	_, err := load(t, r).ValidateAccount(ctx, r, store.Account{SiteKey: "s", Username: "bob", Password: "short"}, map[string]interface{}{})
+	want := map[string]string{"username": "type", "password": "minLength", "props.plan": "required"}
+	if got := codes(t, err); !reflect.DeepEqual(got, want) { t.Fatalf("violations: %v", got) }
+	if msg := err.Error(); msg[:len("invalid account: ")] != "invalid account: " { t.Fatalf("message: %q", msg) }
+
+	// nil props skips the props check, as for an update that leaves them alone
+	_, err = load(t, r).ValidateAccount(ctx, r, store.Account{SiteKey: "s", Password: "longenough"}, nil)
+	if got := codes(t, err); !reflect.DeepEqual(got, map[string]string{"username": "required"}) { t.Fatalf("nil props: %v", got) }
+	if _, err := load(t, r).ValidateAccount(ctx, r, store.Account{SiteKey: "s", Username: "b@x.io", Password: "longenough"}, nil); err != nil { t.Fatalf("valid account: %v", err) }
+}
+
+func TestAccountRulesCheck(t *testing.T) {
+	for _, tc := range []struct {
+		in string
+		ok bool
+	}{
+		{``, true},
+		{`{"username":{"minLength":3}}`, true},
+		{`{"username":{"type":"integer"}}`, false},
+		{`{"password":{"regex":"("}}`, false},
+		{`{"password":{"minLength":5,"maxLength":2}}`, false},
+	} {
+		ar, err := validation.ParseAccountRules(tc.in)
+		if err != nil { t.Fatalf("%s: %v", tc.in, err) }
+		if err := ar.Check(); (err == nil) != tc.ok { t.Errorf("%s: check = %v", tc.in, err) }
+	}
+	ar, _ := validation.ParseAccountRules(`{"username":{"minLength":3}}`)
+	_ = ar.Check()
+	if ar.Username.Type != "string" { t.Fatalf("default type: %q", ar.Username.Type) }
+	if (&validation.AccountRules{}).Encode() != "{}" { t.Fatal("empty rules must encode as {}") }
+}
+
+func TestCheckField(t *testing.T) {
+	bad := []store.SiteFieldSchema{
+		{Field: "x", Type: "nope"},
+		{Field: "x", Type: "string", Regex: "("},
+		{Field: "x", Type: "number", Min: f64(5), Max: f64(1)},
+		{Field: "x", Type: "array", Items: `{"type":"string","regex":"["}`},
+	}
+	for _, s := range bad {
+		if err := validation.CheckField(s); !errors.Is(err, validation.ErrInvalidField) { t.Errorf("%+v: %v", s, err) }
+	}
+	if err := validation.CheckField(store.SiteFieldSchema{Field: "x", Type: "string", Regex: "^a"}); err != nil { t.Fatal(err) }
+}
+
+func TestNormalize(t *testing.T) {
+	schemas := []store.SiteFieldSchema{
+		{Field: "n", Type: "integer"},
+		{Field: "on", Type: "boolean"},
+		{Field: "at", Type: "datetime"},
+		{Field: "name", Type: "string"},
+		{Field: "tier", Type: "string", DefaultValue: `"free"`},
+	}
+	in := map[string]interface{}{"n": "42", "on": "yes", "at": "2024-01-02 03:04", "name": "  bob ", "other": "x"}
+	got := validation.Normalize(schemas, in)
+	want := map[string]interface{}{"n": 42.0, "on": true, "at": "2024-01-02T03:04:00Z", "name": "bob", "tier": "free", "other": "x"}
+	if !reflect.DeepEqual(got, want) { t.Fatalf("normalize:\n got %v\nwant %v", got, want) }
+	if in["n"] != "42" { t.Fatal("input modified") }
+}
+
+func TestCoerceString(t *testing.T) {
+	for _, tc := range []struct {
+		raw, typ string
+		want     interface{}
+		ok       bool
+	}{
+		{"", "integer", nil, true},
+		{"7", "integer", 7.0, true},
+		{"7.5", "integer", nil, false},
+		{"no", "boolean", false, true},
+		{"maybe", "boolean", nil, false},
+		{"2024-05-06", "date", "2024-05-06", true},
+		{"1h30m", "duration", "1h30m", true},
+		{"soon", "duration", nil, false},
+		{`[1,"a"]`, "array", []interface{}{1.0, "a"}, true},
+	} {
+		got, err := validation.CoerceString(tc.raw, tc.typ)
+		if (err == nil) != tc.ok || (tc.ok && !reflect.DeepEqual(got, tc.want)) { t.Errorf("%s %q: %v %v", tc.typ, tc.raw, got, err) }
+		if tc.ok && got != nil && validation.FormatValue(got) == "" { t.Errorf("%s %q: empty format", tc.typ, tc.raw) }
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	ctx := context.Background()
+	r := seed(t, "", "", store.SiteFieldSchema{Field: "a", Type: "string"})
+	c := validation.NewCache(time.Hour)
+	v1, err := c.Get(ctx, r, "s")
+	if err != nil { t.Fatal(err) }
+	if err := r.Schemas.Upsert(ctx, &store.SiteFieldSchema{SiteKey: "s", Field: "b", Type: "string"}, 0); err != nil { t.Fatal(err) }
+	if v, _ := c.Get(ctx, r, "s"); v != v1 { t.Fatal("cached validator not reused") }
+	c.Invalidate("s")
+	v2, _ := c.Get(ctx, r, "s")
+	if v2 == v1 || len(v2.Schemas) != 2 { t.Fatalf("after invalidate: %d fields", len(v2.Schemas)) }
+	c.Reset()
+	if v, _ := c.Get(ctx, r, "s"); v == v2 { t.Fatal("reset kept the validator") }
+
+	off := validation.NewCache(0)
+	a, _ := off.Get(ctx, r, "s")
+	if b, _ := off.Get(ctx, r, "s"); a == b { t.Fatal("ttl 0 must not cache") }
+}
@@ -0,0 +1,273 @@
+package validation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"mss/internal/store"
+)
+
+// Validator is a site's field schema and account rules prepared for
+// repeated use: choices, items and subfields decoded and regexes compiled
+// once. Build one with Load or Compile, or share one per site through a
+// Cache. A Validator is read-only and safe for concurrent use.
+type Validator struct {
+	SiteKey string
+	Schemas []store.SiteFieldSchema
+	rules   map[string]Rule
+	// broken holds fields whose stored definition does not decode or
+	// compile; props using them fail validation.
+	broken map[string]error
+	// mode is the site's AdditionalProps.
+	mode    string
+	account AccountRules
+	// accountErr is set when the stored account rules do not decode or
+	// compile; every account of the site then fails validation.
+	accountErr error
+}
+
+// Compile prepares schemas, the fields of siteKey, for validation, with
+// no account rules and undeclared props allowed. Load also applies the
+// site's settings.
+func Compile(siteKey string, schemas []store.SiteFieldSchema) *Validator {
+	v := &Validator{SiteKey: siteKey, Schemas: schemas, mode: store.PropsAllow,
+		rules: make(map[string]Rule, len(schemas)), broken: map[string]error{}}
+	for _, s := range schemas {
+		r, err := RuleFromSchema(s)
+		if err == nil { err = r.compile() }
+		if err != nil { v.broken[s.Field] = err; continue }
+		v.rules[s.Field] = r
+	}
+	return v
+}
+
+// Load reads the site and its schema from repos and compiles them.
+func Load(ctx context.Context, repos store.Repos, siteKey string) (*Validator, error) {
+	schemas, err := repos.Schemas.List(ctx, siteKey)
+	if err != nil { return nil, err }
+	v := Compile(siteKey, schemas)
+	site, err := repos.Sites.Get(ctx, siteKey)
+	if err != nil { return nil, err }
+	if site == nil { return v, nil }
+	if site.AdditionalProps != "" { v.mode = site.AdditionalProps }
+	ar, err := ParseAccountRules(site.AccountRules)
+	if err == nil {
+		for _, r := range []*Rule{ar.Username, ar.Password} {
+			if r != nil && err == nil { err = r.compile() }
+		}
+	}
+	if err != nil { v.accountErr = err; return v, nil }
+	v.account = *ar
+	return v, nil
+}
+
+// Validate checks props against the site's field rules. accountID is the
+// account being updated, or "" for a new one; unique fields must not repeat
+// a value held by any other live account of the site. Props the schema does
+// not declare are handled by the site's AdditionalProps mode: kept silently,
+// kept and reported in the returned warnings, or rejected. Every violation
+// is reported at once: the error is Errors unless reading the store failed.
+func (v *Validator) Validate(ctx context.Context, repos store.Repos, accountID string, props map[string]interface{}) ([]string, error) {
+	warnings, errs, err := v.props(ctx, repos, accountID, props, nil)
+	if err != nil { return nil, err }
+	if len(errs) > 0 { return nil, errs }
+	return warnings, nil
+}
+
+// ValidateAccount checks acc's username and password against the site's
+// account rules and, unless props is nil, props as Validate does. Every
+// violation found is returned at once as Errors.
+func (v *Validator) ValidateAccount(ctx context.Context, repos store.Repos, acc store.Account, props map[string]interface{}) ([]string, error) {
+	return v.validateAccount(ctx, repos, acc, props, nil)
+}
+
+// validateAccount is ValidateAccount with pending, accounts about to be written
+// alongside acc, taking part in unique checks.
+func (v *Validator) validateAccount(ctx context.Context, repos store.Repos, acc store.Account, props map[string]interface{}, pending []store.Account) ([]string, error) {
+	var errs Errors
+	if v.accountErr != nil {
+		errs = append(errs, Violation{Field: "username", Code: CodeSchema, Message: fmt.Sprintf("invalid account rules: %v", v.accountErr)})
+	}
+	errs = append(errs, credential("username", v.account.Username, acc.Username)...)
+	errs = append(errs, credential("password", v.account.Password, acc.Password)...)
+	var warnings []string
+	if props != nil {
+		w, perrs, err := v.props(ctx, repos, acc.ID, props, pending)
+		if err != nil { return nil, err }
+		warnings, errs = w, append(errs, perrs...)
+	}
+	if len(errs) > 0 { return nil, errs }
+	return warnings, nil
+}
+
+// Batch validates accounts written together, such as the items of a bulk
+// request or the rows of a CSV file, where unique values must not repeat
+// within the batch either. Validate each account against the repos it is
+// written through, then Claim it once it is accepted.
+type Batch struct {
+	v       *Validator
+	claimed []store.Account
+}
+
+// Batch starts a Batch against v.
+func (v *Validator) Batch() *Batch { return &Batch{v: v} }
+
+// ValidateAccount is Validator.ValidateAccount, with the accounts claimed
+// so far counted for unique fields.
+func (b *Batch) ValidateAccount(ctx context.Context, repos store.Repos, acc store.Account, props map[string]interface{}) ([]string, error) {
+	return b.v.validateAccount(ctx, repos, acc, props, b.claimed)
+}
+
+// Claim records acc, with Extra as it will be stored, as part of the batch.
+// A later claim for the same ID replaces it.
+func (b *Batch) Claim(acc store.Account) {
+	for i := range b.claimed {
+		if b.claimed[i].ID == acc.ID { b.claimed[i] = acc; return }
+	}
+	b.claimed = append(b.claimed, acc)
+}
+
+// props collects the warnings and violations of props; the error is for
+// failures to read the store. Unique fields are checked against the stored
+// accounts, with pending ones replacing or adding to them.
+func (v *Validator) props(ctx context.Context, repos store.Repos, accountID string, props map[string]interface{}, pending []store.Account) ([]string, Errors, error) {
+	var errs Errors
+	var unique []store.SiteFieldSchema
+	for _, s := range v.Schemas {
+		val, ok := props[s.Field]
+		if !ok || isEmptyForType(val, s.Type) {
+			if s.Required != 0 {
+				errs = append(errs, Violation{Field: "props." + s.Field, Code: CodeRequired, Message: fmt.Sprintf("field '%s' required", s.Field)})
+				continue
+			}
+			if !ok { continue }
+		}
+		if err := v.broken[s.Field]; err != nil {
+			errs = append(errs, Violation{Field: "props." + s.Field, Code: CodeSchema, Message: fmt.Sprintf("invalid schema for field '%s': %v", s.Field, err)})
+			continue
+		}
+		found := v.rules[s.Field].violations(s.Field, val, true)
+		for _, pv := range found { errs = append(errs, propViolation(pv)) }
+		if len(found) == 0 && s.Unique != 0 && !isEmptyForType(val, s.Type) { unique = append(unique, s) }
+	}
+	var warnings []string
+	for _, k := range UndeclaredProps(v.Schemas, props) {
+		switch v.mode {
+		case store.PropsReject:
+			errs = append(errs, Violation{Field: "props." + k, Code: CodeUndeclared, Message: fmt.Sprintf("field '%s' is not declared in the site schema", k)})
+		case store.PropsWarn:
+			warnings = append(warnings, fmt.Sprintf("field '%s' is not declared in the site schema", k))
+		}
+	}
+	if len(unique) == 0 { return warnings, errs, nil }
+	stored, err := repos.Accounts.List(ctx, v.SiteKey)
+	if err != nil { return nil, nil, err }
+	accs := pending
+	if len(pending) > 0 {
+		ids := make(map[string]bool, len(pending))
+		for _, p := range pending { ids[p.ID] = true }
+		for _, acc := range stored {
+			if !ids[acc.ID] { accs = append(accs, acc) }
+		}
+	} else {
+		accs = stored
+	}
+	for _, s := range unique {
+		for _, acc := range accs {
+			if acc.ID == accountID || acc.Extra == "" { continue }
+			var other map[string]interface{}
+			if json.Unmarshal([]byte(acc.Extra), &other) != nil { continue }
+			if equalJSONValue(props[s.Field], other[s.Field]) {
+				errs = append(errs, Violation{Field: "props." + s.Field, Code: CodeUnique,
+					Message: fmt.Sprintf("field '%s' must be unique, account %s already has %v", s.Field, acc.ID, FormatValue(props[s.Field]))})
+				break
+			}
+		}
+	}
+	return warnings, errs, nil
+}
+
+// Normalize is the package Normalize against v's schema.
+func (v *Validator) Normalize(props map[string]interface{}) map[string]interface{} {
+	var out map[string]interface{}
+	if props != nil {
+		out = make(map[string]interface{}, len(props))
+		for k, val := range props { out[k] = val }
+	}
+	for _, s := range v.Schemas {
+		rule, ok := v.rules[s.Field]
+		if !ok { continue }
+		if val, ok := out[s.Field]; ok {
+			out[s.Field] = rule.normalize(val)
+		}
+		if val, ok := out[s.Field]; (ok && !isEmptyForType(val, s.Type)) || s.DefaultValue == "" { continue }
+		var def interface{}
+		if err := json.Unmarshal([]byte(s.DefaultValue), &def); err != nil || def == nil { continue }
+		if out == nil { out = map[string]interface{}{} }
+		out[s.Field] = def
+	}
+	return out
+}
+
+// Mask returns a copy of props with secret fields replaced by "***".
+func (v *Validator) Mask(props map[string]interface{}) map[string]interface{} {
+	return maskWithSchemas(v.Schemas, props)
+}
+
+// Cache shares compiled validators by site key. Whatever writes a site or
+// its schema calls Invalidate (or Reset for writes touching many sites); entries
+// also expire after the TTL so schema changes made by other processes, such
+// as `mss-server apply`, are picked up. A TTL of zero or less disables
+// caching: every Get compiles afresh.
+type Cache struct {
+	ttl   time.Duration
+	mu    sync.Mutex
+	gen   uint64 // bumped by every invalidation
+	items map[string]cachedValidator
+}
+
+type cachedValidator struct {
+	v  *Validator
+	at time.Time
+}
+
+func NewCache(ttl time.Duration) *Cache {
+	return &Cache{ttl: ttl, items: map[string]cachedValidator{}}
+}
+
+// Get returns the validator of siteKey, loading it from repos when it is
+// not cached or has expired.
+func (c *Cache) Get(ctx context.Context, repos store.Repos, siteKey string) (*Validator, error) {
+	c.mu.Lock()
+	e, ok := c.items[siteKey]
+	gen := c.gen
+	c.mu.Unlock()
+	if ok && time.Since(e.at) < c.ttl { return e.v, nil }
+	v, err := Load(ctx, repos, siteKey)
+	if err != nil { return nil, err }
+	if c.ttl <= 0 { return v, nil }
+	c.mu.Lock()
+	// an invalidation while we were loading may have made v stale
+	if c.gen == gen { c.items[siteKey] = cachedValidator{v: v, at: time.Now()} }
+	c.mu.Unlock()
+	return v, nil
+}
+
+// Invalidate drops the cached validator of siteKey.
+func (c *Cache) Invalidate(siteKey string) {
+	c.mu.Lock()
+	delete(c.items, siteKey)
+	c.gen++
+	c.mu.Unlock()
+}
+
+// Reset drops every cached validator.
+func (c *Cache) Reset() {
+	c.mu.Lock()
+	c.items = map[string]cachedValidator{}
+	c.gen++
+	c.mu.Unlock()
+}
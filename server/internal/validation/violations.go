@@ -0,0 +1,112 @@
+package validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Violation codes.
+const (
+	CodeRequired   = "required"
+	CodeType       = "type"
+	CodePattern    = "pattern"
+	CodeChoice     = "choice"
+	CodeMin        = "min"
+	CodeMax        = "max"
+	CodeMinLength  = "minLength"
+	CodeMaxLength  = "maxLength"
+	CodeUnique     = "unique"
+	CodeUndeclared = "undeclared"
+	// CodeSchema marks a stored rule that cannot be applied, such as a
+	// regex that no longer compiles.
+	CodeSchema = "schema"
+)
+
+// Violation is one problem with an account. Field is "username",
+// "password" or "props.<path>" as in revision diffs, with paths like
+// props.tags[0] or props.addr.city for nested values; Expected is what the
+// rule wanted (type, regex, choices, bound) where there is one.
+type Violation struct {
+	Field    string      `json:"field"`
+	Code     string      `json:"code"`
+	Message  string      `json:"message"`
+	Expected interface{} `json:"expected,omitempty"`
+}
+
+// Errors is every violation found in one account. Validation returns it as
+// its error; use errors.As to get at the items.
+type Errors []Violation
+
+func (e Errors) Error() string {
+	prefix := "invalid props: "
+	msgs := make([]string, len(e))
+	for i, v := range e {
+		msgs[i] = v.Message
+		if !strings.HasPrefix(v.Field, "props.") { prefix = "invalid account: " }
+	}
+	return prefix + strings.Join(msgs, "; ")
+}
+
+// propViolation turns a rule violation at path inside props into a
+// Violation of the account.
+func propViolation(v Violation) Violation {
+	v.Message = fmt.Sprintf("field '%s' %s", v.Field, v.Message)
+	v.Field = "props." + v.Field
+	return v
+}
+
+// AccountRules are a site's rules for account usernames and passwords,
+// kept as JSON in sites.account_rules. Each is a string-like Rule: type
+// string (the default), email or url with required, regex, choices,
+// minLength and maxLength.
+type AccountRules struct {
+	Username *Rule `json:"username,omitempty" yaml:"username,omitempty"`
+	Password *Rule `json:"password,omitempty" yaml:"password,omitempty"`
+}
+
+// ParseAccountRules decodes stored account rules; "" means none.
+func ParseAccountRules(s string) (*AccountRules, error) {
+	ar := &AccountRules{}
+	if s == "" { return ar, nil }
+	if err := json.Unmarshal([]byte(s), ar); err != nil { return nil, fmt.Errorf("account rules: %v", err) }
+	return ar, nil
+}
+
+// Check reports a rule that is not string-like or contradicts itself, and
+// fills in the default type.
+func (ar *AccountRules) Check() error {
+	for _, it := range []struct {
+		name string
+		r    *Rule
+	}{{"username", ar.Username}, {"password", ar.Password}} {
+		if it.r == nil { continue }
+		if it.r.Type == "" { it.r.Type = "string" }
+		if !textType(it.r.Type) { return fmt.Errorf("%w: %s rule needs type string, email or url, not %s", ErrInvalidField, it.name, it.r.Type) }
+		if msg := it.r.check(); msg != "" { return fmt.Errorf("%w: %s rule %s", ErrInvalidField, it.name, msg) }
+	}
+	return nil
+}
+
+// Empty reports whether ar has no rules.
+func (ar *AccountRules) Empty() bool { return ar == nil || (ar.Username == nil && ar.Password == nil) }
+
+// Encode returns ar as stored in sites.account_rules; "{}" for no rules,
+// so that an update clears them.
+func (ar *AccountRules) Encode() string {
+	if ar.Empty() { return "{}" }
+	b, _ := json.Marshal(ar)
+	return string(b)
+}
+
+// credential checks one of username or password against rule r.
+func credential(name string, r *Rule, value string) []Violation {
+	if r == nil { return nil }
+	if value == "" {
+		if r.Required { return []Violation{{Field: name, Code: CodeRequired, Message: name + " required"}} }
+		return nil
+	}
+	out := r.violations(name, value, true)
+	for i := range out { out[i].Message = name + " " + out[i].Message }
+	return out
+}